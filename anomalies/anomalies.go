@@ -0,0 +1,74 @@
+package anomalies
+
+import (
+	"math"
+	"sort"
+
+	"github.com/pisush/fin-chat/cluster"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+const (
+	maxClusters = 20 // topics the messages are grouped in before looking for outliers
+	threshold   = 3  // standard deviations above the mean distance that make a message an outlier
+	minTopic    = 3  // smaller clusters are outliers themselves, k-means++ likes to seed on them
+)
+
+// A message far from every topic of the chat
+type Anomaly struct {
+	Row      vectors.Row
+	Distance float64 // cosine distance to the nearest topic centroid
+	Score    float64 // standard deviations above the mean distance
+}
+
+// Clusters the messages and returns the ones much further from their nearest centroid than
+// the rest, most unusual first: spam, messages pasted into the wrong chat, parsing glitches...
+func Detect(rows []vectors.Row) []Anomaly {
+	if len(rows) < 2 {
+		return nil
+	}
+
+	points := make([][]float64, len(rows))
+	for i, row := range rows {
+		points[i] = row.Values
+	}
+	assignments, centroids := cluster.KMeans(points, cluster.DefaultK(len(rows), maxClusters))
+
+	sizes := make([]int, len(centroids))
+	for _, c := range assignments {
+		sizes[c]++
+	}
+	var topics [][]float64
+	for c, centroid := range centroids {
+		if sizes[c] >= minTopic || sizes[c] == len(rows) {
+			topics = append(topics, centroid)
+		}
+	}
+	if len(topics) == 0 {
+		return nil // too few messages to tell topics from outliers
+	}
+
+	distances := make([]float64, len(rows))
+	mean := 0.0
+	for i, p := range points {
+		distances[i] = 1 - cluster.Cosine(p, topics[cluster.Nearest(p, topics)])
+		mean += distances[i] / float64(len(rows))
+	}
+	variance := 0.0
+	for _, d := range distances {
+		variance += (d - mean) * (d - mean) / float64(len(rows))
+	}
+	stddev := math.Sqrt(variance)
+	if stddev == 0 {
+		return nil // all messages equally far, nothing stands out
+	}
+
+	var found []Anomaly
+	for i, d := range distances {
+		if score := (d - mean) / stddev; score > threshold {
+			found = append(found, Anomaly{Row: rows[i], Distance: d, Score: score})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Distance > found[j].Distance })
+	return found
+}
@@ -0,0 +1,233 @@
+package anonymize
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pisush/fin-chat/secure"
+)
+
+const (
+	mappingFilePath = "./pseudonyms.enc" // the real names behind the pseudonyms, encrypted
+	keyEnv          = "FINCHAT_ANONYMIZE_KEY"
+	mappingMagic    = "FINCHAT-NAMES2\n" // then the KDF of the key; the first files began with its salt
+	saltSize        = 16
+)
+
+var (
+	enabled    bool
+	key        []byte
+	kdf        []byte                // how key is derived, saved with the mapping
+	pseudonyms = map[string]string{} // real name to pseudonym
+	names      = map[string]string{} // pseudonym to real name
+)
+
+// Loads the mapping of earlier runs. With on, senders are replaced by pseudonyms before
+// they're embedded, which needs the key; without it the mapping is only loaded to show the
+// real names, if the key is set.
+func Setup(on bool) error {
+	enabled = on
+	passphrase := os.Getenv(keyEnv)
+	if passphrase == "" {
+		if on {
+			return fmt.Errorf("set %s to the passphrase the pseudonyms are encrypted with", keyEnv)
+		}
+		return nil
+	}
+
+	data, err := os.ReadFile(mappingFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return newKey(passphrase)
+	}
+	if err != nil {
+		return err
+	}
+	var sealed []byte
+	rest, current := bytes.CutPrefix(data, []byte(mappingMagic))
+	switch {
+	case current && len(rest) >= secure.KDFSize:
+		kdf, sealed = rest[:secure.KDFSize], rest[secure.KDFSize:]
+	case !current && len(data) >= saltSize:
+		kdf, sealed = secure.LegacyKDF(data[:saltSize]), data[saltSize:]
+	default:
+		return fmt.Errorf("%s is damaged", mappingFilePath)
+	}
+	if key, err = secure.Key(passphrase, kdf); err != nil {
+		return fmt.Errorf("%s: %w", mappingFilePath, err)
+	}
+	plain, err := secure.Unseal(key, sealed, nil)
+	if err != nil {
+		return fmt.Errorf("can't decrypt %s, is %s right? %w", mappingFilePath, keyEnv, err)
+	}
+	if !current {
+		// A mapping of the first version is saved again with a key of the current KDF
+		if err := newKey(passphrase); err != nil {
+			return err
+		}
+	}
+	if err := json.Unmarshal(plain, &pseudonyms); err != nil {
+		return fmt.Errorf("%s: %w", mappingFilePath, err)
+	}
+	for name, pseudonym := range pseudonyms {
+		names[pseudonym] = name
+	}
+	return nil
+}
+
+// Derives a key with a new KDF, for the mapping to be saved with
+func newKey(passphrase string) error {
+	var err error
+	if kdf, err = secure.NewKDF(); err != nil {
+		return err
+	}
+	key, err = secure.Key(passphrase, kdf)
+	return err
+}
+
+func Enabled() bool {
+	return enabled
+}
+
+// The pseudonym of a sender, Person A, Person B and so on in the order they first appear.
+// A new one is saved before it's returned, so it's never used without a way back.
+func Sender(name string) (string, error) {
+	if !enabled || name == "" {
+		return name, nil
+	}
+	if pseudonym, ok := pseudonyms[name]; ok {
+		return pseudonym, nil
+	}
+	pseudonym := "Person " + letters(len(pseudonyms))
+	pseudonyms[name] = pseudonym
+	names[pseudonym] = name
+	if err := save(); err != nil {
+		delete(pseudonyms, name)
+		delete(names, pseudonym)
+		return "", err
+	}
+	return pseudonym, nil
+}
+
+// The pseudonym to search for a real sender name, or the name as it is if it has none
+func Pseudonym(name string) string {
+	if pseudonym, ok := pseudonyms[name]; ok {
+		return pseudonym
+	}
+	return name
+}
+
+// The text with the senders seen so far replaced by their pseudonyms where they're mentioned,
+// by full name or by a first name no other sender shares
+func Text(text string) string {
+	if !enabled || len(pseudonyms) == 0 {
+		return text
+	}
+	return replaceWords(text, mentions())
+}
+
+// The text, a search result or an answer, with the pseudonyms replaced by the real names
+func Reveal(text string) string {
+	if len(names) == 0 {
+		return text
+	}
+	return replaceWords(text, names)
+}
+
+// The full and unambiguous first names of the senders, with their pseudonyms
+func mentions() map[string]string {
+	found := map[string]string{}
+	firsts := map[string][]string{}
+	for name, pseudonym := range pseudonyms {
+		found[name] = pseudonym
+		if first := strings.Fields(name); len(first) > 1 && utf8.RuneCountInString(first[0]) > 1 {
+			firsts[first[0]] = append(firsts[first[0]], pseudonym)
+		}
+	}
+	for first, owners := range firsts {
+		if _, ok := found[first]; !ok && len(owners) == 1 {
+			found[first] = owners[0]
+		}
+	}
+	return found
+}
+
+// Replaces the keys of replacements found as whole words, longest first, so "Person AB"
+// isn't taken for "Person A" and "Dana Cohen" for "Dana"
+func replaceWords(text string, replacements map[string]string) string {
+	keys := make([]string, 0, len(replacements))
+	for k := range replacements {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(a, b int) bool { return len(keys[a]) > len(keys[b]) })
+
+	var sb strings.Builder
+	for i := 0; i < len(text); {
+		replaced := false
+		if i == 0 || !isWordRune(lastRune(text[:i])) {
+			for _, k := range keys {
+				end := i + len(k)
+				if strings.HasPrefix(text[i:], k) && (end == len(text) || !isWordRune(firstRune(text[end:]))) {
+					sb.WriteString(replacements[k])
+					i = end
+					replaced = true
+					break
+				}
+			}
+		}
+		if !replaced {
+			_, size := utf8.DecodeRuneInString(text[i:])
+			sb.WriteString(text[i : i+size])
+			i += size
+		}
+	}
+	return sb.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+func firstRune(s string) rune {
+	r, _ := utf8.DecodeRuneInString(s)
+	return r
+}
+
+func lastRune(s string) rune {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return r
+}
+
+// A, B, ..., Z, AA, AB, ... for 0, 1, ...
+func letters(n int) string {
+	s := ""
+	for n++; n > 0; n = (n - 1) / 26 {
+		s = string(rune('A'+(n-1)%26)) + s
+	}
+	return s
+}
+
+// Writes the mapping encrypted, through a temporary file so a crash can't lose it
+func save() error {
+	plain, err := json.Marshal(pseudonyms)
+	if err != nil {
+		return err
+	}
+	sealed, err := secure.Seal(key, plain, nil)
+	if err != nil {
+		return err
+	}
+	tmp := mappingFilePath + ".tmp"
+	data := append(append([]byte(mappingMagic), kdf...), sealed...)
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, mappingFilePath)
+}
@@ -0,0 +1,223 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pisush/fin-chat/cluster"
+	"github.com/pisush/fin-chat/pinecone"
+	"github.com/pisush/fin-chat/secure"
+)
+
+const (
+	Dir          = "./cold_storage" // where the cold vectors of every index are kept
+	DefaultYears = 3                // vectors of messages older than this are archived
+
+	pageSize    = 100  // IDs listed, and vectors fetched, per request
+	deleteBatch = 1000 // Pinecone's limit of IDs per delete request
+)
+
+// A vector moved out of the index, with the namespace it came from
+type Entry struct {
+	pinecone.Vector
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// An archived vector found by Search, with its cosine similarity to the query
+type Match struct {
+	Entry
+	Score float64
+}
+
+var (
+	loadedMu sync.Mutex
+	loaded   = map[string][]Entry{} // index name -> archive, read once per run
+)
+
+// The archive file of an index: gzipped JSON lines, one vector per line. Every Move appends
+// another gzip stream, which readers see as one file.
+func Path(indexName string) string {
+	return filepath.Join(Dir, indexName+".jsonl.gz")
+}
+
+// Moves the vectors of messages written before cutoff from every namespace of the index to
+// its archive file. The file is synced before anything is deleted, so an interruption leaves
+// vectors in both places rather than in neither. Vectors forgotten with forget stay in the
+// index until they are purged. Returns the number of vectors archived.
+func Move(indexName string, cutoff time.Time, log *log.Logger) (int, error) {
+	stats, err := pinecone.DescribeIndexStats(indexName)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(Dir, 0755); err != nil {
+		return 0, err
+	}
+	file, err := secure.Append(Path(indexName))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	writer := gzip.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	namespaces := make([]string, 0, len(stats.Namespaces))
+	for namespace := range stats.Namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	archived := map[string][]string{} // namespace -> IDs written to the archive
+	count := 0
+	err = walk(indexName, namespaces, func(namespace string, vector pinecone.Vector) error {
+		if !old(vector.Metadata, cutoff) {
+			return nil
+		}
+		if err := encoder.Encode(Entry{Vector: vector, Namespace: namespace}); err != nil {
+			return err
+		}
+		archived[namespace] = append(archived[namespace], vector.ID)
+		count++
+		return nil
+	}, log)
+	// Closed even after an error, a gzip stream without its end would spoil the whole file
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	loadedMu.Lock()
+	delete(loaded, indexName)
+	loadedMu.Unlock()
+
+	for _, namespace := range namespaces {
+		ids := archived[namespace]
+		for start := 0; start < len(ids); start += deleteBatch {
+			if err := pinecone.DeleteVectors(indexName, namespace, ids[start:min(start+deleteBatch, len(ids))]); err != nil {
+				// Archived but still in the index: the next Move archives them again, searches keep one copy
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
+
+// Lists and fetches every vector of the namespaces, page by page, and passes each to visit
+func walk(indexName string, namespaces []string, visit func(namespace string, vector pinecone.Vector) error, log *log.Logger) error {
+	for _, namespace := range namespaces {
+		for token := ""; ; {
+			ids, next, err := pinecone.ListVectorIDs(indexName, namespace, pageSize, token)
+			if err != nil {
+				return err
+			}
+			if len(ids) > 0 {
+				vectors, err := pinecone.FetchVectors(indexName, namespace, ids)
+				if err != nil {
+					return err
+				}
+				for _, id := range ids {
+					vector, ok := vectors[id]
+					if !ok {
+						log.Printf("Vector %s was listed but not fetched, deleted meanwhile?", id)
+						continue
+					}
+					if err := visit(namespace, vector); err != nil {
+						return err
+					}
+				}
+			}
+			if next == "" {
+				break
+			}
+			token = next
+		}
+	}
+	return nil
+}
+
+// Whether a vector's message was written before cutoff and isn't waiting to be purged
+func old(metadata map[string]interface{}, cutoff time.Time) bool {
+	if deleted, _ := metadata["deleted"].(bool); deleted {
+		return false
+	}
+	timestamp, ok := metadata["timestamp"].(float64)
+	return ok && int64(timestamp) < cutoff.Unix()
+}
+
+// The topK archived vectors of the index most similar to vector among those keep accepts,
+// best first, searched by brute force on this machine. An index without an archive has none.
+func Search(indexName string, vector []float64, topK int, keep func(Entry) bool) ([]Match, error) {
+	entries, err := load(indexName)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []Match
+	for _, e := range entries {
+		if keep(e) {
+			matches = append(matches, Match{Entry: e, Score: cluster.Cosine(vector, e.Values)})
+		}
+	}
+	sort.SliceStable(matches, func(a, b int) bool { return matches[a].Score > matches[b].Score })
+	return matches[:min(topK, len(matches))], nil
+}
+
+// Reads the archive of the index, once per run. A vector archived more than once is kept
+// in its latest version.
+func load(indexName string) ([]Entry, error) {
+	loadedMu.Lock()
+	defer loadedMu.Unlock()
+	if entries, ok := loaded[indexName]; ok {
+		return entries, nil
+	}
+
+	file, err := secure.Open(Path(indexName))
+	if errors.Is(err, fs.ErrNotExist) {
+		loaded[indexName] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(bufio.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var entries []Entry
+	positions := map[string]int{} // namespace and ID -> index in entries
+	decoder := json.NewDecoder(reader)
+	for {
+		var e Entry
+		if err := decoder.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		key := e.Namespace + "\x00" + e.ID
+		if i, ok := positions[key]; ok {
+			entries[i] = e
+			continue
+		}
+		positions[key] = len(entries)
+		entries = append(entries, e)
+	}
+	loaded[indexName] = entries
+	return entries, nil
+}
@@ -0,0 +1,162 @@
+package ask
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/llm"
+	"github.com/pisush/fin-chat/query"
+	"github.com/pisush/fin-chat/ranking"
+)
+
+const (
+	contextTopK     = 5  // retrieved messages given to the model per question
+	maxHistoryTurns = 10 // question/answer pairs kept as conversation memory
+
+	systemPrompt = "You answer questions about a WhatsApp group chat. " +
+		"Use only the numbered chat messages below and the conversation so far. " +
+		"Cite the messages that support each claim inline by their number, e.g. [1] or [2][3]. " +
+		"If the messages don't contain the answer, say so."
+	rewritePrompt = "Rewrite the user's last question as a standalone search query " +
+		"that can be understood without the conversation. Reply with the query only."
+)
+
+// Inline citation markers such as [1] in a generated answer
+var citationRegex = regexp.MustCompile(`\[(\d+)\]`)
+
+// A retrieved message referenced by an answer
+type Citation struct {
+	Number    int // the [n] used in the answer text
+	ID        string
+	Sender    string
+	Timestamp time.Time
+	Text      string
+}
+
+// A generated answer with the messages it cites, ordered by citation number
+type Answer struct {
+	Text      string
+	Citations []Citation
+	Retrieved []string // IDs of all messages given to the model, cited or not
+}
+
+// A stateful chat over the indexed messages
+type Conversation struct {
+	indexName string
+	filter    query.Filter
+	history   []llm.Message
+}
+
+// A conversation searching the messages that pass filter, e.g. one namespace or language
+func NewConversation(indexName string, filter query.Filter) *Conversation {
+	return &Conversation{indexName: indexName, filter: filter}
+}
+
+// Forgets all previous turns
+func (c *Conversation) Reset() {
+	c.history = nil
+}
+
+// Answers a question, using the previous turns to resolve follow-ups
+func (c *Conversation) Ask(question string, log *log.Logger) (Answer, error) {
+	searchQuery, err := c.standaloneQuery(question)
+	if err != nil {
+		log.Printf("Error rewriting follow-up question: %v", err)
+		return Answer{}, err
+	}
+
+	matches, err := ranking.Search(c.indexName, searchQuery, contextTopK, c.filter, log)
+	if err != nil {
+		log.Printf("Error retrieving context for question: %v", err)
+		return Answer{}, err
+	}
+
+	messages := []llm.Message{{Role: "system", Content: systemPrompt + "\n\nChat messages:\n" + formatContext(matches)}}
+	messages = append(messages, c.history...)
+	messages = append(messages, llm.Message{Role: "user", Content: question})
+
+	answer, err := llm.Complete(messages)
+	if err != nil {
+		log.Printf("Error generating answer: %v", err)
+		return Answer{}, err
+	}
+
+	retrieved := make([]string, 0, len(matches))
+	for _, match := range matches {
+		retrieved = append(retrieved, match.ID)
+	}
+
+	c.remember(question, answer)
+	return Answer{Text: answer, Citations: citations(answer, matches), Retrieved: retrieved}, nil
+}
+
+// The first question is searched as is, follow-ups are rewritten using the history
+func (c *Conversation) standaloneQuery(question string) (string, error) {
+	if len(c.history) == 0 {
+		return question, nil
+	}
+
+	messages := []llm.Message{{Role: "system", Content: rewritePrompt}}
+	messages = append(messages, c.history...)
+	messages = append(messages, llm.Message{Role: "user", Content: question})
+
+	rewritten, err := llm.Complete(messages)
+	if err != nil {
+		return "", err
+	}
+
+	rewritten = strings.TrimSpace(rewritten)
+	if rewritten == "" {
+		return question, nil
+	}
+	return rewritten, nil
+}
+
+func (c *Conversation) remember(question, answer string) {
+	c.history = append(c.history,
+		llm.Message{Role: "user", Content: question},
+		llm.Message{Role: "assistant", Content: answer},
+	)
+	if len(c.history) > 2*maxHistoryTurns {
+		c.history = c.history[len(c.history)-2*maxHistoryTurns:]
+	}
+}
+
+// Formats the retrieved messages as numbered "[n] date sender: text" lines
+func formatContext(matches []query.QueryResponse) string {
+	var sb strings.Builder
+	for i, match := range matches {
+		fmt.Fprintf(&sb, "[%d] %s %s: %s\n", i+1, match.Timestamp().Format("2006-01-02 15:04"), match.Sender(), match.Text())
+	}
+	return sb.String()
+}
+
+// Maps the [n] markers in the answer back to the retrieved messages, ignoring unknown numbers
+func citations(answer string, matches []query.QueryResponse) []Citation {
+	seen := map[int]bool{}
+	var cited []Citation
+	for _, m := range citationRegex.FindAllStringSubmatch(answer, -1) {
+		number, err := strconv.Atoi(m[1])
+		if err != nil || number < 1 || number > len(matches) || seen[number] {
+			continue
+		}
+		seen[number] = true
+
+		match := matches[number-1]
+		cited = append(cited, Citation{
+			Number:    number,
+			ID:        match.ID,
+			Sender:    match.Sender(),
+			Timestamp: match.Timestamp(),
+			Text:      match.Text(),
+		})
+	}
+
+	sort.Slice(cited, func(i, j int) bool { return cited[i].Number < cited[j].Number })
+	return cited
+}
@@ -0,0 +1,565 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pisush/fin-chat/batch"
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/pinecone"
+	"github.com/pisush/fin-chat/upsert"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+const (
+	Dir            = "./backups"     // where backups are written by default
+	ManifestName   = "manifest.json" // in every backup directory, next to its shards
+	DefaultWorkers = 4               // parallel upserts of a restore
+
+	pageSize         = 100   // IDs listed, and vectors fetched, per request
+	shardSize        = 10000 // vectors per shard file
+	restoreBatch     = 1000  // vectors a worker collects before upserting them
+	progressInterval = 10 * time.Second
+	readyPoll        = 5 * time.Second
+	readyTimeout     = 30 * time.Minute // collections of large indexes take a while
+)
+
+// Describes a backup: the index it was taken of and every shard file, so that a missing,
+// truncated or corrupted shard is found before anything is restored
+type Manifest struct {
+	Index     string    `json:"index"`
+	Dimension int       `json:"dimension"`
+	Metric    string    `json:"metric"`
+	Created   time.Time `json:"created"`
+	Shards    []Shard   `json:"shards"`
+}
+
+// One JSON lines file of a backup, holding vectors of a single namespace
+type Shard struct {
+	File      string `json:"file"`
+	Namespace string `json:"namespace,omitempty"`
+	Vectors   int    `json:"vectors"`
+	SHA256    string `json:"sha256"`
+}
+
+// Every line of a shard: one vector
+type entry struct {
+	pinecone.Vector
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// The name of a backup directory of an index, after it and the time, to be put in Dir or a bucket
+func Name(indexName string, now time.Time) string {
+	return indexName + "-" + now.Format("20060102-150405")
+}
+
+// Writes every vector of every namespace of the index to shard files in dir, and the
+// manifest last, so that a backup without one is known to be incomplete. Returns the
+// number of vectors written.
+func ToDir(indexName, dir string, log *log.Logger) (int, error) {
+	index, err := pinecone.DescribeIndex(indexName)
+	if err != nil {
+		return 0, err
+	}
+	stats, err := pinecone.DescribeIndexStats(indexName)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	manifest := Manifest{Index: index.Name, Dimension: index.Dimension, Metric: index.Metric, Created: time.Now().UTC(), Shards: []Shard{}}
+	var shard *shardWriter
+	closeShard := func() error {
+		if shard == nil {
+			return nil
+		}
+		done, err := shard.close()
+		shard = nil
+		if err != nil {
+			return err
+		}
+		manifest.Shards = append(manifest.Shards, done)
+		return nil
+	}
+
+	written, err := walk(indexName, namespaces(stats), func(e entry) error {
+		if shard != nil && (shard.namespace != e.Namespace || shard.count >= shardSize) {
+			if err := closeShard(); err != nil {
+				return err
+			}
+		}
+		if shard == nil {
+			name := fmt.Sprintf("shard-%05d.jsonl", len(manifest.Shards)+1)
+			w, err := newShardWriter(dir, name, e.Namespace)
+			if err != nil {
+				return err
+			}
+			shard = w
+		}
+		return shard.write(e)
+	}, log)
+	if err == nil {
+		err = closeShard()
+	} else if shard != nil {
+		shard.file.Close()
+	}
+	if err != nil {
+		return written, err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return written, err
+	}
+	return written, os.WriteFile(filepath.Join(dir, ManifestName), data, 0644)
+}
+
+type shardWriter struct {
+	file      *os.File
+	name      string
+	namespace string
+	count     int
+	hash      hash.Hash
+	writer    *bufio.Writer
+	encoder   *json.Encoder
+}
+
+func newShardWriter(dir, name, namespace string) (*shardWriter, error) {
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	w := &shardWriter{file: file, name: name, namespace: namespace, hash: sha256.New()}
+	w.writer = bufio.NewWriter(io.MultiWriter(file, w.hash))
+	w.encoder = json.NewEncoder(w.writer)
+	return w, nil
+}
+
+func (w *shardWriter) write(e entry) error {
+	w.count++
+	return w.encoder.Encode(e)
+}
+
+func (w *shardWriter) close() (Shard, error) {
+	if err := w.writer.Flush(); err != nil {
+		w.file.Close()
+		return Shard{}, err
+	}
+	if err := w.file.Close(); err != nil {
+		return Shard{}, err
+	}
+	return Shard{File: w.name, Namespace: w.namespace, Vectors: w.count, SHA256: hex.EncodeToString(w.hash.Sum(nil))}, nil
+}
+
+// Checks every shard of the backup in dir against its manifest: that it exists, has the
+// recorded checksum, and holds the recorded number of vectors of the recorded dimension
+func Verify(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%s has no %s, the backup is incomplete or not a backup", dir, ManifestName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", ManifestName, err)
+	}
+
+	for _, shard := range manifest.Shards {
+		if err := verifyShard(dir, shard, manifest.Dimension); err != nil {
+			return &manifest, fmt.Errorf("shard %s: %w", shard.File, err)
+		}
+	}
+	return &manifest, nil
+}
+
+func verifyShard(dir string, shard Shard, dimension int) error {
+	file, err := os.Open(filepath.Join(dir, shard.File))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sum := sha256.New()
+	decoder := json.NewDecoder(io.TeeReader(bufio.NewReader(file), sum))
+	count := 0
+	for decoder.More() {
+		var e entry
+		if err := decoder.Decode(&e); err != nil {
+			return fmt.Errorf("vector %d: %w", count+1, err)
+		}
+		if len(e.Values) != dimension {
+			return fmt.Errorf("vector %s has %d values, the backup's dimension is %d", e.ID, len(e.Values), dimension)
+		}
+		count++
+	}
+	if _, err := io.Copy(sum, file); err != nil { // trailing bytes the decoder didn't need
+		return err
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != shard.SHA256 {
+		return fmt.Errorf("checksum %s, the manifest says %s", got, shard.SHA256)
+	}
+	if count != shard.Vectors {
+		return fmt.Errorf("%d vectors, the manifest says %d", count, shard.Vectors)
+	}
+	return nil
+}
+
+// Verifies the backup in dir, then upserts its vectors into the index with workers in
+// parallel, creating the index if it doesn't exist. Every vector ID is always upserted by
+// the same worker, in backup order, and of several versions of a vector the one ingested
+// last wins. Vectors already in the index with the same IDs are overwritten, others are
+// kept. Returns the number of vectors restored.
+func FromDir(dir, indexName string, workers int, log *log.Logger) (int, error) {
+	manifest, err := Verify(dir)
+	if err != nil {
+		return 0, err
+	}
+	if err := upsert.GetOrCreatePineconeIndex(indexName, log); err != nil {
+		return 0, err
+	}
+	index, err := pinecone.DescribeIndex(indexName)
+	if err != nil {
+		return 0, err
+	}
+	if index.Dimension != manifest.Dimension {
+		return 0, fmt.Errorf("%s holds %d-dimensional vectors, but index %s has dimension %d", dir, manifest.Dimension, indexName, index.Dimension)
+	}
+
+	total := 0
+	for _, shard := range manifest.Shards {
+		total += shard.Vectors
+	}
+	workers = max(workers, 1)
+	sizer := upsert.NewSizer(log)
+	defer sizer.Save(log)
+
+	var restored atomic.Int64
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	queues := make([]chan entry, workers)
+	for i := range queues {
+		queues[i] = make(chan entry, restoreBatch)
+		wg.Add(1)
+		go func(queue <-chan entry) {
+			defer wg.Done()
+			if err := restoreWorker(indexName, queue, sizer, &restored, log); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(queues[i])
+	}
+	done := make(chan struct{})
+	go printProgress(total, &restored, done)
+
+	for _, shard := range manifest.Shards {
+		err = readShard(filepath.Join(dir, shard.File), func(e entry) {
+			queues[route(e, workers)] <- e
+		})
+		if err != nil {
+			err = fmt.Errorf("shard %s: %w", shard.File, err)
+			break
+		}
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	close(done)
+
+	if err == nil {
+		err = firstErr
+	}
+	return int(restored.Load()), err
+}
+
+// The worker a vector goes to, always the same for an ID
+func route(e entry, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(e.Namespace + "\x00" + e.ID))
+	return int(h.Sum32() % uint32(workers))
+}
+
+// Upserts the vectors of the queue in batches until it is closed. A vector whose ID came
+// before with a later "ingested" time is skipped; within a batch the latest version replaces
+// the earlier one. After an error the rest of the queue is drained, so the reader isn't blocked.
+func restoreWorker(indexName string, queue <-chan entry, sizer *batch.Sizer, restored *atomic.Int64, log *log.Logger) error {
+	latest := map[string]float64{} // namespace and ID -> ingested time of the version kept
+	positions := map[string]int{}  // namespace and ID -> index in pending
+	var pending []upsert.UpsertData
+	var failed error
+	flush := func() {
+		if failed == nil && len(pending) > 0 {
+			n, err := upsert.Vectors(indexName, pending, sizer, log)
+			restored.Add(int64(n))
+			failed = err
+		}
+		pending = pending[:0]
+		clear(positions)
+	}
+
+	for e := range queue {
+		if failed != nil {
+			continue
+		}
+		key := e.Namespace + "\x00" + e.ID
+		version, _ := e.Metadata["ingested"].(float64)
+		if kept, ok := latest[key]; ok && version < kept {
+			continue
+		}
+		latest[key] = version
+
+		vector := upsert.UpsertData{ID: e.ID, Values: e.Values, Metadata: e.Metadata, Namespace: e.Namespace}
+		if i, ok := positions[key]; ok {
+			pending[i] = vector
+			continue
+		}
+		positions[key] = len(pending)
+		pending = append(pending, vector)
+		if len(pending) >= restoreBatch {
+			flush()
+		}
+	}
+	flush()
+	return failed
+}
+
+// Prints how far the restore got, and how long the rest should take, until done is closed
+func printProgress(total int, restored *atomic.Int64, done <-chan struct{}) {
+	start := time.Now()
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			n := int(restored.Load())
+			if n == 0 || total == 0 {
+				continue
+			}
+			left := time.Duration(float64(time.Since(start)) / float64(n) * float64(max(total-n, 0)))
+			fmt.Println(i18n.T("restore.progress", n, total, 100*n/total, left.Round(time.Second)))
+		}
+	}
+}
+
+// Passes every vector of a shard file to send, in order
+func readShard(path string, send func(entry)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for decoder.More() {
+		var e entry
+		if err := decoder.Decode(&e); err != nil {
+			return err
+		}
+		send(e)
+	}
+	return nil
+}
+
+// A line of an export file
+type Record struct {
+	ID        string                 `json:"id"`
+	Namespace string                 `json:"namespace,omitempty"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Values    []float64              `json:"values,omitempty"` // only with withValues
+}
+
+// Writes the ID and metadata of every vector of the namespace, or of every namespace if it's
+// empty, to a JSON lines file for offline analysis or loading into another backend. Unlike a
+// backup it is a single file without a manifest, and the values are left out unless withValues.
+func Export(indexName, namespace, path string, withValues bool, log *log.Logger) (int, error) {
+	stats, err := pinecone.DescribeIndexStats(indexName)
+	if err != nil {
+		return 0, err
+	}
+	names := namespaces(stats)
+	if namespace != "" {
+		names = []string{namespace}
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	written, err := walk(indexName, names, func(e entry) error {
+		record := Record{ID: e.ID, Namespace: e.Namespace, Metadata: e.Metadata}
+		if withValues {
+			record.Values = e.Values
+		}
+		return encoder.Encode(record)
+	}, log)
+	if err != nil {
+		return written, err
+	}
+	if err := writer.Flush(); err != nil {
+		return written, err
+	}
+	return written, file.Close()
+}
+
+// The vectors of the namespace, or of every namespace if it's empty, with their values, as
+// rows of an embeddings file, e.g. to cluster what the index holds when the file is elsewhere
+func Rows(indexName, namespace string, log *log.Logger) ([]vectors.Row, error) {
+	stats, err := pinecone.DescribeIndexStats(indexName)
+	if err != nil {
+		return nil, err
+	}
+	names := namespaces(stats)
+	if namespace != "" {
+		names = []string{namespace}
+	}
+	var rows []vectors.Row
+	_, err = walk(indexName, names, func(e entry) error {
+		rows = append(rows, Record{ID: e.ID, Namespace: e.Namespace, Metadata: e.Metadata, Values: e.Values}.Row())
+		return nil
+	}, log)
+	return rows, err
+}
+
+// Reads an export file written with its values, see Export, as rows of an embeddings file
+func ReadExport(path string) ([]vectors.Row, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	var rows []vectors.Row
+	for line := 1; ; line++ {
+		var record Record
+		if err := decoder.Decode(&record); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("line %d of %s: %w", line, path, err)
+		}
+		if len(record.Values) == 0 {
+			return nil, fmt.Errorf("%s has no embedding values, export it with --export-values", path)
+		}
+		rows = append(rows, record.Row())
+	}
+	return rows, nil
+}
+
+// The record as a row of an embeddings file, from the metadata upsert gave its vector
+func (r Record) Row() vectors.Row {
+	text := func(key string) string {
+		value, _ := r.Metadata[key].(string)
+		return value
+	}
+	timestamp, _ := r.Metadata["timestamp"].(float64)
+	return vectors.Row{
+		ID: r.ID, Text: text("text"), Sender: text("sender"), Timestamp: time.Unix(int64(timestamp), 0).UTC(),
+		MessageID: text("message_id"), ReplyTo: text("reply_to"), Namespace: r.Namespace, Values: r.Values,
+	}
+}
+
+func namespaces(stats *pinecone.IndexStats) []string {
+	names := make([]string, 0, len(stats.Namespaces))
+	for namespace := range stats.Namespaces {
+		names = append(names, namespace)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lists and fetches every vector of the namespaces, page by page, and passes each to write.
+// Returns the number of vectors written.
+func walk(indexName string, namespaces []string, write func(entry) error, log *log.Logger) (int, error) {
+	written := 0
+	for _, namespace := range namespaces {
+		token := ""
+		for {
+			ids, next, err := pinecone.ListVectorIDs(indexName, namespace, pageSize, token)
+			if err != nil {
+				return written, err
+			}
+			if len(ids) > 0 {
+				vectors, err := pinecone.FetchVectors(indexName, namespace, ids)
+				if err != nil {
+					return written, err
+				}
+				for _, id := range ids {
+					vector, ok := vectors[id]
+					if !ok {
+						log.Printf("Vector %s was listed but not fetched, deleted meanwhile?", id)
+						continue
+					}
+					if err := write(entry{Vector: vector, Namespace: namespace}); err != nil {
+						return written, err
+					}
+					written++
+				}
+			}
+			if next == "" {
+				break
+			}
+			token = next
+		}
+	}
+	return written, nil
+}
+
+// Snapshots a pod-based index of the legacy API into a new collection, named after the
+// index and the time, and waits until it is ready
+func ToCollection(indexName string, now time.Time) (string, error) {
+	name := indexName + "-" + now.Format("20060102-150405")
+	if err := pinecone.CreateCollection(name, indexName); err != nil {
+		return "", err
+	}
+	for start := time.Now(); ; time.Sleep(readyPoll) {
+		collection, err := pinecone.DescribeCollection(name)
+		if err == nil && collection.Status == "Ready" {
+			return name, nil
+		}
+		if err != nil && !errors.Is(err, pinecone.ErrIndexNotFound) {
+			return name, err
+		}
+		if time.Since(start) > readyTimeout {
+			return name, fmt.Errorf("collection %s isn't ready after %v", name, readyTimeout)
+		}
+	}
+}
+
+// Creates the index from a collection of the legacy API. The index must not exist yet.
+func FromCollection(collectionName, indexName, metric string) error {
+	collection, err := pinecone.DescribeCollection(collectionName)
+	if err != nil {
+		return fmt.Errorf("can't find collection %s: %w", collectionName, err)
+	}
+	if _, err := pinecone.DescribeIndex(indexName); err == nil {
+		return fmt.Errorf("index %s already exists, delete it first or restore to another name", indexName)
+	}
+	return pinecone.CreateIndexFromCollection(indexName, collectionName, collection.Dimension, metric)
+}
@@ -0,0 +1,113 @@
+package batch
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/pisush/fin-chat/state"
+)
+
+const (
+	minTemperature     = 0.05 // growth never stops completely
+	learnedTemperature = 0.25 // a size learned in a previous run is already close to the optimum
+)
+
+// An HTTP response rejected by the embedding or vector DB provider
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Body)
+}
+
+// Whether a failed request should be retried with a smaller batch
+func ShouldShrink(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// Adapts the batch size to a provider's observed error rate.
+// The size grows after every successful batch and halves on every rejected one.
+// Each rejection also cools the temperature, so growth slows down around the optimum.
+// A Sizer is safe for concurrent use.
+type Sizer struct {
+	mu          sync.Mutex
+	provider    string
+	size        int
+	max         int
+	best        int // largest size known to succeed
+	temperature float64
+}
+
+// Starts at the size learned in a previous run, or at start if there is none
+func NewSizer(provider string, start, max int, log *log.Logger) *Sizer {
+	s := &Sizer{provider: provider, size: start, max: max, temperature: 1}
+
+	st, err := state.Load()
+	if err != nil {
+		log.Printf("Error loading state, using default batch size for %s: %v", provider, err)
+		return s
+	}
+	if learned := st.BatchSizes[provider]; learned > 0 {
+		s.size = min(learned, max)
+		s.temperature = learnedTemperature
+	}
+	return s
+}
+
+// The number of items to send in the next batch
+func (s *Sizer) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Records a batch of the current size that went through
+func (s *Sizer) Success() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.best = max(s.best, s.size)
+	grow := max(int(float64(s.size)*s.temperature), 1)
+	s.size = min(s.size+grow, s.max)
+}
+
+// Records a rejected batch of the current size
+func (s *Sizer) Failure() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size = max(s.size/2, 1)
+	s.best = min(s.best, s.size)
+	s.temperature = max(s.temperature/2, minTemperature)
+}
+
+// Persists the largest size that succeeded for future runs
+func (s *Sizer) Save(log *log.Logger) {
+	s.mu.Lock()
+	best := s.best
+	s.mu.Unlock()
+	if best == 0 {
+		return
+	}
+
+	st, err := state.Load()
+	if err != nil {
+		log.Printf("Error loading state to save batch size: %v", err)
+		return
+	}
+	st.BatchSizes[s.provider] = best
+	if err := st.Save(); err != nil {
+		log.Printf("Error saving batch size for %s: %v", s.provider, err)
+	}
+}
@@ -0,0 +1,224 @@
+package benchmark
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pisush/fin-chat/dedup"
+	"github.com/pisush/fin-chat/embed"
+	"github.com/pisush/fin-chat/eval"
+	"github.com/pisush/fin-chat/llm"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+const (
+	minNameChars    = 3  // shorter parts of a sender's name aren't replaced in the text ("Li", "Jo")
+	paraphraseBatch = 20 // messages rewritten per chat completion
+
+	paraphrasePrompt = "Paraphrase each of these chat messages so that the wording is different " +
+		"but the meaning, language and tone stay the same. Keep placeholders like [email] and " +
+		"names like Participant 3 as they are. Reply with a JSON array of strings, one per message, in order."
+)
+
+var (
+	emailRegex = regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`)
+	urlRegex   = regexp.MustCompile(`(?i)\b(https?://|www\.)\S+`)
+	phoneRegex = regexp.MustCompile(`\+?\d[\d\s().-]{6,}\d`)
+)
+
+// One message of the anonymized corpus
+type Document struct {
+	ID      string `json:"id"`
+	Chat    string `json:"chat,omitempty"` // pseudonym of the namespace, for corpora of several chats
+	Sender  string `json:"sender"`
+	Text    string `json:"text"`
+	ReplyTo string `json:"reply_to,omitempty"` // ID of the document it replies to
+}
+
+// A labeled query, with its judgments pointing at documents
+type Query struct {
+	Query      string   `json:"query"`
+	Relevant   []string `json:"relevant"`
+	Irrelevant []string `json:"irrelevant,omitempty"`
+}
+
+// Builds the anonymized corpus from the messages and, for the eval cases, the queries:
+// messages are shuffled and renumbered, senders and chats pseudonymized, and names, emails,
+// phone numbers and links removed from the text. Timestamps and the export's message IDs are dropped.
+func Build(messages []embed.Message, cases []eval.Case) ([]Document, []Query) {
+	var chunks []embed.Message
+	for _, msg := range messages {
+		chunks = append(chunks, embed.Chunks(msg)...)
+	}
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	random.Shuffle(len(chunks), func(i, j int) { chunks[i], chunks[j] = chunks[j], chunks[i] })
+
+	// Pseudonyms are handed out in the shuffled order, so they say nothing about who wrote first
+	senders, chats := map[string]string{}, map[string]string{}
+	for _, msg := range chunks {
+		if _, ok := senders[msg.Sender]; !ok {
+			senders[msg.Sender] = fmt.Sprintf("Participant %d", len(senders)+1)
+		}
+		if _, ok := chats[msg.Namespace]; !ok && msg.Namespace != "" {
+			chats[msg.Namespace] = fmt.Sprintf("chat-%d", len(chats)+1)
+		}
+	}
+	scrub := newScrubber(senders)
+
+	documents := make([]Document, len(chunks))
+	docIDs := map[string]string{}     // vector ID -> document ID, to carry the eval labels over
+	messageIDs := map[string]string{} // chat and export message ID -> document ID, for replies
+	for i, msg := range chunks {
+		id := fmt.Sprintf("doc-%06d", i+1)
+		docIDs[vectors.ID(msg.Namespace, dedup.Hash(msg.Text, msg.Sender, msg.Timestamp))] = id
+		if msg.ID != "" {
+			if _, ok := messageIDs[msg.Namespace+"\x00"+msg.ID]; !ok {
+				messageIDs[msg.Namespace+"\x00"+msg.ID] = id
+			}
+		}
+		documents[i] = Document{ID: id, Chat: chats[msg.Namespace], Sender: senders[msg.Sender], Text: scrub(msg.Text)}
+	}
+	for i, msg := range chunks {
+		if msg.ReplyTo != "" {
+			documents[i].ReplyTo = messageIDs[msg.Namespace+"\x00"+msg.ReplyTo]
+		}
+	}
+
+	var queries []Query
+	for _, c := range cases {
+		q := Query{Query: scrub(c.Query), Relevant: mapIDs(c.Relevant, docIDs), Irrelevant: mapIDs(c.Irrelevant, docIDs)}
+		if len(q.Relevant) > 0 {
+			queries = append(queries, q)
+		}
+	}
+	return documents, queries
+}
+
+// Rewrites the text of every document with the chat model, so that the wording can't be
+// searched for either. The documents are changed in place.
+func Paraphrase(documents []Document) error {
+	for start := 0; start < len(documents); start += paraphraseBatch {
+		batch := documents[start:min(start+paraphraseBatch, len(documents))]
+		texts := make([]string, len(batch))
+		for i, doc := range batch {
+			texts[i] = doc.Text
+		}
+		input, err := json.Marshal(texts)
+		if err != nil {
+			return err
+		}
+
+		reply, err := llm.Complete([]llm.Message{
+			{Role: "system", Content: paraphrasePrompt},
+			{Role: "user", Content: string(input)},
+		})
+		if err != nil {
+			return err
+		}
+		var paraphrased []string
+		if err := json.Unmarshal([]byte(strings.TrimSpace(reply)), &paraphrased); err != nil || len(paraphrased) != len(batch) {
+			return fmt.Errorf("unexpected paraphrase reply for documents %s-%s", batch[0].ID, batch[len(batch)-1].ID)
+		}
+		for i := range batch {
+			batch[i].Text = paraphrased[i]
+		}
+	}
+	return nil
+}
+
+// Writes values as JSON lines
+func WriteJSONL[T any](path string, values []T) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, v := range values {
+		if err := encoder.Encode(v); err != nil {
+			return err
+		}
+	}
+	return file.Close()
+}
+
+func mapIDs(ids []string, docIDs map[string]string) []string {
+	var mapped []string
+	for _, id := range ids {
+		if docID, ok := docIDs[id]; ok {
+			mapped = append(mapped, docID)
+		}
+	}
+	sort.Strings(mapped)
+	return mapped
+}
+
+// Returns a function that removes emails, links and phone numbers from a text and replaces
+// the senders' names, and the parts of them that are long enough, with their pseudonyms
+func newScrubber(senders map[string]string) func(string) string {
+	names := map[string]string{} // lower case name -> pseudonym
+	for sender, pseudonym := range senders {
+		names[strings.ToLower(sender)] = pseudonym
+		for _, part := range strings.FieldsFunc(sender, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+			if utf8.RuneCountInString(part) >= minNameChars {
+				names[strings.ToLower(part)] = pseudonym
+			}
+		}
+	}
+	// Longest first, so a full name wins over its first name
+	ordered := make([]string, 0, len(names))
+	for name := range names {
+		ordered = append(ordered, name)
+	}
+	sort.Slice(ordered, func(a, b int) bool {
+		if len(ordered[a]) != len(ordered[b]) {
+			return len(ordered[a]) > len(ordered[b])
+		}
+		return ordered[a] < ordered[b]
+	})
+	patterns := make([]*regexp.Regexp, len(ordered))
+	for i, name := range ordered {
+		patterns[i] = regexp.MustCompile(`(?i)` + regexp.QuoteMeta(name))
+	}
+
+	return func(text string) string {
+		text = emailRegex.ReplaceAllString(text, "[email]")
+		text = urlRegex.ReplaceAllString(text, "[link]")
+		text = phoneRegex.ReplaceAllString(text, "[phone]")
+		for i, pattern := range patterns {
+			text = replaceWords(text, pattern, names[ordered[i]])
+		}
+		return text
+	}
+}
+
+// Replaces the matches of pattern that aren't part of a longer word, which \b can't tell for Hebrew
+func replaceWords(text string, pattern *regexp.Regexp, replacement string) string {
+	var sb strings.Builder
+	last := 0
+	for _, m := range pattern.FindAllStringIndex(text, -1) {
+		before, _ := utf8.DecodeLastRuneInString(text[:m[0]])
+		after, _ := utf8.DecodeRuneInString(text[m[1]:])
+		if isWordRune(before) || isWordRune(after) {
+			continue
+		}
+		sb.WriteString(text[last:m[0]])
+		sb.WriteString(replacement)
+		last = m[1]
+	}
+	sb.WriteString(text[last:])
+	return sb.String()
+}
+
+func isWordRune(r rune) bool {
+	return r != utf8.RuneError && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
@@ -0,0 +1,109 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pisush/fin-chat/anonymize"
+	"github.com/pisush/fin-chat/ask"
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/query"
+)
+
+// The apps a bot answers in
+const (
+	AppTelegram = "telegram"
+	AppWhatsApp = "whatsapp" // through Twilio
+)
+
+const citationChars = 300 // of a cited message shown under the answer
+
+// What the bots of every app share: who may ask, and a conversation per user that follow-ups
+// build on
+type asker struct {
+	indexName string
+	filter    query.Filter
+	allowed   map[string]bool // user IDs, usernames without the @ and phone numbers, lowercase
+
+	mu            sync.Mutex // answers one question at a time, conversations aren't safe to share
+	conversations map[string]*ask.Conversation
+}
+
+func newAsker(indexName string, filter query.Filter, allowed []string) *asker {
+	a := &asker{indexName: indexName, filter: filter, allowed: map[string]bool{}, conversations: map[string]*ask.Conversation{}}
+	for _, user := range allowed {
+		if user = strings.TrimPrefix(strings.TrimSpace(user), "@"); user != "" {
+			a.allowed[strings.ToLower(user)] = true
+		}
+	}
+	return a
+}
+
+// Whether any of the names of a user is allowed
+func (a *asker) allows(names ...string) bool {
+	for _, name := range names {
+		if name != "" && a.allowed[strings.ToLower(name)] {
+			return true
+		}
+	}
+	return false
+}
+
+// The reply to a user's message: an answer with the messages it cites, or what a command does.
+// /start and /help explain the bot, /reset (or reset, as in ask) starts the conversation over.
+func (a *asker) reply(user, text string, log *log.Logger) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	conversation, ok := a.conversations[user]
+	if !ok {
+		conversation = ask.NewConversation(a.indexName, a.filter)
+		a.conversations[user] = conversation
+	}
+	text = strings.TrimSpace(text)
+	command, _, _ := strings.Cut(text, "@") // /reset@finchat_bot in Telegram
+	switch strings.ToLower(command) {
+	case "/start", "/help":
+		return i18n.T("bot.welcome")
+	case "/reset", "reset":
+		conversation.Reset()
+		return i18n.T("ask.reset")
+	}
+
+	answer, err := conversation.Ask(text, log)
+	if err != nil {
+		return i18n.T("ask.error", err)
+	}
+	return formatAnswer(answer)
+}
+
+// The answer, then the messages it cites as "[n] date sender: text"
+func formatAnswer(answer ask.Answer) string {
+	var sb strings.Builder
+	sb.WriteString(anonymize.Reveal(answer.Text))
+	if len(answer.Citations) > 0 {
+		sb.WriteString("\n\n" + i18n.T("ask.sources"))
+	}
+	for _, citation := range answer.Citations {
+		fmt.Fprintf(&sb, "\n[%d] %s %s: %s", citation.Number, citation.Timestamp.Format("2006-01-02 15:04"),
+			anonymize.Reveal(citation.Sender), grapheme.Snippet(anonymize.Reveal(citation.Text), citationChars))
+	}
+	return sb.String()
+}
+
+// Splits text into parts of at most limit characters, at line breaks where it can
+func split(text string, limit int) []string {
+	var parts []string
+	for utf8.RuneCountInString(text) > limit {
+		cut := len(string([]rune(text)[:limit]))
+		if newline := strings.LastIndex(text[:cut], "\n"); newline > 0 {
+			cut = newline
+		}
+		parts = append(parts, text[:cut])
+		text = strings.TrimLeft(text[cut:], "\n")
+	}
+	return append(parts, text)
+}
@@ -0,0 +1,202 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/httpclient"
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/query"
+)
+
+const (
+	apiEnv     = "FINCHAT_TELEGRAM_API" // a self-hosted Bot API server, instead of Telegram's
+	defaultAPI = "https://api.telegram.org"
+
+	pollSeconds   = 30               // how long a getUpdates call waits for messages
+	retryDelay    = 5 * time.Second  // after a failed poll, e.g. while the network is down
+	sendTimeout   = 30 * time.Second // for the calls that aren't polls
+	maxReplyChars = 2048             // Telegram takes 4096 UTF-16 units per message, and an emoji is two
+)
+
+// Answers the questions its allowed users DM it, each user in a conversation of their own that
+// follow-ups build on, with the messages the answer cites.
+type Telegram struct {
+	api    string // the Bot API's URL for this bot's token
+	client *http.Client
+	asker  *asker
+	log    *log.Logger
+}
+
+// A bot answering from the index for the users allowed, given by numeric user ID or username.
+// Everyone else is told their user ID, to be allowed by the bot's owner.
+func NewTelegram(token string, allowed []string, indexName string, filter query.Filter, log *log.Logger) *Telegram {
+	api := os.Getenv(apiEnv)
+	if api == "" {
+		api = defaultAPI
+	}
+	return &Telegram{
+		api:    strings.TrimSuffix(api, "/") + "/bot" + token + "/",
+		client: httpclient.WithTimeout(0), // polls set their own deadline through the context
+		asker:  newAsker(indexName, filter, allowed),
+		log:    log,
+	}
+}
+
+type user struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+}
+
+type message struct {
+	MessageID int64 `json:"message_id"`
+	From      *user `json:"from"`
+	Chat      struct {
+		ID   int64  `json:"id"`
+		Type string `json:"type"` // private for a DM
+	} `json:"chat"`
+	Text string `json:"text"`
+}
+
+type update struct {
+	UpdateID int64    `json:"update_id"`
+	Message  *message `json:"message"`
+}
+
+// What every Bot API call returns
+type response struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+}
+
+// An error of the Bot API, e.g. 401 for a wrong token
+type apiError struct {
+	code        int
+	description string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("Telegram responded %d: %s", e.code, e.description)
+}
+
+// Polls for messages and answers them until ctx is done. Network errors are retried; a token
+// Telegram rejects is returned.
+func (t *Telegram) Run(ctx context.Context) error {
+	var me user
+	if err := t.call(ctx, "getMe", nil, &me, sendTimeout); err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("bot.listening", me.Username))
+
+	var offset int64
+	for {
+		var updates []update
+		params := map[string]interface{}{"offset": offset, "timeout": pollSeconds, "allowed_updates": []string{"message"}}
+		err := t.call(ctx, "getUpdates", params, &updates, (pollSeconds+10)*time.Second)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && (apiErr.code == http.StatusUnauthorized || apiErr.code == http.StatusNotFound) {
+			return err
+		}
+		if err != nil {
+			t.log.Printf("Error polling Telegram for messages: %v", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(retryDelay):
+			}
+			continue
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1 // confirmed with the next poll, so a message is answered once
+			if u.Message != nil {
+				t.handle(ctx, u.Message)
+			}
+		}
+	}
+}
+
+// Answers one message. Only DMs are answered, so the archive isn't read out to a group.
+func (t *Telegram) handle(ctx context.Context, msg *message) {
+	if msg.From == nil || msg.Chat.Type != "private" || strings.TrimSpace(msg.Text) == "" {
+		return
+	}
+	userID := strconv.FormatInt(msg.From.ID, 10)
+	if !t.asker.allows(userID, msg.From.Username) {
+		t.log.Printf("Telegram user %d (%s) isn't allowed to ask the bot", msg.From.ID, msg.From.Username)
+		t.reply(ctx, msg, i18n.T("bot.not_allowed", msg.From.ID))
+		return
+	}
+
+	// Answering takes a few seconds, the chat shows the bot typing meanwhile
+	if err := t.call(ctx, "sendChatAction", map[string]interface{}{"chat_id": msg.Chat.ID, "action": "typing"}, nil, sendTimeout); err != nil {
+		t.log.Printf("Error sending the typing status to Telegram: %v", err)
+	}
+	t.reply(ctx, msg, t.asker.reply(userID, msg.Text, t.log))
+}
+
+// Sends text in reply to msg, split into as many messages as Telegram needs
+func (t *Telegram) reply(ctx context.Context, msg *message, text string) {
+	for _, part := range split(text, maxReplyChars) {
+		params := map[string]interface{}{
+			"chat_id":          msg.Chat.ID,
+			"text":             part,
+			"reply_parameters": map[string]interface{}{"message_id": msg.MessageID, "allow_sending_without_reply": true},
+		}
+		if err := t.call(ctx, "sendMessage", params, nil, sendTimeout); err != nil {
+			t.log.Printf("Error sending a reply to Telegram chat %d: %v", msg.Chat.ID, err)
+			return
+		}
+	}
+}
+
+// Calls a Bot API method with JSON params, decoding its result into result unless it's nil
+func (t *Telegram) call(ctx context.Context, method string, params interface{}, result interface{}, timeout time.Duration) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.api+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		// The URL holds the token, which mustn't end up in the log
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("%s: %w", method, urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("%s: reading Telegram's response (%s): %w", method, resp.Status, err)
+	}
+	if !r.OK {
+		return &apiError{code: r.ErrorCode, description: r.Description}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(r.Result, result)
+}
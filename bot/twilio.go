@@ -0,0 +1,204 @@
+package bot
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/httpclient"
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/query"
+)
+
+const (
+	twilioAPIEnv      = "FINCHAT_TWILIO_API"         // a Twilio edge, e.g. https://api.dublin.ie1.twilio.com
+	twilioURLEnv      = "FINCHAT_TWILIO_WEBHOOK_URL" // the webhook's public URL, if a proxy rewrites it
+	defaultTwilioAPI  = "https://api.twilio.com"
+	whatsAppPrefix    = "whatsapp:" // of Twilio's WhatsApp addresses, e.g. whatsapp:+14155238886
+	webhookPath       = "/twilio"   // where Twilio POSTs the messages sent to the bot's number
+	maxWhatsAppChars  = 1600        // Twilio's limit per message
+	twilioSendTimeout = 30 * time.Second
+	shutdownTimeout   = 5 * time.Second
+	queueSize         = 100 // messages waiting for an answer, more are dropped
+)
+
+// Answers the questions WhatsApp users text to a Twilio number. Twilio POSTs every message to
+// the webhook; the answer is sent back through Twilio's API once it's ready, as it can take
+// longer than Twilio waits for the webhook.
+type Twilio struct {
+	accountSID string
+	authToken  string // signs the webhook's requests, and the API's
+	api        string
+	client     *http.Client
+	asker      *asker
+	queue      chan incoming // answered in the order they came
+	log        *log.Logger
+}
+
+// A message to the bot, from and to Twilio's WhatsApp addresses
+type incoming struct {
+	from, bot, text string
+}
+
+// A WhatsApp bot of a Twilio account answering from the index for the phone numbers allowed,
+// e.g. +14155550100. Everyone else is told their number, to be allowed by the bot's owner.
+func NewTwilio(accountSID, authToken string, allowed []string, indexName string, filter query.Filter, log *log.Logger) *Twilio {
+	api := os.Getenv(twilioAPIEnv)
+	if api == "" {
+		api = defaultTwilioAPI
+	}
+	return &Twilio{
+		accountSID: accountSID,
+		authToken:  authToken,
+		api:        strings.TrimSuffix(api, "/"),
+		client:     httpclient.WithTimeout(twilioSendTimeout),
+		asker:      newAsker(indexName, filter, allowed),
+		queue:      make(chan incoming, queueSize),
+		log:        log,
+	}
+}
+
+// Serves the webhook on addr until ctx is done
+func (t *Twilio) Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(webhookPath, t.webhook)
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			t.log.Printf("Error stopping the WhatsApp bot's webhook: %v", err)
+		}
+	}()
+
+	go func() {
+		for msg := range t.queue {
+			t.answer(msg)
+		}
+	}()
+
+	fmt.Println(i18n.T("bot.whatsapp_listening", addr, webhookPath))
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-done
+	return nil
+}
+
+// Handles a message Twilio POSTs, queueing it to be answered
+func (t *Twilio) webhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "bad form", http.StatusBadRequest)
+		return
+	}
+	if !t.signed(r) {
+		t.log.Printf("Rejected a request to the WhatsApp webhook without a valid Twilio signature from %s", r.RemoteAddr)
+		http.Error(w, "bad signature", http.StatusForbidden)
+		return
+	}
+	// No reply in the response, it comes as a message of its own
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprint(w, "<Response></Response>")
+
+	msg := incoming{from: r.PostForm.Get("From"), bot: r.PostForm.Get("To"), text: r.PostForm.Get("Body")}
+	if !strings.HasPrefix(msg.from, whatsAppPrefix) || strings.TrimSpace(msg.text) == "" {
+		return // an SMS to the same number, or media without a caption
+	}
+	select {
+	case t.queue <- msg:
+	default:
+		t.log.Printf("Dropped a WhatsApp message from %s, %d are waiting for an answer", msg.from, queueSize)
+	}
+}
+
+// Sends the reply to a message, split into as many messages as Twilio needs
+func (t *Twilio) answer(msg incoming) {
+	number := strings.TrimPrefix(msg.from, whatsAppPrefix)
+	reply := i18n.T("bot.not_allowed_number", number)
+	if t.asker.allows(number) {
+		reply = t.asker.reply(number, msg.text, t.log)
+	} else {
+		t.log.Printf("WhatsApp number %s isn't allowed to ask the bot", number)
+	}
+	for _, part := range split(reply, maxWhatsAppChars) {
+		if err := t.send(msg.bot, msg.from, part); err != nil {
+			t.log.Printf("Error sending a reply to WhatsApp number %s: %v", number, err)
+			return
+		}
+	}
+}
+
+// Whether the request carries Twilio's signature: the HMAC-SHA1, keyed with the auth token, of
+// the webhook's URL followed by the POSTed parameters sorted by name, each name then its value
+func (t *Twilio) signed(r *http.Request) bool {
+	webhookURL := os.Getenv(twilioURLEnv)
+	if webhookURL == "" {
+		scheme := "http"
+		if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+			scheme = "https"
+		}
+		webhookURL = scheme + "://" + r.Host + r.URL.RequestURI()
+	}
+	names := make([]string, 0, len(r.PostForm))
+	for name := range r.PostForm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	sb.WriteString(webhookURL)
+	for _, name := range names {
+		for _, value := range r.PostForm[name] {
+			sb.WriteString(name + value)
+		}
+	}
+	mac := hmac.New(sha1.New, []byte(t.authToken))
+	mac.Write([]byte(sb.String()))
+	want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(want), []byte(r.Header.Get("X-Twilio-Signature")))
+}
+
+// Sends a WhatsApp message from the bot's number through Twilio's Messages API
+func (t *Twilio) send(from, to, text string) error {
+	form := url.Values{"From": {from}, "To": {to}, "Body": {text}}
+	req, err := http.NewRequest(http.MethodPost, t.api+"/2010-04-01/Accounts/"+t.accountSID+"/Messages.json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(t.accountSID, t.authToken)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var twilioErr struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&twilioErr) == nil && twilioErr.Message != "" {
+			return fmt.Errorf("Twilio responded %s: %s (error %d)", resp.Status, twilioErr.Message, twilioErr.Code)
+		}
+		return fmt.Errorf("Twilio responded %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package bundle
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"time"
+
+	"github.com/pisush/fin-chat/dedup"
+	"github.com/pisush/fin-chat/secure"
+	"github.com/pisush/fin-chat/store"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+const (
+	format  = "fin-chat-archive"
+	version = 1
+
+	maxLineBytes = 64 << 20 // a message line, with its embedding
+)
+
+// How the messages were embedded, so that they are only loaded where the same embedding
+// model is used and searched the same way
+type Settings struct {
+	Model           string `json:"model"`
+	Dimension       int    `json:"dimension"`
+	MaxMessageChars int    `json:"max_message_chars"` // longer messages were split into several
+	Emoji           string `json:"emoji"`
+	Spam            string `json:"spam"`
+	SystemMessages  string `json:"system_messages"`
+	Timezone        string `json:"timezone,omitempty"` // the exports' clocks were read in, as they are if empty
+	Redact          bool   `json:"redact"`
+	Anonymize       bool   `json:"anonymize"` // senders are pseudonyms, revealed only where they were made
+}
+
+// The first line of an archive
+type Header struct {
+	Format   string    `json:"format"`
+	Version  int       `json:"version"`
+	Created  time.Time `json:"created"`
+	Index    string    `json:"index"`
+	Messages int       `json:"messages"`
+	Settings Settings  `json:"settings"`
+}
+
+// Every other line: a message as embed parsed it, and its embedding
+type Message struct {
+	ID        string    `json:"id"`
+	Text      string    `json:"text"`
+	Sender    string    `json:"sender"`
+	Timestamp int64     `json:"timestamp"`
+	MessageID string    `json:"message_id,omitempty"`
+	ReplyTo   string    `json:"reply_to,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Values    []float64 `json:"values"`
+}
+
+// The default file name of an archive of an index, after it and the time
+func Name(indexName string, now time.Time) string {
+	return indexName + "-" + now.Format("20060102-150405") + ".archive.jsonl.gz"
+}
+
+// Writes every message of the embeddings file, with its embedding, to a single gzipped JSON
+// lines file at path, after a header with the settings. Returns the number of messages.
+func Create(path, indexName, embeddingsFileName string, settings Settings, log *log.Logger) (int, error) {
+	rows, err := vectors.ReadFile(embeddingsFileName, log)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) > 0 {
+		settings.Dimension = len(rows[0].Values)
+	}
+
+	file, err := secure.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	writer := gzip.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	err = encoder.Encode(Header{Format: format, Version: version, Created: time.Now().UTC(), Index: indexName, Messages: len(rows), Settings: settings})
+	for _, row := range rows {
+		if err != nil {
+			break
+		}
+		err = encoder.Encode(Message{
+			ID: row.ID, Text: row.Text, Sender: row.Sender, Timestamp: row.Timestamp.Unix(),
+			MessageID: row.MessageID, ReplyTo: row.ReplyTo, Namespace: row.Namespace, Values: row.Values,
+		})
+	}
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(rows), file.Close()
+}
+
+// Appends the messages of the archive at path to the embeddings file, skipping those it
+// already has, and adds them to the message store. The archive must be of the embedding
+// model and dimension given, vectors of another can't be searched with this one's queries.
+// Returns the archive's header and the number of messages added; upsert then puts them in
+// the index.
+func Load(path, embeddingsFileName, model string, dimension int, log *log.Logger) (Header, int, error) {
+	file, err := secure.Open(path)
+	if err != nil {
+		return Header{}, 0, err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return Header{}, 0, fmt.Errorf("%s isn't an archive: %w", path, err)
+	}
+	defer reader.Close()
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 1<<20), maxLineBytes)
+
+	var header Header
+	if !scanner.Scan() {
+		return Header{}, 0, fmt.Errorf("%s is empty", path)
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil || header.Format != format {
+		return Header{}, 0, fmt.Errorf("%s isn't an archive", path)
+	}
+	if header.Version > version {
+		return header, 0, fmt.Errorf("%s is an archive of version %d, this version reads up to %d", path, header.Version, version)
+	}
+	if header.Settings.Model != model {
+		return header, 0, fmt.Errorf("%s was embedded with %s, not %s", path, header.Settings.Model, model)
+	}
+	if header.Messages > 0 && header.Settings.Dimension != dimension {
+		return header, 0, fmt.Errorf("%s holds %d-dimensional embeddings, not %d; load it with --dimensions %d", path, header.Settings.Dimension, dimension, header.Settings.Dimension)
+	}
+
+	// The file's own rows are skipped, so loading an archive twice adds nothing
+	known := map[string]bool{}
+	existing, err := vectors.ReadFile(embeddingsFileName, log)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return header, 0, err
+	}
+	for _, row := range existing {
+		known[row.ID] = true
+	}
+
+	out, err := vectors.Append(embeddingsFileName)
+	if err != nil {
+		return header, 0, err
+	}
+	defer out.Close() // after an error too, so the file doesn't end in half a row
+
+	added := 0
+	var stored []store.Message
+	for lineNumber := 2; scanner.Scan(); lineNumber++ {
+		var m Message
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return header, added, fmt.Errorf("line %d of %s: %w", lineNumber, path, err)
+		}
+		timestamp := time.Unix(m.Timestamp, 0).UTC()
+		// The ID is worked out again, rather than trusted, so it is the one upsert will use
+		id := vectors.ID(m.Namespace, dedup.Hash(m.Text, m.Sender, timestamp))
+		if known[id] {
+			continue
+		}
+		if len(m.Values) != header.Settings.Dimension {
+			return header, added, fmt.Errorf("line %d of %s has %d values, not %d", lineNumber, path, len(m.Values), header.Settings.Dimension)
+		}
+		row := vectors.Row{Text: m.Text, Sender: m.Sender, Timestamp: timestamp, MessageID: m.MessageID, ReplyTo: m.ReplyTo, Namespace: m.Namespace, Values: m.Values}
+		if err := out.Write(row.Record()); err != nil {
+			return header, added, err
+		}
+		known[id] = true
+		added++
+		stored = append(stored, store.Message{ID: id, Text: m.Text, Sender: m.Sender, Timestamp: timestamp, Chat: m.Namespace})
+	}
+	if err := scanner.Err(); err != nil {
+		return header, added, err
+	}
+	if err := out.Close(); err != nil {
+		return header, added, err
+	}
+	// The embeddings file has the messages too, the store is only a faster way to them
+	if err := store.Put(stored); err != nil {
+		log.Printf("Error adding the archive's messages to the message store: %v", err)
+	}
+	return header, added, nil
+}
@@ -0,0 +1,128 @@
+package chats
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const DefaultPath = "./chats.json"
+
+// How a chat is kept apart from the others
+const (
+	PolicyIndex     = "index"     // an index of its own, and an embeddings file of its own
+	PolicyNamespace = "namespace" // a namespace of the shared index
+)
+
+const maxIndexName = 45 // Pinecone's limit
+
+// Where a chat's vectors are: the index, and the namespace in it
+type Chat struct {
+	Index      string `json:"index"`
+	Namespace  string `json:"namespace,omitempty"`
+	Embeddings string `json:"embeddings,omitempty"` // as --embeddings, empty for the shared file
+}
+
+// The chats registered with "chats add", by name
+type Registry struct {
+	Chats map[string]Chat `json:"chats"`
+}
+
+// Reads the registry, a missing file is an empty one
+func Load(path string) (*Registry, error) {
+	r := &Registry{Chats: map[string]Chat{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(r); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if r.Chats == nil {
+		r.Chats = map[string]Chat{}
+	}
+	return r, nil
+}
+
+func (r *Registry) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// The registered chat called name
+func (r *Registry) Lookup(name string) (Chat, error) {
+	chat, ok := r.Chats[name]
+	if !ok {
+		if len(r.Chats) == 0 {
+			return Chat{}, fmt.Errorf("no chat %q, none are registered yet: add one with chats add", name)
+		}
+		return Chat{}, fmt.Errorf("no chat %q, there are: %s", name, strings.Join(r.Names(), ", "))
+	}
+	return chat, nil
+}
+
+// The names of the registered chats, sorted
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.Chats))
+	for name := range r.Chats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Where a new chat called name goes with policy: an index named after baseIndex and the
+// chat, with its embeddings file in embeddingsDir, or a namespace of baseIndex
+func New(name, policy, baseIndex, embeddingsDir string) (Chat, error) {
+	slug := Slug(name)
+	switch policy {
+	case PolicyIndex:
+		index := baseIndex + "-" + slug
+		if len(index) > maxIndexName {
+			index = strings.TrimRight(index[:maxIndexName], "-")
+		}
+		return Chat{Index: index, Embeddings: filepath.Join(embeddingsDir, slug+"-embeddings.csv")}, nil
+	case PolicyNamespace:
+		return Chat{Index: baseIndex, Namespace: slug}, nil
+	}
+	return Chat{}, fmt.Errorf("unknown chat policy %q, use %s or %s", policy, PolicyIndex, PolicyNamespace)
+}
+
+// A chat name as index and file names allow: lowercase letters, digits and hyphens. Names
+// with none of those, e.g. Hebrew ones, get a short hash of the name instead.
+func Slug(name string) string {
+	var sb strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if hyphen && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(r)
+			hyphen = false
+			continue
+		}
+		hyphen = true
+	}
+	if sb.Len() == 0 {
+		sum := sha256.Sum256([]byte(name))
+		return "chat-" + hex.EncodeToString(sum[:4])
+	}
+	return sb.String()
+}
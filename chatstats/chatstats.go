@@ -0,0 +1,172 @@
+package chatstats
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pisush/fin-chat/anonymize"
+	"github.com/pisush/fin-chat/embed"
+	"github.com/pisush/fin-chat/system"
+)
+
+const (
+	barWidth     = 30 // characters of the longest bar
+	busiestHours = 3
+)
+
+// What a chat export holds, counted without embedding anything
+type Stats struct {
+	Messages int
+	Unparsed int // entries of the export that didn't parse, e.g. continuation lines of a WhatsApp message
+	Media    int // placeholders of attachments the export left out
+	Notices  int // messages written by the app, see system.Classify
+	Chars    int // of the messages people wrote, without media and app messages
+	written  int // messages counted in Chars
+	From, To time.Time
+	Senders  []Sender       // most messages first
+	Months   map[string]int // by "2006-01"
+	Hours    [24]int        // by the hour of the day the messages were sent, in the export's time
+}
+
+// One sender's share of the chat
+type Sender struct {
+	Name     string
+	Messages int
+	Chars    int
+	Media    int
+	written  int
+}
+
+// Counts the messages of an export, of which unparsed entries didn't parse
+func Compute(messages []embed.Message, unparsed int) Stats {
+	s := Stats{Messages: len(messages), Unparsed: unparsed, Months: map[string]int{}}
+	senders := map[string]*Sender{}
+	for _, msg := range messages {
+		if s.From.IsZero() || msg.Timestamp.Before(s.From) {
+			s.From = msg.Timestamp
+		}
+		if msg.Timestamp.After(s.To) {
+			s.To = msg.Timestamp
+		}
+		s.Months[msg.Timestamp.Format("2006-01")]++
+		s.Hours[msg.Timestamp.Hour()]++
+
+		sender, ok := senders[msg.Sender]
+		if !ok {
+			sender = &Sender{Name: msg.Sender}
+			senders[msg.Sender] = sender
+		}
+		sender.Messages++
+		switch system.Classify(msg.Text) {
+		case system.Media:
+			s.Media++
+			sender.Media++
+			continue
+		case system.Notice:
+			s.Notices++
+			continue
+		}
+		chars := utf8.RuneCountInString(msg.Text)
+		s.Chars += chars
+		sender.Chars += chars
+		s.written++
+		sender.written++
+	}
+	for _, sender := range senders {
+		s.Senders = append(s.Senders, *sender)
+	}
+	sort.Slice(s.Senders, func(a, b int) bool {
+		if s.Senders[a].Messages != s.Senders[b].Messages {
+			return s.Senders[a].Messages > s.Senders[b].Messages
+		}
+		return s.Senders[a].Name < s.Senders[b].Name
+	})
+	return s
+}
+
+// The n hours of the day with the most messages, busiest first, e.g. "21:00"
+func (s Stats) BusiestHours(n int) []string {
+	hours := make([]int, 24)
+	for i := range hours {
+		hours[i] = i
+	}
+	sort.SliceStable(hours, func(a, b int) bool { return s.Hours[hours[a]] > s.Hours[hours[b]] })
+	var busiest []string
+	for _, hour := range hours[:n] {
+		if s.Hours[hour] > 0 {
+			busiest = append(busiest, fmt.Sprintf("%02d:00", hour))
+		}
+	}
+	return busiest
+}
+
+// Writes the stats as a plain text report, with bars for the months and hours
+func Write(w io.Writer, s Stats) error {
+	var sb strings.Builder
+	if s.Messages == 0 {
+		fmt.Fprintf(&sb, "No messages, %d entries didn't parse.\n", s.Unparsed)
+		_, err := io.WriteString(w, sb.String())
+		return err
+	}
+	fmt.Fprintf(&sb, "%d messages from %d senders, %s to %s\n", s.Messages, len(s.Senders), s.From.Format("2006-01-02"), s.To.Format("2006-01-02"))
+	fmt.Fprintf(&sb, "%d entries didn't parse (see err.log)\n", s.Unparsed)
+	fmt.Fprintf(&sb, "Average length: %.0f characters\n", average(s.Chars, s.written))
+	fmt.Fprintf(&sb, "Media: %d (%.1f%%), app messages: %d\n", s.Media, percent(s.Media, s.Messages), s.Notices)
+	fmt.Fprintf(&sb, "Busiest hours: %s\n", strings.Join(s.BusiestHours(busiestHours), ", "))
+
+	sb.WriteString("\nPer sender:\n")
+	width := 0
+	for _, sender := range s.Senders {
+		width = max(width, utf8.RuneCountInString(anonymize.Reveal(sender.Name)))
+	}
+	for _, sender := range s.Senders {
+		name := anonymize.Reveal(sender.Name)
+		fmt.Fprintf(&sb, "  %s%s  %6d  %5.1f%%  avg %4.0f chars  %d media\n", name, strings.Repeat(" ", width-utf8.RuneCountInString(name)),
+			sender.Messages, percent(sender.Messages, s.Messages), average(sender.Chars, sender.written), sender.Media)
+	}
+
+	sb.WriteString("\nPer month:\n")
+	months := make([]string, 0, len(s.Months))
+	most := 0
+	for month, n := range s.Months {
+		months = append(months, month)
+		most = max(most, n)
+	}
+	sort.Strings(months)
+	for _, month := range months {
+		fmt.Fprintln(&sb, strings.TrimRight(fmt.Sprintf("  %s  %6d  %s", month, s.Months[month], bar(s.Months[month], most)), " "))
+	}
+
+	sb.WriteString("\nPer hour of the day:\n")
+	most = 0
+	for _, n := range s.Hours {
+		most = max(most, n)
+	}
+	for hour, n := range s.Hours {
+		fmt.Fprintln(&sb, strings.TrimRight(fmt.Sprintf("  %02d:00  %6d  %s", hour, n, bar(n, most)), " "))
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func bar(n, most int) string {
+	if most == 0 {
+		return ""
+	}
+	return strings.Repeat("#", (n*barWidth+most-1)/most)
+}
+
+func average(total, count int) float64 {
+	if count <= 0 {
+		return 0
+	}
+	return float64(total) / float64(count)
+}
+
+func percent(n, total int) float64 {
+	return 100 * average(n, total)
+}
@@ -0,0 +1,127 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// A command of the CLI, as shown by help and completed by the shell
+type Command struct {
+	Name        string
+	Args        string   // after the name in the usage line, e.g. "list|describe|delete"
+	Summary     string   // one line, for the list of commands
+	Subcommands []string // completed after the name
+	Flags       []string // the flags that change what it does, shown in its help
+	Chains      bool     // can be followed by other commands that chain, e.g. "embed upsert query"
+}
+
+// Shown by the help of every command but the root, instead of the flags all commands take
+const commandUsage = `Usage:
+  {{.UseLine}}{{if .HasAvailableLocalFlags}}
+
+Flags:
+{{.LocalFlags.FlagUsages | trimTrailingWhitespaces}}{{end}}
+
+The flags every command takes, like --profile and --locale, are listed by '{{.Root.Name}} --help'.
+`
+
+// The root command of the CLI, with a command for each of commands and cobra's help and
+// completion. Every command takes all the flags, which the commands chained after it share;
+// its help shows the ones it names. run is called with the command given and its arguments,
+// e.g. embed, upsert and query for "embed upsert query", and not for help or completion.
+func New(prog, summary string, commands []Command, flags *pflag.FlagSet, run func(args []string)) *cobra.Command {
+	root := &cobra.Command{
+		Use:          prog,
+		Short:        summary,
+		SilenceUsage: true, // a mistyped flag shouldn't print all the others
+	}
+	root.PersistentFlags().AddFlagSet(flags)
+	cobra.EnableCommandSorting = false // in the order of commands, the ones that chain first
+
+	var chains []string
+	for _, c := range commands {
+		if c.Chains {
+			chains = append(chains, c.Name)
+		}
+	}
+	for _, c := range commands {
+		c := c
+		use := c.Name
+		if c.Args != "" {
+			use += " " + c.Args
+		}
+		if c.Chains {
+			use += " [command]..."
+		}
+		cmd := &cobra.Command{
+			Use:   use,
+			Short: c.Summary,
+			Run: func(cmd *cobra.Command, args []string) {
+				// The flags given are marked on flags too, the copies in the help were set instead
+				cmd.Flags().Visit(func(f *pflag.Flag) { flags.Lookup(f.Name).Changed = true })
+				run(append([]string{c.Name}, args...))
+			},
+			ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+				return complete(commands, chains, c, args)
+			},
+		}
+		// A copy, sharing the value, as cobra leaves the root's own flags out of a command's help
+		for _, name := range c.Flags {
+			if f := flags.Lookup(name); f != nil {
+				local := *f
+				cmd.Flags().AddFlag(&local)
+			}
+		}
+		cmd.SetUsageTemplate(commandUsage)
+		root.AddCommand(cmd)
+	}
+	return root
+}
+
+// Completes a command's argument: the subcommands after a command that has them, otherwise
+// the commands that chain after one that does, otherwise file names
+func complete(commands []Command, chains []string, c Command, args []string) ([]string, cobra.ShellCompDirective) {
+	previous := c
+	if len(args) > 0 {
+		previous = Command{}
+		for _, other := range commands {
+			if other.Name == args[len(args)-1] {
+				previous = other
+			}
+		}
+	}
+	if len(previous.Subcommands) > 0 {
+		return previous.Subcommands, cobra.ShellCompDirectiveNoFileComp
+	}
+	if c.Chains {
+		return chains, cobra.ShellCompDirectiveNoFileComp
+	}
+	return nil, cobra.ShellCompDirectiveDefault
+}
+
+// Sets the flags from the environment, where each is its name in upper case after the prefix,
+// with underscores for dashes, e.g. FINCHAT_EMBEDDING_MODEL for --embedding-model. Called before
+// the command line is parsed, so it wins.
+func FromEnv(fs *pflag.FlagSet, prefix string) error {
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		name := envName(prefix, f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, name, setErr)
+		}
+	})
+	return err
+}
+
+// The environment variable of a flag, see FromEnv
+func envName(prefix, flagName string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
@@ -0,0 +1,105 @@
+package cli
+
+import (
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+var testCommands = []Command{
+	{Name: "embed", Chains: true, Flags: []string{"input"}},
+	{Name: "upsert", Chains: true},
+	{Name: "index", Args: "list|delete", Subcommands: []string{"list", "delete"}, Chains: true},
+	{Name: "chats", Args: "list|add <name>", Subcommands: []string{"list", "add"}},
+}
+
+func TestNew(t *testing.T) {
+	for _, c := range []struct {
+		args     []string
+		want     []string
+		changed  []string
+		input    string
+		unparsed bool
+	}{
+		{args: []string{"embed", "upsert", "--input", "a.txt"}, want: []string{"embed", "upsert"}, changed: []string{"input"}, input: "a.txt"},
+		{args: []string{"--namespace", "x", "index", "list", "upsert"}, want: []string{"index", "list", "upsert"}, changed: []string{"namespace"}},
+		{args: []string{"chats", "add", "family"}, want: []string{"chats", "add", "family"}},
+		{args: []string{"help", "embed"}},
+		{args: []string{"completion", "bash"}},
+		{args: []string{"frob"}, unparsed: true},
+	} {
+		flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+		input := flags.String("input", "", "")
+		flags.String("namespace", "", "")
+		var got []string
+		root := New("test", "", testCommands, flags, func(args []string) { got = args })
+		root.SetArgs(c.args)
+		root.SetOut(io.Discard)
+		root.SetErr(io.Discard)
+		if err := root.Execute(); (err != nil) != c.unparsed {
+			t.Errorf("%v: %v", c.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v ran %v, want %v", c.args, got, c.want)
+		}
+		var changed []string
+		flags.VisitAll(func(f *pflag.Flag) {
+			if f.Changed {
+				changed = append(changed, f.Name)
+			}
+		})
+		if !reflect.DeepEqual(changed, c.changed) {
+			t.Errorf("%v changed %v, want %v", c.args, changed, c.changed)
+		}
+		if *input != c.input {
+			t.Errorf("%v: --input is %q, want %q", c.args, *input, c.input)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	chains := []string{"embed", "upsert", "index"}
+	for _, c := range []struct {
+		command string
+		args    []string
+		want    []string
+	}{
+		{"embed", nil, chains},
+		{"embed", []string{"index"}, []string{"list", "delete"}},
+		{"index", nil, []string{"list", "delete"}},
+		{"index", []string{"list"}, chains},
+		{"chats", nil, []string{"list", "add"}},
+		{"chats", []string{"add"}, nil},
+	} {
+		var command Command
+		for _, other := range testCommands {
+			if other.Name == c.command {
+				command = other
+			}
+		}
+		if got, _ := complete(testCommands, chains, command, c.args); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s %v completes %v, want %v", c.command, c.args, got, c.want)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	model := flags.String("embedding-model", "ada", "")
+	t.Setenv("TEST_EMBEDDING_MODEL", "small")
+	if err := FromEnv(flags, "TEST_"); err != nil {
+		t.Fatal(err)
+	}
+	if *model != "small" || !flags.Lookup("embedding-model").Changed {
+		t.Errorf("--embedding-model is %q, want small from the environment", *model)
+	}
+
+	flags.Int("replicas", 1, "")
+	t.Setenv("TEST_REPLICAS", "two")
+	if err := FromEnv(flags, "TEST_"); err == nil {
+		t.Error("an invalid value in the environment was accepted")
+	}
+}
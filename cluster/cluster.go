@@ -0,0 +1,143 @@
+package cluster
+
+import (
+	"math"
+	"math/rand"
+)
+
+const (
+	maxIterations = 50
+	seed          = 1 // fixed so the same embeddings always give the same clusters
+)
+
+// Groups the points into k clusters by cosine similarity (spherical k-means, k-means++ seeding).
+// Returns the cluster of every point and the unit-length centroids, fewer than k if the
+// points have fewer distinct directions.
+func KMeans(points [][]float64, k int) ([]int, [][]float64) {
+	if k > len(points) {
+		k = len(points)
+	}
+	if k == 0 {
+		return nil, nil
+	}
+
+	unit := make([][]float64, len(points))
+	for i, p := range points {
+		unit[i] = normalize(p)
+	}
+
+	centroids := seedCentroids(unit, k, rand.New(rand.NewSource(seed)))
+	assignments := make([]int, len(unit))
+	for iteration := 0; iteration < maxIterations; iteration++ {
+		changed := false
+		for i, p := range unit {
+			if best := Nearest(p, centroids); best != assignments[i] {
+				assignments[i] = best
+				changed = true
+			}
+		}
+		if !changed && iteration > 0 {
+			break
+		}
+
+		sums := make([][]float64, len(centroids))
+		for c := range sums {
+			sums[c] = make([]float64, len(unit[0]))
+		}
+		for i, p := range unit {
+			for d, v := range p {
+				sums[assignments[i]][d] += v
+			}
+		}
+		for c, sum := range sums {
+			if norm(sum) > 0 { // an empty cluster keeps its centroid
+				centroids[c] = normalize(sum)
+			}
+		}
+	}
+	return assignments, centroids
+}
+
+// A cluster count for n points: the rule of thumb sqrt(n/2), between 1 and max
+func DefaultK(n, max int) int {
+	k := int(math.Sqrt(float64(n) / 2))
+	if k < 1 {
+		k = 1
+	}
+	if k > max {
+		k = max
+	}
+	return k
+}
+
+// The index of the centroid most similar to p
+func Nearest(p []float64, centroids [][]float64) int {
+	best, bestSimilarity := 0, math.Inf(-1)
+	for c, centroid := range centroids {
+		if similarity := Cosine(p, centroid); similarity > bestSimilarity {
+			best, bestSimilarity = c, similarity
+		}
+	}
+	return best
+}
+
+// Cosine similarity of two vectors, 0 if either is all zeros
+func Cosine(a, b []float64) float64 {
+	na, nb := norm(a), norm(b)
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot(a, b) / (na * nb)
+}
+
+// k-means++: each next centroid is picked with probability proportional to its distance
+func seedCentroids(points [][]float64, k int, rng *rand.Rand) [][]float64 {
+	centroids := [][]float64{points[rng.Intn(len(points))]}
+	distances := make([]float64, len(points))
+	for len(centroids) < k {
+		total := 0.0
+		for i, p := range points {
+			distances[i] = 1 - Cosine(p, centroids[Nearest(p, centroids)])
+			distances[i] *= distances[i]
+			total += distances[i]
+		}
+		if total == 0 {
+			break // fewer distinct points than k
+		}
+
+		target := rng.Float64() * total
+		next := len(points) - 1
+		for i, d := range distances {
+			if target -= d; target <= 0 {
+				next = i
+				break
+			}
+		}
+		centroids = append(centroids, points[next])
+	}
+	return centroids
+}
+
+func dot(a, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+func norm(v []float64) float64 {
+	return math.Sqrt(dot(v, v))
+}
+
+func normalize(v []float64) []float64 {
+	n := norm(v)
+	unit := make([]float64, len(v))
+	if n == 0 {
+		return unit
+	}
+	for i, x := range v {
+		unit[i] = x / n
+	}
+	return unit
+}
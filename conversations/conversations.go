@@ -0,0 +1,223 @@
+package conversations
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/embed"
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/llm"
+	"github.com/pisush/fin-chat/state"
+	"github.com/pisush/fin-chat/timezone"
+	"github.com/pisush/fin-chat/upsert"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+// The namespace the summaries are upserted to, apart from the messages
+const Namespace = "summaries"
+
+// What a summary covers, from --summaries
+const (
+	Off            = "off"
+	ByDay          = "day"
+	ByWeek         = "week"
+	ByConversation = "conversation" // messages with no pause longer than conversationGap between them
+)
+
+const (
+	conversationGap = 3 * time.Hour
+	maxPeriodChars  = 12000 // of a period's messages sent to be summarized, the rest is left out
+	maxMetadataText = 8000
+
+	prompt = "Summarize this part of a chat in two to four sentences: the topics discussed, " +
+		"any decisions, and who took part. Write it so that it can be found by searching for the topics."
+)
+
+// The messages of a chat over a day, a week or a conversation
+type Period struct {
+	Chat       string // the namespace of its messages
+	Start, End time.Time
+	Rows       []vectors.Row
+}
+
+// Checks a --summaries value
+func Valid(by string) error {
+	switch by {
+	case Off, ByDay, ByWeek, ByConversation:
+		return nil
+	}
+	return fmt.Errorf("unknown summaries period %q, use %s, %s, %s or %s", by, Off, ByDay, ByWeek, ByConversation)
+}
+
+// Groups the rows into periods per chat, each chat's in time order. Weeks start on Monday;
+// days and weeks are in UTC, like the timestamps.
+func Periods(rows []vectors.Row, by string) []Period {
+	sorted := append([]vectors.Row(nil), rows...)
+	sort.SliceStable(sorted, func(a, b int) bool {
+		if sorted[a].Namespace != sorted[b].Namespace {
+			return sorted[a].Namespace < sorted[b].Namespace
+		}
+		return sorted[a].Timestamp.Before(sorted[b].Timestamp)
+	})
+
+	var periods []Period
+	for _, row := range sorted {
+		if row.Namespace == Namespace {
+			continue
+		}
+		if n := len(periods); n > 0 && periods[n-1].Chat == row.Namespace && samePeriod(periods[n-1], row.Timestamp, by) {
+			periods[n-1].Rows = append(periods[n-1].Rows, row)
+			periods[n-1].End = row.Timestamp
+			continue
+		}
+		periods = append(periods, Period{Chat: row.Namespace, Start: row.Timestamp, End: row.Timestamp, Rows: []vectors.Row{row}})
+	}
+	return periods
+}
+
+func samePeriod(p Period, t time.Time, by string) bool {
+	switch by {
+	case ByDay:
+		return t.Format("2006-01-02") == p.Start.Format("2006-01-02")
+	case ByWeek:
+		return weekOf(t).Equal(weekOf(p.Start))
+	}
+	return t.Sub(p.End) <= conversationGap
+}
+
+// The Monday the week of t starts on
+func weekOf(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// The vector ID of a period's summary, the same for a period however many messages it has:
+// of its chat and its day, week or first message
+func (p Period) ID(by string) string {
+	key := p.Start.Format(time.RFC3339)
+	switch by {
+	case ByDay:
+		key = p.Start.Format("2006-01-02")
+	case ByWeek:
+		key = weekOf(p.Start).Format("2006-01-02")
+	}
+	sum := sha256.Sum256([]byte(p.Chat + "\x00" + by + "\x00" + key))
+	return "sum-" + hex.EncodeToString(sum[:16])
+}
+
+// Identifies the messages of the period, so a summary is only redone when they change
+func (p Period) hash() string {
+	h := sha256.New()
+	for _, row := range p.Rows {
+		h.Write([]byte(row.ID + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// The period a match of the summaries namespace covers, for searching its messages
+func PeriodOf(metadata map[string]interface{}) (Period, bool) {
+	start, ok := metadata["timestamp"].(float64)
+	end, hasEnd := metadata["end"].(float64)
+	if !ok || !hasEnd {
+		return Period{}, false
+	}
+	chat, _ := metadata["chat"].(string)
+	return Period{Chat: chat, Start: timezone.Clock(time.Unix(int64(start), 0)), End: timezone.Clock(time.Unix(int64(end), 0))}, true
+}
+
+// Summarizes every period of the embeddings file's messages, embeds the summaries and upserts
+// them to the Namespace of the index. Periods summarized before, with the same messages, are
+// skipped. Returns how many summaries were upserted.
+func Upsert(indexName, embeddingsFileName, by string, log *log.Logger) (int, error) {
+	rows, err := vectors.ReadFile(embeddingsFileName, log)
+	if err != nil {
+		return 0, err
+	}
+	st, err := state.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	var changed []Period
+	for _, p := range Periods(rows, by) {
+		if st.Summaries[p.ID(by)] != p.hash() {
+			changed = append(changed, p)
+		}
+	}
+	if len(changed) == 0 {
+		fmt.Println(i18n.T("summaries.none_new"))
+		return 0, nil
+	}
+
+	sizer := upsert.NewSizer(log)
+	defer sizer.Save(log)
+	upserted := 0
+	for i, p := range changed {
+		fmt.Println(i18n.T("summaries.period", i+1, len(changed), p.Start.Format("2006-01-02"), p.End.Format("2006-01-02")))
+		summary, err := llm.Complete([]llm.Message{
+			{Role: "system", Content: prompt},
+			{Role: "user", Content: transcript(p.Rows)},
+		})
+		if err != nil {
+			log.Printf("Error summarizing the messages of %s from %s: %v", p.Chat, p.Start.Format(time.RFC3339), err)
+			return upserted, err
+		}
+		embeddings, err := embed.Embed(context.Background(), []string{summary})
+		if err != nil {
+			return upserted, err
+		}
+
+		vector := upsert.UpsertData{
+			ID:     p.ID(by),
+			Values: vectors.Normalize(embeddings[0]),
+			Metadata: map[string]interface{}{
+				"text":      grapheme.TruncateBytes(summary, maxMetadataText),
+				"timestamp": p.Start.Unix(), // so date filters find the periods that began in their range
+				"end":       p.End.Unix(),
+				"date":      p.Start.Format("2006-01-02"),
+				"chat":      p.Chat,
+				"period":    by,
+				"messages":  len(p.Rows),
+			},
+			Namespace: Namespace,
+		}
+		n, err := upsert.Vectors(indexName, []upsert.UpsertData{vector}, sizer, log)
+		if err != nil {
+			return upserted, err
+		}
+		if n == 0 {
+			continue // logged by Vectors, tried again next time
+		}
+		upserted++
+
+		// Saved after every period, summarizing a long chat takes a while
+		if st, err = state.Load(); err != nil {
+			return upserted, err
+		}
+		st.Summaries[p.ID(by)] = p.hash()
+		if err := st.Save(); err != nil {
+			return upserted, err
+		}
+	}
+	return upserted, nil
+}
+
+// The period's messages as "[date] sender: text" lines, cut at maxPeriodChars
+func transcript(rows []vectors.Row) string {
+	var sb strings.Builder
+	for _, row := range rows {
+		line := fmt.Sprintf("[%s] %s: %s\n", row.Timestamp.Format("2006-01-02 15:04"), row.Sender, row.Text)
+		if sb.Len() > 0 && sb.Len()+len(line) > maxPeriodChars {
+			break
+		}
+		sb.WriteString(line)
+	}
+	return sb.String()
+}
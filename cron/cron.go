@@ -0,0 +1,127 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shorthands for common schedules
+var shorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@nightly": "0 3 * * *", // when nobody is chatting, for the syncs of daemon
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+const searchYears = 5 // a schedule with no time in this many years, e.g. February 30th, never runs
+
+// A cron schedule: minute, hour, day of the month, month and day of the week
+type Schedule struct {
+	minutes, hours, days, months, weekdays uint64 // bit n set if n matches
+	anyDay, anyWeekday                     bool   // the field was *, see matches
+}
+
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{{"minute", 0, 59}, {"hour", 0, 23}, {"day of the month", 1, 31}, {"month", 1, 12}, {"day of the week", 0, 7}}
+
+// Parses five fields as crontab(5) has them, e.g. "30 2 * * 1-5" for 02:30 on weekdays, or a
+// shorthand such as @nightly. Fields are *, numbers, ranges, lists and steps like */15; days of
+// the week count from Sunday, 0 or 7.
+func Parse(expr string) (Schedule, error) {
+	if full, ok := shorthands[strings.TrimSpace(expr)]; ok {
+		expr = full
+	}
+	parts := strings.Fields(expr)
+	if len(parts) != len(fields) {
+		return Schedule{}, fmt.Errorf("cron schedule %q needs 5 fields (minute hour day month weekday) or one of @hourly, @daily, @nightly, @weekly, @monthly", expr)
+	}
+	var bits [5]uint64
+	for i, part := range parts {
+		var err error
+		if bits[i], err = parseField(part, fields[i]); err != nil {
+			return Schedule{}, fmt.Errorf("cron schedule %q: %w", expr, err)
+		}
+	}
+	if bits[4]&(1<<7) != 0 { // Sunday as 7
+		bits[4] |= 1
+	}
+	return Schedule{
+		minutes: bits[0], hours: bits[1], days: bits[2], months: bits[3], weekdays: bits[4],
+		anyDay: strings.HasPrefix(parts[2], "*"), anyWeekday: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+func parseField(part string, f field) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(part, ",") {
+		span, stepText, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step %q in the %s", stepText, f.name)
+			}
+		}
+		low, high := f.min, f.max
+		if span != "*" {
+			from, to, isRange := strings.Cut(span, "-")
+			var err error
+			if low, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("bad %s %q", f.name, item)
+			}
+			high = low
+			if isRange {
+				if high, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("bad %s %q", f.name, item)
+				}
+			} else if hasStep {
+				high = f.max // 5/15 is 5, 20, 35...
+			}
+		}
+		if low < f.min || high > f.max || low > high {
+			return 0, fmt.Errorf("%s %q is out of %d-%d", f.name, item, f.min, f.max)
+		}
+		for n := low; n <= high; n += step {
+			bits |= 1 << n
+		}
+	}
+	return bits, nil
+}
+
+// The first time after t the schedule runs, to the minute, in t's location; zero if never
+func (s Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(searchYears, 0, 0)
+	for t.Before(end) {
+		switch {
+		case s.months&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hours&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location()) // not Truncate, offsets can be half hours
+		case s.minutes&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// As in cron, with both the day of the month and the day of the week restricted, either will do
+func (s Schedule) matchesDay(t time.Time) bool {
+	day := s.days&(1<<t.Day()) != 0
+	weekday := s.weekdays&(1<<int(t.Weekday())) != 0
+	if !s.anyDay && !s.anyWeekday {
+		return day || weekday
+	}
+	return day && weekday
+}
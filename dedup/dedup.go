@@ -0,0 +1,130 @@
+package dedup
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// One line per message upserted so far: the index, the namespace and the content hash, separated
+// by tabs. Lines of the first version, only a hash, said nothing of the index and are ignored.
+const ledgerFilePath = "./content_hashes.txt"
+
+// Identifies a message by its content: whitespace-normalized text, sender and timestamp.
+// Re-exports of the same chat give the same hashes, whatever line the message ended up on.
+func Hash(text, sender string, timestamp time.Time) string {
+	normalized := strings.Join(strings.Fields(text), " ") + "\x00" +
+		strings.TrimSpace(sender) + "\x00" +
+		strconv.FormatInt(timestamp.Unix(), 10)
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:16])
+}
+
+// The hashes of the messages already upserted from this machine to one index, by namespace
+type Ledger struct {
+	indexName string
+	hashes    map[string]bool // namespace, a tab and the hash
+	added     []string        // not yet saved
+}
+
+// Reads the ledger of an index, a missing file is an empty ledger
+func Load(indexName string) (*Ledger, error) {
+	ledger := &Ledger{indexName: indexName, hashes: map[string]bool{}}
+	err := scan(func(line string) {
+		if index, entry, ok := strings.Cut(line, "\t"); ok && index == indexName {
+			ledger.hashes[entry] = true
+		}
+	})
+	return ledger, err
+}
+
+func (l *Ledger) Has(namespace, hash string) bool {
+	return l.hashes[namespace+"\t"+hash]
+}
+
+func (l *Ledger) Add(namespace, hash string) {
+	entry := namespace + "\t" + hash
+	if !l.hashes[entry] {
+		l.hashes[entry] = true
+		l.added = append(l.added, entry)
+	}
+}
+
+// Appends the hashes added since the last save to the ledger file
+func (l *Ledger) Save() error {
+	if len(l.added) == 0 {
+		return nil
+	}
+	file, err := os.OpenFile(ledgerFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var sb strings.Builder
+	for _, entry := range l.added {
+		sb.WriteString(l.indexName + "\t" + entry + "\n")
+	}
+	if _, err := file.WriteString(sb.String()); err != nil {
+		return err
+	}
+	l.added = nil
+	return nil
+}
+
+// Removes the index's entries that drop returns true for, e.g. all of them once the index is
+// deleted, so upserting the messages again puts them back. Returns how many were removed.
+func Forget(indexName string, drop func(namespace, hash string) bool) (int, error) {
+	var kept []string
+	removed := 0
+	err := scan(func(line string) {
+		if index, entry, ok := strings.Cut(line, "\t"); ok && index == indexName {
+			namespace, hash, _ := strings.Cut(entry, "\t")
+			if drop(namespace, hash) {
+				removed++
+				return
+			}
+		}
+		kept = append(kept, line)
+	})
+	if err != nil || removed == 0 {
+		return 0, err
+	}
+
+	// Through a temporary file, so a crash can't leave half a ledger
+	data := strings.Join(kept, "\n")
+	if data != "" {
+		data += "\n"
+	}
+	tmp := ledgerFilePath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return 0, err
+	}
+	return removed, os.Rename(tmp, ledgerFilePath)
+}
+
+// Calls visit with every line of the ledger file, if there is one
+func scan(visit func(line string)) error {
+	file, err := os.Open(ledgerFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			visit(line)
+		}
+	}
+	return scanner.Err()
+}
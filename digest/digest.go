@@ -0,0 +1,261 @@
+package digest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/anonymize"
+	"github.com/pisush/fin-chat/embed"
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/httpclient"
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/state"
+	"github.com/pisush/fin-chat/summarize"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+const (
+	Period = 7 * 24 * time.Hour // a digest covers a week of ingested content
+
+	dir            = "./digests" // every digest is also kept here, named by its date
+	topSenders     = 5
+	notableCount   = 5
+	notableChars   = 200
+	webhookTimeout = 10 * time.Second
+	retryDelay     = time.Hour // after a digest failed, e.g. when OpenAI was unreachable
+
+	webhookEnv = "FINCHAT_DIGEST_WEBHOOK" // URL the digest is POSTed to as {"text": ...}
+	smtpEnv    = "FINCHAT_SMTP_ADDR"      // host:port of the mail server, e.g. smtp.gmail.com:587
+	userEnv    = "FINCHAT_SMTP_USER"
+	passEnv    = "FINCHAT_SMTP_PASSWORD"
+	fromEnv    = "FINCHAT_DIGEST_FROM"
+	toEnv      = "FINCHAT_DIGEST_TO" // comma separated recipients
+)
+
+// No new attempt before this time, set when the last one failed
+var nextAttempt time.Time
+
+// Sends the digest of the rows appended to the embeddings file since the last one, once a
+// Period has passed. Called on every poll of the watch loop; the first call only starts the clock.
+func Tick(embeddingsFileName string, log *log.Logger) error {
+	if time.Now().Before(nextAttempt) {
+		return nil
+	}
+	st, err := state.Load()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if st.Digest == nil {
+		info, err := os.Stat(embeddingsFileName)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		st.Digest = &state.Digest{Last: now}
+		if info != nil {
+			st.Digest.Offset = info.Size()
+		}
+		return st.Save()
+	}
+	if now.Sub(st.Digest.Last) < Period {
+		return nil
+	}
+
+	rows, end, err := vectors.ReadFileFrom(embeddingsFileName, st.Digest.Offset, log)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		fmt.Println(i18n.T("digest.empty"))
+	} else {
+		text, err := Build(rows, st.Digest.Last, now, log)
+		if err == nil {
+			err = deliver(text, now, log)
+		}
+		if err != nil {
+			nextAttempt = now.Add(retryDelay)
+			return err
+		}
+	}
+
+	// Reloaded, summarizing took a while
+	if st, err = state.Load(); err != nil {
+		return err
+	}
+	st.Digest = &state.Digest{Last: now, Offset: end}
+	return st.Save()
+}
+
+// Writes the markdown digest of the rows ingested between from and to: stats,
+// the summary of the summarize action and the messages that got the most replies
+func Build(rows []vectors.Row, from, to time.Time, log *log.Logger) (string, error) {
+	sort.SliceStable(rows, func(a, b int) bool { return rows[a].Timestamp.Before(rows[b].Timestamp) })
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Chat digest %s to %s\n\n", from.Format("2006-01-02"), to.Format("2006-01-02"))
+	writeStats(&sb, rows)
+
+	messages := make([]embed.Message, len(rows))
+	for i, row := range rows {
+		messages[i] = embed.Message{Timestamp: row.Timestamp, Sender: row.Sender, Text: row.Text, ID: row.MessageID, ReplyTo: row.ReplyTo, Namespace: row.Namespace}
+	}
+	summary, err := summarize.Summarize(messages, log)
+	if err != nil {
+		return "", err
+	}
+	// Drop the summary's own title, the digest has one
+	if i := strings.Index(summary, "\n\n"); strings.HasPrefix(summary, "# ") && i >= 0 {
+		summary = summary[i+2:]
+	}
+	sb.WriteString(summary + "\n\n")
+
+	if notable := notableRows(rows); len(notable) > 0 {
+		sb.WriteString("## Notable messages\n")
+		for _, n := range notable {
+			fmt.Fprintf(&sb, "- **%s** (%s, %d replies): %s\n", n.row.Sender, n.row.Timestamp.Format("2006-01-02 15:04"), n.replies, grapheme.Snippet(n.row.Text, notableChars))
+		}
+	}
+	return anonymize.Reveal(sb.String()), nil
+}
+
+func writeStats(sb *strings.Builder, rows []vectors.Row) {
+	senders := map[string]int{}
+	days := map[string]int{}
+	for _, row := range rows {
+		senders[row.Sender]++
+		days[row.Timestamp.Format("2006-01-02")]++
+	}
+
+	names := make([]string, 0, len(senders))
+	for name := range senders {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(a, b int) bool {
+		if senders[names[a]] != senders[names[b]] {
+			return senders[names[a]] > senders[names[b]]
+		}
+		return names[a] < names[b]
+	})
+	busiest := ""
+	for day, n := range days {
+		if busiest == "" || n > days[busiest] || (n == days[busiest] && day < busiest) {
+			busiest = day
+		}
+	}
+
+	sb.WriteString("## Stats\n")
+	fmt.Fprintf(sb, "- %d new messages from %d senders\n", len(rows), len(senders))
+	fmt.Fprintf(sb, "- Busiest day: %s (%d messages)\n", busiest, days[busiest])
+	var top []string
+	for _, name := range names[:min(topSenders, len(names))] {
+		top = append(top, fmt.Sprintf("%s (%d)", name, senders[name]))
+	}
+	fmt.Fprintf(sb, "- Most active: %s\n\n", strings.Join(top, ", "))
+}
+
+type notable struct {
+	row     vectors.Row
+	replies int
+}
+
+// The messages with the most replies within the rows, for exports that keep replies
+func notableRows(rows []vectors.Row) []notable {
+	replies := map[string]int{}
+	for _, row := range rows {
+		if row.ReplyTo != "" {
+			replies[row.Namespace+"\x00"+row.ReplyTo]++
+		}
+	}
+
+	var found []notable
+	for _, row := range rows {
+		if n := replies[row.Namespace+"\x00"+row.MessageID]; row.MessageID != "" && n > 0 {
+			found = append(found, notable{row: row, replies: n})
+		}
+	}
+	sort.SliceStable(found, func(a, b int) bool { return found[a].replies > found[b].replies })
+	return found[:min(notableCount, len(found))]
+}
+
+// Saves the digest in ./digests and sends it to the webhook and email recipients configured
+func deliver(text string, now time.Time, log *log.Logger) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, now.Format("2006-01-02")+".md")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("digest.written", path))
+
+	// A failed delivery is logged, the digest is on disk either way
+	if url := os.Getenv(webhookEnv); url != "" {
+		if err := postWebhook(url, text); err != nil {
+			fmt.Println(i18n.T("digest.delivery_error", "webhook", err))
+			log.Printf("Error posting the digest to the webhook: %v", err)
+		}
+	}
+	if addr := os.Getenv(smtpEnv); addr != "" {
+		if err := sendEmail(addr, text); err != nil {
+			fmt.Println(i18n.T("digest.delivery_error", "email", err))
+			log.Printf("Error emailing the digest: %v", err)
+		}
+	}
+	return nil
+}
+
+func postWebhook(url, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	client := httpclient.WithTimeout(webhookTimeout)
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+func sendEmail(addr, text string) error {
+	from := os.Getenv(fromEnv)
+	var to []string
+	for _, recipient := range strings.Split(os.Getenv(toEnv), ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			to = append(to, recipient)
+		}
+	}
+	if from == "" || len(to) == 0 {
+		return fmt.Errorf("%s and %s are needed to send email", fromEnv, toEnv)
+	}
+	subject := strings.TrimPrefix(strings.SplitN(text, "\n", 2)[0], "# ")
+	msg := "From: " + from + "\r\n" +
+		"To: " + strings.Join(to, ", ") + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n\r\n" +
+		strings.ReplaceAll(text, "\n", "\r\n")
+
+	var auth smtp.Auth
+	if user := os.Getenv(userEnv); user != "" {
+		host := addr
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			host = addr[:i]
+		}
+		auth = smtp.PlainAuth("", user, os.Getenv(passEnv), host)
+	}
+	return smtp.SendMail(addr, auth, from, to, []byte(msg))
+}
@@ -0,0 +1,135 @@
+package doctor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/openai"
+	"github.com/pisush/fin-chat/pinecone"
+	"github.com/pisush/fin-chat/upsert"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+// One line of the checklist: what was checked, what was found and, if it failed, why
+type Check struct {
+	Name   string
+	Detail string
+	Err    error
+}
+
+// Runs every check, also after one failed, so that a single run lists all there is to fix.
+// Nothing is changed or paid for: OpenAI and Pinecone are only asked to list and describe.
+func Run(indexName, model, chatFile, embeddingsFile string) []Check {
+	return []Check{
+		checkOpenAI(model),
+		checkPinecone(),
+		checkIndex(indexName, false),
+		checkFile(i18n.T("doctor.chat_file", chatFile), chatFile, false, func(path string) (io.ReadCloser, error) {
+			return os.Open(path)
+		}),
+		checkFile(i18n.T("doctor.embeddings_file", embeddingsFile), embeddingsFile, true, func(path string) (io.ReadCloser, error) {
+			return vectors.Open(path, 0)
+		}),
+	}
+}
+
+// The checks of the services searches need, for a server to tell whether it's ready: OpenAI,
+// Pinecone and the indexes, which have to exist
+func Backends(model string, indexNames ...string) []Check {
+	checks := []Check{checkOpenAI(model), checkPinecone()}
+	for _, indexName := range indexNames {
+		checks = append(checks, checkIndex(indexName, true))
+	}
+	return checks
+}
+
+// Whether all the checks passed
+func Passed(checks []Check) bool {
+	for _, check := range checks {
+		if check.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// The key works and can use the embedding model
+func checkOpenAI(model string) Check {
+	check := Check{Name: i18n.T("doctor.openai")}
+	models, err := openai.ListModels()
+	if err != nil {
+		check.Err = err
+		return check
+	}
+	if !slices.Contains(models, model) {
+		check.Err = fmt.Errorf("the key can't use the embedding model %s", model)
+		return check
+	}
+	check.Detail = i18n.T("doctor.model", model)
+	return check
+}
+
+// The key works, and with the legacy API the environment too
+func checkPinecone() Check {
+	check := Check{Name: i18n.T("doctor.pinecone")}
+	project, err := pinecone.Whoami()
+	if err != nil {
+		check.Err = err
+		return check
+	}
+	check.Detail = i18n.T("doctor.api", pinecone.Mode())
+	if project != "" {
+		check.Detail = i18n.T("doctor.project", project, pinecone.Mode())
+	}
+	return check
+}
+
+// The index fits the embeddings. One that doesn't exist yet passes unless it must exist, upsert
+// creates it.
+func checkIndex(indexName string, mustExist bool) Check {
+	check := Check{Name: i18n.T("doctor.index", indexName)}
+	index, err := pinecone.DescribeIndex(indexName)
+	if errors.Is(err, pinecone.ErrIndexNotFound) && !mustExist {
+		check.Detail = i18n.T("doctor.index_missing")
+		return check
+	}
+	if err != nil {
+		check.Err = err
+		return check
+	}
+	if err := upsert.CheckIndex(index); err != nil {
+		check.Err = err
+		return check
+	}
+	check.Detail = i18n.T("doctor.index_found", index.Dimension, index.Metric, index.Status.State)
+	return check
+}
+
+// The file can be opened and read. A missing file passes if it's optional, i.e. written by
+// embed, and an empty one fails if it isn't.
+func checkFile(name, path string, optional bool, open func(string) (io.ReadCloser, error)) Check {
+	check := Check{Name: name}
+	file, err := open(path)
+	if optional && errors.Is(err, fs.ErrNotExist) {
+		check.Detail = i18n.T("doctor.file_missing")
+		return check
+	}
+	if err != nil {
+		check.Err = err
+		return check
+	}
+	defer file.Close()
+
+	// The first byte shows it's readable and, if encrypted, that the passphrase opens it
+	if _, err := io.ReadFull(file, make([]byte, 1)); err == io.EOF && !optional {
+		check.Err = fmt.Errorf("%s is empty", path)
+	} else if err != nil && err != io.EOF {
+		check.Err = err
+	}
+	return check
+}
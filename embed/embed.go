@@ -1,147 +1,558 @@
 package embed
 
 import (
-	"bufio"
-	"encoding/csv"
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
-	"regexp"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/pisush/fin-chat/anonymize"
+	"github.com/pisush/fin-chat/batch"
+	"github.com/pisush/fin-chat/dedup"
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/httpclient"
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/normalize"
+	"github.com/pisush/fin-chat/notify"
+	"github.com/pisush/fin-chat/openai"
+	"github.com/pisush/fin-chat/parser"
+	"github.com/pisush/fin-chat/redact"
+	"github.com/pisush/fin-chat/secrets"
+	"github.com/pisush/fin-chat/spam"
+	"github.com/pisush/fin-chat/store"
+	"github.com/pisush/fin-chat/system"
+	"github.com/pisush/fin-chat/timezone"
+	"github.com/pisush/fin-chat/vectors"
 )
 
 const (
-	openAIAPIKey   = "Bearer sk-xxx"
-	embeddingModel = "text-embedding-ada-002"
+	embeddingModel = "text-embedding-ada-002" // unless SetModel sets another
 	embeddingsURL  = "https://api.openai.com/v1/embeddings"
+
+	batchProvider    = "openai"
+	initialBatchSize = 8
+	maxBatchSize     = 2048 // OpenAI's limit on inputs per embeddings request
+
+	MaxMessageChars = 8000 // longer messages are split into several embeddings, well under ada-002's 8191 tokens
 )
 
+// A single parsed chat message, see parser.Message
+type Message = parser.Message
+
 type ResponseData struct {
 	Data []struct {
+		Index     int       `json:"index"`
 		Embedding []float64 `json:"embedding"`
 	} `json:"data"`
 }
 
-// Obtains an embedding for a given line
-func GetEmbedding(text string, model string) ([]float64, error) {
-	text = strings.ReplaceAll(text, "\n", " ")
-	text = strings.ReplaceAll(text, "'", "'\\''")
+// A parsed line waiting to be embedded as part of a batch
+type pendingLine struct {
+	lineNumber int
+	msg        Message
+	input      string // the text sent to the embeddings API, see emoji.Apply
+}
 
-	body := fmt.Sprintf(`{"input": ["%s"], "model": "%s"}`, text, model)
-	req, err := http.NewRequest("POST", embeddingsURL, strings.NewReader(body))
+// An option of Embed
+type Option func(*options)
+
+type options struct {
+	model     string
+	batchSize int
+	client    httpclient.Doer
+}
+
+// Embeds with another OpenAI model than the one of SetModel
+func WithModel(model string) Option {
+	return func(o *options) { o.model = model }
+}
+
+// Sends at most n texts per request, instead of OpenAI's limit of 2048
+func WithBatchSize(n int) Option {
+	return func(o *options) { o.batchSize = min(max(n, 1), maxBatchSize) }
+}
+
+// Sends the requests with d instead of httpclient.Client(), e.g. a fakeapi server's client
+func WithClient(d httpclient.Doer) Option {
+	return func(o *options) { o.client = d }
+}
+
+// Obtains the embeddings of the texts, in their order, in as few requests as the batch size
+// allows, shortened to --dimensions. Cancelling ctx stops the request in flight and the ones after it.
+func Embed(ctx context.Context, texts []string, opts ...Option) ([][]float64, error) {
+	o := options{model: model, batchSize: maxBatchSize, client: httpclient.Client()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	embeddings := make([][]float64, 0, len(texts))
+	for start := 0; start < len(texts); start += o.batchSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		embedded, err := embedBatch(ctx, o.client, texts[start:min(start+o.batchSize, len(texts))], o.model)
+		if err != nil {
+			return nil, err
+		}
+		for _, embedding := range embedded {
+			embeddings = append(embeddings, shorten(embedding))
+		}
+	}
+	return embeddings, nil
+}
+
+// Obtains embeddings for a batch of texts in a single request, in input order
+func embedBatch(ctx context.Context, client httpclient.Doer, texts []string, model string) ([][]float64, error) {
+	inputs := make([]string, len(texts))
+	for i, text := range texts {
+		inputs[i] = strings.ReplaceAll(redact.Text(text), "\n", " ")
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"input": inputs, "model": model})
+	if err != nil {
+		return nil, err
+	}
+	key, err := secrets.Get(secrets.OpenAI)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", embeddingsURL, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", openAIAPIKey)
+	req.Header.Set("Authorization", "Bearer "+key)
 
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("HTTP request error: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, openai.ReadError(resp)
+	}
+
 	var responseData ResponseData
 
 	if err := json.NewDecoder(resp.Body).Decode(&responseData); err != nil {
 		return nil, err
 	}
 
-	if len(responseData.Data) == 0 || len(responseData.Data[0].Embedding) == 0 {
+	if len(responseData.Data) != len(texts) {
 		return nil, fmt.Errorf("no data in response")
 	}
 
-	return responseData.Data[0].Embedding, nil
-}
+	embeddings := make([][]float64, len(texts))
+	for _, d := range responseData.Data {
+		if d.Index < 0 || d.Index >= len(texts) || len(d.Embedding) == 0 {
+			return nil, fmt.Errorf("no data in response")
+		}
+		embeddings[d.Index] = d.Embedding
+	}
 
-// Creates a csv file in the format: (embedding []float64)
-func CreateEmbeddingFile(inputFileName string, embeddingsFileName string, embeddingModel string, log *log.Logger) error {
-	// Initialize counters
-	var linesProcessed, parseFailures, embeddingFailures, writeFailures, successCount int
+	return embeddings, nil
+}
 
+// Creates a csv file in the format: (text string, sender string, timestamp int64, id string, reply_to string, namespace string, embedding []float64)
+// Returns the name of the file written, embeddingsFileName with the time appended.
+// Cancelling ctx stops embedding; the rows written so far stay in the file.
+func CreateEmbeddingFile(ctx context.Context, inputFileName string, source string, embeddingsFileName string, embeddingModel string, log *log.Logger) (string, error) {
 	// In case embeddings work well and no temp files needed - delete this block
 	// get the current date and time to add as a suffix to the file name
 	currentTime := time.Now()
 	suffix := currentTime.Format("01-02-15-04")
-	// append suffix to embeddingsFileName
-	embeddingsFileName = fmt.Sprintf("%s-%s", embeddingsFileName, suffix)
+	// append suffix to embeddingsFileName, before the extensions that give its format
+	embeddingsFileName = suffixed(embeddingsFileName, suffix)
 
 	// create embeddings file
-	embedFile, err := os.Create(embeddingsFileName)
+	embedFile, err := vectors.Create(embeddingsFileName)
 	if err != nil {
 		log.Fatalf("In CreateEmbeddingsFile: Can't open embeddings file: %v", err)
+		return "", err
+	}
+	defer embedFile.Close()
+
+	if err := writeEmbeddings(ctx, inputFileName, source, embedFile, embeddingModel, map[string]bool{}, log); err != nil {
+		log.Printf("Error embedding %s export: %v", source, err)
+		return "", err
+	}
+	return embeddingsFileName, nil
+}
+
+// The file name with the suffix appended, or put before .jsonl or .gz, e.g. embeddings-01-02-15-04.csv.gz
+func suffixed(name, suffix string) string {
+	for _, ext := range []string{".jsonl.gz", ".csv.gz", ".jsonl", ".gz"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext) + "-" + suffix + ext
+		}
+	}
+	return name + "-" + suffix
+}
+
+// Embeds an export and appends its rows to embeddingsFileName, creating it if needed.
+// Messages that already have a row in the file are skipped.
+func AppendEmbeddings(ctx context.Context, inputFileName string, source string, embeddingsFileName string, embeddingModel string, log *log.Logger) error {
+	known := map[string]bool{}
+	rows, err := vectors.ReadFile(embeddingsFileName, log)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Can't read embeddings file: %v", err)
+		return err
+	}
+	for _, row := range rows {
+		known[dedup.Hash(row.Text, row.Sender, row.Timestamp)] = true
+	}
+
+	embedFile, err := vectors.Append(embeddingsFileName)
+	if err != nil {
+		log.Printf("Can't open embeddings file: %v", err)
 		return err
 	}
 	defer embedFile.Close()
 
-	csvWriter := csv.NewWriter(embedFile)
-	defer csvWriter.Flush()
+	return writeEmbeddings(ctx, inputFileName, source, embedFile, embeddingModel, known, log)
+}
+
+// Parses the export, embeds its messages and writes them as rows to embedFile.
+// Messages whose content hash is in known, or that were upserted before, are skipped.
+func writeEmbeddings(ctx context.Context, inputFileName string, source string, embedFile *vectors.Writer, embeddingModel string, known map[string]bool, log *log.Logger) error {
+	// Initialize counters
+	var linesProcessed, parseFailures, embeddingFailures, writeFailures, successCount, duplicates, older, spamSkipped, systemSkipped, filtered, emojiOnly int
+
+	ledger, err := dedup.Load(indexName)
+	if err != nil {
+		log.Printf("Error reading the content hash ledger: %v", err)
+		return err
+	}
+	marks, err := loadHighWaterMarks()
+	if err != nil {
+		log.Printf("Error reading the high-water marks: %v", err)
+		return err
+	}
 
 	// parse input and obtain embeddings
 	parsedFile, err := os.Open(inputFileName)
 	if err != nil {
-		log.Fatalf("In CreatingEmbeddingsFile: Error opening input file: %v", err)
+		log.Printf("Error opening input file: %v", err)
 		return err
 	}
 	defer parsedFile.Close()
+	p, err := exportParser(parsedFile, source)
+	if err != nil {
+		log.Printf("Error picking the parser of %s: %v", inputFileName, err)
+		return err
+	}
+	source = p.Source() // the high-water marks of a chat are kept under the app it came from
 
-	scanner := bufio.NewScanner(parsedFile)
-	lineNumber := 0
-	for scanner.Scan() {
-		lineNumber++
-		line := scanner.Text()
+	sizer := batch.NewSizer(batchProvider, initialBatchSize, maxBatchSize, log)
+	defer sizer.Save(log)
 
-		re := regexp.MustCompile(`(?:\[.*?\]\s*:\s*~?|^)(\S+)`)
+	var pending []pendingLine
+	var fatal error // a wrong key, no quota left or ctx cancelled, which fails every batch after it too
+	// Embeds the pending lines in batches, retrying rejected batches at a smaller size
+	embedPending := func() {
+		for len(pending) > 0 && fatal == nil {
+			n := min(sizer.Size(), len(pending))
+			chunk := pending[:n]
+			texts := make([]string, n)
+			for i, p := range chunk {
+				texts[i] = p.input
+			}
 
-		matches := re.FindStringSubmatch(line)
-		linesProcessed++ // Increment the lines processed counter
+			embeddings, err := Embed(ctx, texts, WithModel(embeddingModel))
+			if openai.Fatal(err) || (err != nil && ctx.Err() != nil) {
+				fatal = err
+				embeddingFailures += len(pending)
+				log.Printf("Stopped embedding at line %d: %v\n", chunk[0].lineNumber, err)
+				for _, p := range pending {
+					marks.failure(chatKey(source, inputFileName, p.msg.Namespace), p.msg.Timestamp)
+				}
+				pending = nil
+				return
+			}
+			if err != nil && batch.ShouldShrink(err) && n > 1 {
+				sizer.Failure()
+				log.Printf("Embedding batch of %d rejected, retrying with %d: %v\n", n, sizer.Size(), err)
+				continue
+			}
+			pending = pending[n:]
+			if err != nil {
+				embeddingFailures += n // Increment the embedding failures counter
+				log.Printf("Error getting embeddings for lines %d-%d: %v\n", chunk[0].lineNumber, chunk[n-1].lineNumber, err)
+				for _, p := range chunk {
+					marks.failure(chatKey(source, inputFileName, p.msg.Namespace), p.msg.Timestamp)
+				}
+				continue
+			}
+			sizer.Success()
 
-		var message string
-		if len(matches) == 3 {
-			message = matches[2]
-		} else if len(matches) == 2 {
-			message = matches[1]
-		} else {
-			parseFailures++ // Increment the parse failures counter
-			log.Printf("Unable to parse line %d of length %d - skipping: Content: %s\n", lineNumber, len(matches), line)
+			var stored []store.Message
+			for i, p := range chunk {
+				record := embeddingsRecord(p.msg, embeddings[i])
+				err = embedFile.Write(record)
+				if err != nil {
+					writeFailures++ // Increment the write failures counter
+					log.Printf("Error writing record to CSV at line %d: %v\n", p.lineNumber, err)
+					marks.failure(chatKey(source, inputFileName, p.msg.Namespace), p.msg.Timestamp)
+					continue
+				}
+				successCount++ // Increment the success counter
+				marks.written(chatKey(source, inputFileName, p.msg.Namespace), p.msg.Timestamp)
+				stored = append(stored, storedMessage(p.msg, record))
+			}
+			// The embeddings file has the messages too, the store is only a faster way to them
+			if err := store.Put(stored); err != nil {
+				log.Printf("Error adding lines %d-%d to the message store: %v\n", chunk[0].lineNumber, chunk[n-1].lineNumber, err)
+			}
 		}
+	}
 
-		embedding, err := GetEmbedding(message, embeddingModel)
-		if err != nil {
-			embeddingFailures++ // Increment the embedding failures counter
-			log.Printf("Error getting embedding for line %d: %s - %v\n", lineNumber, line, err)
-			continue
+	err = forEachMessage(parsedFile, p, log, func(lineNumber int, msg Message, ok bool) {
+		if fatal != nil {
+			return
+		}
+		linesProcessed++ // Increment the lines processed counter
+		if !ok {
+			parseFailures++ // Increment the parse failures counter
+			return
+		}
+		if incremental && !marks.isNew(chatKey(source, inputFileName, msg.Namespace), msg.Timestamp) {
+			older++
+			return
+		}
+		if spam.Mode() == spam.ModeSkip && spam.Classify(msg.Text, msg.Sender).Spam() {
+			spamSkipped++
+			return
+		}
+		if system.Mode() == system.ModeSkip && system.Classify(msg.Text) != "" {
+			systemSkipped++
+			return
+		}
+		if !filter.keeps(msg) {
+			filtered++
+			return
 		}
 
-		strEmbedding := float64ToStringSlice(embedding)
-		err = csvWriter.Write(strEmbedding)
-		if err != nil {
-			writeFailures++ // Increment the write failures counter
-			log.Printf("Error writing record to CSV at line %d: %v\n", lineNumber, err)
-			continue
+		for _, chunkMsg := range Chunks(msg) {
+			hash := dedup.Hash(chunkMsg.Text, chunkMsg.Sender, chunkMsg.Timestamp)
+			if known[hash] || ledger.Has(chunkMsg.Namespace, hash) {
+				duplicates++
+				continue
+			}
+			input := embeddedInput(chunkMsg)
+			if input == "" {
+				emojiOnly++
+				continue
+			}
+			known[hash] = true
+			pending = append(pending, pendingLine{lineNumber: lineNumber, msg: chunkMsg, input: input})
 		}
-		successCount++ // Increment the success counter
+		if len(pending) >= sizer.Size() {
+			embedPending()
+		}
+	})
+	embedPending()
 
-	}
 	log.Printf("Process Summary: Lines Processed=%d, Parse Failures=%d, Embedding Failures=%d, Write Failures=%d, Successes=%d", linesProcessed, parseFailures, embeddingFailures, writeFailures, successCount)
-	fmt.Println("Process Summary: Lines Processed =", linesProcessed, ", Parse Failures =", parseFailures, ", Embedding Failures =", embeddingFailures, ", Write Failures =", writeFailures, ", Successes =", successCount)
+	fmt.Println(i18n.T("embed.summary", linesProcessed, parseFailures, embeddingFailures, writeFailures, successCount))
+	notify.Count("embed", map[string]int{
+		"lines": linesProcessed, "parse_failures": parseFailures, "embedding_failures": embeddingFailures,
+		"write_failures": writeFailures, "successes": successCount, "duplicates": duplicates, "older": older,
+		"spam": spamSkipped, "system_messages": systemSkipped, "filtered": filtered, "emoji_only": emojiOnly,
+	})
+	if duplicates > 0 {
+		log.Printf("Skipped %d messages that were already embedded or upserted", duplicates)
+		fmt.Println(i18n.T("embed.duplicates", duplicates))
+	}
+	if older > 0 {
+		fmt.Println(i18n.T("embed.older", older))
+	}
+	if spamSkipped > 0 {
+		fmt.Println(i18n.T("embed.spam", spamSkipped))
+	}
+	if systemSkipped > 0 {
+		fmt.Println(i18n.T("embed.system", systemSkipped))
+	}
+	if filtered > 0 {
+		fmt.Println(i18n.T("embed.filtered", filtered))
+	}
+	if emojiOnly > 0 {
+		fmt.Println(i18n.T("embed.emoji_only", emojiOnly))
+	}
+
+	// Recorded on every run, so the first --incremental run knows where the last full one ended
+	if saveErr := marks.save(); saveErr != nil {
+		log.Printf("Error saving the high-water marks: %v", saveErr)
+	}
+
+	if err == nil {
+		err = fatal
+	}
+	return err
+}
+
+// A row of the embeddings file: text,sender,timestamp,id,reply_to,namespace,embedding...
+func embeddingsRecord(msg Message, embedding []float64) []string {
+	// Newlines would split the row, which upsert reads line by line
+	text := strings.ReplaceAll(msg.Text, "\n", " ")
+	record := []string{text, msg.Sender, strconv.FormatInt(msg.Timestamp.Unix(), 10), msg.ID, msg.ReplyTo, msg.Namespace}
+	return append(record, vectors.FormatValues(embedding)...)
+}
 
-	if err := scanner.Err(); err != nil {
-		log.Fatalf("Scanner error: %v", err)
+// The message of a row for the message store, under the ID upsert gives its vector
+func storedMessage(msg Message, record []string) store.Message {
+	text := record[0]
+	return store.Message{
+		ID:   vectors.ID(msg.Namespace, dedup.Hash(text, msg.Sender, msg.Timestamp)),
+		Text: text, Sender: msg.Sender, Timestamp: msg.Timestamp, Chat: msg.Namespace,
 	}
+}
 
+// Reads all the messages of a chat export, skipping entries that don't parse
+func ReadMessages(inputFileName string, source string, log *log.Logger) ([]Message, error) {
+	messages, _, err := ReadExport(inputFileName, source, log)
+	return messages, err
+}
+
+// Like ReadMessages, with the number of entries that didn't parse
+func ReadExport(inputFileName string, source string, log *log.Logger) ([]Message, int, error) {
+	file, err := os.Open(inputFileName)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	p, err := exportParser(file, source)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var messages []Message
+	unparsed := 0
+	err = forEachMessage(file, p, log, func(lineNumber int, msg Message, ok bool) {
+		if ok {
+			messages = append(messages, msg)
+		} else {
+			unparsed++
+		}
+	})
+	return messages, unparsed, err
+}
+
+// Namespace of the messages whose export doesn't give one, see SetNamespace
+var defaultNamespace string
+
+// The index the messages are embedded for: those its ledger has were upserted already
+var indexName string
+
+func SetIndex(name string) {
+	indexName = name
+}
+
+// Puts the messages of exports without channels, e.g. WhatsApp, in a namespace, so several
+// chats can share an index. Messages of Discord and Slack channels keep their channel.
+func SetNamespace(namespace string) {
+	defaultNamespace = namespace
+}
+
+// The parser named by SetFormat, empty to detect the format of every export
+var format string
+
+// Makes exports be read by the named parser, see parser.Names, instead of the one their first
+// lines look like. Empty goes back to detecting.
+func SetFormat(name string) error {
+	if name != "" {
+		if _, err := parser.Lookup(name); err != nil {
+			return err
+		}
+	}
+	format = name
 	return nil
 }
 
-// Utility function to convert a slice of float64 to a slice of string
-func float64ToStringSlice(floats []float64) []string {
-	strs := make([]string, len(floats))
-	for i, f := range floats {
-		strs[i] = fmt.Sprintf("%f", f)
+// The parser of an export: the one of SetFormat, or the one detected among the parsers of
+// source, any if source is empty
+func exportParser(file *os.File, source string) (parser.Parser, error) {
+	if format == "" {
+		return parser.Detect(file, source)
+	}
+	p, err := parser.Lookup(format)
+	if err == nil && source != "" && p.Source() != source {
+		err = fmt.Errorf("format %s reads %s exports, not %s", format, p.Source(), source)
+	}
+	return p, err
+}
+
+// Calls fn for every message of the export in order, with its line (or message) number.
+// Entries that can't be parsed are logged and passed with ok false.
+func forEachMessage(file *os.File, p parser.Parser, log *log.Logger, fn func(lineNumber int, msg Message, ok bool)) error {
+	return p.Parse(file, log, cleaned(threaded(fn), log))
+}
+
+// Wraps a parser's callback to clean every message of bidi marks and odd spacing before it is
+// hashed and embedded, put its time on the export's clock, and with --anonymize to replace the
+// names in it
+func cleaned(fn func(lineNumber int, msg Message, ok bool), log *log.Logger) func(lineNumber int, msg Message, ok bool) {
+	return func(lineNumber int, msg Message, ok bool) {
+		if ok {
+			msg.Timestamp = timezone.Clock(msg.Timestamp)
+			msg.Text = normalize.Text(msg.Text)
+			msg.Sender = normalize.Text(msg.Sender)
+			if msg.Namespace == "" {
+				msg.Namespace = defaultNamespace
+			}
+		}
+		// With --anonymize nothing past this point sees a real name
+		if ok && anonymize.Enabled() {
+			sender, err := anonymize.Sender(msg.Sender)
+			if err != nil {
+				log.Printf("Error saving the pseudonym of a sender at line %d: %v\n", lineNumber, err)
+				ok = false
+			}
+			msg.Sender = sender
+			msg.Text = anonymize.Text(msg.Text)
+		}
+		fn(lineNumber, msg, ok)
+	}
+}
+
+// The pieces a message is embedded as: the message itself, or several consecutive
+// chunks of a long one, each with the message's sender, time and IDs
+func Chunks(msg Message) []Message {
+	var chunks []Message
+	for _, chunk := range chunkText(msg.Text, MaxMessageChars) {
+		chunkMsg := msg
+		chunkMsg.Text = chunk
+		chunks = append(chunks, chunkMsg)
+	}
+	return chunks
+}
+
+// Splits text into pieces of at most maxChars characters, preferring to break at spaces.
+// Characters are grapheme clusters, so emoji and pointed Hebrew letters stay whole.
+func chunkText(text string, maxChars int) []string {
+	clusters := grapheme.Split(text)
+	var chunks []string
+	for len(clusters) > maxChars {
+		cut := maxChars
+		for i := maxChars; i > maxChars/2; i-- {
+			if clusters[i] == " " {
+				cut = i
+				break
+			}
+		}
+		chunks = append(chunks, strings.Join(clusters[:cut], ""))
+		for cut < len(clusters) && clusters[cut] == " " {
+			cut++
+		}
+		clusters = clusters[cut:]
 	}
-	return strs
+	return append(chunks, strings.Join(clusters, ""))
 }
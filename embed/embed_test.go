@@ -0,0 +1,52 @@
+package embed
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/pisush/fin-chat/fakeapi"
+	"github.com/pisush/fin-chat/httpclient"
+)
+
+func TestEmbedWithClient(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "test")
+	fake := fakeapi.New()
+	defer fake.Close()
+
+	texts := []string{"the rent is due on Friday", "I paid the electricity bill", "the rent went up"}
+	embeddings, err := Embed(context.Background(), texts, WithClient(fake.Client()), WithBatchSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(embeddings) != len(texts) {
+		t.Fatalf("got %d embeddings for %d texts", len(embeddings), len(texts))
+	}
+	for i, text := range texts {
+		if len(embeddings[i]) != fakeapi.Dimension {
+			t.Fatalf("the embedding of %q has %d values, want %d", text, len(embeddings[i]), fakeapi.Dimension)
+		}
+		if want := fakeapi.Embed(text); embeddings[i][0] != want[0] {
+			t.Fatalf("the embedding of %q isn't the fake's, batches came back out of order", text)
+		}
+	}
+}
+
+// Cancelling stops before the next request, none reaches the client
+func TestEmbedCancelled(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "test")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Embed(ctx, []string{"hello"}, WithClient(unreachable{t})); err != context.Canceled {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
+
+type unreachable struct{ t *testing.T }
+
+func (u unreachable) Do(req *http.Request) (*http.Response, error) {
+	u.t.Fatalf("sent %s %s", req.Method, req.URL)
+	return nil, nil
+}
+
+var _ httpclient.Doer = unreachable{}
@@ -0,0 +1,55 @@
+package embed
+
+import (
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pisush/fin-chat/anonymize"
+)
+
+// Which messages are embedded, from --include-regex, --exclude-regex, --min-length, --sender,
+// --since and --until. Zero values don't filter.
+type Filter struct {
+	Include   *regexp.Regexp // the text must match it
+	Exclude   *regexp.Regexp // the text must not match it
+	MinLength int            // characters of the text, after cleanup
+	Senders   []string       // any of them, ignoring case
+	Since     time.Time      // sent at or after
+	Until     time.Time      // sent before
+}
+
+var filter Filter
+
+// Makes embedding skip the messages the filter leaves out, see Filter
+func SetFilter(f Filter) {
+	filter = f
+}
+
+// Whether the message passes the filter. With --anonymize the senders are compared by their
+// pseudonyms, and the text has pseudonyms for the names mentioned in it.
+func (f Filter) keeps(msg Message) bool {
+	if !f.Since.IsZero() && msg.Timestamp.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !msg.Timestamp.Before(f.Until) {
+		return false
+	}
+	if len(f.Senders) > 0 {
+		found := false
+		for _, sender := range f.Senders {
+			found = found || strings.EqualFold(msg.Sender, anonymize.Pseudonym(sender))
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.MinLength > 0 && utf8.RuneCountInString(strings.TrimSpace(msg.Text)) < f.MinLength {
+		return false
+	}
+	if f.Include != nil && !f.Include.MatchString(msg.Text) {
+		return false
+	}
+	return f.Exclude == nil || !f.Exclude.MatchString(msg.Text)
+}
@@ -0,0 +1,75 @@
+package embed
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/pisush/fin-chat/state"
+)
+
+// Whether embedding skips messages older than the chat's last run, see SetIncremental
+var incremental bool
+
+// Makes embedding only process messages newer than the previous run over the same chat
+func SetIncremental(on bool) {
+	incremental = on
+}
+
+// Identifies a chat across re-exports: the export file name, or the channel for exports holding several
+func chatKey(source, inputFileName, namespace string) string {
+	if namespace != "" {
+		return source + "/" + namespace
+	}
+	return source + "/" + filepath.Base(inputFileName)
+}
+
+// The newest message time embedded per chat, the high-water marks of incremental runs
+type highWaterMarks struct {
+	previous map[string]time.Time
+	newest   map[string]time.Time // newest message written in this run
+	failed   map[string]time.Time // oldest message that failed in this run
+}
+
+func loadHighWaterMarks() (*highWaterMarks, error) {
+	st, err := state.Load()
+	if err != nil {
+		return nil, err
+	}
+	return &highWaterMarks{previous: st.HighWaterMarks, newest: map[string]time.Time{}, failed: map[string]time.Time{}}, nil
+}
+
+// Messages at the mark itself are kept and left to the content-hash deduplication,
+// as several messages can share a second
+func (h *highWaterMarks) isNew(key string, timestamp time.Time) bool {
+	return !timestamp.Before(h.previous[key])
+}
+
+func (h *highWaterMarks) written(key string, timestamp time.Time) {
+	if timestamp.After(h.newest[key]) {
+		h.newest[key] = timestamp
+	}
+}
+
+func (h *highWaterMarks) failure(key string, timestamp time.Time) {
+	if oldest, ok := h.failed[key]; !ok || timestamp.Before(oldest) {
+		h.failed[key] = timestamp
+	}
+}
+
+// Moves each chat's mark to its newest written message, but never past a failed one,
+// so failed messages are tried again by the next run
+func (h *highWaterMarks) save() error {
+	st, err := state.Load()
+	if err != nil {
+		return err
+	}
+	for key, newest := range h.newest {
+		if failed, ok := h.failed[key]; ok && !newest.Before(failed) {
+			newest = failed.Add(-time.Second)
+		}
+		if newest.After(st.HighWaterMarks[key]) {
+			st.HighWaterMarks[key] = newest
+		}
+	}
+	return st.Save()
+}
@@ -0,0 +1,67 @@
+package embed
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pisush/fin-chat/vectors"
+)
+
+// The OpenAI embedding models, by the dimension of their embeddings
+var modelDimensions = map[string]int{
+	"text-embedding-ada-002": 1536,
+	"text-embedding-3-small": 1536,
+	"text-embedding-3-large": 3072,
+}
+
+var (
+	model      = embeddingModel
+	dimensions int // the embeddings are shortened to, 0 to keep them whole
+)
+
+// Sets the model that embeds messages and queries, from --embedding-model, and with
+// dims above 0 keeps only the first dims values of every embedding, renormalized, from
+// --dimensions. text-embedding-3 models are trained to put the most of a text's meaning
+// first (Matryoshka representation learning), so 256 or 512 of them search almost as well
+// at a fraction of the index's storage. ada-002 embeddings can't be shortened.
+func SetModel(name string, dims int) error {
+	full, ok := modelDimensions[name]
+	if !ok {
+		names := make([]string, 0, len(modelDimensions))
+		for known := range modelDimensions {
+			names = append(names, known)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown embedding model %q, use one of %s", name, strings.Join(names, ", "))
+	}
+	if dims != 0 && !strings.HasPrefix(name, "text-embedding-3") {
+		return fmt.Errorf("--dimensions needs a text-embedding-3 model, %s embeddings can't be shortened", name)
+	}
+	if dims < 0 || dims > full {
+		return fmt.Errorf("--dimensions must be between 1 and %d for %s, not %d", full, name, dims)
+	}
+	model, dimensions = name, dims
+	return nil
+}
+
+func Model() string {
+	return model
+}
+
+// The dimension of the embeddings: the index's, the embeddings file's and the queries'
+func Dimension() int {
+	if dimensions > 0 {
+		return dimensions
+	}
+	return modelDimensions[model]
+}
+
+// Keeps the first values of an embedding and scales them back to length 1, as OpenAI's
+// own dimensions parameter does, so cosine and dot product scores stay comparable
+func shorten(embedding []float64) []float64 {
+	if dimensions == 0 || len(embedding) <= dimensions {
+		return embedding
+	}
+	return vectors.Unit(embedding[:dimensions])
+}
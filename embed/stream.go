@@ -0,0 +1,247 @@
+package embed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/batch"
+	"github.com/pisush/fin-chat/dedup"
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/linereader"
+	"github.com/pisush/fin-chat/normalize"
+	"github.com/pisush/fin-chat/notify"
+	"github.com/pisush/fin-chat/openai"
+	"github.com/pisush/fin-chat/parser"
+	"github.com/pisush/fin-chat/spam"
+	"github.com/pisush/fin-chat/store"
+	"github.com/pisush/fin-chat/system"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+// The --input that reads messages from standard input, see Stream
+const Stdin = "-"
+
+const streamFlushInterval = 2 * time.Second // longest a piped message waits for its batch to fill
+
+// Reads messages from r as they come, one per line, and embeds them in batches, appending
+// their rows to embeddingsFileName. A line is a JSON object read through the column mapping,
+// a WhatsApp export line, or else the text of a message. Messages without a time are at the
+// time they were read. A batch is embedded when it is full or the input pauses, then written
+// is called with its rows, e.g. to upsert them; an error from it stops the stream.
+// Messages already in the file or upserted before are skipped. Reading ends at the end of r
+// or when ctx is cancelled; the rows written so far stay in the file.
+func Stream(ctx context.Context, r io.Reader, embeddingsFileName, embeddingModel string, written func(records [][]string) error, log *log.Logger) error {
+	var linesProcessed, parseFailures, embeddingFailures, writeFailures, successCount, duplicates, spamSkipped, systemSkipped, filtered, emojiOnly int
+
+	ledger, err := dedup.Load(indexName)
+	if err != nil {
+		log.Printf("Error reading the content hash ledger: %v", err)
+		return err
+	}
+	known := map[string]bool{}
+	rows, err := vectors.ReadFile(embeddingsFileName, log)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("Can't read embeddings file: %v", err)
+		return err
+	}
+	for _, row := range rows {
+		known[dedup.Hash(row.Text, row.Sender, row.Timestamp)] = true
+	}
+
+	embedFile, err := vectors.Append(embeddingsFileName)
+	if err != nil {
+		log.Printf("Can't open embeddings file: %v", err)
+		return err
+	}
+	defer embedFile.Close()
+
+	sizer := batch.NewSizer(batchProvider, initialBatchSize, maxBatchSize, log)
+	defer sizer.Save(log)
+
+	// Lines are read apart from embedding, so a pause in the input can be noticed
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		scanner := linereader.New(r, parser.ReadBufferSize, parser.MaxLineBytes)
+		for scanner.Scan() {
+			if scanner.Truncated() {
+				log.Printf("A line is longer than %d bytes, using only its beginning\n", parser.MaxLineBytes)
+			}
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+		readErr <- scanner.Err()
+		close(lines)
+	}()
+
+	var pending []pendingLine
+	// Embeds the pending lines in batches, retrying rejected batches at a smaller size, and
+	// writes their rows out before passing them on
+	embedPending := func() error {
+		for len(pending) > 0 {
+			n := min(sizer.Size(), len(pending))
+			chunk := pending[:n]
+			texts := make([]string, n)
+			for i, p := range chunk {
+				texts[i] = p.input
+			}
+
+			embeddings, err := Embed(ctx, texts, WithModel(embeddingModel))
+			if openai.Fatal(err) || (err != nil && ctx.Err() != nil) {
+				embeddingFailures += len(pending)
+				log.Printf("Stopped embedding at line %d: %v\n", chunk[0].lineNumber, err)
+				pending = nil
+				return err
+			}
+			if err != nil && batch.ShouldShrink(err) && n > 1 {
+				sizer.Failure()
+				log.Printf("Embedding batch of %d rejected, retrying with %d: %v\n", n, sizer.Size(), err)
+				continue
+			}
+			pending = pending[n:]
+			if err != nil {
+				embeddingFailures += n
+				log.Printf("Error getting embeddings for lines %d-%d: %v\n", chunk[0].lineNumber, chunk[n-1].lineNumber, err)
+				continue
+			}
+			sizer.Success()
+
+			var records [][]string
+			var stored []store.Message
+			for i, p := range chunk {
+				record := embeddingsRecord(p.msg, embeddings[i])
+				if err := embedFile.Write(record); err != nil {
+					writeFailures++
+					log.Printf("Error writing record to CSV at line %d: %v\n", p.lineNumber, err)
+					continue
+				}
+				successCount++
+				records = append(records, record)
+				stored = append(stored, storedMessage(p.msg, record))
+			}
+			// On disk before they are upserted, so a crash doesn't lose a vector's row
+			if err := embedFile.Sync(); err != nil {
+				return err
+			}
+			if err := store.Put(stored); err != nil {
+				log.Printf("Error adding lines %d-%d to the message store: %v\n", chunk[0].lineNumber, chunk[n-1].lineNumber, err)
+			}
+			if written != nil && len(records) > 0 {
+				if err := written(records); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	add := cleaned(threaded(func(lineNumber int, msg Message, ok bool) {
+		if !ok {
+			parseFailures++
+			return
+		}
+		if spam.Mode() == spam.ModeSkip && spam.Classify(msg.Text, msg.Sender).Spam() {
+			spamSkipped++
+			return
+		}
+		if system.Mode() == system.ModeSkip && system.Classify(msg.Text) != "" {
+			systemSkipped++
+			return
+		}
+		if !filter.keeps(msg) {
+			filtered++
+			return
+		}
+		for _, chunkMsg := range Chunks(msg) {
+			hash := dedup.Hash(chunkMsg.Text, chunkMsg.Sender, chunkMsg.Timestamp)
+			if known[hash] || ledger.Has(chunkMsg.Namespace, hash) {
+				duplicates++
+				continue
+			}
+			input := embeddedInput(chunkMsg)
+			if input == "" {
+				emojiOnly++
+				continue
+			}
+			known[hash] = true
+			pending = append(pending, pendingLine{lineNumber: lineNumber, msg: chunkMsg, input: input})
+		}
+	}), log)
+
+	ticker := time.NewTicker(streamFlushInterval)
+	defer ticker.Stop()
+	var fatal error
+	for done := false; !done && fatal == nil; {
+		select {
+		case line, open := <-lines:
+			if !open {
+				fatal = embedPending()
+				if err := <-readErr; fatal == nil {
+					fatal = err
+				}
+				done = true
+				continue
+			}
+			linesProcessed++
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			msg, ok := streamedMessage(line, time.Now())
+			add(linesProcessed, msg, ok)
+			if len(pending) >= sizer.Size() {
+				fatal = embedPending()
+			}
+		case <-ticker.C:
+			fatal = embedPending()
+		case <-ctx.Done():
+			fatal = ctx.Err()
+		}
+	}
+
+	log.Printf("Process Summary: Lines Processed=%d, Parse Failures=%d, Embedding Failures=%d, Write Failures=%d, Successes=%d", linesProcessed, parseFailures, embeddingFailures, writeFailures, successCount)
+	fmt.Println(i18n.T("embed.summary", linesProcessed, parseFailures, embeddingFailures, writeFailures, successCount))
+	notify.Count("embed", map[string]int{
+		"lines": linesProcessed, "parse_failures": parseFailures, "embedding_failures": embeddingFailures,
+		"write_failures": writeFailures, "successes": successCount, "duplicates": duplicates,
+		"spam": spamSkipped, "system_messages": systemSkipped, "filtered": filtered, "emoji_only": emojiOnly,
+	})
+	if duplicates > 0 {
+		log.Printf("Skipped %d messages that were already embedded or upserted", duplicates)
+		fmt.Println(i18n.T("embed.duplicates", duplicates))
+	}
+	if spamSkipped > 0 {
+		fmt.Println(i18n.T("embed.spam", spamSkipped))
+	}
+	if systemSkipped > 0 {
+		fmt.Println(i18n.T("embed.system", systemSkipped))
+	}
+	if filtered > 0 {
+		fmt.Println(i18n.T("embed.filtered", filtered))
+	}
+	if emojiOnly > 0 {
+		fmt.Println(i18n.T("embed.emoji_only", emojiOnly))
+	}
+	return fatal
+}
+
+// Parses a line of the stream: a JSON object, a WhatsApp export line or a bare message
+func streamedMessage(line string, arrived time.Time) (Message, bool) {
+	arrived = arrived.UTC().Truncate(time.Second) // the precision of the embeddings file
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		msg, ok := parser.JSONMessage(line, arrived)
+		return msg, ok && strings.TrimSpace(msg.Text) != ""
+	}
+	if msg, ok := parser.ParseLine(normalize.StripBidi(line)); ok {
+		return msg, true
+	}
+	return Message{Text: line, Timestamp: arrived}, true
+}
@@ -0,0 +1,144 @@
+package embed
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pisush/fin-chat/dedup"
+	"github.com/pisush/fin-chat/emoji"
+	"github.com/pisush/fin-chat/grapheme"
+)
+
+// How replies are found in exports that don't mark them, e.g. WhatsApp's
+const (
+	RepliesOff   = "off"   // only the replies the export marks
+	RepliesLink  = "link"  // a message that starts by quoting an earlier one is its reply
+	RepliesQuote = "quote" // and is embedded with the message it replies to
+)
+
+const (
+	threadWindow   = 1000 // earlier messages of a chat a quote is looked up in
+	minQuoteChars  = 4    // shorter quotes match too many messages
+	maxQuotedChars = 1000 // of the replied-to message embedded with a reply
+)
+
+// Opening and closing marks of a quote at the start of a message, e.g. “see you at 5” ok!
+var quoteMarks = map[rune]rune{'"': '"', '“': '”', '„': '“', '«': '»'}
+
+var repliesMode = RepliesLink
+
+// Picks how replies are found, from --replies: RepliesOff, RepliesLink or RepliesQuote
+func SetReplies(mode string) error {
+	switch mode {
+	case RepliesOff, RepliesLink, RepliesQuote:
+		repliesMode = mode
+		return nil
+	}
+	return fmt.Errorf("unknown replies mode %q, use %s, %s or %s", mode, RepliesOff, RepliesLink, RepliesQuote)
+}
+
+// A message a later one can quote
+type quotable struct {
+	id, namespace, key, text string
+}
+
+// Wraps a parser's callback to link replies to the messages they quote. Messages without an
+// ID of their own get one from their content, so a reply's reply_to can name them. Under
+// RepliesQuote, a reply also carries the text it replies to, whether the export marked the
+// reply or its quote was matched.
+func threaded(fn func(lineNumber int, msg Message, ok bool)) func(lineNumber int, msg Message, ok bool) {
+	if repliesMode == RepliesOff {
+		return fn
+	}
+	var recent []quotable // oldest first
+	return func(lineNumber int, msg Message, ok bool) {
+		if ok {
+			if msg.ID == "" {
+				msg.ID = dedup.Hash(msg.Text, msg.Sender, msg.Timestamp)[:16]
+			}
+			if quoted, found := repliedTo(recent, msg); found {
+				msg.ReplyTo = quoted.id
+				if repliesMode == RepliesQuote {
+					msg.Quoted = grapheme.Snippet(quoted.text, maxQuotedChars)
+				}
+			}
+			recent = append(recent, quotable{id: msg.ID, namespace: msg.Namespace, key: quoteKey(msg.Text), text: msg.Text})
+			if len(recent) >= 2*threadWindow {
+				recent = append([]quotable(nil), recent[len(recent)-threadWindow:]...)
+			}
+		}
+		fn(lineNumber, msg, ok)
+	}
+}
+
+// The latest earlier message of the chat that msg replies to: the one the export names, or
+// else the one whose text has the quote msg starts with
+func repliedTo(recent []quotable, msg Message) (quotable, bool) {
+	quote := ""
+	if msg.ReplyTo == "" {
+		var ok bool
+		if quote, ok = leadingQuote(msg.Text); !ok {
+			return quotable{}, false
+		}
+	}
+	for i := len(recent) - 1; i >= 0 && i >= len(recent)-threadWindow; i-- {
+		candidate := recent[i]
+		if candidate.namespace != msg.Namespace {
+			continue
+		}
+		if msg.ReplyTo != "" {
+			if candidate.id == msg.ReplyTo {
+				return candidate, true
+			}
+			continue
+		}
+		if candidate.id != msg.ID && strings.Contains(candidate.key, quote) {
+			return candidate, true
+		}
+	}
+	return quotable{}, false
+}
+
+// The quote a message starts with, as quoteKey gives it: a line starting with >, or text
+// between quote marks followed by the reply
+func leadingQuote(text string) (string, bool) {
+	text = strings.TrimSpace(text)
+	quote := ""
+	if rest, ok := strings.CutPrefix(text, ">"); ok {
+		quote, _, _ = strings.Cut(rest, "\n")
+	} else {
+		open, size := utf8.DecodeRuneInString(text)
+		closing, ok := quoteMarks[open]
+		if !ok {
+			return "", false
+		}
+		end := strings.IndexRune(text[size:], closing)
+		if end < 0 || strings.TrimSpace(text[size+end+utf8.RuneLen(closing):]) == "" {
+			return "", false // a message that is only a quotation isn't a reply
+		}
+		quote = text[size : size+end]
+	}
+	key := quoteKey(quote)
+	if utf8.RuneCountInString(key) < minQuoteChars {
+		return "", false
+	}
+	return key, true
+}
+
+// Text as quotes are compared: lowercase, with single spaces and without the ellipsis of a
+// cut quote
+func quoteKey(text string) string {
+	key := strings.ToLower(strings.Join(strings.Fields(text), " "))
+	return strings.TrimSpace(strings.TrimRight(key, ".…"))
+}
+
+// The text sent to the embeddings API for a message, see emoji.Apply; a reply carrying the
+// message it replies to has it first, as a quote. Empty if nothing of the message is left.
+func embeddedInput(msg Message) string {
+	input := emoji.Apply(msg.Text)
+	if input == "" || msg.Quoted == "" {
+		return input
+	}
+	return "> " + emoji.Apply(msg.Quoted) + "\n" + input
+}
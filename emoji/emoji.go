@@ -0,0 +1,178 @@
+package emoji
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pisush/fin-chat/grapheme"
+)
+
+// What is done with emoji before a message or query is embedded
+const (
+	ModeKeep     = "keep"     // sent as they are
+	ModeStrip    = "strip"    // removed, messages of nothing but emoji aren't embedded
+	ModeDescribe = "describe" // replaced by their names, e.g. 🎂 → :birthday cake:
+)
+
+const (
+	variationSelector = '\ufe0f' // asks for the emoji presentation of a symbol
+	keycap            = '\u20e3'
+	zwj               = '\u200d'
+)
+
+var mode = ModeKeep
+
+// Picks how emoji are embedded: ModeKeep, ModeStrip or ModeDescribe
+func SetMode(emojiMode string) error {
+	switch emojiMode {
+	case ModeKeep, ModeStrip, ModeDescribe:
+		mode = emojiMode
+		return nil
+	}
+	return fmt.Errorf("unknown emoji mode %q, use %s, %s or %s", emojiMode, ModeKeep, ModeStrip, ModeDescribe)
+}
+
+func Mode() string {
+	return mode
+}
+
+// The text as it should be embedded under the current mode. Emoji without a known name are
+// dropped when describing, and the spaces left behind are collapsed.
+func Apply(text string) string {
+	if mode == ModeKeep {
+		return text
+	}
+
+	var sb strings.Builder
+	changed := false
+	for _, cluster := range grapheme.Split(text) {
+		if !isEmoji(cluster) {
+			sb.WriteString(cluster)
+			continue
+		}
+		changed = true
+		if mode == ModeDescribe {
+			if name := Name(cluster); name != "" {
+				sb.WriteString(" :" + name + ": ")
+			}
+		}
+	}
+	if !changed {
+		return text
+	}
+
+	lines := strings.Split(sb.String(), "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// The short name of an emoji, e.g. "birthday cake", empty if it isn't known. Skin tones and
+// variation selectors don't change the name, flags are named after their country code and
+// an unknown ZWJ sequence after its first emoji.
+func Name(cluster string) string {
+	base := strings.Map(func(r rune) rune {
+		if r == variationSelector || (r >= 0x1F3FB && r <= 0x1F3FF) {
+			return -1
+		}
+		return r
+	}, cluster)
+	if name, ok := names[base]; ok {
+		return name
+	}
+
+	runes := []rune(base)
+	switch {
+	case len(runes) == 2 && isRegionalIndicator(runes[0]) && isRegionalIndicator(runes[1]):
+		return "flag " + string('A'+runes[0]-0x1F1E6) + string('A'+runes[1]-0x1F1E6)
+	case len(runes) == 2 && runes[1] == keycap:
+		return "keycap " + string(runes[0])
+	}
+	if first, _, ok := strings.Cut(base, string(zwj)); ok {
+		return names[first]
+	}
+	return ""
+}
+
+// Whether a character (grapheme cluster) is an emoji
+func isEmoji(cluster string) bool {
+	r, _ := utf8.DecodeRuneInString(cluster)
+	if strings.ContainsRune(cluster, variationSelector) || strings.ContainsRune(cluster, keycap) {
+		return true
+	}
+	return (r >= 0x1F000 && r <= 0x1FAFF) || // pictographs, emoticons, transport, flags...
+		(r >= 0x2600 && r <= 0x27BF) || // miscellaneous symbols and dingbats
+		r == 0x231A || r == 0x231B || (r >= 0x23E9 && r <= 0x23FA) || // watch, hourglass, media buttons
+		r == 0x2B50 || r == 0x2B55 || (r >= 0x2B1B && r <= 0x2B1C) // star, circle, squares
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// The Unicode short names of the emoji chats use most
+var names = map[string]string{
+	"😀": "grinning face", "😃": "grinning face with big eyes", "😄": "grinning face with smiling eyes",
+	"😁": "beaming face with smiling eyes", "😆": "grinning squinting face", "😅": "grinning face with sweat",
+	"🤣": "rolling on the floor laughing", "😂": "face with tears of joy", "🙂": "slightly smiling face",
+	"🙃": "upside-down face", "😉": "winking face", "😊": "smiling face with smiling eyes",
+	"😇": "smiling face with halo", "🥰": "smiling face with hearts", "😍": "smiling face with heart-eyes",
+	"🤩": "star-struck", "😘": "face blowing a kiss", "😋": "face savoring food", "😛": "face with tongue",
+	"😜": "winking face with tongue", "🤪": "zany face", "🤑": "money-mouth face", "🤗": "smiling face with open hands",
+	"🤭": "face with hand over mouth", "🤫": "shushing face", "🤔": "thinking face", "🤐": "zipper-mouth face",
+	"🤨": "face with raised eyebrow", "😐": "neutral face", "😑": "expressionless face", "😶": "face without mouth",
+	"😏": "smirking face", "😒": "unamused face", "🙄": "face with rolling eyes", "😬": "grimacing face",
+	"😌": "relieved face", "😔": "pensive face", "😪": "sleepy face", "😴": "sleeping face", "😷": "face with medical mask",
+	"🤒": "face with thermometer", "🤢": "nauseated face", "🤮": "face vomiting", "🥵": "hot face", "🥶": "cold face",
+	"🤯": "exploding head", "🥳": "partying face", "😎": "smiling face with sunglasses", "🤓": "nerd face",
+	"😕": "confused face", "😟": "worried face", "🙁": "slightly frowning face", "😮": "face with open mouth",
+	"😲": "astonished face", "😳": "flushed face", "🥺": "pleading face", "😨": "fearful face", "😰": "anxious face with sweat",
+	"😥": "sad but relieved face", "😢": "crying face", "😭": "loudly crying face", "😱": "face screaming in fear",
+	"😖": "confounded face", "😞": "disappointed face", "😓": "downcast face with sweat", "😩": "weary face",
+	"😫": "tired face", "🥱": "yawning face", "😤": "face with steam from nose", "😡": "enraged face", "😠": "angry face",
+	"🤬": "face with symbols on mouth", "😈": "smiling face with horns", "💀": "skull", "💩": "pile of poo",
+	"🤡": "clown face", "👻": "ghost", "👽": "alien", "🤖": "robot", "🙈": "see-no-evil monkey", "🙉": "hear-no-evil monkey",
+	"🙊": "speak-no-evil monkey", "🫠": "melting face", "🫡": "saluting face", "🥹": "face holding back tears",
+
+	"❤": "red heart", "🧡": "orange heart", "💛": "yellow heart", "💚": "green heart", "💙": "blue heart",
+	"💜": "purple heart", "🖤": "black heart", "🤍": "white heart", "🤎": "brown heart", "💔": "broken heart",
+	"💕": "two hearts", "💖": "sparkling heart", "💗": "growing heart", "💘": "heart with arrow", "💞": "revolving hearts",
+	"❣": "heart exclamation", "💯": "hundred points", "💥": "collision", "💫": "dizzy", "💦": "sweat droplets",
+	"💤": "zzz", "💬": "speech balloon", "💋": "kiss mark",
+
+	"👋": "waving hand", "🤚": "raised back of hand", "✋": "raised hand", "👌": "OK hand", "🤌": "pinched fingers",
+	"✌": "victory hand", "🤞": "crossed fingers", "🤟": "love-you gesture", "🤘": "sign of the horns", "🤙": "call me hand",
+	"👈": "backhand index pointing left", "👉": "backhand index pointing right", "👆": "backhand index pointing up",
+	"👇": "backhand index pointing down", "☝": "index pointing up", "👍": "thumbs up", "👎": "thumbs down",
+	"✊": "raised fist", "👊": "oncoming fist", "👏": "clapping hands", "🙌": "raising hands", "👐": "open hands",
+	"🤲": "palms up together", "🤝": "handshake", "🙏": "folded hands", "💪": "flexed biceps", "👀": "eyes",
+	"🫶": "heart hands", "🤷": "person shrugging", "🤦": "person facepalming", "🙋": "person raising hand",
+	"🙆": "person gesturing OK", "🙅": "person gesturing NO", "💃": "woman dancing", "🕺": "man dancing",
+
+	"🎂": "birthday cake", "🎉": "party popper", "🎊": "confetti ball", "🎈": "balloon", "🎁": "wrapped gift",
+	"🥂": "clinking glasses", "🍾": "bottle with popping cork", "🍷": "wine glass", "🍺": "beer mug", "🍻": "clinking beer mugs",
+	"☕": "hot beverage", "🍕": "pizza", "🍔": "hamburger", "🍟": "french fries", "🍣": "sushi", "🍰": "shortcake",
+	"🍫": "chocolate bar", "🍎": "red apple", "🍌": "banana", "🍉": "watermelon", "🥗": "green salad", "🍽": "fork and knife with plate",
+	"🎄": "Christmas tree", "🕎": "menorah", "🕯": "candle", "🎃": "jack-o-lantern", "🏆": "trophy", "🥇": "1st place medal",
+	"⚽": "soccer ball", "🏀": "basketball", "🎵": "musical note", "🎶": "musical notes", "🎮": "video game", "📸": "camera with flash",
+
+	"🔥": "fire", "✨": "sparkles", "⭐": "star", "🌟": "glowing star", "☀": "sun", "🌙": "crescent moon", "🌈": "rainbow",
+	"☔": "umbrella with rain drops", "❄": "snowflake", "⚡": "high voltage", "🌊": "water wave", "🌹": "rose",
+	"🌸": "cherry blossom", "🌻": "sunflower", "🌷": "tulip", "🍀": "four leaf clover", "🌍": "globe showing Europe-Africa",
+	"🐶": "dog face", "🐱": "cat face", "🐭": "mouse face", "🦁": "lion", "🐵": "monkey face", "🦄": "unicorn", "🐝": "honeybee",
+
+	"✅": "check mark button", "✔": "check mark", "❌": "cross mark", "❗": "red exclamation mark", "❓": "red question mark",
+	"⚠": "warning", "⛔": "no entry", "🚫": "prohibited", "🆗": "OK button", "🆕": "NEW button", "🔔": "bell",
+	"📌": "pushpin", "📍": "round pushpin", "📎": "paperclip", "📅": "calendar", "📆": "tear-off calendar", "⏰": "alarm clock",
+	"⌛": "hourglass done", "⏳": "hourglass not done", "📞": "telephone receiver", "📱": "mobile phone", "💻": "laptop",
+	"📧": "e-mail", "📝": "memo", "📚": "books", "💡": "light bulb", "🔑": "key", "💰": "money bag", "💸": "money with wings",
+	"💵": "dollar banknote", "🛒": "shopping cart", "🏠": "house", "🏥": "hospital", "🏫": "school", "🚗": "automobile",
+	"🚌": "bus", "🚆": "train", "✈": "airplane", "🚀": "rocket", "⚓": "anchor", "🎯": "bullseye", "🔗": "link",
+	"➡": "right arrow", "⬅": "left arrow", "⬆": "up arrow", "⬇": "down arrow", "🔴": "red circle", "🟢": "green circle",
+	"🔵": "blue circle", "⚪": "white circle", "⚫": "black circle", "☺": "smiling face", "♥": "heart suit",
+}
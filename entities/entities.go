@@ -0,0 +1,318 @@
+package entities
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/llm"
+)
+
+// How mentions are found at upsert, from --entities
+const (
+	ModeOff   = "off"
+	ModeLocal = "local" // capitalized names, @mentions and a list of places, nothing leaves the machine
+	ModeLLM   = "llm"   // OpenAI's chat model, in batches
+)
+
+// The metadata fields the mentions are stored in, lists of lowercase names
+const (
+	People        = "people"
+	Places        = "places"
+	Organizations = "organizations"
+)
+
+const (
+	maxPerKind = 20  // names of a kind stored per message
+	llmBatch   = 20  // messages read per chat completion
+	maxChars   = 500 // of a message sent to be read
+
+	prompt = "List the people, places and organizations mentioned by name in each numbered chat message. " +
+		"Reply with one line per message: its number, then people, places and organizations separated by |, " +
+		"names within a kind separated by commas, e.g. \"3: Dana, Yossi | Haifa | Bank Hapoalim\". " +
+		"Leave a kind empty if there are none. Nothing else."
+)
+
+var mode = ModeOff
+
+// Picks how mentions are found: ModeOff, ModeLocal or ModeLLM
+func SetMode(entitiesMode string) error {
+	switch entitiesMode {
+	case ModeOff, ModeLocal, ModeLLM:
+		mode = entitiesMode
+		return nil
+	}
+	return fmt.Errorf("unknown entities mode %q, use %s, %s or %s", entitiesMode, ModeOff, ModeLocal, ModeLLM)
+}
+
+func Mode() string {
+	return mode
+}
+
+// The names a message mentions, lowercase
+type Mentions struct {
+	People, Places, Organizations []string
+}
+
+// The mentions as vector metadata, leaving out the empty kinds
+func (m Mentions) Metadata() map[string]interface{} {
+	metadata := map[string]interface{}{}
+	for kind, names := range map[string][]string{People: m.People, Places: m.Places, Organizations: m.Organizations} {
+		if len(names) > 0 {
+			metadata[kind] = names
+		}
+	}
+	return metadata
+}
+
+// Finds the mentions of the texts with the current mode, nil under ModeOff. Under ModeLLM a
+// batch the chat model fails on, or lines it doesn't answer, are read locally; the error is
+// returned with the results for logging.
+func Extract(texts []string) ([]Mentions, error) {
+	if mode == ModeOff {
+		return nil, nil
+	}
+	results := make([]Mentions, len(texts))
+	for i, text := range texts {
+		results[i] = Find(text)
+	}
+	if mode == ModeLocal {
+		return results, nil
+	}
+
+	var failed error
+	for start := 0; start < len(texts); start += llmBatch {
+		end := min(start+llmBatch, len(texts))
+		if err := extractBatch(texts[start:end], results[start:end]); err != nil {
+			failed = err
+		}
+	}
+	return results, failed
+}
+
+var answerLine = regexp.MustCompile(`^\s*(\d+)[:.)]\s*(.*)$`)
+
+// Overwrites the local results of the texts with the chat model's
+func extractBatch(texts []string, results []Mentions) error {
+	var sb strings.Builder
+	for i, text := range texts {
+		fmt.Fprintf(&sb, "%d: %s\n", i+1, strings.Join(strings.Fields(grapheme.Snippet(text, maxChars)), " "))
+	}
+	answer, err := llm.Complete([]llm.Message{
+		{Role: "system", Content: prompt},
+		{Role: "user", Content: sb.String()},
+	})
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(answer, "\n") {
+		match := answerLine.FindStringSubmatch(line)
+		if match == nil || !strings.Contains(match[2], "|") {
+			continue
+		}
+		n, _ := strconv.Atoi(match[1])
+		if n < 1 || n > len(texts) {
+			continue
+		}
+		kinds := strings.SplitN(match[2], "|", 3)
+		var m Mentions
+		for k, kind := range []*[]string{&m.People, &m.Places, &m.Organizations} {
+			if k < len(kinds) {
+				for _, name := range strings.Split(kinds[k], ",") {
+					*kind = add(*kind, name)
+				}
+			}
+		}
+		results[n-1] = m
+	}
+	return nil
+}
+
+// Finds the mentions of a message without a model: @mentions are people; runs of capitalized
+// words are organizations with a company word in them or as acronyms, places after "in", "at"
+// and the like or with a place word, and people otherwise; and the places of a short list are
+// found in any script. A capitalized word starting a sentence only counts as part of a run or
+// an acronym, and shouted words don't count.
+func Find(text string) Mentions {
+	var m Mentions
+	for _, match := range atMention.FindAllStringSubmatch(text, -1) {
+		m.People = add(m.People, match[1])
+	}
+	lower := strings.ToLower(text)
+	for _, place := range knownPlaces {
+		if mentionsPlace(lower, place) {
+			m.Places = add(m.Places, place)
+		}
+	}
+
+	words := strings.Fields(text)
+	sentenceStart := true
+	for i := 0; i < len(words); {
+		word := strings.Trim(words[i], punctuation)
+		if !capitalized(word) || stopwords[strings.ToLower(word)] {
+			sentenceStart = endsSentence(words[i])
+			i++
+			continue
+		}
+		run := []string{word}
+		j := i + 1
+		for ; j < len(words) && !endsSentence(words[j-1]) && !strings.ContainsAny(words[j-1], ",;:"); j++ {
+			next := strings.Trim(words[j], punctuation)
+			if !capitalized(next) && !connectors[next] {
+				break
+			}
+			run = append(run, next)
+		}
+		for len(run) > 1 && connectors[run[len(run)-1]] {
+			run = run[:len(run)-1]
+		}
+		previous := ""
+		if i > 0 {
+			previous = strings.ToLower(strings.Trim(words[i-1], punctuation))
+		}
+		name := strings.Join(run, " ")
+		shouted := strings.ToUpper(name) == name && !acronym(name)
+		if !shouted && (!sentenceStart || len(run) > 1 || acronym(name)) {
+			switch {
+			case hasAny(run, organizationWords) || acronym(name):
+				m.Organizations = add(m.Organizations, name)
+			case hasAny(run, placeWords) || placePrepositions[previous]:
+				m.Places = add(m.Places, name)
+			default:
+				m.People = add(m.People, name)
+			}
+		}
+		sentenceStart = endsSentence(words[j-1])
+		i = j
+	}
+	return m
+}
+
+const punctuation = ".,;:!?\"'()[]{}“”«»…"
+
+var atMention = regexp.MustCompile(`@([\p{L}][\p{L}\p{N}_.]*[\p{L}\p{N}])`)
+
+// Adds the name to the list, lowercase and without surrounding punctuation, unless it is
+// already there or the list is full
+func add(names []string, name string) []string {
+	name = strings.ToLower(strings.Join(strings.Fields(strings.Trim(name, punctuation+" ")), " "))
+	if name == "" || len(names) >= maxPerKind {
+		return names
+	}
+	for _, existing := range names {
+		if existing == name {
+			return names
+		}
+	}
+	return append(names, name)
+}
+
+func capitalized(word string) bool {
+	for _, r := range word {
+		return unicode.IsUpper(r)
+	}
+	return false
+}
+
+func endsSentence(word string) bool {
+	return strings.ContainsAny(strings.TrimRight(word, "\"'”)"), ".!?") && !strings.HasSuffix(word, "...")
+}
+
+// Short all-caps names, e.g. IBM, but not a shouted word
+func acronym(name string) bool {
+	letters := 0
+	for _, r := range name {
+		if !unicode.IsUpper(r) && !unicode.IsDigit(r) && r != '&' {
+			return false
+		}
+		letters++
+	}
+	return letters >= 2 && letters <= 5
+}
+
+func hasAny(run []string, words map[string]bool) bool {
+	for _, word := range run {
+		if words[strings.ToLower(word)] {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether text has word with no letter right before or after it
+func containsWord(text, word string) bool {
+	for start := 0; ; {
+		i := strings.Index(text[start:], word)
+		if i < 0 {
+			return false
+		}
+		i += start
+		end := i + len(word)
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if !unicode.IsLetter(before) && !unicode.IsLetter(after) {
+			return true
+		}
+		start = end
+	}
+}
+
+// Whether text mentions the place, in Hebrew also with a one-letter prefix as in בחיפה
+func mentionsPlace(text, place string) bool {
+	if containsWord(text, place) {
+		return true
+	}
+	if r, _ := utf8.DecodeRuneInString(place); !unicode.Is(unicode.Hebrew, r) {
+		return false
+	}
+	for _, prefix := range hebrewPrefixes {
+		if containsWord(text, string(prefix)+place) {
+			return true
+		}
+	}
+	return false
+}
+
+const hebrewPrefixes = "בהוכלמש"
+
+// Capitalized words that aren't names
+var stopwords = map[string]bool{
+	"i": true, "i'm": true, "i'll": true, "i've": true, "i'd": true, "ok": true, "okay": true, "yes": true, "no": true,
+	"hi": true, "hey": true, "thanks": true, "lol": true, "omg": true, "btw": true, "the": true, "a": true,
+	"ask": true, "tell": true, "call": true, "meet": true, "please": true, "and": true, "but": true, "so": true,
+	"when": true, "where": true, "what": true, "who": true, "how": true, "did": true, "does": true, "is": true,
+	"are": true, "can": true, "will": true, "let's": true, "maybe": true, "also": true, "happy": true, "good": true,
+	"monday": true, "tuesday": true, "wednesday": true, "thursday": true, "friday": true, "saturday": true, "sunday": true,
+	"january": true, "february": true, "march": true, "april": true, "may": true, "june": true, "july": true,
+	"august": true, "september": true, "october": true, "november": true, "december": true,
+	"media": true, "omitted": true, "deleted": true, "message": true, "forwarded": true,
+}
+
+// Lowercase words that can be inside a name, e.g. Bank of America
+var connectors = map[string]bool{"of": true, "de": true, "and": true, "&": true}
+
+var organizationWords = map[string]bool{
+	"inc": true, "ltd": true, "llc": true, "corp": true, "co": true, "company": true, "bank": true, "university": true,
+	"college": true, "school": true, "group": true, "airlines": true, "ministry": true, "hospital": true,
+	"foundation": true, "association": true, "agency": true, "institute": true, "club": true, "team": true,
+}
+
+var placeWords = map[string]bool{
+	"street": true, "st": true, "road": true, "rd": true, "avenue": true, "ave": true, "boulevard": true, "blvd": true,
+	"park": true, "city": true, "airport": true, "beach": true, "mall": true, "station": true, "square": true,
+	"lake": true, "river": true, "mountain": true, "island": true, "valley": true,
+}
+
+var placePrepositions = map[string]bool{"in": true, "at": true, "from": true, "to": true, "near": true, "into": true, "via": true}
+
+// Places found by name in any case and script, lowercase
+var knownPlaces = []string{
+	"tel aviv", "jerusalem", "haifa", "eilat", "beer sheva", "netanya", "herzliya", "ramat gan", "israel",
+	"london", "paris", "berlin", "new york", "amsterdam", "rome", "barcelona", "madrid", "athens", "cyprus",
+	"תל אביב", "ירושלים", "חיפה", "אילת", "באר שבע", "נתניה", "הרצליה", "רמת גן", "ישראל", "לונדון", "פריז",
+	"ברלין", "ניו יורק", "אמסטרדם", "רומא", "ברצלונה", "יוון", "קפריסין",
+}
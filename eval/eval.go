@@ -0,0 +1,174 @@
+package eval
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/pisush/fin-chat/query"
+	"github.com/pisush/fin-chat/ranking"
+)
+
+const (
+	DatasetPath = "./eval_set.jsonl" // one labeled query per line
+	TopK        = 10                 // results retrieved per query when scoring
+)
+
+// A query with the results judged relevant or irrelevant to it
+type Case struct {
+	Query      string   `json:"query"`
+	Namespace  string   `json:"namespace,omitempty"`
+	Relevant   []string `json:"relevant"`   // vector IDs
+	Irrelevant []string `json:"irrelevant"` // vector IDs, kept so results aren't judged twice
+}
+
+// Retrieval quality over the cases that have at least one relevant result
+type Report struct {
+	Cases  int
+	Recall float64 // share of relevant results found in the top TopK, averaged over cases
+	MRR    float64 // mean reciprocal rank of the first relevant result
+}
+
+// Reads the labeled dataset, a missing file is an empty one
+func Load(path string) ([]Case, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var cases []Case
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var c Case
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", path, lineNumber, err)
+		}
+		cases = append(cases, c)
+	}
+	return cases, scanner.Err()
+}
+
+// Writes the dataset, one case per line
+func Save(path string, cases []Case) error {
+	var sb strings.Builder
+	for _, c := range cases {
+		line, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		sb.Write(line)
+		sb.WriteByte('\n')
+	}
+	return os.WriteFile(path, []byte(sb.String()), 0644)
+}
+
+// Records judgments for a query in the dataset file, merging with earlier labels of the
+// same query. A later judgment of a result replaces the earlier one.
+func Label(path, queryMessage, namespace string, relevant, irrelevant []string) error {
+	cases, err := Load(path)
+	if err != nil {
+		return err
+	}
+
+	i := -1
+	for j, c := range cases {
+		if c.Query == queryMessage && c.Namespace == namespace {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		cases = append(cases, Case{Query: queryMessage, Namespace: namespace})
+		i = len(cases) - 1
+	}
+
+	c := &cases[i]
+	c.Relevant = without(c.Relevant, irrelevant)
+	c.Irrelevant = without(c.Irrelevant, relevant)
+	c.Relevant = union(c.Relevant, relevant)
+	c.Irrelevant = union(c.Irrelevant, irrelevant)
+	return Save(path, cases)
+}
+
+// Runs every labeled query against the index and scores the results
+func Run(cases []Case, indexName string, log *log.Logger) (Report, error) {
+	var report Report
+	for _, c := range cases {
+		if len(c.Relevant) == 0 {
+			continue // nothing to find
+		}
+
+		matches, err := ranking.Search(indexName, c.Query, TopK, query.Filter{Namespace: c.Namespace}, log)
+		if err != nil {
+			log.Printf("Error querying eval case %q: %v", c.Query, err)
+			return report, err
+		}
+
+		relevant := map[string]bool{}
+		for _, id := range c.Relevant {
+			relevant[id] = true
+		}
+		found, firstRank := 0, 0
+		for rank, match := range matches {
+			if relevant[match.ID] {
+				found++
+				if firstRank == 0 {
+					firstRank = rank + 1
+				}
+			}
+		}
+
+		report.Cases++
+		report.Recall += float64(found) / float64(len(c.Relevant))
+		if firstRank > 0 {
+			report.MRR += 1 / float64(firstRank)
+		}
+	}
+
+	if report.Cases > 0 {
+		report.Recall /= float64(report.Cases)
+		report.MRR /= float64(report.Cases)
+	}
+	return report, nil
+}
+
+func without(ids, remove []string) []string {
+	kept := []string{}
+	for _, id := range ids {
+		if !contains(remove, id) {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+func union(ids, add []string) []string {
+	for _, id := range add {
+		if !contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func contains(ids []string, id string) bool {
+	for _, existing := range ids {
+		if existing == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package eval
+
+import (
+	"sort"
+
+	"github.com/pisush/fin-chat/cluster"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+const (
+	maxClusters      = 20 // regions of the embedding space checked for coverage
+	examplesPerTopic = 3  // messages shown for each suggested region
+)
+
+// A region of the embedding space without labeled queries, with the messages closest to its center
+type Suggestion struct {
+	Size     int // messages in the region
+	Examples []vectors.Row
+}
+
+// Clusters the embedded messages and returns the clusters that no labeled query has a relevant
+// result in, largest first. Writing queries for them makes the eval set cover the whole chat.
+func Suggest(cases []Case, rows []vectors.Row) []Suggestion {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	points := make([][]float64, len(rows))
+	for i, row := range rows {
+		points[i] = row.Values
+	}
+	assignments, centroids := cluster.KMeans(points, cluster.DefaultK(len(rows), maxClusters))
+
+	relevant := map[string]bool{}
+	for _, c := range cases {
+		for _, id := range c.Relevant {
+			relevant[id] = true
+		}
+	}
+	covered := make([]bool, len(centroids))
+	members := make([][]int, len(centroids))
+	for i, row := range rows {
+		members[assignments[i]] = append(members[assignments[i]], i)
+		if relevant[row.ID] {
+			covered[assignments[i]] = true
+		}
+	}
+
+	var suggestions []Suggestion
+	for c, centroid := range centroids {
+		if covered[c] || len(members[c]) == 0 {
+			continue
+		}
+
+		closest := members[c]
+		sort.SliceStable(closest, func(i, j int) bool {
+			return cluster.Cosine(points[closest[i]], centroid) > cluster.Cosine(points[closest[j]], centroid)
+		})
+		if len(closest) > examplesPerTopic {
+			closest = closest[:examplesPerTopic]
+		}
+
+		suggestion := Suggestion{Size: len(members[c])}
+		for _, i := range closest {
+			suggestion.Examples = append(suggestion.Examples, rows[i])
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool { return suggestions[i].Size > suggestions[j].Size })
+	return suggestions
+}
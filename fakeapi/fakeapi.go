@@ -0,0 +1,574 @@
+package fakeapi
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/pisush/fin-chat/pinecone"
+)
+
+// Stands in for OpenAI and Pinecone's current API, in memory, so the whole pipeline can run
+// offline, in CI or while developing. Embeddings are hashed bags of words, so messages that
+// share words come out similar; chat completions answer with Reply.
+
+const (
+	Dimension      = 1536 // of the embeddings, as text-embedding-ada-002's
+	EmbeddingModel = "text-embedding-ada-002"
+	ChatModel      = "gpt-3.5-turbo"
+
+	originalHostHeader = "X-Fake-Original-Host"
+	openAIHost         = "api.openai.com"
+	controlHost        = "api.pinecone.io"
+	dataHostSuffix     = "-fake.svc.pinecone.io"
+	listPageSize       = 100
+	queryReadUnits     = 5 // reported by every query, as a small serverless namespace's
+)
+
+// The embedding models the fake serves, by their dimension
+var embeddingModels = map[string]int{EmbeddingModel: Dimension, "text-embedding-3-small": 1536, "text-embedding-3-large": 3072}
+
+type Server struct {
+	*httptest.Server
+
+	// Answers chat completions, by default with a fixed sentence naming the first source
+	Reply func(messages []Message) string
+
+	mu      sync.Mutex
+	indexes map[string]*index
+}
+
+// One turn of a chat completion request
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type index struct {
+	Name       string                                `json:"name"`
+	Dimension  int                                   `json:"dimension"`
+	Metric     string                                `json:"metric"`
+	Namespaces map[string]map[string]pinecone.Vector `json:"namespaces"`
+}
+
+// Starts a fake with no indexes
+func New() *Server {
+	s := &Server{
+		Reply:   func([]Message) string { return "This is a fake answer [1]." },
+		indexes: map[string]*index{},
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.route))
+	return s
+}
+
+// A client that sends every request to the fake, whatever its URL. Give it to httpclient.Set.
+func (s *Server) Client() *http.Client {
+	target, _ := url.Parse(s.URL)
+	return &http.Client{Transport: redirect{target: target}}
+}
+
+type redirect struct {
+	target *url.URL
+}
+
+func (r redirect) RoundTrip(req *http.Request) (*http.Response, error) {
+	sent := req.Clone(req.Context())
+	sent.Header.Set(originalHostHeader, req.URL.Host)
+	sent.URL.Scheme, sent.URL.Host, sent.Host = r.target.Scheme, r.target.Host, r.target.Host
+	return http.DefaultTransport.RoundTrip(sent)
+}
+
+// The vectors of a namespace of an index, a copy
+func (s *Server) Vectors(indexName, namespace string) map[string]pinecone.Vector {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vectors := map[string]pinecone.Vector{}
+	if idx, ok := s.indexes[indexName]; ok {
+		for id, v := range idx.Namespaces[namespace] {
+			vectors[id] = v
+		}
+	}
+	return vectors
+}
+
+// Reads indexes saved by Save, so a fake index outlives the process. A missing file is fine.
+func (s *Server) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Unmarshal(data, &s.indexes)
+}
+
+func (s *Server) Save(path string) error {
+	s.mu.Lock()
+	data, err := json.Marshal(s.indexes)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	host := r.Header.Get(originalHostHeader)
+	switch {
+	case host == openAIHost && r.URL.Path == "/v1/embeddings":
+		s.embeddings(w, r)
+	case host == openAIHost && r.URL.Path == "/v1/chat/completions":
+		s.completions(w, r)
+	case host == openAIHost && r.URL.Path == "/v1/models":
+		models := []map[string]string{{"id": ChatModel}}
+		for model := range embeddingModels {
+			models = append(models, map[string]string{"id": model})
+		}
+		reply(w, map[string]interface{}{"data": models})
+	case host == controlHost:
+		s.control(w, r)
+	case strings.HasSuffix(host, dataHostSuffix):
+		s.data(w, r, strings.TrimSuffix(host, dataHostSuffix))
+	default:
+		http.Error(w, "the fake doesn't serve "+host+r.URL.Path+", only OpenAI and Pinecone's current API", http.StatusNotImplemented)
+	}
+}
+
+func (s *Server) embeddings(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Input []string `json:"input"`
+		Model string   `json:"model"`
+	}
+	if !decode(w, r, &request) {
+		return
+	}
+	dimension, ok := embeddingModels[request.Model]
+	if !ok {
+		dimension = Dimension
+	}
+	type datum struct {
+		Index     int       `json:"index"`
+		Embedding []float64 `json:"embedding"`
+	}
+	data := make([]datum, len(request.Input))
+	tokens := 0
+	for i, text := range request.Input {
+		data[i] = datum{Index: i, Embedding: embed(text, dimension)}
+		tokens += len(strings.Fields(text))
+	}
+	reply(w, map[string]interface{}{"data": data, "model": EmbeddingModel, "usage": map[string]int{"prompt_tokens": tokens, "total_tokens": tokens}})
+}
+
+// The fake embedding of a text: its words hashed into the dimensions, normalized
+func Embed(text string) []float64 {
+	return embed(text, Dimension)
+}
+
+func embed(text string, dimension int) []float64 {
+	vector := make([]float64, dimension)
+	vector[0] = 1e-3 // so no text is the zero vector
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		h := fnv.New64a()
+		h.Write([]byte(word))
+		sum := h.Sum64()
+		sign := 1.0
+		if sum&1 == 1 {
+			sign = -1
+		}
+		vector[(sum>>1)%uint64(dimension)] += sign
+	}
+	norm := 0.0
+	for _, v := range vector {
+		norm += v * v
+	}
+	norm = math.Sqrt(norm)
+	for i := range vector {
+		vector[i] /= norm
+	}
+	return vector
+}
+
+func (s *Server) completions(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Messages []Message `json:"messages"`
+	}
+	if !decode(w, r, &request) {
+		return
+	}
+	answer := Message{Role: "assistant", Content: s.Reply(request.Messages)}
+	prompt := 0
+	for _, message := range request.Messages {
+		prompt += len(strings.Fields(message.Content))
+	}
+	completion := len(strings.Fields(answer.Content))
+	reply(w, map[string]interface{}{
+		"choices": []map[string]interface{}{{"message": answer}},
+		"model":   ChatModel,
+		"usage":   map[string]int{"prompt_tokens": prompt, "completion_tokens": completion, "total_tokens": prompt + completion},
+	})
+}
+
+// The control plane: listing, describing, creating and deleting indexes
+func (s *Server) control(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name, named := strings.CutPrefix(r.URL.Path, "/indexes/")
+	switch {
+	case r.URL.Path == "/indexes" && r.Method == http.MethodGet:
+		list := []pinecone.Index{}
+		for _, idx := range s.indexes {
+			list = append(list, idx.describe())
+		}
+		sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+		reply(w, map[string]interface{}{"indexes": list})
+	case r.URL.Path == "/indexes" && r.Method == http.MethodPost:
+		var request struct {
+			Name      string `json:"name"`
+			Dimension int    `json:"dimension"`
+			Metric    string `json:"metric"`
+		}
+		if !decode(w, r, &request) {
+			return
+		}
+		if _, ok := s.indexes[request.Name]; ok {
+			http.Error(w, "index "+request.Name+" already exists", http.StatusConflict)
+			return
+		}
+		s.indexes[request.Name] = &index{Name: request.Name, Dimension: request.Dimension, Metric: request.Metric, Namespaces: map[string]map[string]pinecone.Vector{}}
+		w.WriteHeader(http.StatusCreated)
+		reply(w, s.indexes[request.Name].describe())
+	case named && r.Method == http.MethodGet:
+		idx, ok := s.indexes[name]
+		if !ok {
+			http.Error(w, "no index "+name, http.StatusNotFound)
+			return
+		}
+		reply(w, idx.describe())
+	case named && r.Method == http.MethodDelete:
+		if _, ok := s.indexes[name]; !ok {
+			http.Error(w, "no index "+name, http.StatusNotFound)
+			return
+		}
+		delete(s.indexes, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (idx *index) describe() pinecone.Index {
+	return pinecone.Index{
+		Name:      idx.Name,
+		Dimension: idx.Dimension,
+		Metric:    idx.Metric,
+		Host:      idx.Name + dataHostSuffix,
+		Status:    pinecone.IndexStatus{Ready: true, State: "Ready"},
+	}
+}
+
+// The data plane of one index
+func (s *Server) data(w http.ResponseWriter, r *http.Request, indexName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, ok := s.indexes[indexName]
+	if !ok {
+		http.Error(w, "no index "+indexName, http.StatusNotFound)
+		return
+	}
+	namespace := func(name string) map[string]pinecone.Vector {
+		if idx.Namespaces[name] == nil {
+			idx.Namespaces[name] = map[string]pinecone.Vector{}
+		}
+		return idx.Namespaces[name]
+	}
+
+	switch r.URL.Path {
+	case "/vectors/upsert":
+		var request struct {
+			Vectors   []pinecone.Vector `json:"vectors"`
+			Namespace string            `json:"namespace"`
+		}
+		if !decode(w, r, &request) {
+			return
+		}
+		for _, v := range request.Vectors {
+			if len(v.Values) != idx.Dimension {
+				http.Error(w, "vector "+v.ID+" has dimension "+strconv.Itoa(len(v.Values))+", the index "+strconv.Itoa(idx.Dimension), http.StatusBadRequest)
+				return
+			}
+		}
+		ns := namespace(request.Namespace)
+		for _, v := range request.Vectors {
+			ns[v.ID] = v
+		}
+		reply(w, map[string]int{"upsertedCount": len(request.Vectors)})
+
+	case "/query":
+		var request struct {
+			Vector          []float64              `json:"vector"`
+			TopK            int                    `json:"topK"`
+			Namespace       string                 `json:"namespace"`
+			Filter          map[string]interface{} `json:"filter"`
+			IncludeValues   bool                   `json:"includeValues"`
+			IncludeMetadata bool                   `json:"includeMetadata"`
+		}
+		if !decode(w, r, &request) {
+			return
+		}
+		type match struct {
+			ID       string                 `json:"id"`
+			Score    float64                `json:"score"`
+			Values   []float64              `json:"values,omitempty"`
+			Metadata map[string]interface{} `json:"metadata,omitempty"`
+		}
+		matches := []match{}
+		for _, v := range idx.Namespaces[request.Namespace] {
+			if !matchesFilter(v.Metadata, request.Filter) {
+				continue
+			}
+			m := match{ID: v.ID, Score: cosine(request.Vector, v.Values)}
+			if request.IncludeValues {
+				m.Values = v.Values
+			}
+			if request.IncludeMetadata {
+				m.Metadata = v.Metadata
+			}
+			matches = append(matches, m)
+		}
+		sort.Slice(matches, func(a, b int) bool {
+			if matches[a].Score != matches[b].Score {
+				return matches[a].Score > matches[b].Score
+			}
+			return matches[a].ID < matches[b].ID
+		})
+		if len(matches) > request.TopK {
+			matches = matches[:request.TopK]
+		}
+		reply(w, map[string]interface{}{"matches": matches, "namespace": request.Namespace, "usage": map[string]int{"readUnits": queryReadUnits}})
+
+	case "/vectors/fetch":
+		params := r.URL.Query()
+		found := map[string]pinecone.Vector{}
+		for _, id := range params["ids"] {
+			if v, ok := idx.Namespaces[params.Get("namespace")][id]; ok {
+				found[id] = v
+			}
+		}
+		reply(w, map[string]interface{}{"vectors": found, "namespace": params.Get("namespace")})
+
+	case "/vectors/list":
+		params := r.URL.Query()
+		ids := make([]string, 0, len(idx.Namespaces[params.Get("namespace")]))
+		for id := range idx.Namespaces[params.Get("namespace")] {
+			if strings.HasPrefix(id, params.Get("prefix")) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		limit, err := strconv.Atoi(params.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = listPageSize
+		}
+		start := 0
+		if token := params.Get("paginationToken"); token != "" {
+			start = sort.SearchStrings(ids, token)
+		}
+		end := min(start+limit, len(ids))
+		page := []map[string]string{}
+		for _, id := range ids[start:end] {
+			page = append(page, map[string]string{"id": id})
+		}
+		response := map[string]interface{}{"vectors": page, "namespace": params.Get("namespace")}
+		if end < len(ids) {
+			response["pagination"] = map[string]string{"next": ids[end]}
+		}
+		reply(w, response)
+
+	case "/describe_index_stats":
+		stats := pinecone.IndexStats{Dimension: idx.Dimension, Namespaces: map[string]pinecone.NamespaceStats{}}
+		for name, vectors := range idx.Namespaces {
+			if len(vectors) == 0 {
+				continue
+			}
+			stats.Namespaces[name] = pinecone.NamespaceStats{VectorCount: len(vectors)}
+			stats.TotalVectorCount += len(vectors)
+		}
+		reply(w, stats)
+
+	case "/vectors/update":
+		var request struct {
+			ID          string                 `json:"id"`
+			SetMetadata map[string]interface{} `json:"setMetadata"`
+			Namespace   string                 `json:"namespace"`
+		}
+		if !decode(w, r, &request) {
+			return
+		}
+		v, ok := idx.Namespaces[request.Namespace][request.ID]
+		if !ok {
+			http.Error(w, "no vector "+request.ID, http.StatusNotFound)
+			return
+		}
+		metadata := map[string]interface{}{}
+		for k, value := range v.Metadata {
+			metadata[k] = value
+		}
+		for k, value := range request.SetMetadata {
+			metadata[k] = value
+		}
+		v.Metadata = metadata
+		namespace(request.Namespace)[request.ID] = v
+		reply(w, map[string]interface{}{})
+
+	case "/vectors/delete":
+		var request struct {
+			IDs       []string `json:"ids"`
+			Namespace string   `json:"namespace"`
+			DeleteAll bool     `json:"deleteAll"`
+		}
+		if !decode(w, r, &request) {
+			return
+		}
+		if request.DeleteAll {
+			delete(idx.Namespaces, request.Namespace)
+		}
+		for _, id := range request.IDs {
+			delete(idx.Namespaces[request.Namespace], id)
+		}
+		reply(w, map[string]interface{}{})
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// Whether metadata passes a Pinecone metadata filter. Fields missing from the metadata only
+// pass $ne and $nin, as with Pinecone.
+func matchesFilter(metadata, filter map[string]interface{}) bool {
+	for key, condition := range filter {
+		switch key {
+		case "$and", "$or":
+			clauses, _ := condition.([]interface{})
+			any := false
+			for _, clause := range clauses {
+				c, _ := clause.(map[string]interface{})
+				ok := matchesFilter(metadata, c)
+				if key == "$and" && !ok {
+					return false
+				}
+				any = any || ok
+			}
+			if key == "$or" && !any {
+				return false
+			}
+			continue
+		}
+
+		value, present := metadata[key]
+		operators, isMap := condition.(map[string]interface{})
+		if !isMap {
+			operators = map[string]interface{}{"$eq": condition}
+		}
+		for op, operand := range operators {
+			if !compare(op, value, present, operand) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func compare(op string, value interface{}, present bool, operand interface{}) bool {
+	switch op {
+	case "$eq":
+		return present && equal(value, operand)
+	case "$ne":
+		return !present || !equal(value, operand)
+	case "$in", "$nin":
+		in := false
+		list, _ := operand.([]interface{})
+		for _, item := range list {
+			in = in || (present && equal(value, item))
+		}
+		return in == (op == "$in")
+	case "$exists":
+		want, _ := operand.(bool)
+		return present == want
+	case "$gt", "$gte", "$lt", "$lte":
+		a, aok := value.(float64)
+		b, bok := operand.(float64)
+		if !present || !aok || !bok {
+			return false
+		}
+		switch op {
+		case "$gt":
+			return a > b
+		case "$gte":
+			return a >= b
+		case "$lt":
+			return a < b
+		default:
+			return a <= b
+		}
+	}
+	return false
+}
+
+func equal(a, b interface{}) bool {
+	if list, ok := a.([]interface{}); ok { // a list field matches if any of its items does
+		for _, item := range list {
+			if item == b {
+				return true
+			}
+		}
+		return false
+	}
+	return a == b
+}
+
+func cosine(a, b []float64) float64 {
+	var dot, na, nb float64
+	for i := range a {
+		if i < len(b) {
+			dot += a[i] * b[i]
+		}
+		na += a[i] * a[i]
+	}
+	for _, v := range b {
+		nb += v * v
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+func decode(w http.ResponseWriter, r *http.Request, into interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(into); err != nil {
+		http.Error(w, "bad request body: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func reply(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
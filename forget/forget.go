@@ -0,0 +1,147 @@
+package forget
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pisush/fin-chat/dedup"
+	"github.com/pisush/fin-chat/pinecone"
+	"github.com/pisush/fin-chat/state"
+	"github.com/pisush/fin-chat/store"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+// How long a forgotten message can be restored before it is deleted from the index
+const DefaultRestoreWindow = 30 * 24 * time.Hour
+
+// Hides the vectors from every search by tagging them deleted, and remembers them in the
+// state file so that Restore can bring them back. With a zero window they are deleted at once.
+func Soft(indexName, namespace string, ids []string, window time.Duration, now time.Time, log *log.Logger) (int, error) {
+	if window == 0 {
+		if err := pinecone.DeleteVectors(indexName, namespace, ids); err != nil {
+			return 0, err
+		}
+		if err := unledger(indexName, map[string][]string{namespace: ids}); err != nil {
+			return 0, err
+		}
+		return len(ids), store.Delete(ids)
+	}
+
+	fetched, err := pinecone.FetchVectors(indexName, namespace, ids)
+	if err != nil {
+		return 0, err
+	}
+	st, err := state.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	forgotten := 0
+	for _, id := range ids {
+		vector, ok := fetched[id]
+		if !ok {
+			log.Printf("Can't forget %s, it isn't in the index", id)
+			continue
+		}
+		if err := pinecone.UpdateMetadata(indexName, namespace, id, map[string]interface{}{"deleted": true, "deleted_at": now.Unix()}); err != nil {
+			log.Printf("Error tagging %s deleted: %v", id, err)
+			continue
+		}
+		text, _ := vector.Metadata["text"].(string)
+		st.Deleted = append(st.Deleted, state.Deleted{ID: id, Namespace: namespace, Text: text, At: now})
+		forgotten++
+	}
+	return forgotten, st.Save()
+}
+
+// Brings soft-deleted vectors back into the searches. IDs that aren't soft-deleted are an error.
+func Restore(indexName string, ids []string) (int, error) {
+	st, err := state.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	wanted := map[string]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	restored := 0
+	var kept []state.Deleted
+	for i, deleted := range st.Deleted {
+		if !wanted[deleted.ID] {
+			kept = append(kept, deleted)
+			continue
+		}
+		if err := pinecone.UpdateMetadata(indexName, deleted.Namespace, deleted.ID, map[string]interface{}{"deleted": false}); err != nil {
+			// The ones restored so far must not be purged later
+			st.Deleted = append(kept, st.Deleted[i:]...)
+			if saveErr := st.Save(); saveErr != nil {
+				return restored, saveErr
+			}
+			return restored, err
+		}
+		delete(wanted, deleted.ID)
+		restored++
+	}
+	st.Deleted = kept
+	if err := st.Save(); err != nil {
+		return restored, err
+	}
+	if len(wanted) > 0 {
+		return restored, fmt.Errorf("%d of the IDs aren't forgotten, or their restore window has passed", len(wanted))
+	}
+	return restored, nil
+}
+
+// Deletes from the index the vectors forgotten longer than window ago. Returns how many.
+func Purge(indexName string, window time.Duration, now time.Time) (int, error) {
+	st, err := state.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	expired := map[string][]string{} // namespace -> IDs
+	var kept []state.Deleted
+	for _, deleted := range st.Deleted {
+		if now.Sub(deleted.At) >= window {
+			expired[deleted.Namespace] = append(expired[deleted.Namespace], deleted.ID)
+		} else {
+			kept = append(kept, deleted)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	purged := 0
+	for namespace, ids := range expired {
+		if err := pinecone.DeleteVectors(indexName, namespace, ids); err != nil {
+			return purged, err // the state is left as it was, the next purge tries again
+		}
+		if err := store.Delete(ids); err != nil {
+			return purged, err
+		}
+		purged += len(ids)
+	}
+	if err := unledger(indexName, expired); err != nil {
+		return purged, err
+	}
+	st.Deleted = kept
+	return purged, st.Save()
+}
+
+// Removes deleted vectors, by namespace, from the content hash ledger, so upserting their
+// messages again isn't skipped
+func unledger(indexName string, deleted map[string][]string) error {
+	ids := map[string]bool{}
+	for namespace, nsIDs := range deleted {
+		for _, id := range nsIDs {
+			ids[namespace+"\x00"+id] = true
+		}
+	}
+	_, err := dedup.Forget(indexName, func(namespace, hash string) bool {
+		return ids[namespace+"\x00"+vectors.ID(namespace, hash)]
+	})
+	return err
+}
@@ -0,0 +1,59 @@
+package grapheme
+
+import (
+	"strings"
+
+	"github.com/rivo/uniseg"
+)
+
+// Splits s into user-perceived characters, the extended grapheme clusters of Unicode's
+// UAX #29, so a cut never separates a Hebrew letter from its niqqud, a Hangul syllable's
+// jamo or the parts of an emoji sequence
+func Split(s string) []string {
+	var clusters []string
+	state := -1
+	for len(s) > 0 {
+		var cluster string
+		cluster, s, _, state = uniseg.FirstGraphemeClusterInString(s, state)
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+// The number of user-perceived characters in s
+func Count(s string) int {
+	return uniseg.GraphemeClusterCount(s)
+}
+
+// The first maxClusters characters of s
+func Truncate(s string, maxClusters int) string {
+	end, state := 0, -1
+	for i := 0; i < maxClusters && end < len(s); i++ {
+		var cluster string
+		cluster, _, _, state = uniseg.FirstGraphemeClusterInString(s[end:], state)
+		end += len(cluster)
+	}
+	return s[:end]
+}
+
+// The longest prefix of s made of whole characters that fits in maxBytes
+func TruncateBytes(s string, maxBytes int) string {
+	end, state := 0, -1
+	for end < len(s) {
+		cluster, _, _, next := uniseg.FirstGraphemeClusterInString(s[end:], state)
+		if end+len(cluster) > maxBytes {
+			break
+		}
+		end, state = end+len(cluster), next
+	}
+	return s[:end]
+}
+
+// Shortens s to maxClusters characters for display, marking the cut with an ellipsis
+func Snippet(s string, maxClusters int) string {
+	truncated := Truncate(s, maxClusters)
+	if len(truncated) == len(s) {
+		return s
+	}
+	return strings.TrimRight(truncated, " ") + "…"
+}
@@ -0,0 +1,42 @@
+package grapheme
+
+import "testing"
+
+func TestCount(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		in   string
+		want int
+	}{
+		{"hebrew with niqqud", "שָׁלוֹם", 4},
+		{"hangul syllables", "한국", 2},
+		{"hangul jamo", "\u1112\u1161\u11ab\u1100\u116e\u11a8", 2},
+		{"zwj family", "👨‍👩‍👧 hi", 4},
+		{"skin tone", "👍🏽", 1},
+		{"flags", "🇮🇱🇺🇸", 2},
+		{"keycap", "1️⃣", 1},
+		{"prepend", "؀١", 1},
+		{"crlf", "a\r\nb", 3},
+	} {
+		if got := Count(c.in); got != c.want {
+			t.Errorf("%s: Count(%q) = %d, want %d", c.name, c.in, got, c.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	family := "👨‍👩‍👧"
+	if got := Truncate(family+"abc", 2); got != family+"a" {
+		t.Errorf("Truncate = %q, want %q", got, family+"a")
+	}
+	if got := TruncateBytes(family+"abc", len(family)-1); got != "" {
+		t.Errorf("TruncateBytes split the family: %q", got)
+	}
+	jamo := "\u1112\u1161\u11ab\u1100\u116e\u11a8" // 한국 spelled with conjoining jamo, 9 bytes a syllable
+	if got := TruncateBytes(jamo, 12); got != jamo[:9] {
+		t.Errorf("TruncateBytes(%q, 12) = %q, want the first syllable", jamo, got)
+	}
+	if got := Snippet("hello world", 6); got != "hello…" {
+		t.Errorf("Snippet = %q, want hello…", got)
+	}
+}
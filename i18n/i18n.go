@@ -0,0 +1,90 @@
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const DefaultLocale = "en"
+
+// One JSON file of message templates per locale, keyed by message name
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+var (
+	catalogs = loadCatalogs()
+	current  = DefaultLocale
+)
+
+func loadCatalogs() map[string]map[string]string {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+
+	catalogs := map[string]map[string]string{}
+	for _, file := range files {
+		data, err := localeFiles.ReadFile(path.Join("locales", file.Name()))
+		if err != nil {
+			panic(err)
+		}
+		catalog := map[string]string{}
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			panic(fmt.Sprintf("locale %s: %v", file.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(file.Name(), ".json")] = catalog
+	}
+	return catalogs
+}
+
+// Picks the locale used by T, an empty locale is taken from $LANG
+func SetLocale(locale string) error {
+	if locale == "" {
+		locale = localeFromEnv()
+	}
+	if _, ok := catalogs[locale]; !ok {
+		return fmt.Errorf("unknown locale %q, available: %s", locale, strings.Join(Locales(), ", "))
+	}
+	current = locale
+	return nil
+}
+
+// The available locales, sorted
+func Locales() []string {
+	locales := make([]string, 0, len(catalogs))
+	for locale := range catalogs {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Formats the named message in the current locale, falling back to English
+func T(key string, args ...interface{}) string {
+	template, ok := catalogs[current][key]
+	if !ok {
+		template, ok = catalogs[DefaultLocale][key]
+	}
+	if !ok {
+		return key
+	}
+	return fmt.Sprintf(template, args...)
+}
+
+// e.g. LANG=he_IL.UTF-8 -> he, anything without a catalog -> en
+func localeFromEnv() string {
+	lang := os.Getenv("LANG")
+	if i := strings.IndexAny(lang, "_.@"); i >= 0 {
+		lang = lang[:i]
+	}
+	if _, ok := catalogs[lang]; ok {
+		return lang
+	}
+	return DefaultLocale
+}
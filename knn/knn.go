@@ -0,0 +1,177 @@
+package knn
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+const labelChars = 80 // message text kept as the node label
+
+// An undirected edge between two rows that are among each other's nearest neighbors
+type Edge struct {
+	Source     int     `json:"source"` // index into the rows, Source < Target
+	Target     int     `json:"target"`
+	Similarity float64 `json:"similarity"` // cosine similarity
+}
+
+// Links every row to its k most similar rows by cosine similarity. An edge found from both
+// ends is kept once. Brute force over all pairs, spread over the CPUs.
+func Graph(rows []vectors.Row, k int) []Edge {
+	unit := make([][]float64, len(rows))
+	for i, row := range rows {
+		unit[i] = normalized(row.Values)
+	}
+
+	neighbors := make([][]Edge, len(rows))
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				neighbors[i] = nearest(unit, i, k)
+			}
+		}()
+	}
+	for i := range rows {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	seen := map[[2]int]bool{}
+	var edges []Edge
+	for _, list := range neighbors {
+		for _, edge := range list {
+			if edge.Source > edge.Target {
+				edge.Source, edge.Target = edge.Target, edge.Source
+			}
+			key := [2]int{edge.Source, edge.Target}
+			if !seen[key] {
+				seen[key] = true
+				edges = append(edges, edge)
+			}
+		}
+	}
+	sort.Slice(edges, func(a, b int) bool {
+		if edges[a].Source != edges[b].Source {
+			return edges[a].Source < edges[b].Source
+		}
+		return edges[a].Target < edges[b].Target
+	})
+	return edges
+}
+
+// The k rows most similar to row i, best first
+func nearest(unit [][]float64, i, k int) []Edge {
+	var best []Edge
+	for j := range unit {
+		if j == i {
+			continue
+		}
+		similarity := dot(unit[i], unit[j])
+		if len(best) == k && similarity <= best[k-1].Similarity {
+			continue
+		}
+		edge := Edge{Source: i, Target: j, Similarity: similarity}
+		at := sort.Search(len(best), func(n int) bool { return best[n].Similarity < similarity })
+		best = append(best, Edge{})
+		copy(best[at+1:], best[at:])
+		best[at] = edge
+		if len(best) > k {
+			best = best[:k]
+		}
+	}
+	return best
+}
+
+type jsonNode struct {
+	ID        string `json:"id"`
+	Sender    string `json:"sender"`
+	Timestamp int64  `json:"timestamp"`
+	Namespace string `json:"namespace,omitempty"`
+	Label     string `json:"label"`
+}
+
+// Writes the graph as {"nodes": [...], "edges": [...]}, edges referring to nodes by index
+func WriteJSON(w io.Writer, rows []vectors.Row, edges []Edge) error {
+	nodes := make([]jsonNode, len(rows))
+	for i, row := range rows {
+		nodes[i] = jsonNode{ID: row.ID, Sender: row.Sender, Timestamp: row.Timestamp.Unix(), Namespace: row.Namespace, Label: grapheme.Snippet(row.Text, labelChars)}
+	}
+	if edges == nil {
+		edges = []Edge{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(map[string]interface{}{"nodes": nodes, "edges": edges})
+}
+
+// Writes the graph as GraphML, which Gephi, Cytoscape and networkx read directly
+func WriteGraphML(w io.Writer, rows []vectors.Row, edges []Edge) error {
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+	escape := func(s string) string {
+		var sb strings.Builder
+		xml.EscapeText(&sb, []byte(s))
+		return sb.String()
+	}
+
+	printf(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	printf(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	printf(`  <key id="label" for="node" attr.name="label" attr.type="string"/>` + "\n")
+	printf(`  <key id="sender" for="node" attr.name="sender" attr.type="string"/>` + "\n")
+	printf(`  <key id="timestamp" for="node" attr.name="timestamp" attr.type="long"/>` + "\n")
+	printf(`  <key id="namespace" for="node" attr.name="namespace" attr.type="string"/>` + "\n")
+	printf(`  <key id="weight" for="edge" attr.name="weight" attr.type="double"/>` + "\n")
+	printf(`  <graph id="knn" edgedefault="undirected">` + "\n")
+	for _, row := range rows {
+		printf(`    <node id="%s">`+"\n", escape(row.ID))
+		printf(`      <data key="label">%s</data>`+"\n", escape(grapheme.Snippet(row.Text, labelChars)))
+		printf(`      <data key="sender">%s</data>`+"\n", escape(row.Sender))
+		printf(`      <data key="timestamp">%d</data>`+"\n", row.Timestamp.Unix())
+		printf(`      <data key="namespace">%s</data>`+"\n", escape(row.Namespace))
+		printf("    </node>\n")
+	}
+	for _, edge := range edges {
+		printf(`    <edge source="%s" target="%s"><data key="weight">%.6f</data></edge>`+"\n",
+			escape(rows[edge.Source].ID), escape(rows[edge.Target].ID), edge.Similarity)
+	}
+	printf("  </graph>\n</graphml>\n")
+	return err
+}
+
+func dot(a, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+func normalized(v []float64) []float64 {
+	n := math.Sqrt(dot(v, v))
+	unit := make([]float64, len(v))
+	if n == 0 {
+		return unit
+	}
+	for i, x := range v {
+		unit[i] = x / n
+	}
+	return unit
+}
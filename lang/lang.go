@@ -0,0 +1,49 @@
+package lang
+
+import "unicode"
+
+// Languages told apart by their script
+const (
+	Hebrew  = "he"
+	Arabic  = "ar"
+	Russian = "ru" // and the other Cyrillic languages
+	English = "en" // and the other Latin script languages, which a script count can't tell apart
+)
+
+var scripts = []struct {
+	language string
+	table    *unicode.RangeTable
+}{
+	{Hebrew, unicode.Hebrew},
+	{Arabic, unicode.Arabic},
+	{Russian, unicode.Cyrillic},
+	{English, unicode.Latin},
+}
+
+// The language of a message by the script most of its letters are in, so a Hebrew message
+// with an English word or a link is still Hebrew. Empty for messages without letters.
+func Detect(text string) string {
+	counts := make([]int, len(scripts))
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		for i, script := range scripts {
+			if unicode.Is(script.table, r) {
+				counts[i]++
+				break
+			}
+		}
+	}
+
+	best := -1
+	for i, n := range counts {
+		if n > 0 && (best < 0 || n > counts[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	return scripts[best].language
+}
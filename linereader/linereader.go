@@ -0,0 +1,86 @@
+package linereader
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pisush/fin-chat/grapheme"
+)
+
+// Extra bytes read past the limit so a cut line can end on a whole character
+const graphemeSlack = 64
+
+// Reads a file line by line like bufio.Scanner, but without its 64KB line limit.
+// Lines longer than maxLineBytes are cut at the last whole character within that length
+// and reported as truncated, and reading continues with the next line instead of
+// stopping the whole scan.
+type Reader struct {
+	r            *bufio.Reader
+	maxLineBytes int
+	line         []byte
+	truncated    bool
+	err          error
+}
+
+func New(r io.Reader, bufferSize, maxLineBytes int) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, bufferSize), maxLineBytes: maxLineBytes}
+}
+
+// Advances to the next line, false at the end of the input or on a read error
+func (r *Reader) Scan() bool {
+	if r.err != nil {
+		return false
+	}
+	r.line = r.line[:0]
+	r.truncated = false
+
+	for {
+		chunk, isPrefix, err := r.r.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				r.err = err
+			}
+			// A final line without a newline still counts
+			r.cut()
+			return len(r.line) > 0 && err == io.EOF
+		}
+
+		if room := r.maxLineBytes + graphemeSlack - len(r.line); room > 0 {
+			if len(chunk) > room {
+				chunk = chunk[:room]
+				r.truncated = true
+			}
+			r.line = append(r.line, chunk...)
+		} else if len(chunk) > 0 {
+			r.truncated = true
+		}
+
+		if !isPrefix {
+			r.cut()
+			return true
+		}
+	}
+}
+
+// Trims a line read past the limit back to whole characters within maxLineBytes
+func (r *Reader) cut() {
+	if len(r.line) > r.maxLineBytes {
+		r.line = []byte(grapheme.TruncateBytes(string(r.line), r.maxLineBytes))
+		r.truncated = true
+	}
+}
+
+// The current line, without the line ending
+func (r *Reader) Text() string {
+	return string(r.line)
+}
+
+// Whether the current line was cut at maxLineBytes
+func (r *Reader) Truncated() bool {
+	return r.truncated
+}
+
+// The first read error, nil at a clean end of input
+func (r *Reader) Err() error {
+	return r.err
+}
@@ -0,0 +1,79 @@
+package llm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/pisush/fin-chat/httpclient"
+	"github.com/pisush/fin-chat/openai"
+	"github.com/pisush/fin-chat/redact"
+	"github.com/pisush/fin-chat/secrets"
+)
+
+const (
+	chatModel      = "gpt-3.5-turbo"
+	completionsURL = "https://api.openai.com/v1/chat/completions"
+)
+
+// One turn of a chat completion conversation
+type Message struct {
+	Role    string `json:"role"` // system, user or assistant
+	Content string `json:"content"`
+}
+
+type completionResponse struct {
+	Choices []struct {
+		Message Message `json:"message"`
+	} `json:"choices"`
+}
+
+// Sends the conversation to OpenAI and returns the assistant's reply. With --redact the
+// contact details and links in the messages are masked first.
+func Complete(messages []Message) (string, error) {
+	sent := make([]Message, len(messages))
+	for i, message := range messages {
+		sent[i] = Message{Role: message.Role, Content: redact.Text(message.Content)}
+	}
+	jsonData, err := json.Marshal(map[string]interface{}{
+		"model":    chatModel,
+		"messages": sent,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	key, err := secrets.Get(secrets.OpenAI)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, completionsURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	client := httpclient.Client()
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("HTTP request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", openai.ReadError(resp)
+	}
+
+	var response completionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", err
+	}
+
+	if len(response.Choices) == 0 {
+		return "", fmt.Errorf("no choices in response")
+	}
+
+	return response.Choices[0].Message.Content, nil
+}
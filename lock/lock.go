@@ -0,0 +1,163 @@
+package lock
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pisush/fin-chat/remote"
+)
+
+const DefaultTTL = 2 * time.Minute // a lease nobody renews for this long can be taken over
+
+// Returned by Acquire while another machine holds the lease
+var ErrHeld = errors.New("another machine is ingesting")
+
+// Returned for what a lease that was lost can no longer do, e.g. uploading the file it guarded
+var ErrLost = errors.New("lost the lease to another machine")
+
+// What the lock object holds
+type record struct {
+	Holder   string    `json:"holder"` // host and process, for the error message
+	ID       string    `json:"id"`     // tells this lease from an earlier one of the same holder
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// A lease on a lock object in a bucket, renewed in the background until Release.
+// Every write is conditional on the object's version, so of two machines racing for it one wins.
+type Lease struct {
+	url string
+	ttl time.Duration
+	log *log.Logger
+
+	mu      sync.Mutex
+	record  record
+	version string
+	lost    bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Takes the lease on the lock object at url, an s3:// or gs:// URL, for ttl at a time. A lease
+// that expired, because its holder crashed or lost its connection, is taken over.
+func Acquire(url string, ttl time.Duration, log *log.Logger) (*Lease, error) {
+	host, _ := os.Hostname()
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	l := &Lease{
+		url:    url,
+		ttl:    ttl,
+		log:    log,
+		record: record{Holder: fmt.Sprintf("%s (pid %d)", host, os.Getpid()), ID: hex.EncodeToString(id), Acquired: now, Expires: now.Add(ttl)},
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	version := "" // no lock object yet
+	data, current, err := remote.Get(url)
+	if err == nil {
+		var held record
+		if err := json.Unmarshal(data, &held); err != nil {
+			return nil, fmt.Errorf("%s: %w", url, err)
+		}
+		if now.Before(held.Expires) {
+			return nil, fmt.Errorf("%w: %s holds %s until %s", ErrHeld, held.Holder, url, held.Expires.Local().Format("15:04:05"))
+		}
+		log.Printf("Taking over the lease of %s on %s, expired at %v", held.Holder, url, held.Expires)
+		version = current
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if err := l.write(version); errors.Is(err, remote.ErrConflict) {
+		return nil, fmt.Errorf("%w: another machine took %s just now", ErrHeld, url)
+	} else if err != nil {
+		return nil, err
+	}
+	go l.renew()
+	return l, nil
+}
+
+// Whether the lease is still held. It is lost when it couldn't be renewed before it expired,
+// or another machine took it over meanwhile; ingesting should stop then.
+func (l *Lease) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.lost && time.Now().Before(l.record.Expires)
+}
+
+// Stops renewing and deletes the lock object, unless another machine has taken it over
+func (l *Lease) Release() error {
+	close(l.stop)
+	<-l.done
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.lost {
+		return nil
+	}
+	_, current, err := remote.Get(l.url)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current != l.version {
+		return nil // taken over after our lease expired
+	}
+	return remote.Delete(l.url)
+}
+
+// Extends the lease every third of its time to live, until Release
+func (l *Lease) renew() {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			l.record.Expires = time.Now().UTC().Add(l.ttl)
+			err := l.write(l.version)
+			if errors.Is(err, remote.ErrConflict) {
+				l.lost = true
+			}
+			l.mu.Unlock()
+			if errors.Is(err, remote.ErrConflict) {
+				l.log.Printf("Lost the lease on %s, another machine took it over", l.url)
+				return
+			}
+			if err != nil {
+				l.log.Printf("Error renewing the lease on %s, trying again: %v", l.url, err)
+			}
+		}
+	}
+}
+
+// Writes the record if the lock object is still at version
+func (l *Lease) write(version string) error {
+	data, err := json.Marshal(l.record)
+	if err != nil {
+		return err
+	}
+	next, err := remote.PutIf(l.url, data, version)
+	if err != nil {
+		return err
+	}
+	l.version = next
+	return nil
+}
@@ -2,353 +2,2851 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode"
 
+	"github.com/pisush/fin-chat/anomalies"
+	"github.com/pisush/fin-chat/anonymize"
+	"github.com/pisush/fin-chat/archive"
+	"github.com/pisush/fin-chat/ask"
+	"github.com/pisush/fin-chat/backup"
+	"github.com/pisush/fin-chat/benchmark"
+	"github.com/pisush/fin-chat/bot"
+	"github.com/pisush/fin-chat/bundle"
+	"github.com/pisush/fin-chat/chats"
+	"github.com/pisush/fin-chat/chatstats"
+	"github.com/pisush/fin-chat/cli"
+	"github.com/pisush/fin-chat/conversations"
+	"github.com/pisush/fin-chat/cron"
+	"github.com/pisush/fin-chat/dedup"
+	"github.com/pisush/fin-chat/digest"
+	"github.com/pisush/fin-chat/doctor"
 	"github.com/pisush/fin-chat/embed"
+	"github.com/pisush/fin-chat/emoji"
+	"github.com/pisush/fin-chat/entities"
+	"github.com/pisush/fin-chat/eval"
+	"github.com/pisush/fin-chat/fakeapi"
+	"github.com/pisush/fin-chat/forget"
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/httpclient"
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/knn"
+	"github.com/pisush/fin-chat/lock"
+	"github.com/pisush/fin-chat/metrics"
+	"github.com/pisush/fin-chat/neardup"
+	"github.com/pisush/fin-chat/notify"
+	"github.com/pisush/fin-chat/parser"
+	"github.com/pisush/fin-chat/participants"
+	"github.com/pisush/fin-chat/pinecone"
+	"github.com/pisush/fin-chat/pipeline"
+	"github.com/pisush/fin-chat/profile"
+	"github.com/pisush/fin-chat/query"
+	"github.com/pisush/fin-chat/querycache"
+	"github.com/pisush/fin-chat/ranking"
+	"github.com/pisush/fin-chat/redact"
+	"github.com/pisush/fin-chat/remote"
+	"github.com/pisush/fin-chat/rtl"
+	"github.com/pisush/fin-chat/secrets"
+	"github.com/pisush/fin-chat/secure"
+	"github.com/pisush/fin-chat/sentiment"
+	"github.com/pisush/fin-chat/server"
+	"github.com/pisush/fin-chat/sessions"
+	"github.com/pisush/fin-chat/spam"
+	"github.com/pisush/fin-chat/state"
+	"github.com/pisush/fin-chat/summarize"
+	"github.com/pisush/fin-chat/system"
+	"github.com/pisush/fin-chat/tenants"
+	"github.com/pisush/fin-chat/timezone"
+	"github.com/pisush/fin-chat/topics"
 	"github.com/pisush/fin-chat/upsert"
+	"github.com/pisush/fin-chat/usage"
+	"github.com/pisush/fin-chat/vectors"
+	"github.com/pisush/fin-chat/visualize"
+	"github.com/pisush/fin-chat/watch"
+
+	"github.com/spf13/pflag"
 )
 
 const (
-	pcAPIKey                     = "PINECONE-API-Key"
-	pcEnv                        = "gcp-starter" // Other envs: https://docs.pinecone.io/docs/projects
-	pcAPIURL                     = ".pinecone.io/"
-	pcCtrlPrefix                 = "https://controller."
-	pcProjectIDPath              = "actions/whoami"
-	pcCreateorConnectToIndexPath = "databases/"
-	pcVectorUpsert               = "vectors/upsert"
-
-	indexName      = "whatsapp-chat"
-	indexDimension = 1536     // stadnard response size from OpenAI's Ada-002
-	indexMetric    = "cosine" // or eculidean or dotproduct: https://docs.pinecone.io/docs/indexes#distance-metrics
-	topK           = 1        // how many results do we want back
-
-	embeddingModel = "text-embedding-ada-002"
-	// format example: [09.09.23, 14:35:02] ~ john_doe: Hello world!
-	enFileToEmbedPath = "./en_files/en_chat.txt"
-	heFileToEmbedPath = "./he_files/he_chat.txt"
-	//format example: "Hello world!",0.12345,0.67890,0.11121,...,0.56433
-	enEmbeddedCSVPath = "./en_files/en_embeddings.csv"
-	heEmbeddedCSVPath = "./he_files/he_embeddings.csv"
-)
+	defaultIndexName = "whatsapp-chat"
+	topK             = 1 // how many results do we want back
 
-// Used to parse the response from a query to the Pinecone index.
-type QueryResponse struct {
-	ID           string    `json:"id"`
-	Score        float64   `json:"score"`
-	Values       []float64 `json:"values"`
-	SparseValues struct {
-		Indices []int     `json:"indices"`
-		Values  []float64 `json:"values"`
-	} `json:"sparseValues"`
-	Metadata map[string]interface{} `json:"metadata"`
-}
+	embeddingModel = "text-embedding-ada-002" // unless --embedding-model says otherwise
+	// format example: [09.09.23, 14:35:02] ~ john_doe: Hello world!
+	chatFilePath = "./chat_files/chat.txt"
+	// Telegram exports are read from result.json next to the chat file, unless --input is given
+	telegramExportName = "result.json"
+	//format example: "Hello world!",john_doe,1694270102,,,0.12345,0.67890,0.11121,...,0.56433
+	embeddingsCSVPath = "./chat_files/embeddings.csv"
 
-type QueryResponseBody struct {
-	Matches   []QueryResponse `json:"matches"`
-	Namespace string          `json:"namespace"`
-}
+	serverAddr  = "127.0.0.1:8080" // where the serve action listens for the web UI, this machine only
+	botAddr     = ":8081"          // where the WhatsApp bot listens for Twilio's webhook
+	progName    = "fin-chat"       // as installed with go install, for help and shell completion
+	summary     = "Embed chat exports, upsert them to Pinecone and search them"
+	fakeAPIsEnv = "FINCHAT_FAKE_APIS" // a file to keep the fake index in, see the README
+	flagEnv     = "FINCHAT_"          // prefix of the environment variables that set the flags, see cli.FromEnv
+	errLogPath  = "err.log"
 
-func getPcProjectID(log *log.Logger) (string, error) {
-	whoamiURL := pcCtrlPrefix + pcEnv + pcAPIURL + pcProjectIDPath
-	req, err := http.NewRequest(http.MethodGet, whoamiURL, nil)
-	if err != nil {
-		log.Printf("Error creating new request: %v", err)
-		return "", err
-	}
-	req.Header.Set("Api-Key", pcAPIKey)
+	twilioAccountEnv = "TWILIO_ACCOUNT_SID" // the Twilio account of the WhatsApp bot
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Error in HTTP request: %v", err)
-		return "", err
-	}
-	defer resp.Body.Close()
+	suggestionSnippetChars = 120 // length of the messages shown by suggest, anomalies and dedupe-report
+	maxDuplicateGroups     = 50  // shown by dedupe-report, the largest
+	forgetBatch            = 100 // IDs forgotten per request, they are fetched in the URL
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		log.Printf("Error decoding response: %v", err)
-		return "", err // Ensure we return here
-	}
+	graphNeighbors = 5 // nearest neighbors linked to each message by the graph action
 
-	pcProjectID, ok := result["project_name"].(string)
-	if !ok {
-		return "", fmt.Errorf("project_name not found or is not a string")
-	}
+	participantGraphPath = "./participants.graphml" // written by analyze graph
+	benchmarkDir         = "./benchmark"            // written by the benchmark command
+)
 
-	return pcProjectID, nil
-}
+// The Pinecone index, defaultIndexName unless --index, the profile or the chat names another
+var indexName = defaultIndexName
 
-// Helper func: Input is a string, and output are the nearest strings
-func queryPinecone(indexName, queryMessage, pcProjectID string, log *log.Logger) ([]QueryResponse, error) {
+// The lease on the embeddings file in a bucket while this run ingests into it, nil otherwise
+var ingestLease *lock.Lease
 
-	// Prepare query
-	url := "https://" + indexName + "-" + pcProjectID + ".svc." + pcEnv + pcAPIURL + "query"
+// Actions that change the index or the embeddings file, run by one machine at a time when the workspace is in a bucket
+var ingests = map[string]bool{"embed": true, "upsert": true, "watch": true, "restore": true, "archive": true}
 
-	// Embed the query message to get the query vector
-	queryVector, err := embed.GetEmbedding(queryMessage, embeddingModel)
-	if err != nil {
-		log.Printf("Error embedding query message: %v", err)
-		return nil, fmt.Errorf("error embedding query message: %v", err)
-	}
+// The actions whose summary is reported to FINCHAT_NOTIFY_WEBHOOK when they finish
+var reportsDone = map[string]bool{"embed": true, "upsert": true}
 
-	queryData := map[string]interface{}{
-		"includeValues":   "false",
-		"includeMetadata": "false",
-		"topK":            topK,
-		"vector":          queryVector,
-	}
+// Actions that read the embeddings file, which is downloaded first when it's an s3:// or gs:// URL
+var readsEmbeddings = map[string]bool{"upsert": true, "suggest": true, "watch": true, "visualize": true, "graph": true, "anomalies": true, "cluster": true, "dedupe-report": true, "describe-index": true, "doctor": true}
 
-	jsonData, err := json.Marshal(queryData)
-	if err != nil {
-		fmt.Println("Error marshalling query data: ", err)
-		return nil, err
-	}
+// The commands of the CLI. The actions, from embed to archive, can be chained and run in order,
+// e.g. "embed upsert query"; the others run alone.
+var commands = []cli.Command{
+	{Name: "embed", Chains: true, Summary: "embed the chat export into the embeddings file", Flags: []string{"source", "format", "date-order", "timezone", "input", "embeddings", "columns", "time-layout", "incremental", "include-regex", "exclude-regex", "min-length", "sender", "since", "until", "spam", "system-messages", "emoji", "replies", "vector-encoding", "vector-decimals", "anonymize", "encrypt", "redact", "embedding-model", "dimensions"}},
+	{Name: "upsert", Chains: true, Summary: "upload the embeddings file to the Pinecone index", Flags: []string{"embeddings", "dry-run", "summaries", "retry-failed", "spam", "system-messages", "sentiment", "entities", "redact", "pinecone-cloud", "pinecone-region", "pinecone-env", "pod-type", "replicas", "embedding-model", "dimensions", "metric", "normalize", "timezone"}},
+	{Name: "query", Chains: true, Summary: "search the chat interactively", Flags: []string{"namespace", "lang", "tone", "mentions", "as-of", "include-archive", "cache-ttl", "expand", "hyde", "keyword-fallback", "embeddings", "explain", "ranking", "bidi", "record", "embedding-model", "dimensions", "metric", "normalize", "timezone"}},
+	{Name: "ask", Chains: true, Summary: "ask questions about the chat, answered from its messages", Flags: []string{"namespace", "lang", "tone", "mentions", "as-of", "include-archive", "cache-ttl", "expand", "hyde", "keyword-fallback", "embeddings", "bidi", "record", "embedding-model", "dimensions", "metric", "normalize", "timezone"}},
+	{Name: "bot", Chains: true, Summary: "answer the questions sent to a Telegram or WhatsApp bot from the chat's messages", Flags: []string{"bot-app", "bot-users", "namespace", "lang", "tone", "mentions", "as-of", "include-archive", "cache-ttl", "expand", "hyde", "keyword-fallback", "embeddings", "embedding-model", "dimensions", "metric", "normalize", "timezone"}},
+	{Name: "summarize", Chains: true, Summary: "summarize the chat", Flags: []string{"source", "format", "date-order", "timezone", "input"}},
+	{Name: "serve", Chains: true, Summary: "serve the search page on http://" + serverAddr + ", with /healthz and /readyz for probes", Flags: []string{"addr", "cache-ttl", "expand", "hyde", "keyword-fallback", "embeddings", "embedding-model", "dimensions", "metric", "normalize", "timezone"}},
+	{Name: "eval", Chains: true, Summary: "score search quality against the labeled queries", Flags: []string{"expand", "hyde", "keyword-fallback", "embeddings", "ranking", "embedding-model", "dimensions", "metric", "normalize"}},
+	{Name: "suggest", Chains: true, Summary: "suggest queries worth labeling for eval", Flags: []string{"embeddings"}},
+	{Name: "watch", Chains: true, Summary: "embed and upsert every export dropped into a folder", Flags: []string{"watch-dir", "source", "format", "date-order", "timezone", "embeddings", "digest", "replies", "vector-encoding", "vector-decimals", "embedding-model", "dimensions", "metric", "normalize"}},
+	{Name: "visualize", Chains: true, Summary: "draw a map of the chat's topics", Flags: []string{"embeddings", "projection", "visualize-out"}},
+	{Name: "graph", Chains: true, Summary: "write the nearest-neighbour graph of the messages", Flags: []string{"embeddings", "graph-out"}},
+	{Name: "anomalies", Chains: true, Summary: "list messages far from every topic of the chat", Flags: []string{"embeddings", "bidi"}},
+	{Name: "dedupe-report", Chains: true, Summary: "list groups of near-identical messages, like chain messages and repeated spam, and optionally forget all but one of each", Flags: []string{"embeddings", "dedupe-threshold", "delete-duplicates", "yes", "restore-window"}},
+	{Name: "cluster", Chains: true, Summary: "group the messages into topics and write a report of them", Flags: []string{"embeddings", "clusters", "cluster-from", "label-topics", "topics-out", "namespace"}},
+	{Name: "index", Chains: true, Args: "list|describe|delete", Summary: "list the Pinecone indexes, describe the chat's or delete one", Subcommands: []string{"list", "describe", "delete"}, Flags: []string{"pinecone-api", "pinecone-env", "embeddings", "yes"}},
+	{Name: "stats", Chains: true, Summary: "count the vectors of the index, per namespace, or with --local the messages of the export", Flags: []string{"local", "source", "format", "date-order", "timezone", "input", "pinecone-api"}},
+	{Name: "doctor", Chains: true, Summary: "check the keys, the index and the files before a long run", Flags: []string{"keys", "pinecone-api", "source", "format", "date-order", "timezone", "input", "embeddings", "ca-bundle", "client-cert", "client-key", "embedding-model", "dimensions", "metric", "normalize"}},
+	{Name: "backup", Chains: true, Summary: "back up the index", Flags: []string{"backup-dir"}},
+	{Name: "restore", Chains: true, Summary: "restore a backup into the index", Flags: []string{"restore-workers"}},
+	{Name: "verify", Chains: true, Summary: "check a backup against its manifest"},
+	{Name: "export", Chains: true, Summary: "export the index as JSON lines", Flags: []string{"namespace", "export-out", "export-values"}},
+	{Name: "forget", Chains: true, Summary: "hide messages from search, deleted for good after the restore window", Flags: []string{"namespace", "restore-window"}},
+	{Name: "archive", Chains: true, Args: "[create [file]|load <file>]", Summary: "move old vectors to cold storage, or write or load a portable archive of the chat and its embeddings", Subcommands: []string{"create", "load"}, Flags: []string{"archive-after", "embeddings"}},
+	{Name: "sessions", Args: "list|show [id]", Summary: "list or show the recorded query and ask sessions", Subcommands: []string{"list", "show"}},
+	{Name: "bookmarks", Args: "list|export [file]", Summary: "list or export the bookmarked results", Subcommands: []string{"list", "export"}},
+	{Name: "chats", Args: "list|add <name>|remove <name>", Summary: "register chats, each in an index or namespace of its own, to pick with --chat", Subcommands: []string{"list", "add", "remove"}, Flags: []string{"chat-policy"}},
+	{Name: "tenants", Args: "list|add <name>|rotate <name>|remove <name>", Summary: "give each user of serve a key that searches only their chat, the --chat or --index and --namespace given", Subcommands: []string{"list", "add", "rotate", "remove"}, Flags: []string{"chat", "index", "namespace", "role"}},
+	{Name: "deleted", Args: "list|restore <id>...|purge", Summary: "manage the messages hidden with forget", Subcommands: []string{"list", "restore", "purge"}, Flags: []string{"restore-window"}},
+	{Name: "benchmark", Args: "[dir]", Summary: "export an anonymized benchmark of the chat", Flags: []string{"source", "format", "date-order", "timezone", "input", "paraphrase"}},
+	{Name: "apply", Args: "[spec]", Summary: "make the index match a pipeline spec, " + pipeline.DefaultPath + " by default", Flags: []string{"dry-run"}},
+	{Name: "daemon", Args: "[spec]", Summary: "keep applying a pipeline spec on its sync schedule, nightly by default"},
+	{Name: "analyze", Args: "graph [file]", Summary: "write the graph of who replies to whom", Subcommands: []string{"graph"}, Flags: []string{"source", "format", "date-order", "timezone", "input", "replies"}},
+	{Name: "usage", Summary: "report the tokens, units, time and estimated cost of past runs, per action and per chat"},
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		fmt.Println("Error creating new request: ", err)
-		return nil, err
-	}
+// Commands that take their own arguments, rather than being chained with other actions
+var runsAlone = map[string]bool{"sessions": true, "bookmarks": true, "chats": true, "tenants": true, "deleted": true, "benchmark": true, "apply": true, "daemon": true, "analyze": true, "usage": true}
 
-	req.Header.Set("accept", "application/json")
-	req.Header.Set("content-type", "application/json")
-	req.Header.Set("Api-Key", pcAPIKey)
+// Whether the command line is "archive create" or "archive load", which run alone, unlike "archive"
+func portableArchive(args []string) bool {
+	return len(args) > 1 && args[0] == "archive" && (args[1] == "create" || args[1] == "load")
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// The actions named by "index <subcommand>"
+var indexActions = map[string]string{"list": "list-indexes", "describe": "describe-index", "delete": "delete-index"}
 
-	if err != nil {
-		log.Printf("Error sending request: %v", err)
-		return nil, err
+// The actions of the command line in order, and the first word that isn't one
+func actionsOf(args []string) ([]string, string) {
+	var actions []string
+	for i := 0; i < len(args); i++ {
+		switch name := args[i]; name {
+		case "index":
+			if i+1 == len(args) || indexActions[args[i+1]] == "" {
+				return nil, strings.Join(args[i:min(i+2, len(args))], " ")
+			}
+			i++
+			actions = append(actions, indexActions[args[i]])
+		case "embed", "upsert", "query", "ask", "bot", "summarize", "serve", "eval", "suggest", "watch", "visualize",
+			"graph", "anomalies", "cluster", "dedupe-report", "stats", "doctor", "backup", "restore", "verify", "export", "forget", "archive":
+			actions = append(actions, name)
+		default:
+			return nil, name
+		}
 	}
-	defer resp.Body.Close()
+	return actions, ""
+}
 
-	var response QueryResponseBody
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		log.Printf("Error decoding response body: %v", err)
-		return nil, err
-	}
+func promptUserAndQueryPinecone(indexName string, filter query.Filter, bidiMode string, transcript *sessions.Session, log *log.Logger) error {
+	reader := bufio.NewReader(os.Stdin)
+	seen := map[string]query.QueryResponse{} // results shown so far, by vector ID, for bookmarking
+	lastQuery := ""                          // the query "label" judgments apply to
 
-	matches := response.Matches
+	for {
+		// Ask the user to provide a query
+		fmt.Print(i18n.T("query.prompt"))
+		queryMessage, err := reader.ReadString('\n')
+		if err != nil {
+			log.Printf("Error reading user input: %v", err)
+			return err
+		}
 
-	// Fetch vector content for each match
-	for _, match := range matches {
-		fetchURL := fmt.Sprintf("https://%s-%s.svc.%s.pinecone.io/vectors/fetch?ids=%s", indexName, pcProjectID, pcEnv, match.ID)
+		// Trim the newline character from the input
+		queryMessage = strings.TrimSpace(queryMessage)
 
-		fetchReq, err := http.NewRequest("GET", fetchURL, nil)
-		if err != nil {
-			log.Printf("Error creating new request to fetch vector: %v", err)
-			return nil, err
+		// Check if the user entered "end", and if so, exit the loop
+		if strings.ToLower(queryMessage) == "end" {
+			fmt.Println(i18n.T("exit"))
+			break
 		}
-		fetchReq.Header.Set("Api-Key", pcAPIKey)
-		fetchReq.Header.Set("Accept", "application/json")
 
-		fetchResp, err := client.Do(fetchReq)
-		if err != nil {
-			log.Printf("Error in HTTP request to fetch vector: %v", err)
-			return nil, err
+		// "bookmark <vectorID>" saves one of the results shown so far
+		if fields := strings.Fields(queryMessage); len(fields) == 2 && strings.ToLower(fields[0]) == "bookmark" {
+			if err := bookmarkResult(seen, fields[1], filter.Namespace); err != nil {
+				fmt.Println(i18n.T("bookmarks.error", err))
+				log.Printf("Error bookmarking %s: %v", fields[1], err)
+			}
+			continue
 		}
-		defer fetchResp.Body.Close()
 
-		var fetchResponse struct {
-			Vectors map[string]struct {
-				ID     string    `json:"id"`
-				Values []float64 `json:"values"`
-			} `json:"vectors"`
-			Namespace string `json:"namespace"`
+		// "label +<id> -<id> ..." marks results of the last query relevant (+) or irrelevant (-)
+		if fields := strings.Fields(queryMessage); len(fields) > 1 && strings.ToLower(fields[0]) == "label" {
+			if err := labelResults(lastQuery, filter.Namespace, seen, fields[1:]); err != nil {
+				fmt.Println(i18n.T("eval.label_error", err))
+				log.Printf("Error labeling results: %v", err)
+			}
+			continue
 		}
 
-		if err := json.NewDecoder(fetchResp.Body).Decode(&fetchResponse); err != nil {
-			log.Printf("Error decoding fetch response: %v", err)
-			return nil, err
+		// "drill <id>" searches the messages of a summarized period for the last query
+		searchFilter := filter
+		if fields := strings.Fields(queryMessage); len(fields) == 2 && strings.ToLower(fields[0]) == "drill" {
+			period, err := summarizedPeriod(seen, fields[1])
+			if err != nil {
+				fmt.Println(i18n.T("summaries.error", err))
+				continue
+			}
+			if lastQuery == "" {
+				fmt.Println(i18n.T("summaries.error", "search for something first"))
+				continue
+			}
+			searchFilter = query.Filter{Namespace: period.Chat, Language: filter.Language, Tone: filter.Tone, Mentions: filter.Mentions, Sender: filter.Sender, From: period.Start, To: period.End}
+			queryMessage = lastQuery
 		}
 
-		if vectorData, exists := fetchResponse.Vectors[match.ID]; exists {
-			match.Values = vectorData.Values
-			log.Printf("Fetched vector content for ID %s: %v", vectorData.ID, vectorData.Values)
-		} else {
-			log.Printf("No vector content found for ID %s", match.ID)
+		// Call queryPinecone with the queryMessage
+		queryResponse, err := ranking.Search(indexName, queryMessage, topK, searchFilter, log)
+		if err != nil {
+			fmt.Println(i18n.T("query.error", err))
+			log.Printf("Error querying Pinecone: %v", err)
+			continue
 		}
 
+		// Print the matched messages
+		var results, ids []string
+		summarized := false
+		for _, match := range queryResponse {
+			sender, text := anonymize.Reveal(match.Sender()), anonymize.Reveal(match.Text())
+			if period, ok := conversations.PeriodOf(match.Metadata); ok {
+				sender = i18n.T("summaries.sender", period.End.Format("2006-01-02 15:04"))
+				summarized = true
+			}
+			fmt.Println(i18n.T("query.result", match.Timestamp().Format("2006-01-02 15:04"), rtl.Display(sender, bidiMode), rtl.Display(text, bidiMode), match.Score))
+			results = append(results, i18n.T("query.result", match.Timestamp().Format("2006-01-02 15:04"), sender, text, match.Score))
+			for _, step := range match.Explanation {
+				fmt.Println(i18n.T("query.explanation", step))
+			}
+			ids = append(ids, match.ID)
+			seen[match.ID] = match
+		}
+		if len(queryResponse) > 0 {
+			fmt.Println(i18n.T("bookmarks.hint", strings.Join(ids, ", ")))
+		}
+		if summarized {
+			fmt.Println(i18n.T("summaries.hint"))
+		}
+		lastQuery = queryMessage
+		if transcript != nil {
+			if err := transcript.Add(queryMessage, ids, strings.Join(results, "\n")); err != nil {
+				log.Printf("Error saving session transcript: %v", err)
+			}
+		}
 	}
 
-	return matches, nil
-
+	return nil
 }
 
-func promptUserAndQueryPinecone(indexName, pcProjectID string, log *log.Logger) error {
+func promptUserAndAsk(indexName string, filter query.Filter, bidiMode string, transcript *sessions.Session, log *log.Logger) error {
 	reader := bufio.NewReader(os.Stdin)
-	client := &http.Client{}
+	conversation := ask.NewConversation(indexName, filter)
 
 	for {
-		// Ask the user to provide a query
-		fmt.Print("Please enter a message to search for (or type 'end' to exit): ")
-		queryMessage, err := reader.ReadString('\n')
+		fmt.Print(i18n.T("ask.prompt"))
+		question, err := reader.ReadString('\n')
 		if err != nil {
 			log.Printf("Error reading user input: %v", err)
 			return err
 		}
+		question = strings.TrimSpace(question)
 
-		// Trim the newline character from the input
-		queryMessage = strings.TrimSpace(queryMessage)
-
-		// Check if the user entered "end", and if so, exit the loop
-		if strings.ToLower(queryMessage) == "end" {
-			fmt.Println("You typed exit. Program exiting!")
-			break
+		switch strings.ToLower(question) {
+		case "":
+			continue
+		case "end":
+			fmt.Println(i18n.T("exit"))
+			return nil
+		case "reset":
+			conversation.Reset()
+			fmt.Println(i18n.T("ask.reset"))
+			continue
 		}
 
-		// Call queryPinecone with the queryMessage
-		queryResponse, err := queryPinecone(indexName, queryMessage, pcProjectID, log)
+		answer, err := conversation.Ask(question, log)
 		if err != nil {
-			log.Printf("Error querying Pinecone: %v", err)
+			fmt.Println(i18n.T("ask.error", err))
 			continue
 		}
-
-		// Get message based on vector ID
-		for _, match := range queryResponse {
-			fetchURL := "https://" + indexName + "-" + pcProjectID + ".svc." + pcEnv + pcAPIURL + "vectors/fetch?ids=" + match.ID
-			fetchReq, err := http.NewRequest("GET", fetchURL, nil)
-			if err != nil {
-				log.Printf("Error creating fetch request: %v", err)
-				return err
+		fmt.Println(rtl.Display(anonymize.Reveal(answer.Text), bidiMode))
+		if transcript != nil {
+			if err := transcript.Add(question, answer.Retrieved, answer.Text); err != nil {
+				log.Printf("Error saving session transcript: %v", err)
 			}
-			fetchReq.Header.Set("Api-Key", pcAPIKey)
-			fetchReq.Header.Set("accept", "application/json")
+		}
 
-			log.Printf("Attempting to fetch vector content for ID %s", match.ID)
+		// Show the cited messages so the answer can be verified
+		if len(answer.Citations) > 0 {
+			fmt.Println("\n" + i18n.T("ask.sources"))
+		}
+		for _, citation := range answer.Citations {
+			fmt.Printf("[%d] %s %s: %s\n", citation.Number, citation.Timestamp.Format("2006-01-02 15:04"), rtl.Display(anonymize.Reveal(citation.Sender), bidiMode), rtl.Display(anonymize.Reveal(citation.Text), bidiMode))
+		}
+	}
+}
 
-			fetchResp, err := client.Do(fetchReq)
-			if err != nil {
-				log.Printf("Error sending fetch request: %v", err)
-				return err
-			}
-			defer fetchResp.Body.Close()
+// Answers the questions sent to the bot of the app until interrupted or terminated
+func runBot(app, indexName string, filter query.Filter, users string, log *log.Logger) error {
+	var run func(ctx context.Context) error
+	switch app {
+	case bot.AppTelegram:
+		token, err := secrets.Get(secrets.Telegram)
+		if err != nil {
+			return err
+		}
+		run = bot.NewTelegram(token, strings.Split(users, ","), indexName, filter, log).Run
+	case bot.AppWhatsApp:
+		accountSID := os.Getenv(twilioAccountEnv)
+		if accountSID == "" {
+			return fmt.Errorf("no Twilio account: set %s, see the README", twilioAccountEnv)
+		}
+		token, err := secrets.Get(secrets.Twilio)
+		if err != nil {
+			return err
+		}
+		twilio := bot.NewTwilio(accountSID, token, strings.Split(users, ","), indexName, filter, log)
+		run = func(ctx context.Context) error { return twilio.Serve(ctx, botAddr) }
+	default:
+		return fmt.Errorf("unknown bot app %q, use %s or %s", app, bot.AppTelegram, bot.AppWhatsApp)
+	}
+	if users == "" {
+		fmt.Println(i18n.T("bot.no_users"))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return run(ctx)
+}
 
-			fmt.Println(">>fetchResp")
-			fmt.Println(fetchResp)
+// The key searches of serve need when it has no tenants: FINCHAT_API_KEY, or the keychain's.
+// Without one, a key is made for this run and printed with a link that signs the page in.
+func serveKey(addr string, log *log.Logger) (string, error) {
+	registry, err := tenants.Load(tenants.DefaultPath)
+	if err != nil || len(registry.Tenants) > 0 {
+		return "", err
+	}
+	key, err := secrets.Get(secrets.Server)
+	if err == nil {
+		return key, nil
+	}
+	log.Printf("Making a key for this run of serve: %v", err)
+	if key, _, err = tenants.NewKey(); err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	fmt.Println(i18n.T("serve.key", "http://"+addr+"/#key="+key))
+	return key, nil
+}
 
-			var fetchResponse struct {
-				Vectors map[string]struct {
-					ID     string    `json:"id"`
-					Values []float64 `json:"values"`
-				} `json:"vectors"`
-				Namespace string `json:"namespace"`
-			}
+// Saves a result shown in this query session to the bookmarks in the state file
+func bookmarkResult(seen map[string]query.QueryResponse, id, namespace string) error {
+	id, err := resolveResultID(seen, id)
+	if err != nil {
+		return err
+	}
+	match := seen[id]
 
-			if err := json.NewDecoder(fetchResp.Body).Decode(&fetchResponse); err != nil {
-				fmt.Println("Error decoding fetch response", fetchResp)
-				log.Printf("Error decoding fetch response: %v", err)
-				return err
-			}
+	st, err := state.Load()
+	if err != nil {
+		return err
+	}
+	added := st.AddBookmark(state.Bookmark{
+		ID:        match.ID,
+		Namespace: namespace,
+		Sender:    match.Sender(),
+		Timestamp: match.Timestamp(),
+		Text:      match.Text(),
+		Added:     time.Now().UTC(),
+	})
+	if !added {
+		fmt.Println(i18n.T("bookmarks.exists", id))
+		return nil
+	}
+	if err := st.Save(); err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("bookmarks.added", id))
+	return nil
+}
 
-			if vectorData, exists := fetchResponse.Vectors[match.ID]; exists {
-				match.Values = vectorData.Values
-				fmt.Println("Fetched vector content for ID", vectorData.ID)
-				fmt.Println(vectorData.Values)
+// Finds the shown result with the given ID, or the only one starting with it,
+// so the long message IDs don't have to be typed in full
+func resolveResultID(seen map[string]query.QueryResponse, id string) (string, error) {
+	if _, ok := seen[id]; ok {
+		return id, nil
+	}
+	var found []string
+	for candidate := range seen {
+		if strings.HasPrefix(candidate, id) {
+			found = append(found, candidate)
+		}
+	}
+	switch len(found) {
+	case 1:
+		return found[0], nil
+	case 0:
+		return "", fmt.Errorf("%s is not one of the results shown in this session", id)
+	default:
+		return "", fmt.Errorf("%s matches several results, type more of the ID", id)
+	}
+}
 
-				log.Printf("Fetched vector content for ID %s: %v", vectorData.ID, vectorData.Values)
-			} else {
-				log.Printf("No vector content found for ID %s", match.ID)
-				fmt.Println("no vector content for ID", vectorData.ID)
-			}
+// The period of a summary shown in this query session, see conversations.PeriodOf
+func summarizedPeriod(seen map[string]query.QueryResponse, id string) (conversations.Period, error) {
+	id, err := resolveResultID(seen, id)
+	if err != nil {
+		return conversations.Period{}, err
+	}
+	period, ok := conversations.PeriodOf(seen[id].Metadata)
+	if !ok {
+		return conversations.Period{}, fmt.Errorf("%s is a message, not a summary", id)
+	}
+	return period, nil
+}
+
+// Adds "+id" and "-id" judgments for the last query to the eval set
+func labelResults(lastQuery, namespace string, seen map[string]query.QueryResponse, judgments []string) error {
+	if lastQuery == "" {
+		return fmt.Errorf("search for something first")
+	}
+
+	var relevant, irrelevant []string
+	for _, judgment := range judgments {
+		if len(judgment) < 2 || (judgment[0] != '+' && judgment[0] != '-') {
+			return fmt.Errorf("%q should be +<id> or -<id>", judgment)
+		}
+		id, err := resolveResultID(seen, judgment[1:])
+		if err != nil {
+			return err
+		}
+		if judgment[0] == '+' {
+			relevant = append(relevant, id)
+		} else {
+			irrelevant = append(irrelevant, id)
 		}
 	}
 
+	if err := eval.Label(eval.DatasetPath, lastQuery, namespace, relevant, irrelevant); err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("eval.labeled", len(relevant), len(irrelevant), eval.DatasetPath))
 	return nil
 }
 
-func main() {
-	// Setup logs
-	logFile, err := os.OpenFile("err.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// Lists regions of the chat that the eval set has no labeled queries for
+func printEvalSuggestions(embeddingsFileName string, log *log.Logger) error {
+	cases, err := eval.Load(eval.DatasetPath)
+	if err != nil {
+		return err
+	}
+	rows, err := vectors.ReadFile(embeddingsFileName, log)
 	if err != nil {
-		log.Fatalf("opening err log file: %v", err)
+		return err
 	}
-	defer logFile.Close()
 
-	log := log.New(logFile, "ERR: ", log.Ldate|log.Ltime)
+	suggestions := eval.Suggest(cases, rows)
+	if len(suggestions) == 0 {
+		fmt.Println(i18n.T("eval.covered"))
+		return nil
+	}
+	fmt.Println(i18n.T("eval.suggest", len(suggestions)))
+	for i, suggestion := range suggestions {
+		fmt.Println("\n" + i18n.T("eval.topic", i+1, suggestion.Size))
+		for _, row := range suggestion.Examples {
+			fmt.Printf("  %s [%s] %s: %s\n", row.ID, row.Timestamp.Format("2006-01-02 15:04"), anonymize.Reveal(row.Sender), anonymize.Reveal(grapheme.Snippet(row.Text, suggestionSnippetChars)))
+		}
+	}
+	return nil
+}
 
-	// Get user action
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("What is the action? Options are: embed/upsert/query")
-	action, _ := reader.ReadString('\n')
-	action = strings.TrimSpace(action)
-	actions := strings.Fields(action)
+// Handles "bookmarks list" and "bookmarks export [file]", exporting markdown to stdout without a file
+func runBookmarksCommand(args []string) error {
+	st, err := state.Load()
+	if err != nil {
+		return err
+	}
 
-	if len(actions) == 0 {
-		fmt.Println("No action specified.")
-		return
+	if len(args) == 0 || args[0] == "list" {
+		if len(st.Bookmarks) == 0 {
+			fmt.Println(i18n.T("bookmarks.none"))
+		}
+		for _, bookmark := range st.Bookmarks {
+			fmt.Printf("%s [%s] %s: %s\n", bookmark.ID, bookmark.Timestamp.Format("2006-01-02 15:04"), anonymize.Reveal(bookmark.Sender), anonymize.Reveal(bookmark.Text))
+		}
+		return nil
 	}
 
-	inputFileName := enFileToEmbedPath
-	embeddingsFileName := enEmbeddedCSVPath
+	if args[0] != "export" {
+		return fmt.Errorf("unknown bookmarks command %q, use list or export", args[0])
+	}
 
-	fmt.Print("Choose language (en/he): ")
-	lang, _ := reader.ReadString('\n')
-	lang = strings.TrimSpace(lang)
-	if lang == "he" {
-		inputFileName = heFileToEmbedPath
-		embeddingsFileName = heEmbeddedCSVPath
-	} else {
-		fmt.Println("Unknown language. Please specify 'en' or 'he'.")
-		return
+	var sb strings.Builder
+	sb.WriteString("# Bookmarked messages\n")
+	for _, bookmark := range st.Bookmarks {
+		fmt.Fprintf(&sb, "\n- **%s** (%s): %s", anonymize.Reveal(bookmark.Sender), bookmark.Timestamp.Format("2006-01-02 15:04"), anonymize.Reveal(bookmark.Text))
+		if bookmark.Namespace != "" {
+			fmt.Fprintf(&sb, " _#%s_", bookmark.Namespace)
+		}
+		fmt.Fprintf(&sb, " `%s`", bookmark.ID)
 	}
+	sb.WriteString("\n")
 
-	// Execute the user request
-	for _, act := range actions {
-		switch act {
-		case "embed":
+	if len(args) < 2 {
+		fmt.Print(sb.String())
+		return nil
+	}
+	if err := os.WriteFile(args[1], []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("bookmarks.exported", len(st.Bookmarks), args[1]))
+	return nil
+}
 
-			err = embed.CreateEmbeddingFile(inputFileName, embeddingsFileName, embeddingModel, log)
-			if err != nil {
-				log.Fatalf("Error creating embedding file: %v", err)
-				fmt.Println("Error embedding", err)
-				return
-			}
+// Handles "chats list", "chats add <name>" and "chats remove <name>". add creates the index
+// of a chat with an index of its own; remove only forgets the chat, its vectors stay.
+func runChatsCommand(args []string, policy string, log *log.Logger) error {
+	registry, err := chats.Load(chats.DefaultPath)
+	if err != nil {
+		return err
+	}
 
-		case "upsert":
-			if inputFileName == "" || embeddingsFileName == "" {
-				fmt.Println("Embedding must be done before upserting.")
-				return
+	if len(args) == 0 || args[0] == "list" {
+		if len(registry.Chats) == 0 {
+			fmt.Println(i18n.T("chats.none"))
+		}
+		for _, name := range registry.Names() {
+			chat := registry.Chats[name]
+			namespace, embeddings := chat.Namespace, chat.Embeddings
+			if namespace == "" {
+				namespace = "-"
 			}
-			// Ensure Pinecone index exists
-			err = upsert.GetOrCreatePineconeIndex(indexName, log)
-			if err != nil {
-				log.Fatalf("Error ensuring Pinecone index exists: %v", err)
+			if embeddings == "" {
+				embeddings = "-"
 			}
+			fmt.Println(i18n.T("chats.entry", name, chat.Index, namespace, embeddings))
+		}
+		return nil
+	}
 
-			// Upsert data to Pinecone
-			err = upsert.UpsertDataToPinecone(indexName, embeddingsFileName, log)
-			if err != nil {
-				fmt.Println("Failed upserting data to pinecone", err)
-				log.Printf("Error upserting data to Pinecone: %v", err)
-				return
+	if args[0] != "add" && args[0] != "remove" {
+		return fmt.Errorf("unknown chats command %q, use list, add or remove", args[0])
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("chats %s needs the name of a chat", args[0])
+	}
+	name := args[1]
+
+	if args[0] == "remove" {
+		chat, err := registry.Lookup(name)
+		if err != nil {
+			return err
+		}
+		delete(registry.Chats, name)
+		if err := registry.Save(chats.DefaultPath); err != nil {
+			return err
+		}
+		fmt.Println(i18n.T("chats.removed", name, chat.Index))
+		return nil
+	}
+
+	if _, ok := registry.Chats[name]; ok {
+		return fmt.Errorf("chat %q is already registered, remove it first", name)
+	}
+	chat, err := chats.New(name, policy, indexName, filepath.Dir(embeddingsCSVPath))
+	if err != nil {
+		return err
+	}
+	for other, registered := range registry.Chats {
+		if registered.Index == chat.Index && registered.Namespace == chat.Namespace {
+			return fmt.Errorf("chat %q would share %s with %q, pick another name", name, chat.Index, other)
+		}
+	}
+	if chat.Namespace == "" {
+		if err := upsert.GetOrCreatePineconeIndex(chat.Index, log); err != nil {
+			return err
+		}
+	}
+	registry.Chats[name] = chat
+	if err := registry.Save(chats.DefaultPath); err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("chats.added", name, chat.Index, name))
+	return nil
+}
+
+// Handles "tenants list", "tenants add <name>", "tenants rotate <name>" and "tenants remove <name>".
+// add and rotate print the tenant's new key, which only its hash is kept of; add gives it role.
+func runTenantsCommand(args []string, namespace, role string) error {
+	registry, err := tenants.Load(tenants.DefaultPath)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 || args[0] == "list" {
+		if len(registry.Tenants) == 0 {
+			fmt.Println(i18n.T("tenants.none"))
+		}
+		for _, name := range registry.Names() {
+			tenant := registry.Tenants[name]
+			ns := tenant.Namespace
+			if ns == "" {
+				ns = "-"
 			}
+			role := tenant.Role
+			if role == "" {
+				role = tenants.RoleRead
+			}
+			fmt.Println(i18n.T("tenants.entry", name, tenant.Index, ns, role))
+		}
+		return nil
+	}
 
-		case "query":
-			pcProjectID, _ := getPcProjectID(log)
-			// Call the function to prompt the user and query Pinecone
-			err = promptUserAndQueryPinecone(indexName, pcProjectID, log)
-			if err != nil {
-				fmt.Println("Error in the query proces: ", err)
-				fmt.Println("There was an Error in the query proces: ")
-				log.Fatalf("Error in the query process: %v", err)
+	if args[0] != "add" && args[0] != "rotate" && args[0] != "remove" {
+		return fmt.Errorf("unknown tenants command %q, use list, add, rotate or remove", args[0])
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("tenants %s needs the name of a tenant", args[0])
+	}
+	name := args[1]
+
+	tenant, registered := registry.Tenants[name]
+	switch {
+	case args[0] == "add" && registered:
+		return fmt.Errorf("tenant %q is already registered, rotate its key or remove it first", name)
+	case args[0] != "add" && !registered:
+		_, err := registry.Lookup(name)
+		return err
+	case args[0] == "remove":
+		delete(registry.Tenants, name)
+		if err := registry.Save(tenants.DefaultPath); err != nil {
+			return err
+		}
+		fmt.Println(i18n.T("tenants.removed", name))
+		return nil
+	case args[0] == "add":
+		if owner, ok := registry.Owner(indexName, namespace); ok {
+			return fmt.Errorf("tenant %q already searches index %s, namespace %q: give %q a chat of its own with --chat", owner, indexName, namespace, name)
+		}
+		if err := tenants.ValidRole(role); err != nil {
+			return err
+		}
+		tenant = tenants.Tenant{Index: indexName, Namespace: namespace, Role: role}
+	}
+
+	key, hash, err := tenants.NewKey()
+	if err != nil {
+		return err
+	}
+	tenant.KeyHash = hash
+	registry.Tenants[name] = tenant
+	if err := registry.Save(tenants.DefaultPath); err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("tenants.key", name, tenant.Index, key))
+	return nil
+}
+
+// Handles "deleted list", "deleted restore <id>..." and "deleted purge" for messages forgotten with forget
+func runDeletedCommand(args []string, window time.Duration) error {
+	if len(args) == 0 || args[0] == "list" {
+		st, err := state.Load()
+		if err != nil {
+			return err
+		}
+		if len(st.Deleted) == 0 {
+			fmt.Println(i18n.T("forget.none"))
+		}
+		for _, deleted := range st.Deleted {
+			fmt.Println(i18n.T("forget.listed", deleted.ID, deleted.At.Add(window).Format("2006-01-02"), grapheme.Snippet(deleted.Text, suggestionSnippetChars)))
+		}
+		return nil
+	}
+
+	switch args[0] {
+	case "restore":
+		if len(args) < 2 {
+			return fmt.Errorf("give the IDs to restore, see deleted list")
+		}
+		n, err := forget.Restore(indexName, args[1:])
+		if n > 0 {
+			fmt.Println(i18n.T("forget.restored", n))
+		}
+		return err
+	case "purge":
+		n, err := forget.Purge(indexName, window, time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Println(i18n.T("forget.purged", n))
+		return nil
+	}
+	return fmt.Errorf("unknown deleted command %q, use list, restore or purge", args[0])
+}
+
+// Handles "archive create [file]", writing the messages of the embeddings file with their
+// embeddings and settings to a portable archive, and "archive load <file>", adding those of
+// an archive to the embeddings file
+func runArchiveCommand(args []string, embeddingsPath string, log *log.Logger) error {
+	// Loading adds to the embeddings file, so another machine sharing the bucket is waited for
+	if args[0] == "load" && remote.IsURL(embeddingsPath) {
+		lease, err := lock.Acquire(lockURL(embeddingsPath), lock.DefaultTTL, log)
+		if err != nil {
+			return err
+		}
+		ingestLease = lease
+		defer func() {
+			ingestLease = nil
+			if err := lease.Release(); err != nil {
+				log.Printf("Error releasing the lock on %s: %v", lockURL(embeddingsPath), err)
+			}
+		}()
+	}
+	embeddingsFileName, err := localCopy(embeddingsPath)
+	if err != nil {
+		return err
+	}
+	if args[0] == "create" {
+		target := bundle.Name(indexName, time.Now())
+		if len(args) > 1 {
+			target = args[1]
+		}
+		path, err := outputPath(target)
+		if err != nil {
+			return err
+		}
+		settings := bundle.Settings{
+			Model: embed.Model(), MaxMessageChars: embed.MaxMessageChars,
+			Emoji: emoji.Mode(), Spam: spam.Mode(), SystemMessages: system.Mode(), Redact: redact.Enabled(), Anonymize: anonymize.Enabled(),
+		}
+		if timezone.Enabled() {
+			settings.Timezone = timezone.Location().String()
+		}
+		count, err := bundle.Create(path, indexName, embeddingsFileName, settings, log)
+		if err != nil {
+			return err
+		}
+		if err := publish(path, target); err != nil {
+			return err
+		}
+		fmt.Println(i18n.T("archive.created", count, target))
+		return nil
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("archive load needs the archive file")
+	}
+	path, err := localCopy(args[1])
+	if err != nil {
+		return err
+	}
+	header, added, err := bundle.Load(path, embeddingsFileName, embed.Model(), embed.Dimension(), log)
+	if err != nil {
+		return err
+	}
+	if err := publish(embeddingsFileName, embeddingsPath); err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("archive.loaded", added, header.Messages, header.Index, header.Created.Format("2006-01-02"), embeddingsPath))
+	if header.Settings.Anonymize {
+		fmt.Println(i18n.T("archive.anonymized"))
+	}
+	return nil
+}
+
+// Handles "analyze graph [file]": the participant graph of the export, as GraphML or JSON by the extension
+func runAnalyzeCommand(args []string, inputFileName, source string, log *log.Logger) error {
+	if len(args) == 0 || args[0] != "graph" {
+		return fmt.Errorf("unknown analyze command, use graph [file]")
+	}
+	target := participantGraphPath
+	if len(args) > 1 {
+		target = args[1]
+	}
+	outputFileName, err := outputPath(target)
+	if err != nil {
+		return err
+	}
+
+	messages, err := embed.ReadMessages(inputFileName, source, log)
+	if err != nil {
+		return err
+	}
+	graph := participants.Build(messages, participants.DefaultWindow)
+
+	file, err := os.Create(outputFileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(outputFileName), ".json") {
+		err = participants.WriteJSON(file, graph)
+	} else {
+		err = participants.WriteGraphML(file, graph)
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err == nil {
+		err = publish(outputFileName, target)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("analyze.written", len(graph.Nodes), len(graph.Edges), target))
+	return nil
+}
+
+// Handles "benchmark [dir]": writes the anonymized corpus.jsonl, and queries.jsonl from the eval set, to dir
+func runBenchmarkCommand(args []string, inputFileName, source string, paraphrase bool, log *log.Logger) error {
+	target := benchmarkDir
+	if len(args) > 0 {
+		target = args[0]
+	}
+	dir, err := outputPath(target)
+	if err != nil {
+		return err
+	}
+
+	messages, err := embed.ReadMessages(inputFileName, source, log)
+	if err != nil {
+		return err
+	}
+	cases, err := eval.Load(eval.DatasetPath)
+	if err != nil {
+		return err
+	}
+	documents, queries := benchmark.Build(messages, cases)
+	if paraphrase {
+		fmt.Println(i18n.T("benchmark.paraphrasing", len(documents)))
+		if err := benchmark.Paraphrase(documents); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := benchmark.WriteJSONL(filepath.Join(dir, "corpus.jsonl"), documents); err != nil {
+		return err
+	}
+	if len(queries) > 0 {
+		if err := benchmark.WriteJSONL(filepath.Join(dir, "queries.jsonl"), queries); err != nil {
+			return err
+		}
+	}
+	if remote.IsURL(target) {
+		if err := publishDir(dir, target, ""); err != nil {
+			return err
+		}
+	}
+	fmt.Println(i18n.T("benchmark.written", len(documents), len(queries), target))
+	return nil
+}
+
+// Makes the index match a pipeline spec: embeds and upserts the new messages of every source
+// and runs the scheduled actions that are due. With dryRun only the plan is printed.
+func runApplyCommand(args []string, dryRun bool, log *log.Logger) error {
+	specPath := pipeline.DefaultPath
+	if len(args) > 0 {
+		specPath = args[0]
+	}
+	local, err := localCopy(specPath)
+	if err != nil {
+		return err
+	}
+	spec, err := pipeline.Load(local)
+	if err != nil {
+		return err
+	}
+
+	// Whatever the flags say, the spec decides
+	pre := spec.Preprocessing
+	if pre.Emoji == "" {
+		pre.Emoji = emoji.ModeKeep
+	}
+	if pre.Spam == "" {
+		pre.Spam = spam.ModeOff
+	}
+	if pre.System == "" {
+		pre.System = system.ModeSkip
+	}
+	if pre.Sentiment == "" {
+		pre.Sentiment = sentiment.ModeOff
+	}
+	if pre.Entities == "" {
+		pre.Entities = entities.ModeOff
+	}
+	if spec.Embedder.Model == "" {
+		spec.Embedder.Model = embeddingModel
+	}
+	if spec.Store.API == "" {
+		spec.Store.API = pinecone.ModeCurrent
+	}
+	if spec.Store.Embeddings == "" {
+		spec.Store.Embeddings = embeddingsCSVPath
+	}
+	if spec.Store.BackupDir == "" {
+		spec.Store.BackupDir = backup.Dir
+	}
+	if err := emoji.SetMode(pre.Emoji); err != nil {
+		return err
+	}
+	if err := embed.SetModel(spec.Embedder.Model, spec.Embedder.Dimensions); err != nil {
+		return err
+	}
+	if err := spam.SetMode(pre.Spam); err != nil {
+		return err
+	}
+	if err := system.SetMode(pre.System); err != nil {
+		return err
+	}
+	if err := sentiment.SetMode(pre.Sentiment); err != nil {
+		return err
+	}
+	if err := entities.SetMode(pre.Entities); err != nil {
+		return err
+	}
+	if err := timezone.Set(pre.Timezone); err != nil {
+		return err
+	}
+	if err := pinecone.SetMode(spec.Store.API); err != nil {
+		return err
+	}
+	redact.SetEnabled(pre.Redact)
+	if err := anonymize.Setup(pre.Anonymize); err != nil {
+		return err
+	}
+	embed.SetIncremental(pre.Incremental)
+
+	st, err := state.Load()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	var due []pipeline.Schedule
+
+	fmt.Println(i18n.T("apply.plan", specPath))
+	for _, source := range spec.Sources {
+		format := source.Parser
+		if format == "" {
+			format = i18n.T("apply.detected")
+		}
+		fmt.Println(i18n.T("apply.plan_source", source.Label(), format, spec.Store.Embeddings))
+	}
+	fmt.Println(i18n.T("apply.plan_upsert", spec.Store.Embeddings, indexName))
+	for _, schedule := range spec.Schedules {
+		last := st.Schedules[schedule.Action]
+		if !schedule.Due(last, now) {
+			fmt.Println(i18n.T("apply.plan_not_due", schedule.Action, last.Local().Format("2006-01-02 15:04"), schedule.Every))
+			continue
+		}
+		fmt.Println(i18n.T("apply.plan_due", schedule.Action, schedule.Every))
+		due = append(due, schedule)
+	}
+	if dryRun {
+		return nil
+	}
+
+	if remote.IsURL(spec.Store.Embeddings) {
+		lease, err := lock.Acquire(lockURL(spec.Store.Embeddings), lock.DefaultTTL, log)
+		if err != nil {
+			return err
+		}
+		ingestLease = lease
+		defer func() {
+			ingestLease = nil
+			if err := lease.Release(); err != nil {
+				log.Printf("Error releasing the lock on %s: %v", lockURL(spec.Store.Embeddings), err)
+			}
+		}()
+	}
+	embeddingsFileName, err := localCopy(spec.Store.Embeddings)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(embeddingsFileName), 0755); err != nil {
+		return err
+	}
+
+	// Ctrl-C stops embedding cleanly, keeping the rows written so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	for _, source := range spec.Sources {
+		if err := parser.SetColumnMapping(source.Columns, source.TimeLayout); err != nil {
+			return fmt.Errorf("%s: %w", source.Label(), err)
+		}
+		if err := embed.SetFormat(source.Parser); err != nil {
+			return fmt.Errorf("%s: %w", source.Label(), err)
+		}
+		if err := parser.SetDateOrder(source.DateOrder); err != nil {
+			return fmt.Errorf("%s: %w", source.Label(), err)
+		}
+		embed.SetNamespace(source.Namespace)
+		input, err := localCopy(source.Path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", source.Label(), err)
+		}
+		fmt.Println(i18n.T("apply.embedding", source.Label()))
+		if err := embed.AppendEmbeddings(ctx, input, "", embeddingsFileName, spec.Embedder.Model, log); err != nil {
+			return fmt.Errorf("%s: %w", source.Label(), err)
+		}
+	}
+	stop()
+	embed.SetNamespace("")
+	embed.SetFormat("")
+	parser.SetDateOrder("")
+	if err := publish(embeddingsFileName, spec.Store.Embeddings); err != nil {
+		return err
+	}
+
+	if err := upsert.GetOrCreatePineconeIndex(indexName, log); err != nil {
+		return err
+	}
+	if err := upsert.UpsertDataToPinecone(indexName, embeddingsFileName, log); err != nil {
+		return err
+	}
+
+	for _, schedule := range due {
+		switch schedule.Action {
+		case pipeline.ActionBackup:
+			err = backupIndex(spec.Store.BackupDir, log)
+		case pipeline.ActionArchive:
+			years := schedule.Years
+			if years == 0 {
+				years = archive.DefaultYears
+			}
+			err = archiveOldVectors(years, log)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", schedule.Action, err)
+		}
+		// Reloaded, embedding and upserting saved their own state meanwhile
+		if st, err = state.Load(); err != nil {
+			return err
+		}
+		st.Schedules[schedule.Action] = now
+		if err := st.Save(); err != nil {
+			return err
+		}
+	}
+	fmt.Println(i18n.T("apply.done", specPath))
+	return nil
+}
+
+// Applies the pipeline spec on its sync schedule until interrupted or terminated, so a chat that
+// is exported again and again stays searchable. The first sync runs at once, as does one missed
+// while the daemon wasn't running. A failed sync waits for the next one.
+func runDaemonCommand(args []string, log *log.Logger) error {
+	specPath := pipeline.DefaultPath
+	if len(args) > 0 {
+		specPath = args[0]
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	for {
+		// Read for every sync, so changes to the spec take effect without a restart
+		local, err := localCopy(specPath)
+		if err != nil {
+			return err
+		}
+		spec, err := pipeline.Load(local)
+		if err != nil {
+			return err
+		}
+		schedule, _ := cron.Parse(spec.Sync) // checked by Load
+		st, err := state.Load()
+		if err != nil {
+			return err
+		}
+		next := time.Now()
+		if last := st.Schedules[pipeline.ActionSync]; !last.IsZero() {
+			if next = schedule.Next(last.Local()); next.IsZero() {
+				return fmt.Errorf("the sync schedule %q never comes", spec.Sync)
+			}
+		}
+		if time.Until(next) > 0 {
+			fmt.Println(i18n.T("daemon.next", specPath, next.Format("2006-01-02 15:04"), spec.Sync))
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Until(next)):
+			}
+		}
+
+		started := time.Now().UTC()
+		fmt.Println(i18n.T("daemon.syncing", specPath))
+		notify.Begin(pipeline.ActionSync)
+		if err := runApplyCommand([]string{specPath}, false, log); err != nil {
+			metrics.RecordError(err)
+			notify.Fail(err)
+			fmt.Println(i18n.T("apply.error", err))
+			log.Printf("Error in the scheduled sync of %s: %v", specPath, err)
+		}
+		notify.Send(log)
+		if ctx.Err() != nil {
+			return nil
+		}
+		// Reloaded, apply saved its own state meanwhile
+		if st, err = state.Load(); err != nil {
+			return err
+		}
+		st.Schedules[pipeline.ActionSync] = started
+		if err := st.Save(); err != nil {
+			return err
+		}
+	}
+}
+
+// Embeds a watched export into the embeddings file and upserts the file. The rows are appended,
+// so every export keeps its own vector IDs.
+func ingestExport(path, source, embeddingsFileName, embeddingsPath string, log *log.Logger) error {
+	if err := embed.AppendEmbeddings(context.Background(), path, source, embeddingsFileName, embed.Model(), log); err != nil {
+		return err
+	}
+	if err := publish(embeddingsFileName, embeddingsPath); err != nil {
+		return err
+	}
+
+	// The export is embedded, a failed upsert is retried with the next export or the upsert action
+	if err := upsert.UpsertDataToPinecone(indexName, embeddingsFileName, log); err != nil {
+		metrics.RecordError(err)
+		fmt.Println(i18n.T("upsert.error", err))
+		log.Printf("Error upserting %s after watching %s: %v", embeddingsFileName, path, err)
+	}
+	return nil
+}
+
+// Lists the messages that are far from every topic of the chat, for review
+func printAnomalies(embeddingsFileName string, log *log.Logger) error {
+	rows, err := vectors.ReadFile(embeddingsFileName, log)
+	if err != nil {
+		return err
+	}
+
+	found := anomalies.Detect(rows)
+	fmt.Println(i18n.T("anomalies.found", len(found), len(rows)))
+	for _, anomaly := range found {
+		row := anomaly.Row
+		fmt.Printf("%s [%s] %s: %s (distance %.3f, %.1fσ)\n", row.ID, row.Timestamp.Format("2006-01-02 15:04"), anonymize.Reveal(row.Sender),
+			anonymize.Reveal(grapheme.Snippet(row.Text, suggestionSnippetChars)), anomaly.Distance, anomaly.Score)
+	}
+	return nil
+}
+
+// Prints the groups of near-identical messages of the embeddings file, and with remove forgets
+// all but the first of every group, once the user confirms or with --yes
+func reportDuplicates(reader *bufio.Reader, embeddingsFileName string, threshold float64, remove, yes bool, window time.Duration, log *log.Logger) error {
+	rows, err := vectors.ReadFile(embeddingsFileName, log)
+	if err != nil {
+		return err
+	}
+	groups := neardup.Find(rows, threshold)
+	if len(groups) == 0 {
+		fmt.Println(i18n.T("dedupe.none", len(rows), threshold))
+		return nil
+	}
+
+	duplicates := 0
+	for _, group := range groups {
+		duplicates += len(group.Duplicates())
+	}
+	fmt.Println(i18n.T("dedupe.found", len(groups), duplicates, len(rows)))
+	for i, group := range groups {
+		if i == maxDuplicateGroups {
+			fmt.Println(i18n.T("dedupe.more", len(groups)-i))
+			break
+		}
+		first, last := group.Rows[0], group.Rows[len(group.Rows)-1]
+		fmt.Println("\n" + i18n.T("dedupe.group", len(group.Rows), group.Kind, first.Timestamp.Format("2006-01-02"), last.Timestamp.Format("2006-01-02")))
+		fmt.Printf("  %s [%s] %s: %s\n", first.ID, first.Timestamp.Format("2006-01-02 15:04"), anonymize.Reveal(first.Sender), anonymize.Reveal(grapheme.Snippet(first.Text, suggestionSnippetChars)))
+	}
+	if !remove {
+		return nil
+	}
+
+	if !yes {
+		fmt.Print(i18n.T("dedupe.confirm", duplicates))
+		answer, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			fmt.Println(i18n.T("dedupe.kept"))
+			return nil
+		}
+	}
+	byNamespace := map[string][]string{}
+	for _, group := range groups {
+		for _, row := range group.Duplicates() {
+			byNamespace[row.Namespace] = append(byNamespace[row.Namespace], row.ID)
+		}
+	}
+	forgotten := 0
+	for namespace, ids := range byNamespace {
+		for start := 0; start < len(ids); start += forgetBatch {
+			n, err := forget.Soft(indexName, namespace, ids[start:min(start+forgetBatch, len(ids))], window, time.Now(), log)
+			forgotten += n
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if window == 0 {
+		fmt.Println(i18n.T("forget.deleted", forgotten))
+	} else {
+		fmt.Println(i18n.T("forget.forgotten", forgotten, time.Now().Add(window).Format("2006-01-02")))
+	}
+	return nil
+}
+
+// Projects the embeddings file to 2D and writes the plot, or its points for a .csv target
+func writeVisualization(embeddingsFileName, projection, target string, log *log.Logger) error {
+	rows, err := vectors.ReadFile(embeddingsFileName, log)
+	if err != nil {
+		return err
+	}
+	points, err := visualize.Project(rows, projection)
+	if err != nil {
+		return err
+	}
+	outputFileName, err := outputPath(target)
+	if err != nil {
+		return err
+	}
+	written := "visualize.written"
+	if strings.EqualFold(filepath.Ext(outputFileName), ".csv") {
+		err = visualize.WriteCSV(outputFileName, points)
+		written = "visualize.points"
+	} else {
+		err = visualize.WriteHTML(outputFileName, points)
+	}
+	if err == nil {
+		err = publish(outputFileName, target)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(i18n.T(written, len(rows), target))
+	return nil
+}
+
+// Clusters the messages of the embeddings file, the index or an export file into topics and
+// writes the markdown report of them to target
+func writeTopicReport(embeddingsFileName, from, namespace string, k int, label bool, target string, log *log.Logger) error {
+	var rows []vectors.Row
+	var err error
+	switch from {
+	case "":
+		rows, err = vectors.ReadFile(embeddingsFileName, log)
+	case "index":
+		rows, err = backup.Rows(indexName, namespace, log)
+	default:
+		rows, err = backup.ReadExport(from)
+	}
+	if err != nil {
+		return err
+	}
+	// Summaries are of the messages, not more of them
+	messages := rows[:0]
+	for _, row := range rows {
+		if row.Namespace != conversations.Namespace || namespace == conversations.Namespace {
+			messages = append(messages, row)
+		}
+	}
+	rows = messages
+	if len(rows) == 0 {
+		return fmt.Errorf("no messages to cluster")
+	}
+
+	found := topics.Find(rows, k)
+	if label {
+		fmt.Println(i18n.T("cluster.labeling", len(found)))
+		if err := topics.Label(found, log); err != nil {
+			return err
+		}
+	}
+	outputFileName, err := outputPath(target)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(outputFileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := topics.WriteReport(file, found, len(rows)); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := publish(outputFileName, target); err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("cluster.written", len(rows), len(found), target))
+	return nil
+}
+
+// Writes the k-nearest-neighbor graph of the embeddings file as GraphML, or JSON for a .json path
+func writeNeighborGraph(embeddingsFileName, target string, log *log.Logger) error {
+	rows, err := vectors.ReadFile(embeddingsFileName, log)
+	if err != nil {
+		return err
+	}
+	edges := knn.Graph(rows, graphNeighbors)
+	outputFileName, err := outputPath(target)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(outputFileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(outputFileName), ".json") {
+		err = knn.WriteJSON(file, rows, edges)
+	} else {
+		err = knn.WriteGraphML(file, rows, edges)
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err == nil {
+		err = publish(outputFileName, target)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("graph.written", len(rows), len(edges), target))
+	return nil
+}
+
+// Prints the name, dimension, metric and status of every index in the Pinecone project
+func printIndexes() error {
+	indexes, err := pinecone.ListIndexes()
+	if err != nil {
+		return err
+	}
+	if len(indexes) == 0 {
+		fmt.Println(i18n.T("indexes.none"))
+		return nil
+	}
+	for _, index := range indexes {
+		fmt.Println(i18n.T("indexes.entry", index.Name, index.Dimension, index.Metric, index.Status.State))
+	}
+	return nil
+}
+
+// Prints the chat index's configuration and vector counts, and whether the embeddings file fits it
+func printIndexDescription(embeddingsFileName string) error {
+	index, err := pinecone.DescribeIndex(indexName)
+	if errors.Is(err, pinecone.ErrIndexNotFound) {
+		fmt.Println(i18n.T("describe_index.missing", indexName))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("describe_index.config", index.Name, index.Dimension, index.Metric, index.Status.State))
+	if index.Host != "" {
+		fmt.Println(i18n.T("describe_index.host", index.Host))
+	}
+
+	if err := printIndexStats(); err != nil {
+		fmt.Println(i18n.T("describe_index.error", err))
+	}
+
+	if err := upsert.ValidateIndex(indexName, embeddingsFileName); err != nil {
+		fmt.Println(i18n.T("describe_index.invalid", err))
+	} else {
+		fmt.Println(i18n.T("describe_index.valid", embeddingsFileName))
+	}
+	return nil
+}
+
+// Prints the number of vectors in the chat index and in each of its namespaces
+func printIndexStats() error {
+	stats, err := pinecone.DescribeIndexStats(indexName)
+	if err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("describe_index.vectors", stats.TotalVectorCount))
+	for namespace, ns := range stats.Namespaces {
+		if namespace == "" {
+			namespace = i18n.T("describe_index.default_namespace")
+		}
+		fmt.Println(i18n.T("describe_index.namespace", namespace, ns.VectorCount))
+	}
+	return nil
+}
+
+// Prints the counts of the export's messages: per sender, month and hour, their length and
+// the media among them, without embedding anything
+func printChatStats(inputFileName, source string, log *log.Logger) error {
+	messages, unparsed, err := embed.ReadExport(inputFileName, source, log)
+	if err != nil {
+		return err
+	}
+	return chatstats.Write(os.Stdout, chatstats.Compute(messages, unparsed))
+}
+
+// Prints the doctor's checklist, and whether it's safe to go on
+func printDoctorChecks(inputFileName, embeddingsFileName string) bool {
+	checks := doctor.Run(indexName, embed.Model(), inputFileName, embeddingsFileName)
+	for _, check := range checks {
+		switch {
+		case check.Err != nil:
+			fmt.Println(i18n.T("doctor.fail", check.Name, check.Err))
+		case check.Detail != "":
+			fmt.Println(i18n.T("doctor.pass_detail", check.Name, check.Detail))
+		default:
+			fmt.Println(i18n.T("doctor.pass", check.Name))
+		}
+	}
+	if !doctor.Passed(checks) {
+		fmt.Println(i18n.T("doctor.failed"))
+		return false
+	}
+	fmt.Println(i18n.T("doctor.passed"))
+	return true
+}
+
+// The filter of the messages embed reads, from --include-regex, --exclude-regex, --min-length,
+// --sender, --since and --until. Dates are whole days in UTC, like the timestamps.
+func embedFilter(include, exclude string, minLength int, senders, since, until string) (embed.Filter, error) {
+	f := embed.Filter{MinLength: minLength}
+	var err error
+	if include != "" {
+		if f.Include, err = regexp.Compile(include); err != nil {
+			return f, fmt.Errorf("--include-regex: %w", err)
+		}
+	}
+	if exclude != "" {
+		if f.Exclude, err = regexp.Compile(exclude); err != nil {
+			return f, fmt.Errorf("--exclude-regex: %w", err)
+		}
+	}
+	for _, sender := range strings.Split(senders, ",") {
+		if sender = strings.TrimSpace(sender); sender != "" {
+			f.Senders = append(f.Senders, sender)
+		}
+	}
+	if since != "" {
+		if f.Since, err = timezone.ParseDate(since); err != nil {
+			return f, fmt.Errorf("--since %q isn't a YYYY-MM-DD date", since)
+		}
+	}
+	if until != "" {
+		day, err := timezone.ParseDate(until)
+		if err != nil {
+			return f, fmt.Errorf("--until %q isn't a YYYY-MM-DD date", until)
+		}
+		f.Until = day.AddDate(0, 0, 1)
+	}
+	if !f.Since.IsZero() && !f.Until.IsZero() && !f.Since.Before(f.Until) {
+		return f, fmt.Errorf("--since %s is after --until %s", since, until)
+	}
+	return f, nil
+}
+
+// The chat the usage of a run is booked to: the profile, or without one the file name of
+// the chat export
+func chatName(profileName, source, input string) string {
+	switch {
+	case profileName != "":
+		return profileName
+	case input != "":
+		return filepath.Base(input)
+	case source == parser.SourceTelegram:
+		return telegramExportName
+	}
+	return filepath.Base(chatFilePath)
+}
+
+// Prints what the runs in the usage ledger used and cost, by action and by chat
+func printUsage() error {
+	entries, err := usage.Load()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println(i18n.T("usage.none"))
+		return nil
+	}
+	for _, by := range []struct {
+		title string
+		key   func(usage.Entry) string
+	}{
+		{i18n.T("usage.by_action"), func(e usage.Entry) string { return e.Action }},
+		{i18n.T("usage.by_chat"), func(e usage.Entry) string { return e.Chat }},
+	} {
+		fmt.Println(by.title)
+		for _, total := range usage.Totals(entries, by.key) {
+			printUsageTotal(total)
+		}
+		fmt.Println()
+	}
+	all := usage.Totals(entries, func(usage.Entry) string { return i18n.T("usage.all") })
+	printUsageTotal(all[0])
+	fmt.Println(i18n.T("usage.since", entries[0].Time.Local().Format("2006-01-02")))
+	return nil
+}
+
+func printUsageTotal(total usage.Total) {
+	elapsed := time.Duration(total.Seconds * float64(time.Second)).Round(time.Second)
+	fmt.Println(i18n.T("usage.row", total.Key, total.Runs, total.OpenAIRequests, total.Tokens(),
+		total.PineconeRequests, total.ReadUnits, total.WriteUnits, elapsed, total.Cost))
+}
+
+// Snapshots the chat index: to a directory of files in backupDir, a local directory or a
+// bucket, with the current API, to a collection with the legacy one
+func backupIndex(backupDir string, log *log.Logger) error {
+	now := time.Now().UTC()
+	if pinecone.Mode() == pinecone.ModeLegacy {
+		name, err := backup.ToCollection(indexName, now)
+		if err != nil {
+			return err
+		}
+		fmt.Println(i18n.T("backup.collection", indexName, name))
+		return nil
+	}
+
+	target := joinPath(backupDir, backup.Name(indexName, now))
+	dir, err := outputPath(target)
+	if err != nil {
+		return err
+	}
+	n, err := backup.ToDir(indexName, dir, log)
+	if err != nil {
+		return err
+	}
+	if remote.IsURL(target) {
+		if err := publishDir(dir, target, backup.ManifestName); err != nil {
+			return err
+		}
+	}
+	fmt.Println(i18n.T("backup.written", n, indexName, target))
+	return nil
+}
+
+// Asks for a backup directory (a collection with the legacy API) and the index to restore it to
+func promptUserAndRestore(reader *bufio.Reader, workers int, log *log.Logger) error {
+	fmt.Print(i18n.T("restore.source_prompt"))
+	source, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	source = strings.TrimSpace(source)
+	if source == "" {
+		return fmt.Errorf("no backup given")
+	}
+	fmt.Print(i18n.T("restore.index_prompt", indexName))
+	target, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if target = strings.TrimSpace(target); target == "" {
+		target = indexName
+	}
+
+	if pinecone.Mode() == pinecone.ModeLegacy {
+		if err := backup.FromCollection(source, target, upsert.Metric()); err != nil {
+			return err
+		}
+		fmt.Println(i18n.T("restore.collection", source, target))
+		return nil
+	}
+
+	dir, err := localDir(source)
+	if err != nil {
+		return err
+	}
+	n, err := backup.FromDir(dir, target, workers, log)
+	if err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("restore.done", n, source, target))
+	return nil
+}
+
+// Asks for a backup directory and checks its shards against the manifest
+func promptUserAndVerify(reader *bufio.Reader) error {
+	fmt.Print(i18n.T("verify.prompt"))
+	dir, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	local, err := localDir(strings.TrimSpace(dir))
+	if err != nil {
+		return err
+	}
+	manifest, err := backup.Verify(local)
+	if err != nil {
+		return err
+	}
+	vectors := 0
+	for _, shard := range manifest.Shards {
+		vectors += shard.Vectors
+	}
+	fmt.Println(i18n.T("verify.ok", len(manifest.Shards), vectors, manifest.Index, manifest.Created.Format("2006-01-02 15:04")))
+	return nil
+}
+
+// Moves the vectors of messages older than the given number of years from the index to its archive file
+func archiveOldVectors(years int, log *log.Logger) error {
+	if years <= 0 {
+		return fmt.Errorf("--archive-after must be at least 1 year")
+	}
+	cutoff := time.Now().AddDate(-years, 0, 0)
+	n, err := archive.Move(indexName, cutoff, log)
+	if err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("archive.moved", n, cutoff.Format("2006-01-02"), archive.Path(indexName)))
+	return nil
+}
+
+// Asks for the IDs of messages to hide from searches, after deleting the ones whose restore window passed
+func promptUserAndForget(reader *bufio.Reader, namespace string, window time.Duration, log *log.Logger) error {
+	if n, err := forget.Purge(indexName, window, time.Now()); err != nil {
+		log.Printf("Error purging expired forgotten messages: %v", err)
+	} else if n > 0 {
+		fmt.Println(i18n.T("forget.purged", n))
+	}
+
+	fmt.Print(i18n.T("forget.prompt"))
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	ids := strings.FieldsFunc(line, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+	if len(ids) == 0 {
+		return fmt.Errorf("no IDs given")
+	}
+
+	n, err := forget.Soft(indexName, namespace, ids, window, time.Now(), log)
+	if err != nil {
+		return err
+	}
+	if window == 0 {
+		fmt.Println(i18n.T("forget.deleted", n))
+	} else {
+		fmt.Println(i18n.T("forget.forgotten", n, time.Now().Add(window).Format("2006-01-02")))
+	}
+	return nil
+}
+
+// Asks which index to delete, defaulting to the chat index, and deletes it once the user
+// types its name again. --yes skips the confirmation.
+func promptUserAndDeleteIndex(reader *bufio.Reader, yes bool, log *log.Logger) error {
+	fmt.Print(i18n.T("delete_index.prompt", indexName))
+	name, err := reader.ReadString('\n')
+	if err != nil {
+		log.Printf("Error reading user input: %v", err)
+		return err
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = indexName
+	}
+
+	if !yes {
+		fmt.Print(i18n.T("delete_index.confirm", name))
+		confirmation, err := reader.ReadString('\n')
+		if err != nil {
+			log.Printf("Error reading user input: %v", err)
+			return err
+		}
+		if strings.TrimSpace(confirmation) != name {
+			fmt.Println(i18n.T("delete_index.cancelled"))
+			return nil
+		}
+	}
+
+	if err := pinecone.DeleteIndex(name); err != nil {
+		if errors.Is(err, pinecone.ErrIndexNotFound) {
+			return fmt.Errorf("there is no index named %s", name)
+		}
+		return err
+	}
+	// Its messages aren't upserted anymore, upserting them again to a new index of the name puts them back
+	if _, err := dedup.Forget(name, func(namespace, hash string) bool { return true }); err != nil {
+		log.Printf("Error removing %s from the content hash ledger: %v", name, err)
+	}
+	fmt.Println(i18n.T("delete_index.deleted", name))
+	return nil
+}
+
+// The local file to read for path: path itself, or the downloaded copy of an s3:// or gs:// object
+func localCopy(path string) (string, error) {
+	if !remote.IsURL(path) {
+		return path, nil
+	}
+	return remote.Fetch(path)
+}
+
+// The local directory to read for path, downloaded first if it's an s3:// or gs:// URL
+func localDir(path string) (string, error) {
+	if !remote.IsURL(path) {
+		return path, nil
+	}
+	return remote.FetchDir(path)
+}
+
+// Where to write a file or directory meant for path: path itself, or for an s3:// or gs://
+// URL its local copy, to be uploaded by publish or publishDir when it's done
+func outputPath(path string) (string, error) {
+	if !remote.IsURL(path) {
+		return path, nil
+	}
+	local, err := remote.LocalPath(path)
+	if err != nil {
+		return "", err
+	}
+	return local, os.MkdirAll(filepath.Dir(local), 0755)
+}
+
+// Embeds the messages piped to stdin into the embeddings file as they come, and with upsert
+// puts each batch in the index once it is written. Ctrl-C stops it, keeping what was written.
+func streamStdin(upserts bool, embeddingsFileName, embeddingsPath string, log *log.Logger) error {
+	var written func(records [][]string) error
+	if upserts {
+		if err := upsert.GetOrCreatePineconeIndex(indexName, log); err != nil {
+			return err
+		}
+		streamer, err := upsert.NewStreamer(indexName, log)
+		if err != nil {
+			return err
+		}
+		defer streamer.Close()
+		written = streamer.Upsert
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	fmt.Println(i18n.T("embed.stream_reading"))
+	err := embed.Stream(ctx, os.Stdin, embeddingsFileName, embed.Model(), written, log)
+	if errors.Is(err, context.Canceled) {
+		err = nil
+	}
+	if publishErr := publish(embeddingsFileName, embeddingsPath); err == nil {
+		err = publishErr
+	}
+	return err
+}
+
+// Uploads the file written to local when path is an s3:// or gs:// URL, unless the lease on
+// the embeddings file was lost meanwhile: the machine holding it now may have uploaded changes
+// this run doesn't have, and anything it wrote since could be overwritten
+func publish(local, path string) error {
+	if !remote.IsURL(path) {
+		return nil
+	}
+	if err := checkLease(path); err != nil {
+		return err
+	}
+	return remote.Put(local, path)
+}
+
+// Uploads the directory as publish does a file, last the file named last, if any
+func publishDir(dir, target, last string) error {
+	if err := checkLease(target); err != nil {
+		return err
+	}
+	return remote.PutDir(dir, target, last)
+}
+
+func checkLease(path string) error {
+	if ingestLease != nil && !ingestLease.Held() {
+		return fmt.Errorf("%w, not uploading %s over its changes", lock.ErrLost, path)
+	}
+	return nil
+}
+
+// A name in a local directory or under a bucket URL, which filepath.Join would mangle
+func joinPath(dir, name string) string {
+	if remote.IsURL(dir) {
+		return strings.TrimRight(dir, "/") + "/" + name
+	}
+	return filepath.Join(dir, name)
+}
+
+// The lock object of the index, next to an s3:// or gs:// embeddings file
+func lockURL(embeddingsPath string) string {
+	return embeddingsPath[:strings.LastIndex(embeddingsPath, "/")] + "/" + indexName + ".lock"
+}
+
+// Asks for the encryption passphrase. Read a byte at a time, so nothing meant for the action
+// prompt is buffered away.
+func readPassphrase() (string, error) {
+	fmt.Print(i18n.T("encrypt.passphrase_prompt", secure.KeyEnv))
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(b)
+		if n == 1 && b[0] != '\n' {
+			line = append(line, b[0])
+		}
+		if (n == 1 && b[0] == '\n') || err == io.EOF {
+			return strings.TrimSpace(string(line)), nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// A transcript for the session when --record is set, nil otherwise
+func newTranscript(record bool, mode string) *sessions.Session {
+	if !record {
+		return nil
+	}
+	return sessions.New(mode)
+}
+
+// Handles "sessions list" and "sessions show [id]", showing the latest session without an id
+func runSessionsCommand(args []string) error {
+	ids, err := sessions.List()
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 || args[0] == "list" {
+		if len(ids) == 0 {
+			fmt.Println(i18n.T("sessions.none"))
+		}
+		for _, id := range ids {
+			session, err := sessions.Load(id)
+			if err != nil {
+				return err
+			}
+			fmt.Println(i18n.T("sessions.entry", id, session.Mode, len(session.Entries)))
+		}
+		return nil
+	}
+
+	if args[0] != "show" {
+		return fmt.Errorf("unknown sessions command %q, use list or show", args[0])
+	}
+	id := ""
+	if len(args) > 1 {
+		id = args[1]
+	} else if len(ids) > 0 {
+		id = ids[len(ids)-1]
+	}
+	if id == "" {
+		fmt.Println(i18n.T("sessions.none"))
+		return nil
+	}
+
+	session, err := sessions.Load(id)
+	if err != nil {
+		return err
+	}
+	fmt.Print(session.Format())
+	return nil
+}
+
+// Asks for a date range and output file, then summarizes the matching messages
+func promptUserAndSummarize(reader *bufio.Reader, inputFileName, source string, log *log.Logger) error {
+	fmt.Print(i18n.T("summarize.from_prompt"))
+	fromStr, _ := reader.ReadString('\n')
+	fmt.Print(i18n.T("summarize.to_prompt"))
+	toStr, _ := reader.ReadString('\n')
+	fmt.Print(i18n.T("summarize.file_prompt"))
+	outputFileName, _ := reader.ReadString('\n')
+	outputFileName = strings.TrimSpace(outputFileName)
+
+	var from, to time.Time
+	var err error
+	if fromStr = strings.TrimSpace(fromStr); fromStr != "" {
+		if from, err = timezone.ParseDate(fromStr); err != nil {
+			return fmt.Errorf("invalid from date: %v", err)
+		}
+	}
+	if toStr = strings.TrimSpace(toStr); toStr != "" {
+		if to, err = timezone.ParseDate(toStr); err != nil {
+			return fmt.Errorf("invalid until date: %v", err)
+		}
+		to = to.AddDate(0, 0, 1).Add(-time.Second) // include the whole last day, however long
+	}
+
+	messages, err := embed.ReadMessages(inputFileName, source, log)
+	if err != nil {
+		log.Printf("Error reading messages to summarize: %v", err)
+		return err
+	}
+	messages = summarize.FilterByDate(messages, from, to)
+	fmt.Println(i18n.T("summarize.count", len(messages)))
+
+	summary, err := summarize.Summarize(messages, log)
+	if err != nil {
+		return err
+	}
+	summary = anonymize.Reveal(summary)
+
+	if outputFileName == "" {
+		fmt.Println(summary)
+		return nil
+	}
+	if err := os.WriteFile(outputFileName, []byte(summary+"\n"), 0644); err != nil {
+		log.Printf("Error writing summary file: %v", err)
+		return err
+	}
+	fmt.Println(i18n.T("summarize.written", outputFileName))
+	return nil
+}
+
+func main() {
+	flags := pflag.NewFlagSet(progName, pflag.ContinueOnError)
+	source := flags.String("source", "", "chat app of the export: whatsapp, telegram, signal, discord, slack, imessage or generic (default: detected from the export)")
+	format := flags.String("format", "", "parser of the export instead of the detected one: "+strings.Join(parser.Names(), ", "))
+	timezoneName := flags.String("timezone", "", "IANA zone the clocks of the exports were in, e.g. Europe/London, to store their times as UTC (default: read as UTC)")
+	dateOrder := flags.String("date-order", parser.DateOrderAuto, "order of day, month and year in WhatsApp timestamps: auto, dmy, mdy or ymd")
+	columns := flags.String("columns", "", "for --source generic: field=column pairs, e.g. text=body,sender=author,timestamp=created_at,id=msg_id")
+	timeLayout := flags.String("time-layout", "", "for --source generic: Go layout of the timestamp column (default: unix times and common formats)")
+	language := flags.String("lang", "", "only search messages in this language: he, en, ar or ru (default: all)")
+	mentions := flags.String("mentions", "", "only search messages mentioning this person, place or organization, found at upsert with --entities (default: all)")
+	tone := flags.String("tone", "", "only search messages of this tone, scored at upsert with --sentiment: positive, neutral, negative or angry (default: all)")
+	namespace := flags.String("namespace", "", "Pinecone namespace to query, e.g. a Discord or Slack channel (default: the default namespace)")
+	input := flags.String("input", "", "chat export to read, instead of ./chat_files/chat.txt (a local path or an s3:// or gs:// URL), or - to embed messages piped to stdin")
+	embeddingsPath := flags.String("embeddings", embeddingsCSVPath, "embeddings file, a local path or an s3:// or gs:// URL; .jsonl for JSON lines, .gz to gzip it")
+	backupDir := flags.String("backup-dir", backup.Dir, "where backup writes its directories, a local directory or an s3:// or gs:// URL")
+	locale := flags.String("locale", "", "language of the CLI messages: en or he (default from $LANG)")
+	bidiMode := flags.String("bidi", rtl.ModeIsolate, "how Hebrew results are printed: isolate (terminal does bidi), visual (terminal prints left to right) or off")
+	watchDir := flags.String("watch-dir", "./inbox", "folder the watch action ingests new exports from")
+	botApp := flags.String("bot-app", bot.AppTelegram, "the app the bot action answers in: telegram, or whatsapp through Twilio")
+	botUsers := flags.String("bot-users", "", "comma separated Telegram user IDs or usernames, or WhatsApp phone numbers, the bot answers; it tells everyone else their ID or number")
+	graphOut := flags.String("graph-out", "./knn_graph.graphml", "file the graph action writes, GraphML or JSON by its extension, may be an s3:// or gs:// URL")
+	paraphrase := flags.Bool("paraphrase", false, "for the benchmark command: also have OpenAI reword every message")
+	digestOn := flags.Bool("digest", false, "in watch mode, send a weekly digest of the newly ingested messages, see FINCHAT_DIGEST_* in the README")
+	incremental := flags.Bool("incremental", false, "only embed messages newer than the previous run over the same chat")
+	record := flags.Bool("record", false, "save a transcript of query and ask sessions in ./sessions")
+	retryFailed := flags.Bool("retry-failed", false, "for upsert: only upsert again the rows that failed in the previous run, listed in "+upsert.FailedPath)
+	dryRun := flags.Bool("dry-run", false, "for upsert: validate the embeddings file and count the vectors per namespace, without sending anything; for apply: only print the plan")
+	restoreWorkers := flags.Int("restore-workers", backup.DefaultWorkers, "parallel upserts when restoring a backup")
+	restoreWindow := flags.Duration("restore-window", forget.DefaultRestoreWindow, "how long messages hidden with forget can be restored before they are deleted from the index, 0 deletes at once")
+	projection := flags.String("projection", visualize.ProjectionPCA, "for visualize: how the embeddings are projected to 2D, pca or tsne (slower, keeps topics apart)")
+	visualizeOut := flags.String("visualize-out", "./visualization.html", "file the visualize action writes: an HTML plot, or .csv for the points (x, y, sender, date, text, cluster), may be an s3:// or gs:// URL")
+	clusters := flags.Int("clusters", 0, "for cluster: how many topics to group the messages into (default: the square root of half the messages, at most 30)")
+	clusterFrom := flags.String("cluster-from", "", "for cluster: \"index\" to cluster the vectors of the index (of --namespace if given), or an export file written with --export-values (default: the embeddings file)")
+	labelTopics := flags.Bool("label-topics", false, "for cluster: name every topic with the chat model")
+	topicsOut := flags.String("topics-out", "./topics.md", "file the cluster action writes its markdown report to, may be an s3:// or gs:// URL")
+	exportOut := flags.String("export-out", "./export.jsonl", "file the export action writes, may be an s3:// or gs:// URL")
+	exportValues := flags.Bool("export-values", false, "for export: include the embedding values, not just IDs and metadata")
+	yes := flags.Bool("yes", false, "don't ask before deleting an index with index delete, or duplicates with dedupe-report --delete-duplicates")
+	dedupeThreshold := flags.Float64("dedupe-threshold", neardup.DefaultThreshold, "for dedupe-report: the cosine similarity from which messages count as copies of each other")
+	deleteDuplicates := flags.Bool("delete-duplicates", false, "for dedupe-report: forget every message of a group but the first sent, restorable for --restore-window")
+	spamMode := flags.String("spam", spam.ModeOff, "promotional, bot and notification messages: off, tag (tag at upsert, leave out of searches) or skip (don't embed)")
+	localStats := flags.Bool("local", false, "for stats: count the messages of the export instead of the vectors of the index")
+	includeRegex := flags.String("include-regex", "", "for embed: only embed messages whose text matches this regular expression, e.g. (?i)rent|landlord")
+	excludeRegex := flags.String("exclude-regex", "", "for embed: don't embed messages whose text matches this regular expression")
+	minLength := flags.Int("min-length", 0, "for embed: don't embed messages shorter than this many characters, e.g. 10 to skip \"ok\" and \"thanks\"")
+	senders := flags.String("sender", "", "for embed: only embed the messages of these senders, comma separated")
+	since := flags.String("since", "", "for embed: only embed messages sent on or after this date, YYYY-MM-DD")
+	until := flags.String("until", "", "for embed: only embed messages sent on or before this date, YYYY-MM-DD")
+	systemMode := flags.String("system-messages", system.ModeSkip, "media placeholders like <Media omitted> and app messages like \"joined using this group's invite link\": skip (don't embed), tag (tag at upsert, leave out of searches) or keep")
+	entitiesMode := flags.String("entities", entities.ModeOff, "find the people, places and organizations every message mentions at upsert, stored as metadata for --mentions: off, local (capitalized names and known places) or llm (OpenAI's chat model)")
+	sentimentMode := flags.String("sentiment", sentiment.ModeOff, "score the sentiment of every message at upsert, stored as metadata for --tone: off, local (word lists) or llm (OpenAI's chat model)")
+	archiveYears := flags.Int("archive-after", archive.DefaultYears, "for archive: move the vectors of messages older than this many years to ./cold_storage")
+	includeArchive := flags.Bool("include-archive", false, "also search the vectors moved to ./cold_storage by the archive action")
+	summaries := flags.String("summaries", conversations.Off, "after upsert, also upsert a summary of every day, week or conversation of the chat to the "+conversations.Namespace+" namespace: off, day, week or conversation")
+	repliesMode := flags.String("replies", embed.RepliesLink, "replies in exports that don't mark them, e.g. WhatsApp's: link (a message starting with a quote of an earlier one replies to it), quote (and is embedded with it) or off")
+	emojiMode := flags.String("emoji", emoji.ModeKeep, "emoji in embedded messages and queries: keep, strip (emoji-only messages aren't embedded) or describe (🎂 becomes :birthday cake:)")
+	model := flags.String("embedding-model", embeddingModel, "OpenAI model that embeds messages and queries: text-embedding-ada-002, text-embedding-3-small or text-embedding-3-large")
+	dimensions := flags.Int("dimensions", 0, "keep only this many dimensions of text-embedding-3 embeddings, e.g. 256 or 512, for a smaller index (0 keeps them all)")
+	metric := flags.String("metric", upsert.MetricCosine, "distance metric of the index: cosine, dotproduct or euclidean; new indexes are created with it")
+	normalize := flags.Bool("normalize", false, "scale vectors to length 1 before they are upserted or queried, as a dotproduct index needs")
+	vectorEncoding := flags.String("vector-encoding", vectors.EncodingDecimal, "how embed writes embedding values: decimal or float32 (base64, about half the size)")
+	vectorDecimals := flags.Int("vector-decimals", vectors.DefaultDecimals, "decimals of every value with --vector-encoding decimal")
+	keySource := flags.String("keys", "", "where the OpenAI and Pinecone API keys are read from: env, keychain, aws:<secret id> or gcp:<project>/<secret> (default: the environment, then the keychain)")
+	encryptOn := flags.Bool("encrypt", false, "encrypt the embeddings file, transcripts, state and cold storage written on this machine, with the passphrase in FINCHAT_ENCRYPTION_KEY or asked for")
+	anonymizeOn := flags.Bool("anonymize", false, "replace sender names with Person A, Person B... before embedding, the real names are kept in ./pseudonyms.enc, see the README")
+	redactOn := flags.Bool("redact", false, "mask phone numbers, emails, card numbers and links in everything sent to OpenAI and Pinecone, the originals stay in the local files")
+	asOf := flags.String("as-of", "", "search the archive as it was at the end of this date, YYYY-MM-DD: only messages ingested by then")
+	cacheTTL := flags.Duration("cache-ttl", 0, "reuse the results of a repeated search for this long, e.g. 10m, without embedding the query or asking Pinecone again (default: off)")
+	expand := flags.Int("expand", 0, "also search this many paraphrases of every query, written by OpenAI's chat model, and its translations into the other languages of the matches")
+	hyde := flags.Bool("hyde", false, "search with a chat message OpenAI's chat model writes to answer the query, rather than the query itself, which finds more for questions")
+	keywordFallback := flags.Float64("keyword-fallback", 0, "when no search result scores this (e.g. 0.8), also search the embeddings file for the query's words, to find names and phone numbers; 0 is off")
+	explain := flags.Bool("explain", false, "print how the ranking stages scored each query result")
+	rankingConfig := flags.String("ranking", ranking.DefaultConfigPath, "JSON file with the search ranking pipelines, see the README")
+	pineconeAPI := flags.String("pinecone-api", pinecone.ModeCurrent, "Pinecone API to talk to: current (serverless, api.pinecone.io) or legacy (old gcp-starter projects)")
+	pineconeEnv := flags.String("pinecone-env", pinecone.DefaultEnvironment, "Pinecone environment, e.g. us-east1-gcp: the project's with --pinecone-api legacy, or the one --pod-type indexes are created in")
+	pineconeCloud := flags.String("pinecone-cloud", pinecone.DefaultCloud, "cloud upsert creates serverless indexes in: aws, gcp or azure")
+	pineconeRegion := flags.String("pinecone-region", pinecone.DefaultRegion, "region upsert creates serverless indexes in, e.g. us-east-1, us-central1 or eastus2")
+	podType := flags.String("pod-type", "", "have upsert create a pod-based index of this pod type, e.g. p1.x1, instead of a serverless one (default: serverless, or the environment's pods with --pinecone-api legacy)")
+	replicas := flags.Int("replicas", 1, "replicas of the pod-based index upsert creates")
+	caBundle := flags.String("ca-bundle", "", "PEM file of CAs to trust on top of the system's, e.g. a corporate proxy's")
+	clientCert := flags.String("client-cert", "", "PEM client certificate for backends that require mutual TLS, with its key unless --client-key is given")
+	clientKey := flags.String("client-key", "", "PEM key of --client-cert")
+	insecureLocal := flags.Bool("insecure-local", false, "don't verify TLS certificates of servers on localhost, for local development; others are always verified")
+	profileName := flags.String("profile", "", "named profile of "+profile.DefaultPath+" to use: its index, namespace, keys and files (default: the file's default)")
+	chatFlag := flags.String("chat", "", "registered chat of "+chats.DefaultPath+" to use: its index, namespace and embeddings file")
+	chatPolicy := flags.String("chat-policy", chats.PolicyIndex, "where chats add puts a chat: index (an index of its own) or namespace (a namespace of the index)")
+	indexFlag := flags.String("index", "", "Pinecone index to use, over the profile's and the chat's (default: "+defaultIndexName+")")
+	tenantRole := flags.String("role", tenants.RoleRead, "what the key of tenants add may do: read (search), or ingest or delete for the endpoints that will write")
+	listenAddr := flags.String("addr", serverAddr, "address serve listens on, e.g. :8080 for every interface, as in a container")
+	logPath := flags.String("log", errLogPath, "file errors and warnings are appended to, or - for stderr, e.g. in a container")
+	if err := cli.FromEnv(flags, flagEnv); err != nil {
+		fmt.Println(err)
+		return
+	}
+	// Cobra parses the command line and answers help and completion, the command given is run below
+	var args []string
+	root := cli.New(progName, summary, commands, flags, func(given []string) { args = given })
+	if err := root.Execute(); err != nil || args == nil {
+		return
+	}
+	actions, unknown := actionsOf(args)
+	if unknown != "" && !runsAlone[args[0]] && !portableArchive(args) {
+		fmt.Println(i18n.T("action.unknown", unknown, progName))
+		return
+	}
+
+	// The profile fills in what the command line doesn't give
+	prof, name, err := profile.Load(profile.DefaultPath, *profileName)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	given := map[string]bool{}
+	flags.VisitAll(func(f *pflag.Flag) { given[f.Name] = f.Changed })
+	for flagName, value := range map[string]string{
+		"namespace": prof.Namespace, "pinecone-api": prof.PineconeAPI, "keys": prof.Keys,
+		"source": prof.Source, "input": prof.Input, "embeddings": prof.Embeddings,
+		"pinecone-env": prof.PineconeEnv, "pinecone-cloud": prof.PineconeCloud, "pinecone-region": prof.PineconeRegion,
+		"pod-type": prof.PodType,
+	} {
+		if value != "" && !given[flagName] {
+			flags.Set(flagName, value)
+		}
+	}
+	if prof.Index != "" {
+		indexName = prof.Index
+	}
+	if prof.Replicas != 0 && !given["replicas"] {
+		flags.Set("replicas", strconv.Itoa(prof.Replicas))
+	}
+	embed.SetNamespace(prof.Namespace)
+	secrets.SetProfile(name)
+
+	// A registered chat routes to its index and namespace, over the profile's
+	if *chatFlag != "" {
+		registry, err := chats.Load(chats.DefaultPath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		chat, err := registry.Lookup(*chatFlag)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		indexName = chat.Index
+		for flagName, value := range map[string]string{"namespace": chat.Namespace, "embeddings": chat.Embeddings} {
+			if value != "" && !given[flagName] {
+				flags.Set(flagName, value)
+			}
+		}
+		if chat.Namespace != "" {
+			embed.SetNamespace(chat.Namespace)
+		}
+	}
+	if *indexFlag != "" {
+		indexName = *indexFlag
+	}
+	embed.SetIndex(indexName)
+
+	if err := i18n.SetLocale(*locale); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := httpclient.Configure(httpclient.TLSOptions{CAFile: *caBundle, CertFile: *clientCert, KeyFile: *clientKey, InsecureLocal: *insecureLocal}); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := secrets.SetSource(*keySource); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := secure.Setup(*encryptOn, readPassphrase); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := parser.SetColumnMapping(*columns, *timeLayout); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := embed.SetFormat(*format); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := parser.SetDateOrder(*dateOrder); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := timezone.Set(*timezoneName); err != nil {
+		fmt.Println(err)
+		return
+	}
+	embed.SetIncremental(*incremental)
+	if err := pinecone.SetMode(*pineconeAPI); err != nil {
+		fmt.Println(err)
+		return
+	}
+	pinecone.SetEnvironment(*pineconeEnv)
+	if err := pinecone.SetIndexSpec(pinecone.IndexSpec{Cloud: *pineconeCloud, Region: *pineconeRegion, PodType: *podType, Replicas: *replicas}); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := spam.SetMode(*spamMode); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := system.SetMode(*systemMode); err != nil {
+		fmt.Println(err)
+		return
+	}
+	ingestFilter, err := embedFilter(*includeRegex, *excludeRegex, *minLength, *senders, *since, *until)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	embed.SetFilter(ingestFilter)
+	if err := sentiment.SetMode(*sentimentMode); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := entities.SetMode(*entitiesMode); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := sentiment.ValidTone(*tone); err != nil {
+		fmt.Println(err)
+		return
+	}
+	redact.SetEnabled(*redactOn)
+	if err := anonymize.Setup(*anonymizeOn); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := emoji.SetMode(*emojiMode); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := embed.SetReplies(*repliesMode); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := visualize.ValidProjection(*projection); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := conversations.Valid(*summaries); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := embed.SetModel(*model, *dimensions); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := upsert.SetMetric(*metric); err != nil {
+		fmt.Println(err)
+		return
+	}
+	// Once another machine took over the lease of whatever holds one, upserts stop, as uploads do
+	upsert.SetLease(func() bool { return ingestLease == nil || ingestLease.Held() })
+	vectors.SetNormalize(*normalize)
+	if err := vectors.SetEncoding(*vectorEncoding, *vectorDecimals); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if err := ranking.LoadConfig(*rankingConfig); err != nil {
+		fmt.Println(err)
+		return
+	}
+	ranking.SetExplain(*explain)
+	ranking.SetExpand(*expand)
+	ranking.SetHyDE(*hyde)
+	query.SetIncludeArchive(*includeArchive)
+	querycache.SetTTL(*cacheTTL)
+	if *asOf != "" {
+		day, err := time.Parse("2006-01-02", *asOf)
+		if err != nil {
+			fmt.Println(i18n.T("as_of.error", *asOf))
+			return
+		}
+		query.SetAsOf(day.AddDate(0, 0, 1)) // the whole day counts
+	}
+
+	// Offline runs, in CI or while developing: OpenAI and Pinecone are faked in memory
+	if fakeState := os.Getenv(fakeAPIsEnv); fakeState != "" {
+		fake := fakeapi.New()
+		defer fake.Close()
+		if err := fake.Load(fakeState); err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer func() {
+			if err := fake.Save(fakeState); err != nil {
+				fmt.Println(err)
+			}
+		}()
+		httpclient.Set(fake.Client())
+		fmt.Println(i18n.T("fake_apis.notice", fakeState))
+	}
+
+	// Setup logs, on stderr for a container's log collector, in UTC as it has no zone
+	logFile, logFlags := os.Stderr, log.Ldate|log.Ltime|log.LUTC
+	if *logPath != "-" {
+		if logFile, err = os.OpenFile(*logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			log.Fatalf("opening err log file: %v", err)
+		}
+		defer logFile.Close()
+		logFlags = log.Ldate | log.Ltime
+	}
+
+	log := log.New(logFile, "ERR: ", logFlags)
+
+	// The tokens, units and time of every action go to the usage ledger
+	if args[0] == "usage" {
+		if err := printUsage(); err != nil {
+			fmt.Println(i18n.T("usage.error", err))
+		}
+		return
+	}
+	httpclient.Set(usage.Meter(httpclient.Client()))
+	defer usage.Flush(log)
+	chat := chatName(name, *source, *input)
+	if *chatFlag != "" {
+		chat = *chatFlag
+	}
+	if runsAlone[args[0]] || portableArchive(args) {
+		usage.Begin(args[0], chat)
+	}
+
+	// go run main.go sessions show [id], bookmarks list/export, analyze graph [file], benchmark [dir], apply [spec], daemon [spec]
+	switch args[0] {
+	case "sessions":
+		if err := runSessionsCommand(args[1:]); err != nil {
+			fmt.Println(i18n.T("sessions.error", err))
+		}
+		return
+	case "bookmarks":
+		if err := runBookmarksCommand(args[1:]); err != nil {
+			fmt.Println(i18n.T("bookmarks.error", err))
+		}
+		return
+	case "chats":
+		if err := runChatsCommand(args[1:], *chatPolicy, log); err != nil {
+			fmt.Println(i18n.T("chats.error", err))
+			log.Printf("Error in chats %v: %v", args[1:], err)
+		}
+		return
+	case "tenants":
+		if err := runTenantsCommand(args[1:], *namespace, *tenantRole); err != nil {
+			fmt.Println(i18n.T("tenants.error", err))
+			log.Printf("Error in tenants %v: %v", args[1:], err)
+		}
+		return
+	case "deleted":
+		if err := runDeletedCommand(args[1:], *restoreWindow); err != nil {
+			fmt.Println(i18n.T("forget.error", err))
+			log.Printf("Error in deleted %v: %v", args[1:], err)
+		}
+		return
+	case "benchmark":
+		exportFileName := *input
+		if exportFileName == "" {
+			exportFileName = chatFilePath
+			if *source == parser.SourceTelegram {
+				exportFileName = filepath.Join(filepath.Dir(exportFileName), telegramExportName)
+			}
+		}
+		local, err := localCopy(exportFileName)
+		if err == nil {
+			err = runBenchmarkCommand(args[1:], local, *source, *paraphrase, log)
+		}
+		if err != nil {
+			fmt.Println(i18n.T("benchmark.error", err))
+			log.Printf("Error exporting a benchmark from %s: %v", exportFileName, err)
+		}
+		return
+	case "archive":
+		if !portableArchive(args) {
+			break
+		}
+		if err := runArchiveCommand(args[1:], *embeddingsPath, log); err != nil {
+			metrics.RecordError(err)
+			fmt.Println(i18n.T("archive.portable_error", err))
+			log.Printf("Error in archive %s: %v", args[1], err)
+		}
+		return
+	case "apply":
+		if !*dryRun {
+			notify.Begin("apply")
+		}
+		if err := runApplyCommand(args[1:], *dryRun, log); err != nil {
+			metrics.RecordError(err)
+			notify.Fail(err)
+			fmt.Println(i18n.T("apply.error", err))
+			log.Printf("Error applying the pipeline spec: %v", err)
+		}
+		notify.Send(log)
+		return
+	case "daemon":
+		if err := runDaemonCommand(args[1:], log); err != nil {
+			metrics.RecordError(err)
+			fmt.Println(i18n.T("daemon.error", err))
+			log.Printf("Error in the daemon: %v", err)
+		}
+		return
+	case "analyze":
+		exportFileName := *input
+		if exportFileName == "" {
+			exportFileName = chatFilePath
+			if *source == parser.SourceTelegram {
+				exportFileName = filepath.Join(filepath.Dir(exportFileName), telegramExportName)
+			}
+		}
+		local, err := localCopy(exportFileName)
+		if err == nil {
+			err = runAnalyzeCommand(args[1:], local, *source, log)
+		}
+		if err != nil {
+			fmt.Println(i18n.T("analyze.error", err))
+			log.Printf("Error analyzing %s: %v", exportFileName, err)
+		}
+		return
+	}
+
+	// Opt-in usage counts, see FINCHAT_METRICS in the README
+	defer metrics.Flush(log)
+
+	// For the actions that ask for more, like forget and restore
+	reader := bufio.NewReader(os.Stdin)
+
+	// Every message's language is detected on its own, one file holds them all
+	inputFileName := chatFilePath
+	if *source == parser.SourceTelegram {
+		inputFileName = filepath.Join(filepath.Dir(inputFileName), telegramExportName)
+	}
+	if *input == embed.Stdin {
+		// Piped messages are embedded, and upserted, as they come; nothing else reads a pipe
+		if !slices.Contains(actions, "embed") || slices.ContainsFunc(actions, func(act string) bool { return act != "embed" && act != "upsert" }) {
+			fmt.Println(i18n.T("embed.stream_actions"))
+			return
+		}
+	} else if *input != "" {
+		if inputFileName, err = localCopy(*input); err != nil {
+			fmt.Println(i18n.T("remote.error", *input, err))
+			return
+		}
+	}
+
+	// Another machine sharing the bucket may be ingesting, it's waited for before reading anything
+	for _, act := range actions {
+		if ingests[act] && remote.IsURL(*embeddingsPath) {
+			if ingestLease, err = lock.Acquire(lockURL(*embeddingsPath), lock.DefaultTTL, log); err != nil {
+				fmt.Println(i18n.T("lock.held", err))
+				return
+			}
+			defer func() {
+				if ingestLease == nil {
+					return
+				}
+				if err := ingestLease.Release(); err != nil {
+					log.Printf("Error releasing the lock on %s: %v", lockURL(*embeddingsPath), err)
+				}
+			}()
+			break
+		}
+	}
+
+	// A remote embeddings file is used through its local copy, downloaded when an action reads it
+	embeddingsFileName, err := outputPath(*embeddingsPath)
+	if err != nil {
+		fmt.Println(i18n.T("remote.error", *embeddingsPath, err))
+		return
+	}
+	for _, act := range actions {
+		searches := act == "query" || act == "ask" || act == "bot" || act == "serve" || act == "eval"
+		streams := act == "embed" && *input == embed.Stdin // appends to the file
+		if (readsEmbeddings[act] || searches && *keywordFallback > 0 || streams) && remote.IsURL(*embeddingsPath) {
+			if embeddingsFileName, err = remote.Fetch(*embeddingsPath); err != nil {
+				fmt.Println(i18n.T("remote.error", *embeddingsPath, err))
+				return
+			}
+			break
+		}
+	}
+
+	if *input == embed.Stdin {
+		metrics.RecordCommand("embed")
+		usage.Begin("embed", chat)
+		notify.Begin(strings.Join(actions, " "))
+		if err := streamStdin(slices.Contains(actions, "upsert"), embeddingsFileName, *embeddingsPath, log); err != nil {
+			metrics.RecordError(err)
+			notify.Fail(err)
+			fmt.Println(i18n.T("embed.error", err))
+			log.Printf("Error streaming from stdin: %v", err)
+		}
+		notify.Send(log)
+		return
+	}
+
+	ranking.SetKeywordFallback(embeddingsFileName, *keywordFallback)
+	searchFilter := query.Filter{Namespace: *namespace, Language: *language, Tone: *tone, Mentions: *mentions}
+
+	// One report for the embed and upsert of this run, e.g. "embed upsert"
+	var jobs []string
+	for _, act := range actions {
+		if reportsDone[act] && !(act == "upsert" && *dryRun) {
+			jobs = append(jobs, act)
+		}
+	}
+	if len(jobs) > 0 {
+		notify.Begin(strings.Join(jobs, " "))
+		defer notify.Send(log)
+	}
+
+	// Execute the user request
+	for _, act := range actions {
+		metrics.RecordCommand(act)
+		usage.Begin(act, chat)
+		switch act {
+		case "embed":
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			written, err := embed.CreateEmbeddingFile(ctx, inputFileName, *source, embeddingsFileName, embed.Model(), log)
+			stop()
+			if err == nil {
+				// Uploaded next to the remote file, under the same name with the time appended
+				err = publish(written, (*embeddingsPath)[:strings.LastIndex(*embeddingsPath, "/")+1]+filepath.Base(written))
+			}
+			if err != nil {
+				metrics.RecordError(err)
+				metrics.Flush(log)
+				usage.Flush(log)
+				notify.Fail(err)
+				notify.Send(log)
+				fmt.Println(i18n.T("embed.error", err))
+				log.Fatalf("Error creating embedding file: %v", err)
+			}
+
+		case "upsert":
+			if *retryFailed {
+				if err := upsert.RetryFailed(indexName, log); err != nil {
+					metrics.RecordError(err)
+					notify.Fail(err)
+					fmt.Println(i18n.T("upsert.error", err))
+					log.Printf("Error retrying the failed upserts: %v", err)
+				}
+				return
+			}
+			if inputFileName == "" || embeddingsFileName == "" {
+				fmt.Println(i18n.T("upsert.needs_embed"))
+				return
+			}
+			if *dryRun {
+				if err := upsert.DryRun(indexName, embeddingsFileName, log); err != nil {
+					fmt.Println(i18n.T("upsert.error", err))
+					log.Printf("Error in the upsert dry run: %v", err)
+				}
+				return
+			}
+
+			// Ensure Pinecone index exists
+			err = upsert.GetOrCreatePineconeIndex(indexName, log)
+			if err != nil {
+				metrics.RecordError(err)
+				metrics.Flush(log)
+				usage.Flush(log)
+				notify.Fail(err)
+				notify.Send(log)
+				log.Fatalf("Error ensuring Pinecone index exists: %v", err)
+			}
+
+			// Upsert data to Pinecone
+			err = upsert.UpsertDataToPinecone(indexName, embeddingsFileName, log)
+			if err != nil {
+				metrics.RecordError(err)
+				notify.Fail(err)
+				fmt.Println(i18n.T("upsert.error", err))
+				log.Printf("Error upserting data to Pinecone: %v", err)
+				return
+			}
+			if *summaries != conversations.Off {
+				n, err := conversations.Upsert(indexName, embeddingsFileName, *summaries, log)
+				if err != nil {
+					metrics.RecordError(err)
+					notify.Fail(err)
+					fmt.Println(i18n.T("summaries.error", err))
+					log.Printf("Error upserting the summaries: %v", err)
+					return
+				}
+				if n > 0 {
+					fmt.Println(i18n.T("summaries.upserted", n, conversations.Namespace))
+				}
+			}
+
+		case "query":
+			// Call the function to prompt the user and query Pinecone
+			err = promptUserAndQueryPinecone(indexName, searchFilter, *bidiMode, newTranscript(*record, act), log)
+			if err != nil {
+				metrics.RecordError(err)
+				metrics.Flush(log)
+				usage.Flush(log)
+				fmt.Println(i18n.T("query.error", err))
+				log.Fatalf("Error in the query process: %v", err)
+			}
+
+		case "ask":
+			err = promptUserAndAsk(indexName, searchFilter, *bidiMode, newTranscript(*record, act), log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("ask.process_error", err))
+				log.Printf("Error in the ask process: %v", err)
+				return
+			}
+
+		case "bot":
+			err = runBot(*botApp, indexName, searchFilter, *botUsers, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("bot.error", err))
+				log.Printf("Error in the %s bot: %v", *botApp, err)
+				return
+			}
+
+		case "summarize":
+			err = promptUserAndSummarize(reader, inputFileName, *source, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("summarize.error", err))
+				log.Printf("Error summarizing the chat: %v", err)
+				return
+			}
+
+		case "eval":
+			cases, err := eval.Load(eval.DatasetPath)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("eval.error", err))
+				return
+			}
+			report, err := eval.Run(cases, indexName, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("eval.error", err))
+				return
+			}
+			fmt.Println(i18n.T("eval.report", report.Cases, eval.TopK, report.Recall, report.MRR))
+
+		case "suggest":
+			err = printEvalSuggestions(embeddingsFileName, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("eval.error", err))
+				return
+			}
+
+		case "watch":
+			notify.Send(log) // what ran before, watch reports every export it ingests
+			err = upsert.GetOrCreatePineconeIndex(indexName, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("upsert.error", err))
+				return
+			}
+			var sendDigest func()
+			if *digestOn {
+				sendDigest = func() {
+					if err := digest.Tick(embeddingsFileName, log); err != nil {
+						metrics.RecordError(err)
+						fmt.Println(i18n.T("digest.error", err))
+						log.Printf("Error generating the digest: %v", err)
+					}
+				}
+			}
+			// Blocks, ingesting every new export dropped in the folder
+			err = watch.Run(*watchDir, func(path string) error {
+				// A daemon that lost its lease, e.g. asleep with the laptop, takes it again when it's free
+				if ingestLease != nil && !ingestLease.Held() {
+					fmt.Println(i18n.T("lock.lost"))
+					if err := ingestLease.Release(); err != nil {
+						log.Printf("Error releasing the lock on %s: %v", lockURL(*embeddingsPath), err)
+					}
+					ingestLease = nil
+				}
+				if ingestLease == nil && remote.IsURL(*embeddingsPath) {
+					renewed, err := lock.Acquire(lockURL(*embeddingsPath), lock.DefaultTTL, log)
+					if err != nil {
+						return err
+					}
+					ingestLease = renewed
+				}
+				notify.Begin("watch " + filepath.Base(path))
+				err := ingestExport(path, *source, embeddingsFileName, *embeddingsPath, log)
+				notify.Fail(err)
+				notify.Send(log)
+				return err
+			}, sendDigest, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("watch.failed", err))
+				return
+			}
+
+		case "visualize":
+			err = writeVisualization(embeddingsFileName, *projection, *visualizeOut, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("visualize.error", err))
+				log.Printf("Error writing the visualization: %v", err)
+				return
+			}
+
+		case "graph":
+			err = writeNeighborGraph(embeddingsFileName, *graphOut, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("graph.error", err))
+				log.Printf("Error writing the neighbor graph: %v", err)
+				return
+			}
+
+		case "anomalies":
+			err = printAnomalies(embeddingsFileName, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("anomalies.error", err))
+				log.Printf("Error looking for anomalies: %v", err)
+				return
+			}
+
+		case "dedupe-report":
+			err = reportDuplicates(reader, embeddingsFileName, *dedupeThreshold, *deleteDuplicates, *yes, *restoreWindow, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("dedupe.error", err))
+				log.Printf("Error in the duplicates report: %v", err)
+				return
+			}
+
+		case "cluster":
+			err = writeTopicReport(embeddingsFileName, *clusterFrom, *namespace, *clusters, *labelTopics, *topicsOut, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("cluster.error", err))
+				log.Printf("Error clustering the messages: %v", err)
+				return
+			}
+
+		case "list-indexes":
+			err = printIndexes()
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("indexes.error", err))
+				log.Printf("Error listing Pinecone indexes: %v", err)
+				return
+			}
+
+		case "describe-index":
+			err = printIndexDescription(embeddingsFileName)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("describe_index.error", err))
+				log.Printf("Error describing the Pinecone index: %v", err)
+				return
+			}
+
+		case "stats":
+			if *localStats {
+				if err := printChatStats(inputFileName, *source, log); err != nil {
+					metrics.RecordError(err)
+					fmt.Println(i18n.T("stats.error", err))
+					log.Printf("Error counting the messages of %s: %v", inputFileName, err)
+					return
+				}
+				break
+			}
+			err = printIndexStats()
+			if errors.Is(err, pinecone.ErrIndexNotFound) {
+				fmt.Println(i18n.T("describe_index.missing", indexName))
+				return
+			}
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("describe_index.error", err))
+				log.Printf("Error counting the vectors of the Pinecone index: %v", err)
+				return
+			}
+
+		case "doctor":
+			if !printDoctorChecks(inputFileName, embeddingsFileName) {
+				metrics.Flush(log)
+				usage.Flush(log)
+				os.Exit(1)
+			}
+
+		case "backup":
+			err = backupIndex(*backupDir, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("backup.error", err))
+				log.Printf("Error backing up the Pinecone index: %v", err)
+				return
+			}
+
+		case "forget":
+			err = promptUserAndForget(reader, *namespace, *restoreWindow, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("forget.error", err))
+				log.Printf("Error forgetting messages: %v", err)
+				return
+			}
+
+		case "export":
+			local, err := outputPath(*exportOut)
+			n := 0
+			if err == nil {
+				n, err = backup.Export(indexName, *namespace, local, *exportValues, log)
+			}
+			if err == nil {
+				err = publish(local, *exportOut)
+			}
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("export.error", err))
+				log.Printf("Error exporting the Pinecone index: %v", err)
+				return
+			}
+			fmt.Println(i18n.T("export.written", n, indexName, *exportOut))
+
+		case "verify":
+			err = promptUserAndVerify(reader)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("verify.error", err))
+				log.Printf("Error verifying a backup: %v", err)
+				return
+			}
+
+		case "restore":
+			err = promptUserAndRestore(reader, *restoreWorkers, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("restore.error", err))
+				log.Printf("Error restoring a backup: %v", err)
+				return
+			}
+
+		case "archive":
+			err = archiveOldVectors(*archiveYears, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("archive.error", err))
+				log.Printf("Error archiving old vectors: %v", err)
+				return
+			}
+
+		case "delete-index":
+			err = promptUserAndDeleteIndex(reader, *yes, log)
+			if err != nil {
+				metrics.RecordError(err)
+				fmt.Println(i18n.T("delete_index.error", err))
+				log.Printf("Error deleting a Pinecone index: %v", err)
+				return
+			}
+
+		case "serve":
+			// Blocks until the server fails, or until Ctrl-C or SIGTERM, e.g. from Kubernetes
+			var key string
+			if key, err = serveKey(*listenAddr, log); err == nil {
+				ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+				err = server.Serve(ctx, *listenAddr, indexName, embed.Model(), key, tenants.DefaultPath, log)
+				stop()
+			}
+			if err != nil {
+				metrics.RecordError(err)
+				metrics.Flush(log)
+				usage.Flush(log)
+				log.Fatalf("Error serving web UI: %v", err)
 			}
 
 		default:
-			fmt.Println("Unknown action: ", act)
+			fmt.Println(i18n.T("action.unknown", act, progName))
 			return
 		}
 
-		// Wrapping up before closing
-		if err := logFile.Sync(); err != nil {
+		// Wrapping up before closing, stderr isn't buffered and can't always be synced
+		if err := logFile.Sync(); err != nil && logFile != os.Stderr {
 			log.Fatalf("Failed to flush err log file: %v", err)
 		}
 	}
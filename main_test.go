@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pisush/fin-chat/backup"
+	"github.com/pisush/fin-chat/embed"
+	"github.com/pisush/fin-chat/fakeapi"
+	"github.com/pisush/fin-chat/forget"
+	"github.com/pisush/fin-chat/httpclient"
+	"github.com/pisush/fin-chat/lock"
+	"github.com/pisush/fin-chat/parser"
+	"github.com/pisush/fin-chat/query"
+	"github.com/pisush/fin-chat/store"
+	"github.com/pisush/fin-chat/upsert"
+)
+
+const testExport = `[13/09/2023, 14:35:02] Dana: the rent is due on Friday
+[13/09/2023, 14:36:10] Yossi: I paid the electricity bill yesterday
+[14/09/2023, 09:05:00] Dana: should we move the savings to the index fund?
+`
+
+// Runs the test in a directory of its own, as every ledger and state file is relative to the
+// working directory, against a fake OpenAI and Pinecone
+func offline(t *testing.T) *fakeapi.Server {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		os.Chdir(wd)
+	})
+
+	t.Setenv("OPENAI_API_KEY", "test")
+	t.Setenv("PINECONE_API_KEY", "test")
+	fake := fakeapi.New()
+	t.Cleanup(fake.Close)
+	client := httpclient.Client()
+	httpclient.Set(fake.Client())
+	t.Cleanup(func() { httpclient.Set(client) })
+	embed.SetIndex(indexName)
+	return fake
+}
+
+// Embeds the export and upserts it, as "embed upsert" does
+func ingest(t *testing.T, export string, log *log.Logger) {
+	t.Helper()
+	file, err := embed.CreateEmbeddingFile(context.Background(), export, parser.SourceWhatsApp, "embeddings.csv", embed.Model(), log)
+	if err != nil {
+		t.Fatalf("embedding: %v", err)
+	}
+	if err := upsert.GetOrCreatePineconeIndex(indexName, log); err != nil {
+		t.Fatalf("creating the index: %v", err)
+	}
+	if err := upsert.UpsertDataToPinecone(indexName, file, log); err != nil {
+		t.Fatalf("upserting: %v", err)
+	}
+}
+
+func TestDeleteIndexThenReingest(t *testing.T) {
+	fake := offline(t)
+	log := log.New(io.Discard, "", 0)
+	export := filepath.Join(t.TempDir(), "chat.txt")
+	if err := os.WriteFile(export, []byte(testExport), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ingest(t, export, log)
+	upserted := len(fake.Vectors(indexName, ""))
+	if upserted != 3 {
+		t.Fatalf("upserted %d vectors, want 3", upserted)
+	}
+
+	if err := promptUserAndDeleteIndex(bufio.NewReader(strings.NewReader("\n")), true, log); err != nil {
+		t.Fatalf("deleting the index: %v", err)
+	}
+	if n := len(fake.Vectors(indexName, "")); n != 0 {
+		t.Fatalf("%d vectors left after deleting the index", n)
+	}
+
+	// The ledger forgot the deleted index, so the same export goes in again
+	ingest(t, export, log)
+	if n := len(fake.Vectors(indexName, "")); n != upserted {
+		t.Fatalf("re-ingesting put back %d vectors, want %d", n, upserted)
+	}
+}
+
+func TestForgetThenReingest(t *testing.T) {
+	fake := offline(t)
+	log := log.New(io.Discard, "", 0)
+	export := filepath.Join(t.TempDir(), "chat.txt")
+	if err := os.WriteFile(export, []byte(testExport), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ingest(t, export, log)
+	var id string
+	for id = range fake.Vectors(indexName, "") {
+		break
+	}
+	if _, err := forget.Soft(indexName, "", []string{id}, 0, time.Now(), log); err != nil {
+		t.Fatalf("forgetting %s: %v", id, err)
+	}
+	if _, ok := fake.Vectors(indexName, "")[id]; ok {
+		t.Fatalf("%s is still in the index after forgetting it", id)
+	}
+
+	ingest(t, export, log)
+	if _, ok := fake.Vectors(indexName, "")[id]; !ok {
+		t.Fatalf("re-ingesting didn't put %s back", id)
+	}
+}
+
+// The whole pipeline offline: parse the export, embed it, upsert it, search it, forget a
+// message and search again
+func TestPipeline(t *testing.T) {
+	fake := offline(t)
+	log := log.New(io.Discard, "", 0)
+	export := filepath.Join(t.TempDir(), "chat.txt")
+	if err := os.WriteFile(export, []byte(testExport), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := embed.ReadMessages(export, parser.SourceWhatsApp, log)
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	if len(messages) != 3 || messages[1].Sender != "Yossi" {
+		t.Fatalf("parsed %+v", messages)
+	}
+
+	ingest(t, export, log)
+	if n := len(fake.Vectors(indexName, "")); n != len(messages) {
+		t.Fatalf("upserted %d vectors, want %d", n, len(messages))
+	}
+
+	results, err := query.QueryPinecone(indexName, "electricity bill", 1, query.Filter{}, log)
+	if err != nil {
+		t.Fatalf("querying: %v", err)
+	}
+	if len(results) != 1 || !strings.Contains(results[0].Text(), "electricity") {
+		t.Fatalf("the search for the electricity bill found %+v", results)
+	}
+
+	if _, err := forget.Soft(indexName, "", []string{results[0].ID}, forget.DefaultRestoreWindow, time.Now(), log); err != nil {
+		t.Fatalf("forgetting: %v", err)
+	}
+	results, err = query.QueryPinecone(indexName, "electricity bill", 3, query.Filter{}, log)
+	if err != nil {
+		t.Fatalf("querying: %v", err)
+	}
+	for _, result := range results {
+		if strings.Contains(result.Text(), "electricity") {
+			t.Fatalf("found the forgotten message: %+v", result)
+		}
+	}
+}
+
+// A backup to a bucket uploads its shards, and its manifest last
+func TestBackupToBucket(t *testing.T) {
+	offline(t)
+	log := log.New(io.Discard, "", 0)
+	export := filepath.Join(t.TempDir(), "chat.txt")
+	if err := os.WriteFile(export, []byte(testExport), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ingest(t, export, log)
+
+	var uploaded []string
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "unexpected "+r.Method, http.StatusMethodNotAllowed)
+			return
+		}
+		uploaded = append(uploaded, r.URL.Path)
+	}))
+	defer bucket.Close()
+	t.Setenv("AWS_ENDPOINT_URL", bucket.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	if err := backupIndex("s3://backups/"+indexName, log); err != nil {
+		t.Fatalf("backing up: %v", err)
+	}
+	if len(uploaded) < 2 {
+		t.Fatalf("uploaded %v, want the shards and the manifest", uploaded)
+	}
+	if last := uploaded[len(uploaded)-1]; !strings.HasSuffix(last, "/"+backup.ManifestName) {
+		t.Fatalf("uploaded %s last, want the manifest", last)
+	}
+}
+
+// Once the lease is lost, no batch is upserted
+func TestUpsertStopsWithoutTheLease(t *testing.T) {
+	fake := offline(t)
+	log := log.New(io.Discard, "", 0)
+	export := filepath.Join(t.TempDir(), "chat.txt")
+	if err := os.WriteFile(export, []byte(testExport), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file, err := embed.CreateEmbeddingFile(context.Background(), export, parser.SourceWhatsApp, "embeddings.csv", embed.Model(), log)
+	if err != nil {
+		t.Fatalf("embedding: %v", err)
+	}
+	if err := upsert.GetOrCreatePineconeIndex(indexName, log); err != nil {
+		t.Fatalf("creating the index: %v", err)
+	}
+
+	upsert.SetLease(func() bool { return false })
+	t.Cleanup(func() { upsert.SetLease(func() bool { return true }) })
+	if err := upsert.UpsertDataToPinecone(indexName, file, log); !errors.Is(err, lock.ErrLost) {
+		t.Fatalf("upserting without the lease returned %v, want lock.ErrLost", err)
+	}
+	if n := len(fake.Vectors(indexName, "")); n != 0 {
+		t.Fatalf("upserted %d vectors without the lease", n)
+	}
+}
@@ -0,0 +1,166 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pisush/fin-chat/httpclient"
+)
+
+const (
+	modeEnv = "FINCHAT_METRICS"     // off (default), local or remote
+	urlEnv  = "FINCHAT_METRICS_URL" // only used in remote mode
+
+	metricsFilePath = "./metrics.json"
+)
+
+// Anonymous usage counts. Never holds message content, queries or file names.
+type Metrics struct {
+	Commands  map[string]int `json:"commands"`
+	Errors    map[string]int `json:"errors"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+var (
+	mu      sync.Mutex
+	current = newMetrics()
+)
+
+func newMetrics() *Metrics {
+	return &Metrics{Commands: map[string]int{}, Errors: map[string]int{}}
+}
+
+// Metrics are only collected when the user opted in
+func enabled() bool {
+	mode := os.Getenv(modeEnv)
+	return mode == "local" || mode == "remote"
+}
+
+// Counts one run of the given action
+func RecordCommand(name string) {
+	if !enabled() {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	current.Commands[name]++
+}
+
+// Counts the class of err, e.g. "network" or "decode", never its message
+func RecordError(err error) {
+	if err == nil || !enabled() {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	current.Errors[errorClass(err)]++
+}
+
+// Adds this run's counts to the local metrics file and, in remote mode, sends them
+func Flush(log *log.Logger) {
+	if !enabled() {
+		return
+	}
+	mu.Lock()
+	run := current
+	current = newMetrics()
+	mu.Unlock()
+
+	if len(run.Commands) == 0 && len(run.Errors) == 0 {
+		return
+	}
+	run.UpdatedAt = time.Now().UTC()
+
+	if err := mergeIntoFile(run); err != nil {
+		log.Printf("Error writing metrics file: %v", err)
+	}
+
+	if os.Getenv(modeEnv) == "remote" {
+		if err := send(run); err != nil {
+			log.Printf("Error sending metrics: %v", err)
+		}
+	}
+}
+
+func mergeIntoFile(run *Metrics) error {
+	total := newMetrics()
+	data, err := os.ReadFile(metricsFilePath)
+	if err == nil {
+		if err := json.Unmarshal(data, total); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	for name, count := range run.Commands {
+		total.Commands[name] += count
+	}
+	for class, count := range run.Errors {
+		total.Errors[class] += count
+	}
+	total.UpdatedAt = run.UpdatedAt
+
+	data, err = json.MarshalIndent(total, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metricsFilePath, data, 0644)
+}
+
+func send(run *Metrics) error {
+	url := os.Getenv(urlEnv)
+	if url == "" {
+		return fmt.Errorf("%s is remote but %s is not set", modeEnv, urlEnv)
+	}
+
+	jsonData, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	client := httpclient.WithTimeout(5 * time.Second)
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("metrics endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Maps an error to a coarse class that says nothing about the user's data
+func errorClass(err error) string {
+	var netErr net.Error
+	var pathErr *fs.PathError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var numErr *strconv.NumError
+	var csvErr *csv.ParseError
+
+	switch {
+	case errors.As(err, &netErr):
+		return "network"
+	case errors.As(err, &pathErr):
+		return "file"
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return "decode"
+	case errors.As(err, &numErr), errors.As(err, &csvErr):
+		return "parse"
+	default:
+		return "other"
+	}
+}
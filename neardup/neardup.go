@@ -0,0 +1,165 @@
+package neardup
+
+import (
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pisush/fin-chat/spam"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+// Messages at least this similar are taken for copies of each other
+const DefaultThreshold = 0.98
+
+// What a group of near duplicates looks like
+const (
+	KindSpam      = "spam"      // the spam classifier flags it, see spam.Classify
+	KindForwarded = "forwarded" // sent by several people, like chain messages
+	KindRepeated  = "repeated"  // sent again by the same person
+)
+
+// Messages of one chat that are near copies of each other, the first sent first
+type Group struct {
+	Rows []vectors.Row
+	Kind string
+}
+
+// The one kept when the group is cleaned up, the first sent
+func (g Group) Representative() vectors.Row {
+	return g.Rows[0]
+}
+
+// The rest of the group
+func (g Group) Duplicates() []vectors.Row {
+	return g.Rows[1:]
+}
+
+// Finds the groups of rows of a namespace whose embeddings have a cosine similarity of at least
+// threshold, directly or through other rows of the group, largest first. Brute force over all
+// pairs of each namespace, spread over the CPUs; rows of the same text are compared once.
+func Find(rows []vectors.Row, threshold float64) []Group {
+	// A message embedded twice is one vector, not a duplicate of itself
+	byNamespace := map[string][]int{}
+	seen := map[string]bool{}
+	for i, row := range rows {
+		if len(row.Values) > 0 && !seen[row.ID] {
+			seen[row.ID] = true
+			byNamespace[row.Namespace] = append(byNamespace[row.Namespace], i)
+		}
+	}
+
+	parent := make([]int, len(rows))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(a, b int) {
+		if ra, rb := find(a), find(b); ra != rb {
+			parent[rb] = ra
+		}
+	}
+
+	for _, members := range byNamespace {
+		// Identical texts are joined without comparing their vectors
+		var distinct []int
+		first := map[string]int{}
+		for _, i := range members {
+			key := strings.ToLower(strings.Join(strings.Fields(rows[i].Text), " "))
+			if j, ok := first[key]; ok {
+				union(j, i)
+				continue
+			}
+			first[key] = i
+			distinct = append(distinct, i)
+		}
+		for _, pair := range similarPairs(rows, distinct, threshold) {
+			union(pair[0], pair[1])
+		}
+	}
+
+	grouped := map[int][]vectors.Row{}
+	for _, members := range byNamespace {
+		for _, i := range members {
+			grouped[find(i)] = append(grouped[find(i)], rows[i])
+		}
+	}
+	var groups []Group
+	for _, members := range grouped {
+		if len(members) < 2 {
+			continue
+		}
+		sort.SliceStable(members, func(a, b int) bool { return members[a].Timestamp.Before(members[b].Timestamp) })
+		groups = append(groups, Group{Rows: members, Kind: kindOf(members)})
+	}
+	sort.SliceStable(groups, func(a, b int) bool {
+		if len(groups[a].Rows) != len(groups[b].Rows) {
+			return len(groups[a].Rows) > len(groups[b].Rows)
+		}
+		return groups[a].Rows[0].Timestamp.Before(groups[b].Rows[0].Timestamp)
+	})
+	return groups
+}
+
+// The pairs of the rows at indexes that are at least threshold similar
+func similarPairs(rows []vectors.Row, indexes []int, threshold float64) [][2]int {
+	unit := make([][]float64, len(indexes))
+	for n, i := range indexes {
+		unit[n] = vectors.Unit(append([]float64(nil), rows[i].Values...))
+	}
+
+	found := make([][][2]int, len(indexes))
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range next {
+				for b := a + 1; b < len(unit); b++ {
+					if len(unit[a]) == len(unit[b]) && dot(unit[a], unit[b]) >= threshold {
+						found[a] = append(found[a], [2]int{indexes[a], indexes[b]})
+					}
+				}
+			}
+		}()
+	}
+	for a := range unit {
+		next <- a
+	}
+	close(next)
+	wg.Wait()
+
+	var pairs [][2]int
+	for _, list := range found {
+		pairs = append(pairs, list...)
+	}
+	return pairs
+}
+
+func kindOf(rows []vectors.Row) string {
+	if spam.Classify(rows[0].Text, rows[0].Sender).Spam() {
+		return KindSpam
+	}
+	for _, row := range rows[1:] {
+		if row.Sender != rows[0].Sender {
+			return KindForwarded
+		}
+	}
+	return KindRepeated
+}
+
+func dot(a, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
@@ -0,0 +1,43 @@
+package normalize
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Invisible bidi controls that exports sprinkle around Hebrew text and names: marks,
+// embeddings, overrides and isolates, and stray byte order marks
+var bidiControls = map[rune]bool{
+	'\u200e': true, '\u200f': true, '\u061c': true, // LRM, RLM, ALM
+	'\u202a': true, '\u202b': true, '\u202c': true, '\u202d': true, '\u202e': true, // LRE, RLE, PDF, LRO, RLO
+	'\u2066': true, '\u2067': true, '\u2068': true, '\u2069': true, // LRI, RLI, FSI, PDI
+	'\ufeff': true,
+}
+
+// Cleans a message before it is hashed and embedded: strips bidi controls, brings the text
+// to Unicode NFC, collapses runs of spaces within a line and drops blank lines. NFC spells
+// Hebrew presentation forms as letter and points, and composes accented letters, so the same
+// words typed on different keyboards get the same hash and embedding.
+func Text(s string) string {
+	s = norm.NFC.String(StripBidi(s))
+
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// Removes the bidi control characters, leaving everything else as it is
+func StripBidi(s string) string {
+	return strings.Map(func(r rune) rune {
+		if bidiControls[r] {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,20 @@
+package normalize
+
+import "testing"
+
+func TestText(t *testing.T) {
+	for _, c := range []struct{ name, in, want string }{
+		{"bidi marks", "‏שלום‏ לכולם", "שלום לכולם"},
+		{"hebrew presentation form", "שׁבת", "שׁבת"},
+		{"hebrew points in canonical order", "בָּ", "בָּ"},
+		{"hebrew points out of order", "בָּ", "בָּ"},
+		{"latin accent", "café", "café"},
+		{"vietnamese stacked marks", "việt", "việt"},
+		{"hangul jamo", "한", "한"},
+		{"spaces and blank lines", "a  b\r\n\n  c ", "a b\nc"},
+	} {
+		if got := Text(c.in); got != c.want {
+			t.Errorf("%s: Text(%q) = %q, want %q", c.name, c.in, got, c.want)
+		}
+	}
+}
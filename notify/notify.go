@@ -0,0 +1,154 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pisush/fin-chat/httpclient"
+	"github.com/pisush/fin-chat/i18n"
+)
+
+const (
+	webhookEnv     = "FINCHAT_NOTIFY_WEBHOOK" // URL the report of every finished job is POSTed to
+	webhookTimeout = 10 * time.Second
+)
+
+// What a finished job POSTs to the webhook. Text is a one-line summary, so Slack incoming
+// webhooks show it as is; the rest is for tools that read the report.
+type Report struct {
+	Text     string                    `json:"text"`
+	Job      string                    `json:"job"` // e.g. "embed upsert", "apply" or "watch"
+	Host     string                    `json:"host"`
+	OK       bool                      `json:"ok"` // no step failed
+	Started  time.Time                 `json:"started"`
+	Finished time.Time                 `json:"finished"`
+	Seconds  float64                   `json:"seconds"`
+	Counters map[string]map[string]int `json:"counters"` // by step, e.g. "embed": {"successes": 120}
+	Failures []string                  `json:"failures"`
+}
+
+var (
+	mu      sync.Mutex
+	current *Report // the job running, nil if none or no webhook is set
+)
+
+// Whether reports are sent
+func Enabled() bool {
+	return os.Getenv(webhookEnv) != ""
+}
+
+// Starts the report of a job, dropping one that wasn't sent
+func Begin(job string) {
+	if !Enabled() {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	current = &Report{Job: job, OK: true, Started: time.Now().UTC(), Counters: map[string]map[string]int{}}
+}
+
+// Adds a step's summary counters to the report, summed with those of earlier runs of the step,
+// e.g. one per source of a pipeline spec
+func Count(step string, counters map[string]int) {
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		return
+	}
+	if current.Counters[step] == nil {
+		current.Counters[step] = map[string]int{}
+	}
+	for name, n := range counters {
+		current.Counters[step][name] += n
+	}
+}
+
+// Records a failure of the job
+func Fail(err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil || err == nil {
+		return
+	}
+	current.OK = false
+	current.Failures = append(current.Failures, err.Error())
+}
+
+// Ends the job and POSTs its report to the webhook. A failed delivery is reported, not fatal.
+func Send(log *log.Logger) {
+	mu.Lock()
+	report := current
+	current = nil
+	mu.Unlock()
+	if report == nil {
+		return
+	}
+	if err := post(report); err != nil {
+		fmt.Println(i18n.T("notify.error", err))
+		log.Printf("Error posting the report of %s to the webhook: %v", report.Job, err)
+	}
+}
+
+func post(report *Report) error {
+	report.Finished = time.Now().UTC()
+	report.Seconds = report.Finished.Sub(report.Started).Seconds()
+	report.Host, _ = os.Hostname()
+	report.Text = summary(report)
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	client := httpclient.WithTimeout(webhookTimeout)
+	resp, err := client.Post(os.Getenv(webhookEnv), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// e.g. "fin-chat embed upsert on server1 finished in 42s: embed lines=130 successes=120, upsert ..."
+func summary(r *Report) string {
+	outcome := "finished"
+	if !r.OK {
+		outcome = "failed"
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "fin-chat %s on %s %s in %s", r.Job, r.Host, outcome, time.Duration(r.Seconds*float64(time.Second)).Round(time.Second))
+	steps := make([]string, 0, len(r.Counters))
+	for step := range r.Counters {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+	for i, step := range steps {
+		sep := ", "
+		if i == 0 {
+			sep = ": "
+		}
+		names := make([]string, 0, len(r.Counters[step]))
+		for name, n := range r.Counters[step] {
+			if n != 0 { // the text leaves out what didn't happen, the counters have it all
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&sb, "%s%s", sep, step)
+		for _, name := range names {
+			fmt.Fprintf(&sb, " %s=%d", name, r.Counters[step][name])
+		}
+	}
+	for _, failure := range r.Failures {
+		fmt.Fprintf(&sb, "; %s", failure)
+	}
+	return sb.String()
+}
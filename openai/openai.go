@@ -0,0 +1,157 @@
+package openai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pisush/fin-chat/batch"
+	"github.com/pisush/fin-chat/httpclient"
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/secrets"
+)
+
+const modelsURL = "https://api.openai.com/v1/models"
+
+// What went wrong with a request, as far as the user can act on it
+const (
+	KindInvalidKey    = "invalid_key"    // the key is wrong or revoked
+	KindQuota         = "quota"          // out of credits, retrying won't help
+	KindRateLimit     = "rate_limit"     // too many requests or tokens per minute, retrying later will
+	KindContextLength = "context_length" // the input is longer than the model takes
+	KindServer        = "server"         // OpenAI's side failed
+	KindOther         = "other"
+)
+
+// An error response of the OpenAI API, with the fields of its error body
+type Error struct {
+	StatusCode int
+	Code       string // e.g. invalid_api_key, insufficient_quota, rate_limit_exceeded
+	Type       string // e.g. invalid_request_error
+	Message    string
+	RetryAfter string // the Retry-After header of a rate limit, if any
+	body       string
+}
+
+func (e *Error) Kind() string {
+	switch {
+	case e.StatusCode == http.StatusUnauthorized || e.Code == "invalid_api_key":
+		return KindInvalidKey
+	case e.Code == "insufficient_quota" || e.Type == "insufficient_quota":
+		return KindQuota
+	case e.StatusCode == http.StatusTooManyRequests:
+		return KindRateLimit
+	case e.Code == "context_length_exceeded" || strings.Contains(e.Message, "maximum context length"):
+		return KindContextLength
+	case e.StatusCode >= http.StatusInternalServerError:
+		return KindServer
+	}
+	return KindOther
+}
+
+// The message with what to do about it
+func (e *Error) Error() string {
+	switch e.Kind() {
+	case KindInvalidKey:
+		return i18n.T("openai.invalid_key", e.Message)
+	case KindQuota:
+		return i18n.T("openai.quota", e.Message)
+	case KindRateLimit:
+		if e.RetryAfter != "" {
+			return i18n.T("openai.rate_limit_retry", e.RetryAfter, e.Message)
+		}
+		return i18n.T("openai.rate_limit", e.Message)
+	case KindContextLength:
+		return i18n.T("openai.context_length", e.Message)
+	case KindServer:
+		return i18n.T("openai.server", e.StatusCode, e.Message)
+	}
+	return i18n.T("openai.other", e.StatusCode, e.Message)
+}
+
+// The response as a batch.StatusError, so rejected batches are still retried smaller
+func (e *Error) Unwrap() error {
+	return &batch.StatusError{StatusCode: e.StatusCode, Body: e.body}
+}
+
+// Whether err makes every further request fail too, a wrong key or no quota left
+func Fatal(err error) bool {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	kind := apiErr.Kind()
+	return kind == KindInvalidKey || kind == KindQuota
+}
+
+// Reads the error of a response that isn't 200 OK. A body that isn't OpenAI's JSON error is
+// kept as the message.
+func ReadError(resp *http.Response) *Error {
+	body, _ := io.ReadAll(resp.Body)
+	e := &Error{StatusCode: resp.StatusCode, RetryAfter: resp.Header.Get("Retry-After"), body: string(body)}
+
+	var parsed struct {
+		Error struct {
+			Message string          `json:"message"`
+			Type    string          `json:"type"`
+			Code    json.RawMessage `json:"code"` // a string, null or, rarely, a number
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &parsed); err != nil || parsed.Error.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+		if e.Message == "" {
+			e.Message = http.StatusText(resp.StatusCode)
+		}
+		return e
+	}
+	e.Message = parsed.Error.Message
+	e.Type = parsed.Error.Type
+	var code string
+	if json.Unmarshal(parsed.Error.Code, &code) == nil {
+		e.Code = code
+	} else if len(parsed.Error.Code) > 0 && string(parsed.Error.Code) != "null" {
+		e.Code = string(parsed.Error.Code)
+	}
+	return e
+}
+
+// The IDs of the models the key can use. Listing them is free, which makes it the way to
+// check the key.
+func ListModels() ([]string, error) {
+	key, err := secrets.Get(secrets.OpenAI)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, modelsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+key)
+
+	client := httpclient.Client()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP request error: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, ReadError(resp)
+	}
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	models := make([]string, len(list.Data))
+	for i, model := range list.Data {
+		models[i] = model.ID
+	}
+	return models, nil
+}
@@ -0,0 +1,190 @@
+package parser
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Layouts of the Date column in DiscordChatExporter CSV exports, newest first
+var discordDateLayouts = []string{time.RFC3339Nano, "02-Jan-06 03:04 PM", "1/2/2006 3:04 PM"}
+
+// The first columns of the header row of DiscordChatExporter CSV exports
+const discordCSVHeader = "AuthorID,Author,Date,Content"
+
+// The [channel id] suffix of DiscordChatExporter file names, e.g. "Guild - general [1234].csv"
+var discordFileIDRegex = regexp.MustCompile(`\s*\[\d+\]$`)
+
+type discordExport struct {
+	Channel struct {
+		Name string `json:"name"`
+	} `json:"channel"`
+	Messages []struct {
+		ID        string `json:"id"`
+		Type      string `json:"type"` // Default, Reply, or system events such as GuildMemberJoin
+		Timestamp string `json:"timestamp"`
+		Content   string `json:"content"`
+		Author    struct {
+			Name     string `json:"name"`
+			Nickname string `json:"nickname"`
+		} `json:"author"`
+		Reference struct {
+			MessageID string `json:"messageId"`
+		} `json:"reference"`
+	} `json:"messages"`
+}
+
+// DiscordChatExporter's JSON and CSV exports
+type discord struct{}
+
+func (discord) Name() string   { return SourceDiscord }
+func (discord) Source() string { return SourceDiscord }
+
+func (discord) Detect(head []byte) bool {
+	header, _, _ := strings.Cut(strings.TrimPrefix(string(head), "\ufeff"), "\n")
+	return jsonWithKey(head, "guild") || strings.HasPrefix(strings.ReplaceAll(header, `"`, ""), discordCSVHeader)
+}
+
+func (discord) Parse(file *os.File, log *log.Logger, fn Func) error {
+	return readDiscordExport(file, file.Name(), fn)
+}
+
+// Reads a DiscordChatExporter JSON or CSV export, calling fn for every message.
+// Each channel becomes its own namespace, named after the channel.
+func readDiscordExport(r io.Reader, fileName string, fn Func) error {
+	br := bufio.NewReader(r)
+	if isJSON(br) {
+		return readDiscordJSON(br, fn)
+	}
+	return readDiscordCSV(br, discordChannelFromFileName(fileName), fn)
+}
+
+func readDiscordJSON(r io.Reader, fn Func) error {
+	var export discordExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return fmt.Errorf("decoding Discord export: %w", err)
+	}
+
+	for i, dm := range export.Messages {
+		if (dm.Type != "Default" && dm.Type != "Reply") || strings.TrimSpace(dm.Content) == "" {
+			continue // joins, pins, attachment-only messages...
+		}
+
+		timestamp, err := time.Parse(time.RFC3339Nano, dm.Timestamp)
+		if err != nil {
+			fn(i+1, Message{}, false)
+			continue
+		}
+
+		sender := dm.Author.Nickname
+		if sender == "" {
+			sender = dm.Author.Name
+		}
+		fn(i+1, Message{
+			Timestamp: timestamp.UTC(),
+			Sender:    sender,
+			Text:      dm.Content,
+			ID:        dm.ID,
+			ReplyTo:   dm.Reference.MessageID,
+			Namespace: export.Channel.Name,
+		}, true)
+	}
+	return nil
+}
+
+// CSV exports have the columns AuthorID,Author,Date,Content,Attachments,Reactions
+func readDiscordCSV(r io.Reader, channel string, fn Func) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("reading Discord CSV header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimPrefix(name, "\ufeff")] = i
+	}
+	for _, name := range []string{"Author", "Date", "Content"} {
+		if _, ok := columns[name]; !ok {
+			return fmt.Errorf("Discord CSV has no %s column", name)
+		}
+	}
+
+	rowNumber := 1
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		rowNumber++
+		if err != nil {
+			return fmt.Errorf("reading Discord CSV row %d: %w", rowNumber, err)
+		}
+
+		if len(row) < len(header) {
+			fn(rowNumber, Message{}, false)
+			continue
+		}
+
+		content := row[columns["Content"]]
+		if strings.TrimSpace(content) == "" {
+			continue // attachment-only messages
+		}
+
+		timestamp, ok := parseDiscordDate(row[columns["Date"]])
+		if !ok {
+			fn(rowNumber, Message{}, false)
+			continue
+		}
+		fn(rowNumber, Message{
+			Timestamp: timestamp,
+			Sender:    row[columns["Author"]],
+			Text:      content,
+			Namespace: channel,
+		}, true)
+	}
+}
+
+func parseDiscordDate(value string) (time.Time, bool) {
+	for _, layout := range discordDateLayouts {
+		if timestamp, err := time.Parse(layout, value); err == nil {
+			return inZone(timestamp, layout), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// "Guild - Text Channels - general [1234].csv" -> "general"
+func discordChannelFromFileName(fileName string) string {
+	name := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	name = discordFileIDRegex.ReplaceAllString(name, "")
+	if i := strings.LastIndex(name, " - "); i >= 0 {
+		name = name[i+len(" - "):]
+	}
+	return name
+}
+
+// Whether the first non-space character starts a JSON object
+func isJSON(br *bufio.Reader) bool {
+	for i := 1; ; i++ {
+		peeked, err := br.Peek(i)
+		if err != nil {
+			return false
+		}
+		switch c := peeked[i-1]; c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		default:
+			return c == '{'
+		}
+	}
+}
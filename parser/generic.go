@@ -0,0 +1,242 @@
+package parser
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Timestamp layouts tried for generic exports when no layout is given
+var genericTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// Which CSV column or JSONL field holds each message field, e.g. Text: "body".
+// JSONL fields can be nested with dots, e.g. "author.name".
+type ColumnMapping struct {
+	Text       string
+	Sender     string
+	Timestamp  string
+	ID         string
+	ReplyTo    string
+	Namespace  string
+	TimeLayout string // Go layout of the timestamps, empty to detect unix times and common formats
+}
+
+var (
+	defaultMapping = ColumnMapping{Text: "text", Sender: "sender", Timestamp: "timestamp", ID: "id"}
+	genericMapping = defaultMapping
+)
+
+// Sets the columns read by the generic source from "field=column" pairs separated by commas,
+// e.g. "text=body,sender=author.name,timestamp=created_at". Fields not given keep their default.
+func SetColumnMapping(spec, timeLayout string) error {
+	mapping := defaultMapping
+	mapping.TimeLayout = timeLayout
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		field, column, ok := strings.Cut(pair, "=")
+		column = strings.TrimSpace(column)
+		if !ok || column == "" {
+			return fmt.Errorf("invalid column mapping %q, expected field=column", pair)
+		}
+		switch strings.TrimSpace(field) {
+		case "text":
+			mapping.Text = column
+		case "sender":
+			mapping.Sender = column
+		case "timestamp":
+			mapping.Timestamp = column
+		case "id":
+			mapping.ID = column
+		case "reply_to":
+			mapping.ReplyTo = column
+		case "namespace":
+			mapping.Namespace = column
+		default:
+			return fmt.Errorf("unknown field %q in column mapping, use text, sender, timestamp, id, reply_to or namespace", field)
+		}
+	}
+	genericMapping = mapping
+	return nil
+}
+
+// CSV and JSONL files read through the column mapping. Any such file would do, so it is never
+// detected, only picked with --source generic or --format generic.
+type generic struct{}
+
+func (generic) Name() string   { return SourceGeneric }
+func (generic) Source() string { return SourceGeneric }
+
+func (generic) Detect(head []byte) bool {
+	return false
+}
+
+func (generic) Parse(file *os.File, log *log.Logger, fn Func) error {
+	return readGenericExport(file, fn)
+}
+
+// Reads a CSV file with a header row or a JSONL file, mapping its columns with the column mapping
+func readGenericExport(r io.Reader, fn Func) error {
+	br := bufio.NewReader(r)
+	if isJSON(br) {
+		return readGenericJSONL(br, fn)
+	}
+	return readGenericCSV(br, fn)
+}
+
+func readGenericCSV(r io.Reader, fn Func) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("reading CSV header: %w", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))] = i
+	}
+	if _, ok := columns[genericMapping.Text]; !ok {
+		return fmt.Errorf("CSV has no %s column for the message text", genericMapping.Text)
+	}
+
+	rowNumber := 1
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		rowNumber++
+		if err != nil {
+			return fmt.Errorf("reading CSV row %d: %w", rowNumber, err)
+		}
+
+		msg, ok := genericMessage(time.Time{}, func(column string) string {
+			if i, exists := columns[column]; exists && i < len(row) {
+				return row[i]
+			}
+			return ""
+		})
+		if ok && strings.TrimSpace(msg.Text) == "" {
+			continue
+		}
+		fn(rowNumber, msg, ok)
+	}
+}
+
+func readGenericJSONL(r io.Reader, fn Func) error {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	for lineNumber := 1; ; lineNumber++ {
+		var record map[string]interface{}
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("decoding JSONL record %d: %w", lineNumber, err)
+		}
+
+		msg, ok := genericMessage(time.Time{}, func(field string) string { return jsonField(record, field) })
+		if ok && strings.TrimSpace(msg.Text) == "" {
+			continue
+		}
+		fn(lineNumber, msg, ok)
+	}
+}
+
+// Reads a JSON object through the column mapping, e.g. a line piped to embed. A record without
+// a timestamp is at arrived.
+func JSONMessage(line string, arrived time.Time) (Message, bool) {
+	decoder := json.NewDecoder(strings.NewReader(line))
+	decoder.UseNumber()
+	var record map[string]interface{}
+	if err := decoder.Decode(&record); err != nil {
+		return Message{}, false
+	}
+	return genericMessage(arrived, func(field string) string { return jsonField(record, field) })
+}
+
+// Builds a message from a record through the column mapping, get returns "" for missing columns.
+// A record without a timestamp is at arrived, or doesn't parse if that is zero.
+func genericMessage(arrived time.Time, get func(column string) string) (Message, bool) {
+	msg := Message{Text: get(genericMapping.Text), Sender: get(genericMapping.Sender)}
+	if genericMapping.ID != "" {
+		msg.ID = get(genericMapping.ID)
+	}
+	if genericMapping.ReplyTo != "" {
+		msg.ReplyTo = get(genericMapping.ReplyTo)
+	}
+	if genericMapping.Namespace != "" {
+		msg.Namespace = get(genericMapping.Namespace)
+	}
+
+	value := get(genericMapping.Timestamp)
+	if strings.TrimSpace(value) == "" && !arrived.IsZero() {
+		msg.Timestamp = arrived
+		return msg, true
+	}
+	timestamp, ok := parseGenericTime(value)
+	if !ok {
+		return Message{}, false
+	}
+	msg.Timestamp = timestamp
+	return msg, true
+}
+
+// Reads a possibly nested field such as "author.name", formatting numbers and booleans as text
+func jsonField(record map[string]interface{}, field string) string {
+	var value interface{} = record
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[key]
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return ""
+	}
+}
+
+// Unix seconds or milliseconds, the configured layout, or one of the common layouts
+func parseGenericTime(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	if genericMapping.TimeLayout != "" {
+		timestamp, err := time.Parse(genericMapping.TimeLayout, value)
+		return inZone(timestamp, genericMapping.TimeLayout), err == nil
+	}
+
+	if unix, err := strconv.ParseFloat(value, 64); err == nil {
+		if unix > 1e11 { // milliseconds
+			return time.UnixMilli(int64(unix)).UTC(), true
+		}
+		return time.Unix(int64(unix), 0).UTC(), true
+	}
+	for _, layout := range genericTimeLayouts {
+		if timestamp, err := time.Parse(layout, value); err == nil {
+			return inZone(timestamp, layout), true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,165 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sqliteCommand  = "sqlite3" // ships with macOS, there is no SQLite in the standard library
+	iMessageSender = "me"      // sender of the messages sent from this Mac
+
+	// Messages with their sender and conversation, oldest first. Reactions (associated
+	// messages) are left out, and text is read from attributedBody when the column is empty.
+	iMessageQuery = `SELECT m.guid AS guid,
+	COALESCE(m.text, '') AS text,
+	COALESCE(hex(m.attributedBody), '') AS body,
+	CAST(m.date AS TEXT) AS date,
+	m.is_from_me AS from_me,
+	COALESCE(h.id, '') AS handle,
+	COALESCE(m.thread_originator_guid, '') AS reply_to,
+	COALESCE(NULLIF(c.display_name, ''), c.chat_identifier, '') AS chat
+FROM message m
+LEFT JOIN handle h ON h.ROWID = m.handle_id
+LEFT JOIN chat_message_join cmj ON cmj.message_id = m.ROWID
+LEFT JOIN chat c ON c.ROWID = cmj.chat_id
+WHERE m.associated_message_type = 0
+ORDER BY m.date, m.ROWID;`
+)
+
+// Apple's epoch for message dates
+var iMessageEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type iMessageRow struct {
+	GUID    string `json:"guid"`
+	Text    string `json:"text"`
+	Body    string `json:"body"` // hex of the attributedBody typedstream
+	Date    string `json:"date"`
+	FromMe  int    `json:"from_me"`
+	Handle  string `json:"handle"`
+	ReplyTo string `json:"reply_to"`
+	Chat    string `json:"chat"`
+}
+
+// The macOS Messages database
+type iMessage struct{}
+
+func (iMessage) Name() string   { return SourceIMessage }
+func (iMessage) Source() string { return SourceIMessage }
+
+func (iMessage) Detect(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("SQLite format 3\x00"))
+}
+
+func (iMessage) Parse(file *os.File, log *log.Logger, fn Func) error {
+	return readIMessageDB(file.Name(), fn)
+}
+
+// Reads the macOS Messages database (chat.db), calling fn for every message.
+// Each conversation becomes a namespace named after the group name or the other handle.
+func readIMessageDB(dbPath string, fn Func) error {
+	cmd := exec.Command(sqliteCommand, "-readonly", "-json", dbPath, iMessageQuery)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("reading %s with %s: %v: %s", dbPath, sqliteCommand, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var rows []iMessageRow
+	if len(bytes.TrimSpace(out)) > 0 { // no output at all when there are no rows
+		if err := json.Unmarshal(out, &rows); err != nil {
+			return fmt.Errorf("decoding %s output: %w", sqliteCommand, err)
+		}
+	}
+
+	for i, row := range rows {
+		text := row.Text
+		if text == "" {
+			text = attributedBodyText(row.Body)
+		}
+		if strings.TrimSpace(text) == "" {
+			continue // attachments, stickers...
+		}
+
+		timestamp, err := iMessageTimestamp(row.Date)
+		if err != nil {
+			fn(i+1, Message{}, false)
+			continue
+		}
+
+		sender := row.Handle
+		if row.FromMe != 0 {
+			sender = iMessageSender
+		}
+		fn(i+1, Message{
+			Timestamp: timestamp,
+			Sender:    sender,
+			Text:      strings.ReplaceAll(text, "\ufffc", ""), // attachment placeholders
+			ID:        row.GUID,
+			ReplyTo:   row.ReplyTo,
+			Namespace: row.Chat,
+		}, true)
+	}
+	return nil
+}
+
+// Dates are nanoseconds since 2001 on macOS 10.13 and later, seconds before that
+func iMessageTimestamp(value string) (time.Time, error) {
+	date, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if date > 1e11 {
+		return iMessageEpoch.Add(time.Duration(date)), nil
+	}
+	return iMessageEpoch.Add(time.Duration(date) * time.Second), nil
+}
+
+// Since macOS Ventura the text is often only stored in attributedBody, an NSAttributedString
+// typedstream. The string follows the NSString class name, prefixed by its length.
+func attributedBodyText(hexBody string) string {
+	body, err := hex.DecodeString(hexBody)
+	if err != nil {
+		return ""
+	}
+	i := bytes.Index(body, []byte("NSString"))
+	if i < 0 {
+		return ""
+	}
+	body = body[i+len("NSString"):]
+	if j := bytes.IndexByte(body, '+'); j >= 0 && j < 8 {
+		body = body[j+1:] // the '+' marks the start of the string data
+	} else {
+		return ""
+	}
+	if len(body) == 0 {
+		return ""
+	}
+
+	length, start := int(body[0]), 1
+	switch body[0] {
+	case 0x81: // 2 byte little-endian length
+		if len(body) < 3 {
+			return ""
+		}
+		length, start = int(body[1])|int(body[2])<<8, 3
+	case 0x82: // 4 byte little-endian length
+		if len(body) < 5 {
+			return ""
+		}
+		length, start = int(body[1])|int(body[2])<<8|int(body[3])<<16|int(body[4])<<24, 5
+	}
+	if start+length > len(body) {
+		return ""
+	}
+	return string(body[start : start+length])
+}
@@ -0,0 +1,160 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/timezone"
+)
+
+const (
+	ReadBufferSize  = 1 << 20  // read buffer for the chat file
+	MaxLineBytes    = 64 << 20 // longer lines are cut, not fatal
+	logSnippetChars = 200      // how much of a bad line is written to the log
+	headBytes       = 4096     // of an export read to tell its format
+)
+
+// The apps whose chat exports can be embedded, each read by one or more parsers
+const (
+	SourceWhatsApp = "whatsapp"
+	SourceTelegram = "telegram"
+	SourceSignal   = "signal"
+	SourceDiscord  = "discord"
+	SourceSlack    = "slack"
+	SourceIMessage = "imessage"
+	SourceGeneric  = "generic" // any CSV or JSONL file, see SetColumnMapping
+)
+
+// A single parsed chat message
+type Message struct {
+	Timestamp time.Time
+	Sender    string
+	Text      string
+	ID        string // the export's own message ID, if it has one
+	ReplyTo   string // ID of the message this one replies to, if known
+	Namespace string // Pinecone namespace to store it in, empty for the default one
+	Quoted    string // text of the message it replies to, embedded with it, see embed.RepliesQuote
+}
+
+// Called for every message of an export in order, with its line (or message) number.
+// Entries that can't be parsed are passed with ok false.
+type Func func(lineNumber int, msg Message, ok bool)
+
+// Reads one export format, e.g. one dialect of WhatsApp's text exports
+type Parser interface {
+	Name() string   // what --format calls it
+	Source() string // the app it reads the exports of, e.g. SourceWhatsApp
+	// Whether an export starting with head, at most its first 4 KB, is in this format
+	Detect(head []byte) bool
+	// Reads the export, logging the entries that can't be parsed
+	Parse(file *os.File, log *log.Logger, fn Func) error
+}
+
+var parsers []Parser
+
+func init() {
+	for _, p := range []Parser{signal{}, whatsApp{}, telegram{}, discord{}, slack{}, iMessage{}, generic{}} {
+		Register(p)
+	}
+}
+
+// Adds a parser to the registry. Detection tries the parsers in the order they were registered,
+// so a format whose lines another parser would also match goes first, e.g. Signal's before
+// WhatsApp's.
+func Register(p Parser) {
+	if _, err := Lookup(p.Name()); err == nil {
+		panic("parser: " + p.Name() + " registered twice")
+	}
+	parsers = append(parsers, p)
+}
+
+// The parser with that name
+func Lookup(name string) (Parser, error) {
+	for _, p := range parsers {
+		if p.Name() == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown format %q, use %s", name, strings.Join(Names(), ", "))
+}
+
+// The names of the registered parsers, in the order they were registered
+func Names() []string {
+	names := make([]string, len(parsers))
+	for i, p := range parsers {
+		names[i] = p.Name()
+	}
+	return names
+}
+
+// Picks the parser of an export from its first lines, among the parsers of source, or all of
+// them if it is empty. A source with a single parser needs no detection.
+func Detect(file *os.File, source string) (Parser, error) {
+	var candidates []Parser
+	for _, p := range parsers {
+		if source == "" || p.Source() == source {
+			candidates = append(candidates, p)
+		}
+	}
+	switch {
+	case len(candidates) == 0:
+		return nil, fmt.Errorf("unknown source %q", source)
+	case len(candidates) == 1 && source != "":
+		return candidates[0], nil
+	}
+
+	head := make([]byte, headBytes)
+	n, err := file.ReadAt(head, 0) // leaves the file where it is for Parse
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	for _, p := range candidates {
+		if p.Detect(head[:n]) {
+			return p, nil
+		}
+	}
+	names := make([]string, len(candidates))
+	for i, p := range candidates {
+		names[i] = p.Name()
+	}
+	return nil, fmt.Errorf("can't tell the format of %s, pass --format: %s", file.Name(), strings.Join(names, ", "))
+}
+
+// The moment a time parsed with layout stands for: as it is if the layout has a zone, and
+// otherwise read on the clock of --timezone
+func inZone(t time.Time, layout string) time.Time {
+	for _, zone := range []string{"MST", "Z07", "-07"} {
+		if strings.Contains(layout, zone) {
+			return t
+		}
+	}
+	return timezone.FromClock(t)
+}
+
+// The lines of the head, the last one left out as it may be cut
+func headLines(head []byte) []string {
+	lines := strings.Split(string(head), "\n")
+	if len(lines) > 1 && len(head) == headBytes {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// Whether the head starts with a JSON object that has any of the keys
+func jsonWithKey(head []byte, keys ...string) bool {
+	text := strings.TrimSpace(strings.TrimPrefix(string(head), "\ufeff"))
+	if !strings.HasPrefix(text, "{") {
+		return false
+	}
+	for _, key := range keys {
+		if strings.Contains(text, `"`+key+`"`) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package parser
+
+import (
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/linereader"
+)
+
+// Message header written by signal-export (chat.md) and signalbackup-tools --exporttxt,
+// e.g. [2023-09-09 14:35] john_doe: Hello world! (seconds are optional)
+var signalLineRegex = regexp.MustCompile(`^\[(\d{4}-\d{2}-\d{2} \d{2}:\d{2}(?::\d{2})?)\]\s*([^:]+):\s?(.*)$`)
+
+var signalTimestampLayouts = []string{"2006-01-02 15:04:05", "2006-01-02 15:04"}
+
+// The text exports of signal-export and signalbackup-tools
+type signal struct{}
+
+func (signal) Name() string   { return SourceSignal }
+func (signal) Source() string { return SourceSignal }
+
+func (signal) Detect(head []byte) bool {
+	for _, line := range headLines(head) {
+		if signalLineRegex.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+func (signal) Parse(file *os.File, log *log.Logger, fn Func) error {
+	return readSignalExport(file, fn)
+}
+
+// Reads a Signal text export, calling fn for every message with the line number of its header.
+// Lines without a header continue the previous message, attachment links are dropped.
+func readSignalExport(r io.Reader, fn Func) error {
+	var current *Message
+	currentLine := 0
+	flush := func() {
+		if current != nil && strings.TrimSpace(current.Text) != "" {
+			fn(currentLine, *current, true)
+		}
+		current = nil
+	}
+
+	scanner := linereader.New(r, ReadBufferSize, MaxLineBytes)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+
+		if matches := signalLineRegex.FindStringSubmatch(line); matches != nil {
+			if timestamp, ok := parseSignalTimestamp(matches[1]); ok {
+				flush()
+				current = &Message{Timestamp: timestamp, Sender: strings.TrimSpace(matches[2]), Text: matches[3]}
+				currentLine = lineNumber
+				continue
+			}
+		}
+
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(line), "!["):
+			continue // ![attachment](media/...)
+		case current != nil:
+			current.Text += " " + line // rows of the embeddings file are single lines
+		case strings.TrimSpace(line) != "":
+			fn(lineNumber, Message{}, false) // text before the first message
+		}
+	}
+	flush()
+
+	return scanner.Err()
+}
+
+func parseSignalTimestamp(value string) (time.Time, bool) {
+	for _, layout := range signalTimestampLayouts {
+		if timestamp, err := time.Parse(layout, value); err == nil {
+			return inZone(timestamp, layout), true
+		}
+	}
+	return time.Time{}, false
+}
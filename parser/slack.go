@@ -0,0 +1,233 @@
+package parser
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message subtypes that carry something a person wrote, the rest are joins, topic changes, bots...
+var slackMessageSubtypes = map[string]bool{"": true, "thread_broadcast": true, "file_share": true, "me_message": true}
+
+// Slack's markup for mentions and links, e.g. <@U123>, <#C123|general> or <https://example.com|label>
+var slackMarkupRegex = regexp.MustCompile(`<([@#!]?)([^<>|]+)(?:\|([^<>]*))?>`)
+
+type slackUser struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	RealName string `json:"real_name"`
+	Profile  struct {
+		DisplayName string `json:"display_name"`
+		RealName    string `json:"real_name"`
+	} `json:"profile"`
+}
+
+type slackMessage struct {
+	Type     string `json:"type"`
+	Subtype  string `json:"subtype"`
+	User     string `json:"user"`
+	Text     string `json:"text"`
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+}
+
+// The ZIP files of Slack's workspace export
+type slack struct{}
+
+func (slack) Name() string   { return SourceSlack }
+func (slack) Source() string { return SourceSlack }
+
+func (slack) Detect(head []byte) bool {
+	return bytes.HasPrefix(head, []byte("PK\x03\x04"))
+}
+
+func (slack) Parse(file *os.File, log *log.Logger, fn Func) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return readSlackExport(file, info.Size(), fn)
+}
+
+// Reads a Slack workspace export ZIP, calling fn for every message.
+// Each channel folder becomes a namespace, and thread replies follow their parent message.
+func readSlackExport(r io.ReaderAt, size int64, fn Func) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("opening Slack export: %w", err)
+	}
+
+	users := map[string]string{}
+	channels := map[string][]slackMessage{}
+	for _, file := range archive.File {
+		dir, name := path.Split(file.Name)
+		if path.Ext(name) != ".json" {
+			continue
+		}
+		switch {
+		case dir == "" && name == "users.json":
+			var list []slackUser
+			if err := decodeZipJSON(file, &list); err != nil {
+				return err
+			}
+			for _, user := range list {
+				users[user.ID] = slackUserName(user)
+			}
+		case dir != "":
+			// <channel>/<YYYY-MM-DD>.json, one file per channel and day
+			channel := strings.TrimSuffix(dir, "/")
+			var day []slackMessage
+			if err := decodeZipJSON(file, &day); err != nil {
+				return err
+			}
+			channels[channel] = append(channels[channel], day...)
+		}
+	}
+
+	names := make([]string, 0, len(channels))
+	for channel := range channels {
+		names = append(names, channel)
+	}
+	sort.Strings(names)
+
+	number := 0
+	for _, channel := range names {
+		for _, sm := range flattenSlackThreads(channels[channel]) {
+			number++
+			if sm.Type != "message" || !slackMessageSubtypes[sm.Subtype] || strings.TrimSpace(sm.Text) == "" {
+				continue
+			}
+
+			timestamp, err := slackTimestamp(sm.TS)
+			if err != nil {
+				fn(number, Message{}, false)
+				continue
+			}
+
+			sender := users[sm.User]
+			if sender == "" {
+				sender = sm.User
+			}
+			msg := Message{
+				Timestamp: timestamp,
+				Sender:    sender,
+				Text:      slackText(sm.Text, users),
+				ID:        sm.TS,
+				Namespace: channel,
+			}
+			if sm.ThreadTS != "" && sm.ThreadTS != sm.TS {
+				msg.ReplyTo = sm.ThreadTS
+			}
+			fn(number, msg, true)
+		}
+	}
+	return nil
+}
+
+func decodeZipJSON(file *zip.File, v interface{}) error {
+	rc, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("opening %s in Slack export: %w", file.Name, err)
+	}
+	defer rc.Close()
+
+	if err := json.NewDecoder(rc).Decode(v); err != nil {
+		return fmt.Errorf("decoding %s in Slack export: %w", file.Name, err)
+	}
+	return nil
+}
+
+// Orders a channel's messages by time, with every thread's replies right after its parent
+func flattenSlackThreads(messages []slackMessage) []slackMessage {
+	sort.SliceStable(messages, func(i, j int) bool { return slackTSLess(messages[i].TS, messages[j].TS) })
+
+	parents := map[string]bool{}
+	replies := map[string][]slackMessage{}
+	for _, sm := range messages {
+		if sm.ThreadTS == "" || sm.ThreadTS == sm.TS {
+			parents[sm.TS] = true
+		}
+	}
+	for _, sm := range messages {
+		if sm.ThreadTS != "" && sm.ThreadTS != sm.TS && parents[sm.ThreadTS] {
+			replies[sm.ThreadTS] = append(replies[sm.ThreadTS], sm)
+		}
+	}
+
+	flat := make([]slackMessage, 0, len(messages))
+	for _, sm := range messages {
+		if sm.ThreadTS != "" && sm.ThreadTS != sm.TS && parents[sm.ThreadTS] {
+			continue // placed after its parent
+		}
+		flat = append(flat, sm)
+		flat = append(flat, replies[sm.TS]...)
+	}
+	return flat
+}
+
+// The display name, falling back to the real name and then the handle
+func slackUserName(user slackUser) string {
+	for _, name := range []string{user.Profile.DisplayName, user.Profile.RealName, user.RealName, user.Name} {
+		if name != "" {
+			return name
+		}
+	}
+	return user.ID
+}
+
+// Replaces mentions with @name and links with their label
+func slackText(text string, users map[string]string) string {
+	text = slackMarkupRegex.ReplaceAllStringFunc(text, func(markup string) string {
+		m := slackMarkupRegex.FindStringSubmatch(markup)
+		kind, target, label := m[1], m[2], m[3]
+		switch {
+		case kind == "@" && users[target] != "":
+			return "@" + users[target]
+		case kind == "!":
+			return "@" + target // @here, @channel
+		case label != "":
+			if kind == "#" || kind == "@" {
+				return kind + label
+			}
+			return label
+		default:
+			return kind + target
+		}
+	})
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(text)
+}
+
+// Slack timestamps are "<unix seconds>.<microseconds>"
+func slackTimestamp(ts string) (time.Time, error) {
+	seconds, fraction, _ := strings.Cut(ts, ".")
+	sec, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var micros int64
+	if fraction != "" {
+		if micros, err = strconv.ParseInt(fraction, 10, 64); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(sec, micros*int64(time.Microsecond)).UTC(), nil
+}
+
+func slackTSLess(a, b string) bool {
+	ta, errA := slackTimestamp(a)
+	tb, errB := slackTimestamp(b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return ta.Before(tb)
+}
@@ -0,0 +1,150 @@
+package parser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layout of the "date" field in Telegram exports, in the exporting device's local time
+const telegramDateLayout = "2006-01-02T15:04:05"
+
+// A chat in Telegram's result.json, either the whole file or one entry of chats.list
+type telegramChat struct {
+	Name     string            `json:"name"`
+	Messages []telegramMessage `json:"messages"`
+	Chats    struct {
+		List []telegramChat `json:"list"`
+	} `json:"chats"`
+}
+
+type telegramMessage struct {
+	ID           int64           `json:"id"`
+	Type         string          `json:"type"` // "message" or "service"
+	Date         string          `json:"date"`
+	DateUnixtime string          `json:"date_unixtime"`
+	From         string          `json:"from"`
+	ReplyTo      int64           `json:"reply_to_message_id"`
+	Text         json.RawMessage `json:"text"`
+}
+
+// Telegram Desktop's JSON exports, of a chat or of the whole account
+type telegram struct{}
+
+func (telegram) Name() string   { return SourceTelegram }
+func (telegram) Source() string { return SourceTelegram }
+
+func (telegram) Detect(head []byte) bool {
+	return jsonWithKey(head, "personal_information", "chats", "messages") && !jsonWithKey(head, "guild")
+}
+
+func (telegram) Parse(file *os.File, log *log.Logger, fn Func) error {
+	messages, err := readTelegramExport(file)
+	if err != nil {
+		return err
+	}
+	for i, msg := range messages {
+		fn(i+1, msg, true)
+	}
+	return nil
+}
+
+// Reads the messages of a Telegram Desktop JSON export (result.json).
+// Handles both a single chat export and a full account export with chats.list.
+func readTelegramExport(r io.Reader) ([]Message, error) {
+	var export telegramChat
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, fmt.Errorf("decoding Telegram export: %w", err)
+	}
+
+	chats := append([]telegramChat{export}, export.Chats.List...)
+	var messages []Message
+	for _, chat := range chats {
+		for _, tm := range chat.Messages {
+			if tm.Type != "message" {
+				continue // joins, pins, calls...
+			}
+
+			text, err := telegramText(tm.Text)
+			if err != nil {
+				return nil, fmt.Errorf("decoding text of message %d: %w", tm.ID, err)
+			}
+			if strings.TrimSpace(text) == "" {
+				continue // media without a caption
+			}
+
+			timestamp, err := telegramTimestamp(tm)
+			if err != nil {
+				return nil, fmt.Errorf("decoding date of message %d: %w", tm.ID, err)
+			}
+
+			msg := Message{
+				Timestamp: timestamp,
+				Sender:    tm.From,
+				Text:      text,
+				ID:        strconv.FormatInt(tm.ID, 10),
+			}
+			if msg.Sender == "" {
+				msg.Sender = chat.Name // channel posts have no author
+			}
+			if tm.ReplyTo != 0 {
+				msg.ReplyTo = strconv.FormatInt(tm.ReplyTo, 10)
+			}
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
+// The text field is either a plain string or a list of strings and formatted entities
+func telegramText(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+
+	var parts []json.RawMessage
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	for _, part := range parts {
+		var plain string
+		if err := json.Unmarshal(part, &plain); err == nil {
+			sb.WriteString(plain)
+			continue
+		}
+
+		var entity struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(part, &entity); err != nil {
+			return "", err
+		}
+		sb.WriteString(entity.Text)
+	}
+	return sb.String(), nil
+}
+
+// Newer exports carry an exact unix time, older ones only the local date
+func telegramTimestamp(tm telegramMessage) (time.Time, error) {
+	if tm.DateUnixtime != "" {
+		seconds, err := strconv.ParseInt(tm.DateUnixtime, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(seconds, 0).UTC(), nil
+	}
+	timestamp, err := time.Parse(telegramDateLayout, tm.Date)
+	return inZone(timestamp, telegramDateLayout), err
+}
@@ -0,0 +1,247 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/linereader"
+	"github.com/pisush/fin-chat/normalize"
+	"github.com/pisush/fin-chat/timezone"
+)
+
+// The order of day, month and year in WhatsApp's timestamps, which follows the phone's locale
+const (
+	DateOrderAuto = "auto" // guessed from the dates of the export
+	DateOrderDMY  = "dmy"  // 09.09.23 or 9/9/2023, most of the world
+	DateOrderMDY  = "mdy"  // 9/9/23, the US
+	DateOrderYMD  = "ymd"  // 2023-09-09, e.g. Sweden or China
+)
+
+const guessBytes = 1 << 20 // of an export read to guess its date order
+
+// The timestamp of a WhatsApp line: a date in any order with dots, slashes or dashes, a 24h or
+// 12h time with or without seconds, and an AM/PM marker in the phone's language
+const whatsAppTimestamp = `(\d{1,4})[./-](\d{1,2})[./-](\d{1,4}),?[ \x{00A0}\x{202F}](\d{1,2})[:.](\d{2})(?:[:.](\d{2}))?` +
+	`(?:[ \x{00A0}\x{202F}]?(\pL[\pL. \x{00A0}\x{202F}"'״]*?))?`
+
+var (
+	// iOS, e.g. [09.09.23, 14:35:02] ~ john_doe: Hello world! or [9/9/23, 2:35:02 PM] john_doe: Hello world!
+	iOSLineRegex = regexp.MustCompile(`^\[` + whatsAppTimestamp + `\]\s*~?\s*([^:]+):\s(.*)$`)
+	// Android, e.g. 09/09/2023, 14:35 - john_doe: Hello world!
+	androidLineRegex = regexp.MustCompile(`^` + whatsAppTimestamp + `\s-\s~?\s*([^:]+):\s(.*)$`)
+)
+
+// AM/PM markers by language, lowercase without dots and spaces
+var meridiems = map[string]bool{
+	"am": false, "pm": true, // English, and what most languages fall back to
+	"vorm": false, "nachm": true, // German
+	"fm": false, "em": true, // Swedish, Norwegian, Danish
+	"sa": false, "ch": true, // Vietnamese
+	"πμ": false, "μμ": true, // Greek
+	"ص": false, "م": true, // Arabic
+	"לפנה״צ": false, "אחה״צ": true, `לפנה"צ`: false, `אחה"צ`: true, // Hebrew
+}
+
+var dateOrder = DateOrderAuto
+
+// Picks the order of day, month and year of WhatsApp exports: DateOrderAuto, DateOrderDMY,
+// DateOrderMDY or DateOrderYMD. Empty is DateOrderAuto.
+func SetDateOrder(order string) error {
+	if err := ValidDateOrder(order); err != nil {
+		return err
+	}
+	if order == "" {
+		order = DateOrderAuto
+	}
+	dateOrder = order
+	return nil
+}
+
+// Checks a date order given to SetDateOrder
+func ValidDateOrder(order string) error {
+	switch order {
+	case "", DateOrderAuto, DateOrderDMY, DateOrderMDY, DateOrderYMD:
+		return nil
+	}
+	return fmt.Errorf("unknown date order %q, use %s, %s, %s or %s", order, DateOrderAuto, DateOrderDMY, DateOrderMDY, DateOrderYMD)
+}
+
+// WhatsApp text exports of iOS and Android phones in any locale, one message per line; the
+// lines a multi-line message continues on don't parse
+type whatsApp struct{}
+
+func (whatsApp) Name() string   { return SourceWhatsApp }
+func (whatsApp) Source() string { return SourceWhatsApp }
+
+func (whatsApp) Detect(head []byte) bool {
+	for _, line := range headLines(head) {
+		if matchLine(normalize.StripBidi(line)) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (whatsApp) Parse(file *os.File, log *log.Logger, fn Func) error {
+	order := dateOrder
+	if order == DateOrderAuto {
+		var err error
+		if order, err = guessDateOrder(file); err != nil {
+			return err
+		}
+	}
+
+	scanner := linereader.New(file, ReadBufferSize, MaxLineBytes)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if scanner.Truncated() {
+			log.Printf("Line %d is longer than %d bytes, using only its beginning\n", lineNumber, MaxLineBytes)
+		}
+
+		msg, ok := parseLine(normalize.StripBidi(line), order) // a mark before the timestamp would fail the match
+		if !ok {
+			log.Printf("Unable to parse line %d - skipping: Content: %s\n", lineNumber, grapheme.Snippet(line, logSnippetChars))
+		}
+		fn(lineNumber, msg, ok)
+	}
+	return scanner.Err()
+}
+
+// Splits a WhatsApp export line into its timestamp, sender and text. Unless SetDateOrder
+// set the date order, it is guessed from the line alone.
+func ParseLine(line string) (Message, bool) {
+	order := dateOrder
+	if order == DateOrderAuto {
+		order = orderOf([][]string{matchLine(line)})
+	}
+	return parseLine(line, order)
+}
+
+// The submatches of a WhatsApp line: the date's three numbers, hour, minute, second, AM/PM
+// marker, sender and text; nil if it isn't one
+func matchLine(line string) []string {
+	if matches := iOSLineRegex.FindStringSubmatch(line); matches != nil {
+		return matches[1:]
+	}
+	if matches := androidLineRegex.FindStringSubmatch(line); matches != nil {
+		return matches[1:]
+	}
+	return nil
+}
+
+func parseLine(line, order string) (Message, bool) {
+	matches := matchLine(line)
+	if matches == nil {
+		return Message{}, false
+	}
+	timestamp, ok := whatsAppTime(matches, order)
+	if !ok {
+		return Message{}, false
+	}
+	return Message{
+		Timestamp: timestamp,
+		Sender:    strings.TrimSpace(matches[7]),
+		Text:      matches[8],
+	}, true
+}
+
+// The timestamp of a line's submatches, with the date read in the order given
+func whatsAppTime(matches []string, order string) (time.Time, bool) {
+	var n [6]int
+	for i := range n {
+		n[i], _ = strconv.Atoi(matches[i]) // the regex only lets digits through; missing seconds are 0
+	}
+	year, month, day := n[2], n[1], n[0]
+	switch order {
+	case DateOrderMDY:
+		month, day = n[0], n[1]
+	case DateOrderYMD:
+		year, month, day = n[0], n[1], n[2]
+	}
+	if year < 100 {
+		year += 2000
+	}
+	hour, minute, second := n[3], n[4], n[5]
+	if marker := matches[6]; marker != "" {
+		pm, ok := meridiem(marker)
+		if !ok || hour < 1 || hour > 12 {
+			return time.Time{}, false
+		}
+		hour %= 12
+		if pm {
+			hour += 12
+		}
+	}
+
+	t := time.Date(year, time.Month(month), day, hour, minute, second, 0, time.UTC)
+	// time.Date rolls over what is out of range, e.g. the 13th month, which is a wrong order
+	if t.Year() != year || t.Month() != time.Month(month) || t.Day() != day || t.Hour() != hour || t.Minute() != minute || t.Second() != second {
+		return time.Time{}, false
+	}
+	return timezone.FromClock(t), true
+}
+
+// Whether the AM/PM marker is PM, and whether it is one at all
+func meridiem(marker string) (pm, ok bool) {
+	key := strings.ToLower(strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ' ', '\u00a0', '\u202f':
+			return -1
+		}
+		return r
+	}, marker))
+	pm, ok = meridiems[key]
+	return pm, ok
+}
+
+// Guesses the date order from the first lines of the export, leaving the file where it is
+func guessDateOrder(file *os.File) (string, error) {
+	head := make([]byte, guessBytes)
+	n, err := file.ReadAt(head, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	var lines [][]string
+	for _, line := range strings.Split(string(head[:n]), "\n") {
+		lines = append(lines, matchLine(normalize.StripBidi(strings.TrimSuffix(line, "\r"))))
+	}
+	return orderOf(lines), nil
+}
+
+// The date order the submatches of some lines are in: year first if it has four digits, and
+// otherwise day first unless a day can only be second. Neither telling, phones with a 12h clock
+// are most likely American.
+func orderOf(lines [][]string) string {
+	twelveHour := false
+	for _, matches := range lines {
+		if matches == nil {
+			continue
+		}
+		if len(matches[0]) == 4 {
+			return DateOrderYMD
+		}
+		first, _ := strconv.Atoi(matches[0])
+		second, _ := strconv.Atoi(matches[1])
+		switch {
+		case first > 12:
+			return DateOrderDMY
+		case second > 12:
+			return DateOrderMDY
+		}
+		twelveHour = twelveHour || matches[6] != ""
+	}
+	if twelveHour {
+		return DateOrderMDY
+	}
+	return DateOrderDMY
+}
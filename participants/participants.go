@@ -0,0 +1,137 @@
+package participants
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/embed"
+)
+
+// A message only counts as answering the previous one if it came within this long
+const DefaultWindow = 30 * time.Minute
+
+// A sender of the chat
+type Node struct {
+	Sender   string `json:"sender"`
+	Messages int    `json:"messages"`
+}
+
+// How often Target wrote right after Source. Replies counts the explicit replies among them.
+type Edge struct {
+	Source  string `json:"source"`
+	Target  string `json:"target"`
+	Weight  int    `json:"weight"`
+	Replies int    `json:"replies"`
+}
+
+type Graph struct {
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+// Builds the who-talks-after-whom graph of the messages. A message that replies to a known
+// message links to its sender; any other message links to the sender of the previous message
+// of the same chat (namespace), if it came within window. Talking after yourself isn't an edge.
+func Build(messages []embed.Message, window time.Duration) Graph {
+	byChat := map[string][]embed.Message{}
+	for _, msg := range messages {
+		byChat[msg.Namespace] = append(byChat[msg.Namespace], msg)
+	}
+
+	counts := map[string]int{}
+	edges := map[[2]string]*Edge{}
+	link := func(source, target string, reply bool) {
+		if source == target {
+			return
+		}
+		key := [2]string{source, target}
+		if edges[key] == nil {
+			edges[key] = &Edge{Source: source, Target: target}
+		}
+		edges[key].Weight++
+		if reply {
+			edges[key].Replies++
+		}
+	}
+
+	for _, chat := range byChat {
+		sort.SliceStable(chat, func(a, b int) bool { return chat[a].Timestamp.Before(chat[b].Timestamp) })
+		senders := map[string]string{} // message ID -> sender, to resolve replies
+		for i, msg := range chat {
+			counts[msg.Sender]++
+			if msg.ID != "" {
+				senders[msg.ID] = msg.Sender
+			}
+
+			if repliedTo, ok := senders[msg.ReplyTo]; ok && msg.ReplyTo != "" {
+				link(repliedTo, msg.Sender, true)
+				continue
+			}
+			if i > 0 && msg.Timestamp.Sub(chat[i-1].Timestamp) <= window {
+				link(chat[i-1].Sender, msg.Sender, false)
+			}
+		}
+	}
+
+	graph := Graph{Nodes: []Node{}, Edges: []Edge{}}
+	for sender, n := range counts {
+		graph.Nodes = append(graph.Nodes, Node{Sender: sender, Messages: n})
+	}
+	sort.Slice(graph.Nodes, func(a, b int) bool { return graph.Nodes[a].Sender < graph.Nodes[b].Sender })
+	for _, edge := range edges {
+		graph.Edges = append(graph.Edges, *edge)
+	}
+	sort.Slice(graph.Edges, func(a, b int) bool {
+		if graph.Edges[a].Weight != graph.Edges[b].Weight {
+			return graph.Edges[a].Weight > graph.Edges[b].Weight
+		}
+		if graph.Edges[a].Source != graph.Edges[b].Source {
+			return graph.Edges[a].Source < graph.Edges[b].Source
+		}
+		return graph.Edges[a].Target < graph.Edges[b].Target
+	})
+	return graph
+}
+
+// Writes the graph as {"nodes": [...], "edges": [...]}, edges referring to nodes by sender
+func WriteJSON(w io.Writer, graph Graph) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(graph)
+}
+
+// Writes the graph as directed GraphML, which Gephi, Cytoscape and networkx read directly
+func WriteGraphML(w io.Writer, graph Graph) error {
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+	escape := func(s string) string {
+		var sb strings.Builder
+		xml.EscapeText(&sb, []byte(s))
+		return sb.String()
+	}
+
+	printf(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	printf(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	printf(`  <key id="messages" for="node" attr.name="messages" attr.type="int"/>` + "\n")
+	printf(`  <key id="weight" for="edge" attr.name="weight" attr.type="int"/>` + "\n")
+	printf(`  <key id="replies" for="edge" attr.name="replies" attr.type="int"/>` + "\n")
+	printf(`  <graph id="participants" edgedefault="directed">` + "\n")
+	for _, node := range graph.Nodes {
+		printf(`    <node id="%s"><data key="messages">%d</data></node>`+"\n", escape(node.Sender), node.Messages)
+	}
+	for _, edge := range graph.Edges {
+		printf(`    <edge source="%s" target="%s"><data key="weight">%d</data><data key="replies">%d</data></edge>`+"\n",
+			escape(edge.Source), escape(edge.Target), edge.Weight, edge.Replies)
+	}
+	printf("  </graph>\n</graphml>\n")
+	return err
+}
@@ -0,0 +1,133 @@
+package pinecone
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pisush/fin-chat/batch"
+	"github.com/pisush/fin-chat/i18n"
+)
+
+// What went wrong with a request, as far as the user can act on it
+const (
+	KindAuth      = "auth"      // the key is wrong, revoked or of another project
+	KindQuota     = "quota"     // a plan limit: indexes, storage, read or write units
+	KindDimension = "dimension" // the vectors don't have the index's dimension
+	KindRateLimit = "rate_limit"
+	KindNotFound  = "not_found"
+	KindServer    = "server"
+	KindOther     = "other"
+)
+
+// An error response of Pinecone, from the control or the data plane
+type Error struct {
+	StatusCode int
+	Code       string // e.g. UNAUTHENTICATED, RESOURCE_EXHAUSTED or, from the data plane, a gRPC code
+	Message    string
+	body       string
+}
+
+func (e *Error) Kind() string {
+	message := strings.ToLower(e.Message)
+	switch {
+	case e.StatusCode == http.StatusUnauthorized || e.Code == "UNAUTHENTICATED" || strings.Contains(message, "api key"):
+		return KindAuth
+	case strings.Contains(message, "dimension"):
+		return KindDimension
+	case e.StatusCode == http.StatusTooManyRequests && !strings.Contains(message, "limit for"):
+		return KindRateLimit
+	case e.StatusCode == http.StatusForbidden || e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode == http.StatusPaymentRequired || e.Code == "RESOURCE_EXHAUSTED" || strings.Contains(message, "quota"):
+		return KindQuota
+	case e.StatusCode == http.StatusNotFound:
+		return KindNotFound
+	case e.StatusCode >= http.StatusInternalServerError:
+		return KindServer
+	}
+	return KindOther
+}
+
+// The message with what to do about it
+func (e *Error) Error() string {
+	switch e.Kind() {
+	case KindAuth:
+		return i18n.T("pinecone.auth", e.Message)
+	case KindQuota:
+		return i18n.T("pinecone.quota", e.Message)
+	case KindDimension:
+		return i18n.T("pinecone.dimension", e.Message)
+	case KindRateLimit:
+		return i18n.T("pinecone.rate_limit", e.Message)
+	case KindNotFound:
+		return i18n.T("pinecone.not_found", e.Message)
+	case KindServer:
+		return i18n.T("pinecone.server", e.StatusCode, e.Message)
+	}
+	return i18n.T("pinecone.other", e.StatusCode, e.Message)
+}
+
+// The response as a batch.StatusError, so rejected batches are still retried smaller
+func (e *Error) Unwrap() error {
+	return &batch.StatusError{StatusCode: e.StatusCode, Body: e.body}
+}
+
+// Whether err makes every further request fail too: a wrong key, a plan limit or vectors
+// of the wrong dimension
+func Fatal(err error) bool {
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.Kind() {
+	case KindAuth, KindQuota, KindDimension:
+		return true
+	}
+	return false
+}
+
+// Reads the error of a response that isn't 2xx. The control plane wraps it as
+// {"error": {"code", "message"}}, the data plane sends {"code", "message"} and the legacy
+// API often plain text, which is kept as the message.
+func ReadError(resp *http.Response) *Error {
+	body, _ := io.ReadAll(resp.Body)
+	e := &Error{StatusCode: resp.StatusCode, body: string(body)}
+
+	var parsed struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+		Code    json.RawMessage `json:"code"` // a number from the data plane
+		Message string          `json:"message"`
+	}
+	if json.Unmarshal(body, &parsed) == nil {
+		switch {
+		case parsed.Error.Message != "":
+			e.Code, e.Message = parsed.Error.Code, parsed.Error.Message
+		case parsed.Message != "":
+			e.Code, e.Message = strings.Trim(string(parsed.Code), `"`), parsed.Message
+			if named, ok := grpcCodes[e.Code]; ok {
+				e.Code = named
+			}
+		}
+	}
+	if e.Message == "" {
+		e.Message = strings.TrimSpace(string(body))
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+// The gRPC status codes the data plane reports, by number, that say more than the HTTP status
+var grpcCodes = map[string]string{
+	"3":  "INVALID_ARGUMENT",
+	"5":  "NOT_FOUND",
+	"7":  "PERMISSION_DENIED",
+	"8":  "RESOURCE_EXHAUSTED",
+	"16": "UNAUTHENTICATED",
+}
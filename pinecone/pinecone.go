@@ -0,0 +1,517 @@
+package pinecone
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pisush/fin-chat/httpclient"
+	"github.com/pisush/fin-chat/querycache"
+	"github.com/pisush/fin-chat/secrets"
+)
+
+const (
+	// The current, global API: one control plane, serverless indexes with their own host
+	ModeCurrent   = "current"
+	controlURL    = "https://api.pinecone.io"
+	apiVersion    = "2024-07" // sent as X-Pinecone-API-Version
+	DefaultCloud  = "aws"
+	DefaultRegion = "us-east-1" // where the free tier's serverless indexes live
+
+	// The deprecated per-environment API, for projects that still use it
+	ModeLegacy         = "legacy"
+	DefaultEnvironment = "gcp-starter" // Other envs: https://docs.pinecone.io/docs/projects
+	legacyWhoami       = "actions/whoami"
+	legacyDatabases    = "databases/"
+	legacyCollections  = "collections/"
+)
+
+// Returned by DescribeIndex, DescribeCollection and DeleteIndex when there is nothing by that name
+var ErrIndexNotFound = errors.New("index not found")
+
+// The clouds serverless indexes can be created in
+var clouds = []string{"aws", "gcp", "azure"}
+
+var (
+	mode        = ModeCurrent
+	environment = DefaultEnvironment
+	spec        = IndexSpec{Cloud: DefaultCloud, Region: DefaultRegion, Replicas: 1}
+
+	hostsMu sync.Mutex
+	hosts   = map[string]string{} // index name -> data plane host, looked up once per run
+)
+
+// Describes an index as returned by the control plane
+type Index struct {
+	Name      string      `json:"name"`
+	Dimension int         `json:"dimension"`
+	Metric    string      `json:"metric"`
+	Host      string      `json:"host"`
+	Status    IndexStatus `json:"status"`
+}
+
+type IndexStatus struct {
+	Ready bool   `json:"ready"`
+	State string `json:"state"`
+}
+
+// What CreateIndex makes. With the current API an index is serverless in Cloud and Region,
+// or pod-based in the environment if PodType is set; with the legacy API it's always
+// pod-based, in the project's environment.
+type IndexSpec struct {
+	Cloud    string // aws, gcp or azure
+	Region   string // e.g. us-east-1 or europe-west4
+	PodType  string // e.g. p1.x1 or s1.x2; empty for the environment's default with the legacy API
+	Replicas int    // of a pod-based index
+}
+
+// A stored vector as fetched from an index
+type Vector struct {
+	ID       string                 `json:"id"`
+	Values   []float64              `json:"values"`
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// A snapshot of a pod-based index, legacy API only
+type Collection struct {
+	Name        string `json:"name"`
+	Status      string `json:"status"` // Initializing, Ready...
+	Dimension   int    `json:"dimension"`
+	VectorCount int    `json:"vector_count"`
+}
+
+// Vector counts of an index, from its data plane
+type IndexStats struct {
+	Dimension        int                       `json:"dimension"`
+	TotalVectorCount int                       `json:"totalVectorCount"`
+	Namespaces       map[string]NamespaceStats `json:"namespaces"`
+}
+
+type NamespaceStats struct {
+	VectorCount int `json:"vectorCount"`
+}
+
+// Picks the API used by all requests: ModeCurrent or ModeLegacy
+func SetMode(apiMode string) error {
+	if apiMode != ModeCurrent && apiMode != ModeLegacy {
+		return fmt.Errorf("unknown Pinecone API %q, use %s or %s", apiMode, ModeCurrent, ModeLegacy)
+	}
+	mode = apiMode
+	return nil
+}
+
+// The API in use, ModeCurrent or ModeLegacy
+func Mode() string {
+	return mode
+}
+
+// Sets the environment, e.g. us-west1-gcp: the project's with the legacy API, and the one
+// pod-based indexes are created in with the current API
+func SetEnvironment(env string) {
+	environment = env
+}
+
+// Sets what CreateIndex makes, after SetMode and SetEnvironment
+func SetIndexSpec(s IndexSpec) error {
+	if !slices.Contains(clouds, s.Cloud) {
+		return fmt.Errorf("unknown cloud %q, use one of %s", s.Cloud, strings.Join(clouds, ", "))
+	}
+	if s.Region == "" {
+		return fmt.Errorf("no region for serverless indexes")
+	}
+	if s.Replicas < 1 {
+		return fmt.Errorf("an index needs at least 1 replica, not %d", s.Replicas)
+	}
+	if s.PodType != "" && mode == ModeCurrent && environment == DefaultEnvironment {
+		return fmt.Errorf("pod-based indexes need the environment to create them in, e.g. --pinecone-env us-east1-gcp")
+	}
+	spec = s
+	return nil
+}
+
+func legacyCtrlURL() string {
+	return "https://controller." + environment + ".pinecone.io/"
+}
+
+// A request with the API key, JSON headers and, for the current API, its version
+func NewRequest(method, endpoint string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	key, err := secrets.Get(secrets.Pinecone)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, endpoint, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Api-Key", key)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if mode == ModeCurrent {
+		req.Header.Set("X-Pinecone-API-Version", apiVersion)
+	}
+	return req, nil
+}
+
+// The URL of a data plane path of the index, e.g. URL(name, "query")
+func URL(indexName, path string) (string, error) {
+	host, err := IndexHost(indexName)
+	if err != nil {
+		return "", err
+	}
+	return "https://" + host + "/" + path, nil
+}
+
+// The index's data plane host. The current API reports it in describe_index,
+// legacy hosts are built from the index name and the project.
+func IndexHost(indexName string) (string, error) {
+	hostsMu.Lock()
+	defer hostsMu.Unlock()
+	if host, ok := hosts[indexName]; ok {
+		return host, nil
+	}
+
+	var host string
+	if mode == ModeLegacy {
+		projectID, err := legacyProjectID()
+		if err != nil {
+			return "", err
+		}
+		host = indexName + "-" + projectID + ".svc." + environment + ".pinecone.io"
+	} else {
+		index, err := DescribeIndex(indexName)
+		if err != nil {
+			return "", err
+		}
+		host = strings.TrimPrefix(index.Host, "https://")
+	}
+	hosts[indexName] = host
+	return host, nil
+}
+
+// Looks up an index, ErrIndexNotFound if there is none by that name
+func DescribeIndex(indexName string) (*Index, error) {
+	if mode == ModeLegacy {
+		// Legacy indexes nest their configuration under "database" and have no host
+		var legacy struct {
+			Database Index       `json:"database"`
+			Status   IndexStatus `json:"status"`
+		}
+		if err := do(http.MethodGet, legacyCtrlURL()+legacyDatabases+indexName, nil, &legacy); err != nil {
+			return nil, err
+		}
+		index := legacy.Database
+		index.Status = legacy.Status
+		return &index, nil
+	}
+
+	var index Index
+	if err := do(http.MethodGet, controlURL+"/indexes/"+indexName, nil, &index); err != nil {
+		return nil, err
+	}
+	return &index, nil
+}
+
+// How many vectors the index holds, in total and per namespace
+func DescribeIndexStats(indexName string) (*IndexStats, error) {
+	endpoint, err := URL(indexName, "describe_index_stats")
+	if err != nil {
+		return nil, err
+	}
+	var stats IndexStats
+	if err := do(http.MethodGet, endpoint, nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// One page of the IDs in a namespace and the token of the next page, empty after the last.
+// Listing is only offered for serverless indexes, so not with the legacy API.
+func ListVectorIDs(indexName, namespace string, limit int, paginationToken string) ([]string, string, error) {
+	if mode == ModeLegacy {
+		return nil, "", fmt.Errorf("listing vectors needs a serverless index, legacy indexes are backed up as collections")
+	}
+	params := url.Values{"limit": {strconv.Itoa(limit)}}
+	if namespace != "" {
+		params.Set("namespace", namespace)
+	}
+	if paginationToken != "" {
+		params.Set("paginationToken", paginationToken)
+	}
+	endpoint, err := URL(indexName, "vectors/list?"+params.Encode())
+	if err != nil {
+		return nil, "", err
+	}
+
+	var page struct {
+		Vectors []struct {
+			ID string `json:"id"`
+		} `json:"vectors"`
+		Pagination struct {
+			Next string `json:"next"`
+		} `json:"pagination"`
+	}
+	if err := do(http.MethodGet, endpoint, nil, &page); err != nil {
+		return nil, "", err
+	}
+	ids := make([]string, len(page.Vectors))
+	for i, v := range page.Vectors {
+		ids[i] = v.ID
+	}
+	return ids, page.Pagination.Next, nil
+}
+
+// The vectors with the given IDs in a namespace, with their values and metadata
+func FetchVectors(indexName, namespace string, ids []string) (map[string]Vector, error) {
+	params := url.Values{"ids": ids}
+	if namespace != "" {
+		params.Set("namespace", namespace)
+	}
+	endpoint, err := URL(indexName, "vectors/fetch?"+params.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	var fetched struct {
+		Vectors map[string]Vector `json:"vectors"`
+	}
+	if err := do(http.MethodGet, endpoint, nil, &fetched); err != nil {
+		return nil, err
+	}
+	return fetched.Vectors, nil
+}
+
+// Sets the given metadata fields of a vector, leaving the others as they are
+func UpdateMetadata(indexName, namespace, id string, metadata map[string]interface{}) error {
+	endpoint, err := URL(indexName, "vectors/update")
+	if err != nil {
+		return err
+	}
+	update := map[string]interface{}{"id": id, "setMetadata": metadata}
+	if namespace != "" {
+		update["namespace"] = namespace
+	}
+	body, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	if err := do(http.MethodPost, endpoint, body, nil); err != nil {
+		return err
+	}
+	querycache.Invalidate(indexName, namespace)
+	return nil
+}
+
+// Deletes vectors of a namespace for good
+func DeleteVectors(indexName, namespace string, ids []string) error {
+	endpoint, err := URL(indexName, "vectors/delete")
+	if err != nil {
+		return err
+	}
+	request := map[string]interface{}{"ids": ids}
+	if namespace != "" {
+		request["namespace"] = namespace
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	if err := do(http.MethodPost, endpoint, body, nil); err != nil {
+		return err
+	}
+	querycache.Invalidate(indexName, namespace)
+	return nil
+}
+
+// Snapshots a pod-based index into a new collection, legacy API only
+func CreateCollection(name, indexName string) error {
+	if mode != ModeLegacy {
+		return fmt.Errorf("collections are only used with the legacy API")
+	}
+	body, err := json.Marshal(map[string]string{"name": name, "source": indexName})
+	if err != nil {
+		return err
+	}
+	return do(http.MethodPost, legacyCtrlURL()+legacyCollections, body, nil)
+}
+
+// Looks up a collection, ErrIndexNotFound if there is none by that name
+func DescribeCollection(name string) (*Collection, error) {
+	if mode != ModeLegacy {
+		return nil, fmt.Errorf("collections are only used with the legacy API")
+	}
+	var collection Collection
+	if err := do(http.MethodGet, legacyCtrlURL()+legacyCollections+name, nil, &collection); err != nil {
+		return nil, err
+	}
+	return &collection, nil
+}
+
+// Creates a pod-based index holding the vectors of a collection, legacy API only
+func CreateIndexFromCollection(indexName, collection string, dimension int, metric string) error {
+	if mode != ModeLegacy {
+		return fmt.Errorf("collections are only used with the legacy API")
+	}
+	data := map[string]interface{}{
+		"name":              indexName,
+		"dimension":         dimension,
+		"metric":            metric,
+		"source_collection": collection,
+	}
+	addLegacyPods(data)
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return do(http.MethodPost, legacyCtrlURL()+legacyDatabases, body, nil)
+}
+
+// All indexes of the project, in the order Pinecone lists them
+func ListIndexes() ([]Index, error) {
+	if mode == ModeLegacy {
+		// The legacy API only lists names, each one is described on its own
+		var names []string
+		if err := do(http.MethodGet, legacyCtrlURL()+legacyDatabases, nil, &names); err != nil {
+			return nil, err
+		}
+		indexes := make([]Index, 0, len(names))
+		for _, name := range names {
+			index, err := DescribeIndex(name)
+			if err != nil {
+				return nil, err
+			}
+			indexes = append(indexes, *index)
+		}
+		return indexes, nil
+	}
+
+	var list struct {
+		Indexes []Index `json:"indexes"`
+	}
+	if err := do(http.MethodGet, controlURL+"/indexes", nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Indexes, nil
+}
+
+// Creates an index as set by SetIndexSpec: by default serverless in aws/us-east-1 with the
+// current API, in the project's environment with the legacy one
+func CreateIndex(indexName string, dimension int, metric string) error {
+	data := map[string]interface{}{
+		"name":      indexName,
+		"dimension": dimension,
+		"metric":    metric,
+	}
+	endpoint := legacyCtrlURL() + legacyDatabases
+	switch {
+	case mode == ModeLegacy:
+		addLegacyPods(data)
+	case spec.PodType != "":
+		endpoint = controlURL + "/indexes"
+		data["spec"] = map[string]interface{}{
+			"pod": map[string]interface{}{"environment": environment, "pod_type": spec.PodType, "replicas": spec.Replicas, "pods": 1},
+		}
+	default:
+		endpoint = controlURL + "/indexes"
+		data["spec"] = map[string]interface{}{
+			"serverless": map[string]interface{}{"cloud": spec.Cloud, "region": spec.Region},
+		}
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return do(http.MethodPost, endpoint, body, nil)
+}
+
+// Adds the pod type and replicas to a legacy create request, if they aren't the
+// environment's defaults
+func addLegacyPods(data map[string]interface{}) {
+	if spec.PodType != "" {
+		data["pod_type"] = spec.PodType
+	}
+	if spec.Replicas > 1 {
+		data["replicas"] = spec.Replicas
+	}
+}
+
+// Deletes an index and all its vectors, ErrIndexNotFound if there is none by that name
+func DeleteIndex(indexName string) error {
+	endpoint := controlURL + "/indexes/" + indexName
+	if mode == ModeLegacy {
+		endpoint = legacyCtrlURL() + legacyDatabases + indexName
+	}
+	if err := do(http.MethodDelete, endpoint, nil, nil); err != nil {
+		return err
+	}
+	querycache.InvalidateIndex(indexName)
+
+	hostsMu.Lock()
+	delete(hosts, indexName)
+	hostsMu.Unlock()
+	return nil
+}
+
+// Checks the API key, and the environment with the legacy API, and returns the key's
+// project: its name from whoami with the legacy API. The current API has no whoami, the
+// indexes are listed instead and the name is empty.
+func Whoami() (string, error) {
+	if mode == ModeLegacy {
+		return legacyProjectID()
+	}
+	_, err := ListIndexes()
+	return "", err
+}
+
+// The project name of the API key, which is part of legacy index hosts
+func legacyProjectID() (string, error) {
+	var result map[string]interface{}
+	if err := do(http.MethodGet, legacyCtrlURL()+legacyWhoami, nil, &result); err != nil {
+		return "", err
+	}
+	projectID, ok := result["project_name"].(string)
+	if !ok {
+		return "", fmt.Errorf("project_name not found or is not a string")
+	}
+	return projectID, nil
+}
+
+// Sends a control plane request and decodes the JSON response into out, if given
+func do(method, endpoint string, body []byte, out interface{}) error {
+	req, err := NewRequest(method, endpoint, body)
+	if err != nil {
+		return err
+	}
+
+	client := httpclient.Client()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && method != http.MethodPost {
+		return ErrIndexNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %w", method, endpoint, ReadError(resp))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
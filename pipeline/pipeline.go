@@ -0,0 +1,155 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pisush/fin-chat/cron"
+	"github.com/pisush/fin-chat/parser"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultPath = "./pipeline.yaml"
+	DefaultSync = "@nightly" // when daemon applies the spec, unless it says
+)
+
+// Actions a schedule can run
+const (
+	ActionBackup  = "backup"
+	ActionArchive = "archive"
+	ActionSync    = "sync" // what daemon runs on Spec.Sync, applying the whole spec
+)
+
+// The whole archive setup, what apply makes the index match. See the README for an example.
+type Spec struct {
+	Sources       []Source      `yaml:"sources"`
+	Preprocessing Preprocessing `yaml:"preprocessing"`
+	Embedder      Embedder      `yaml:"embedder"`
+	Store         Store         `yaml:"store"`
+	Schedules     []Schedule    `yaml:"schedules"`
+	Sync          string        `yaml:"sync"` // when daemon applies the spec, a cron schedule, DefaultSync if empty
+}
+
+// A chat export to ingest
+type Source struct {
+	Name       string `yaml:"name"`        // for the plan, the path if empty
+	Path       string `yaml:"path"`        // a local path or an s3:// or gs:// URL
+	Parser     string `yaml:"parser"`      // as --format, detected from the export if empty
+	Columns    string `yaml:"columns"`     // for the generic parser, as --columns
+	TimeLayout string `yaml:"time_layout"` // for the generic parser, as --time-layout
+	DateOrder  string `yaml:"date_order"`  // for WhatsApp exports, as --date-order
+	Namespace  string `yaml:"namespace"`   // for exports without channels, the default namespace if empty
+}
+
+// What is done to messages before they are embedded, as the flags of the same names
+type Preprocessing struct {
+	Emoji       string `yaml:"emoji"`
+	Spam        string `yaml:"spam"`
+	System      string `yaml:"system_messages"`
+	Sentiment   string `yaml:"sentiment"`
+	Entities    string `yaml:"entities"`
+	Timezone    string `yaml:"timezone"`
+	Redact      bool   `yaml:"redact"`
+	Anonymize   bool   `yaml:"anonymize"`
+	Incremental bool   `yaml:"incremental"`
+}
+
+type Embedder struct {
+	Model      string `yaml:"model"`
+	Dimensions int    `yaml:"dimensions"` // as --dimensions
+}
+
+// Where the vectors and files go
+type Store struct {
+	API        string `yaml:"api"`        // as --pinecone-api
+	Embeddings string `yaml:"embeddings"` // as --embeddings
+	BackupDir  string `yaml:"backup_dir"` // as --backup-dir
+}
+
+// An action apply runs when its interval has passed since it last ran
+type Schedule struct {
+	Action string `yaml:"action"` // backup or archive
+	Every  string `yaml:"every"`  // a duration, e.g. 24h
+	Years  int    `yaml:"years"`  // for archive, as --archive-after
+}
+
+// Reads and checks a YAML spec. Unknown keys are errors, so a typo isn't silently ignored.
+func Load(path string) (*Spec, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	spec := &Spec{}
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(spec); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := spec.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return spec, nil
+}
+
+func (s *Spec) validate() error {
+	if len(s.Sources) == 0 {
+		return fmt.Errorf("no sources")
+	}
+	for i := range s.Sources {
+		if s.Sources[i].Path == "" {
+			return fmt.Errorf("source %d has no path", i+1)
+		}
+		if s.Sources[i].Parser != "" {
+			if _, err := parser.Lookup(s.Sources[i].Parser); err != nil {
+				return fmt.Errorf("source %d: %w", i+1, err)
+			}
+		}
+		if err := parser.ValidDateOrder(s.Sources[i].DateOrder); err != nil {
+			return fmt.Errorf("source %d: %w", i+1, err)
+		}
+	}
+	if s.Sync == "" {
+		s.Sync = DefaultSync
+	}
+	sync, err := cron.Parse(s.Sync)
+	if err != nil {
+		return err
+	}
+	if sync.Next(time.Now()).IsZero() {
+		return fmt.Errorf("the sync schedule %q never comes", s.Sync)
+	}
+	seen := map[string]bool{}
+	for _, schedule := range s.Schedules {
+		if schedule.Action != ActionBackup && schedule.Action != ActionArchive {
+			return fmt.Errorf("unknown scheduled action %q, use %s or %s", schedule.Action, ActionBackup, ActionArchive)
+		}
+		if seen[schedule.Action] {
+			return fmt.Errorf("%s is scheduled twice", schedule.Action)
+		}
+		seen[schedule.Action] = true
+		if every, err := time.ParseDuration(schedule.Every); err != nil || every <= 0 {
+			return fmt.Errorf("%s: every must be a duration like 24h, not %q", schedule.Action, schedule.Every)
+		}
+	}
+	return nil
+}
+
+func (s Source) Label() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Path
+}
+
+// Whether the schedule should run at now, given when it last ran (zero if never)
+func (s Schedule) Due(last, now time.Time) bool {
+	every, _ := time.ParseDuration(s.Every) // checked by Load
+	return last.IsZero() || now.Sub(last) >= every
+}
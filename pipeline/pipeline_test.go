@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func load(t *testing.T, spec string) (*Spec, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "pipeline.yaml")
+	if err := os.WriteFile(path, []byte(spec), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestLoad(t *testing.T) {
+	// Anchors, flow mappings and block scalars are all YAML a spec may use
+	spec, err := load(t, `
+sources:
+  - &whatsapp
+    name: family
+    path: ./family.txt
+    parser: whatsapp
+  - <<: *whatsapp
+    name: work
+    path: "s3://chats/work.txt"
+    namespace: work
+preprocessing: {redact: true, emoji: describe}
+store:
+  embeddings: s3://chats/embeddings.csv
+  backup_dir: >-
+    s3://chats/backups
+schedules:
+  - action: backup
+    every: 24h
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Sources) != 2 || spec.Sources[1].Namespace != "work" || spec.Sources[1].Parser != "whatsapp" {
+		t.Errorf("sources = %+v", spec.Sources)
+	}
+	if !spec.Preprocessing.Redact || spec.Preprocessing.Emoji != "describe" {
+		t.Errorf("preprocessing = %+v", spec.Preprocessing)
+	}
+	if spec.Store.BackupDir != "s3://chats/backups" {
+		t.Errorf("backup_dir = %q", spec.Store.BackupDir)
+	}
+	if spec.Sync != DefaultSync {
+		t.Errorf("sync = %q, want %q", spec.Sync, DefaultSync)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	for _, c := range []struct{ name, spec, want string }{
+		{"empty", "", "no sources"},
+		{"unknown key", "sources:\n  - path: a.txt\n    namespce: x\n", "namespce"},
+		{"no path", "sources:\n  - name: a\n", "no path"},
+		{"bad schedule", "sources:\n  - path: a.txt\nschedules:\n  - {action: backup, every: daily}\n", "duration"},
+	} {
+		if _, err := load(t, c.spec); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want an error mentioning %q", c.name, err, c.want)
+		}
+	}
+}
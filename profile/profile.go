@@ -0,0 +1,74 @@
+package profile
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+)
+
+const DefaultPath = "./profiles.json"
+
+// A chat archive: which index it lives in and how to reach it. Empty fields keep the defaults,
+// and flags given on the command line win over the profile.
+type Profile struct {
+	Index       string `json:"index"`        // the Pinecone index
+	Namespace   string `json:"namespace"`    // searched, and given to messages of exports without channels
+	PineconeAPI string `json:"pinecone_api"` // as --pinecone-api
+	PineconeEnv string `json:"pinecone_env"` // as --pinecone-env, the project's environment with the legacy API
+	Keys        string `json:"keys"`         // as --keys
+	Source      string `json:"source"`       // as --source
+	Input       string `json:"input"`        // as --input
+	Embeddings  string `json:"embeddings"`   // as --embeddings
+
+	// Where and on what upsert creates the index, as --pinecone-cloud, --pinecone-region,
+	// --pod-type and --replicas
+	PineconeCloud  string `json:"pinecone_cloud"`
+	PineconeRegion string `json:"pinecone_region"`
+	PodType        string `json:"pod_type"`
+	Replicas       int    `json:"replicas"`
+}
+
+type config struct {
+	Default  string             `json:"default"` // used without --profile
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+// Reads the profile called name from the config file, or its default profile if name is empty.
+// Without a config file or a default, the empty profile and name are returned.
+func Load(path, name string) (Profile, string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && name == "" {
+		return Profile{}, "", nil
+	}
+	if err != nil {
+		return Profile{}, "", err
+	}
+
+	var cfg config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return Profile{}, "", fmt.Errorf("%s: %w", path, err)
+	}
+	if name == "" {
+		name = cfg.Default
+	}
+	if name == "" {
+		return Profile{}, "", nil
+	}
+	p, ok := cfg.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(cfg.Profiles))
+		for n := range cfg.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return Profile{}, "", fmt.Errorf("no profile %q in %s, there are: %s", name, path, strings.Join(names, ", "))
+	}
+	return p, name, nil
+}
@@ -0,0 +1,161 @@
+package query
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pisush/fin-chat/archive"
+	"github.com/pisush/fin-chat/normalize"
+	"github.com/pisush/fin-chat/pinecone"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+const (
+	minKeywordShare = 0.5 // of the query's words a message must contain to be a keyword match
+	minPhoneDigits  = 5   // digits a number needs to also be matched ignoring spaces and dashes, e.g. a phone number
+)
+
+// The messages of the embeddings file, kept between searches until the file changes
+var (
+	localMu       sync.Mutex
+	localPath     string
+	localModified time.Time
+	localRows     []vectors.Row // without their values
+)
+
+// Searches the messages of the local embeddings file for the query's words, for what embeddings
+// find poorly: names, phone numbers, addresses. A message containing the whole query scores 1,
+// others the share of its words they contain, at least minKeywordShare. The matches are fetched
+// from the index, so they are returned as it holds them, e.g. redacted, and messages forgotten,
+// archived or left out by the filter are not returned.
+func KeywordSearch(indexName, embeddingsFileName, queryMessage string, topK int, filter Filter, log *log.Logger) ([]QueryResponse, error) {
+	rows, err := localMessages(embeddingsFileName, log)
+	if err != nil {
+		return nil, err
+	}
+
+	phrase := strings.ToLower(normalize.Text(queryMessage))
+	terms := words(phrase)
+	// A query of only a number, e.g. "054-123 4567", also matches it written differently
+	phraseDigits := ""
+	if !strings.ContainsFunc(phrase, unicode.IsLetter) {
+		phraseDigits = digits(phrase)
+	}
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	type scored struct {
+		row   vectors.Row
+		score float64
+	}
+	var found []scored
+	for _, row := range rows {
+		if row.Namespace != filter.Namespace {
+			continue
+		}
+		text := strings.ToLower(normalize.Text(row.Text))
+		score := 0.0
+		if strings.Contains(text, phrase) || len(phraseDigits) >= minPhoneDigits && strings.Contains(digits(text), phraseDigits) {
+			score = 1
+		} else {
+			have := words(text)
+			for term := range terms {
+				if have[term] {
+					score++
+				}
+			}
+			score /= float64(len(terms))
+		}
+		if score >= minKeywordShare {
+			found = append(found, scored{row, score})
+		}
+	}
+	// The best first, and among equals the latest
+	sort.Slice(found, func(a, b int) bool {
+		if found[a].score != found[b].score {
+			return found[a].score > found[b].score
+		}
+		return found[a].row.Timestamp.After(found[b].row.Timestamp)
+	})
+
+	// More than topK are fetched, some may have been left out of the index since
+	var ids []string
+	score := map[string]float64{}
+	for _, f := range found {
+		if len(ids) == min(topK*asOfOversample, maxTopK) {
+			break
+		}
+		if _, ok := score[f.row.ID]; !ok {
+			ids = append(ids, f.row.ID)
+			score[f.row.ID] = f.score
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	fetched, err := pinecone.FetchVectors(indexName, filter.Namespace, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []QueryResponse
+	for _, id := range ids {
+		vector, ok := fetched[id]
+		if !ok || !filter.keeps(archive.Entry{Vector: vector, Namespace: filter.Namespace}) {
+			continue
+		}
+		matches = append(matches, QueryResponse{ID: id, Score: score[id], Metadata: vector.Metadata})
+		if len(matches) == topK {
+			break
+		}
+	}
+	return matches, nil
+}
+
+// The rows of the embeddings file, read again only when it changed
+func localMessages(embeddingsFileName string, log *log.Logger) ([]vectors.Row, error) {
+	localMu.Lock()
+	defer localMu.Unlock()
+	info, err := os.Stat(embeddingsFileName)
+	if err != nil {
+		return nil, err
+	}
+	if embeddingsFileName == localPath && info.ModTime().Equal(localModified) {
+		return localRows, nil
+	}
+	rows, err := vectors.ReadFile(embeddingsFileName, log)
+	if err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		rows[i].Values = nil
+	}
+	localPath, localModified, localRows = embeddingsFileName, info.ModTime(), rows
+	return rows, nil
+}
+
+// The words of a lowercased text, of 2 letters or digits or more
+func words(text string) map[string]bool {
+	found := map[string]bool{}
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if len([]rune(word)) > 1 {
+			found[word] = true
+		}
+	}
+	return found
+}
+
+func digits(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, text)
+}
@@ -0,0 +1,383 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/anonymize"
+	"github.com/pisush/fin-chat/archive"
+	"github.com/pisush/fin-chat/embed"
+	"github.com/pisush/fin-chat/emoji"
+	"github.com/pisush/fin-chat/entities"
+	"github.com/pisush/fin-chat/httpclient"
+	"github.com/pisush/fin-chat/normalize"
+	"github.com/pisush/fin-chat/pinecone"
+	"github.com/pisush/fin-chat/querycache"
+	"github.com/pisush/fin-chat/spam"
+	"github.com/pisush/fin-chat/store"
+	"github.com/pisush/fin-chat/system"
+	"github.com/pisush/fin-chat/timezone"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+const (
+	asOfOversample = 3    // with an as-of date, matches ingested later are dropped after the query
+	maxTopK        = 1000 // Pinecone's topK limit for queries returning metadata
+)
+
+// Searches only see what the archive held before this time, zero for everything
+var asOf time.Time
+
+// Limits every search to the vectors ingested before t: messages timestamped later are
+// filtered out by Pinecone, and matches whose "ingested" metadata is later are dropped
+func SetAsOf(t time.Time) {
+	asOf = t
+}
+
+// Whether searches also look through the vectors moved to the local archive
+var includeArchive bool
+
+// Adds the archive of old vectors to every search, searched on this machine and merged
+// with the index's matches by score
+func SetIncludeArchive(on bool) {
+	includeArchive = on
+}
+
+// Used to parse the response from a query to the Pinecone index.
+type QueryResponse struct {
+	ID           string    `json:"id"`
+	Score        float64   `json:"score"`
+	Values       []float64 `json:"values"`
+	SparseValues struct {
+		Indices []int     `json:"indices"`
+		Values  []float64 `json:"values"`
+	} `json:"sparseValues"`
+	Metadata map[string]interface{} `json:"metadata"`
+
+	Explanation []string `json:"explanation,omitempty"` // how the ranking stages got to Score, with --explain
+}
+
+type QueryResponseBody struct {
+	Matches   []QueryResponse `json:"matches"`
+	Namespace string          `json:"namespace"`
+}
+
+// Narrows a query by namespace, sender and date range. Zero values are not filtered on.
+type Filter struct {
+	Namespace string // searched namespace, empty for the default one
+	Sender    string
+	Language  string // e.g. "he", as detected by the lang package at upsert
+	Tone      string // e.g. "angry", as scored by the sentiment package at upsert
+	Mentions  string // a person, place or organization, as found by the entities package at upsert
+	From      time.Time
+	To        time.Time
+}
+
+// Returns the message text stored in the match metadata
+func (r QueryResponse) Text() string {
+	text, _ := r.Metadata["text"].(string)
+	return text
+}
+
+// Returns the sender stored in the match metadata
+func (r QueryResponse) Sender() string {
+	sender, _ := r.Metadata["sender"].(string)
+	return sender
+}
+
+// Returns the message time stored in the match metadata
+func (r QueryResponse) Timestamp() time.Time {
+	timestamp, _ := r.Metadata["timestamp"].(float64)
+	return timezone.Clock(time.Unix(int64(timestamp), 0))
+}
+
+// Converts the filter to Pinecone's metadata filter syntax
+func (f Filter) pineconeFilter() map[string]interface{} {
+	filter := map[string]interface{}{}
+	if f.Sender != "" {
+		filter["sender"] = map[string]interface{}{"$eq": anonymize.Pseudonym(f.Sender)}
+	}
+	if f.Language != "" {
+		filter["lang"] = map[string]interface{}{"$eq": f.Language}
+	}
+	if f.Tone != "" {
+		filter["tone"] = map[string]interface{}{"$eq": f.Tone}
+	}
+	if name := f.mentioned(); name != "" {
+		var clauses []interface{}
+		for _, key := range []string{entities.People, entities.Places, entities.Organizations} {
+			clauses = append(clauses, map[string]interface{}{key: map[string]interface{}{"$in": []string{name}}})
+		}
+		filter["$or"] = clauses
+	}
+
+	timestamp := map[string]interface{}{}
+	if !f.From.IsZero() {
+		timestamp["$gte"] = f.From.Unix()
+	}
+	if !f.To.IsZero() {
+		timestamp["$lte"] = f.To.Unix()
+	}
+	// A message can't have been ingested before it was written
+	if !asOf.IsZero() {
+		timestamp["$lt"] = asOf.Unix()
+	}
+	if len(timestamp) > 0 {
+		filter["timestamp"] = timestamp
+	}
+	if spam.Mode() == spam.ModeTag {
+		filter["spam"] = map[string]interface{}{"$ne": true}
+	}
+	if system.Mode() == system.ModeTag {
+		filter["system"] = map[string]interface{}{"$ne": true}
+	}
+	filter["deleted"] = map[string]interface{}{"$ne": true} // soft-deleted by forget
+	return filter
+}
+
+// Whether an archived vector passes the filter, the same conditions as pineconeFilter
+func (f Filter) keeps(e archive.Entry) bool {
+	if e.Namespace != f.Namespace {
+		return false
+	}
+	text := func(key string) string {
+		value, _ := e.Metadata[key].(string)
+		return value
+	}
+	flag := func(key string) bool {
+		value, _ := e.Metadata[key].(bool)
+		return value
+	}
+	if f.Sender != "" && text("sender") != anonymize.Pseudonym(f.Sender) {
+		return false
+	}
+	if f.Language != "" && text("lang") != f.Language {
+		return false
+	}
+	if f.Tone != "" && text("tone") != f.Tone {
+		return false
+	}
+	if name := f.mentioned(); name != "" {
+		found := false
+		for _, key := range []string{entities.People, entities.Places, entities.Organizations} {
+			names, _ := e.Metadata[key].([]interface{})
+			for _, n := range names {
+				found = found || n == name
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	timestamp, _ := e.Metadata["timestamp"].(float64)
+	if !f.From.IsZero() && int64(timestamp) < f.From.Unix() {
+		return false
+	}
+	if !f.To.IsZero() && int64(timestamp) > f.To.Unix() {
+		return false
+	}
+	if !asOf.IsZero() {
+		if int64(timestamp) >= asOf.Unix() {
+			return false
+		}
+		if ingested, ok := e.Metadata["ingested"].(float64); ok && int64(ingested) >= asOf.Unix() {
+			return false
+		}
+	}
+	if spam.Mode() == spam.ModeTag && flag("spam") {
+		return false
+	}
+	if system.Mode() == system.ModeTag && flag("system") {
+		return false
+	}
+	return !flag("deleted")
+}
+
+// The name searched for, as the entities package stores it
+func (f Filter) mentioned() string {
+	return strings.ToLower(strings.Join(strings.Fields(f.Mentions), " "))
+}
+
+// Input is a string, and output are the topK nearest messages
+func QueryPinecone(indexName, queryMessage string, topK int, filter Filter, log *log.Logger) ([]QueryResponse, error) {
+	return queryPinecone(indexName, queryMessage, topK, filter, false, log)
+}
+
+// Like QueryPinecone, with the vectors of the matches in their Values
+func QueryPineconeWithValues(indexName, queryMessage string, topK int, filter Filter, log *log.Logger) ([]QueryResponse, error) {
+	return queryPinecone(indexName, queryMessage, topK, filter, true, log)
+}
+
+func queryPinecone(indexName, queryMessage string, topK int, filter Filter, includeValues bool, log *log.Logger) ([]QueryResponse, error) {
+
+	// The query message is cleaned the same way as the messages. A query of nothing but
+	// emoji is embedded as it is rather than not at all.
+	input := normalize.Text(queryMessage)
+	if withoutEmoji := emoji.Apply(input); withoutEmoji != "" {
+		input = withoutEmoji
+	}
+
+	// A search repeated within the cache's TTL is answered without embedding or Pinecone. The
+	// model and dimension are in the key, another model's query vector finds other matches.
+	cacheKey := querycache.Key(indexName, embed.Model(), embed.Dimension(), input, topK, filter.Namespace, filter.pineconeFilter(), includeValues, includeArchive)
+	var cached []QueryResponse
+	if hit, err := querycache.Get(cacheKey, &cached); err != nil {
+		log.Printf("Error reading the query cache: %v", err)
+	} else if hit {
+		return cached, nil
+	}
+
+	// Prepare query
+	url, err := pinecone.URL(indexName, "query")
+	if err != nil {
+		log.Printf("Error looking up the index host: %v", err)
+		return nil, err
+	}
+
+	// Embed the query message to get the query vector
+	embedded, err := embed.Embed(context.Background(), []string{input}, embed.WithModel(embed.Model()))
+	if err != nil {
+		log.Printf("Error embedding query message: %v", err)
+		return nil, fmt.Errorf("error embedding query message: %v", err)
+	}
+	queryVector := vectors.Normalize(embedded[0])
+
+	requested := topK
+	if !asOf.IsZero() {
+		requested = min(topK*asOfOversample, maxTopK)
+	}
+	queryData := map[string]interface{}{
+		"includeValues":   includeValues,
+		"includeMetadata": true,
+		"topK":            requested,
+		"vector":          queryVector,
+	}
+	if filter.Namespace != "" {
+		queryData["namespace"] = filter.Namespace
+	}
+	if pcFilter := filter.pineconeFilter(); pcFilter != nil {
+		queryData["filter"] = pcFilter
+	}
+
+	jsonData, err := json.Marshal(queryData)
+	if err != nil {
+		log.Printf("Error marshalling query data: %v", err)
+		return nil, err
+	}
+
+	req, err := pinecone.NewRequest("POST", url, jsonData)
+	if err != nil {
+		log.Printf("Error creating new request: %v", err)
+		return nil, err
+	}
+
+	client := httpclient.Client()
+	resp, err := client.Do(req)
+
+	if err != nil {
+		log.Printf("Error sending request: %v", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := pinecone.ReadError(resp)
+		log.Printf("Error querying Pinecone: %v", err)
+		return nil, err
+	}
+
+	var response QueryResponseBody
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		log.Printf("Error decoding response body: %v", err)
+		return nil, err
+	}
+
+	matches := response.Matches
+	if !asOf.IsZero() {
+		matches = matches[:0]
+		for _, match := range response.Matches {
+			// Vectors upserted before ingestion times were recorded only have their timestamp to go by
+			if ingested, ok := match.Metadata["ingested"].(float64); ok && int64(ingested) >= asOf.Unix() {
+				continue
+			}
+			matches = append(matches, match)
+		}
+	}
+	if includeArchive {
+		if matches, err = withArchive(indexName, matches, queryVector, topK, filter, includeValues); err != nil {
+			log.Printf("Error searching the archive: %v", err)
+			return nil, err
+		}
+	}
+	matches = matches[:min(topK, len(matches))]
+	if err := withStoredMessages(matches); err != nil {
+		log.Printf("Error reading the message store: %v", err)
+	}
+	if err := querycache.Put(indexName, filter.Namespace, cacheKey, matches); err != nil {
+		log.Printf("Error writing the query cache: %v", err)
+	}
+	return matches, nil
+}
+
+// Fills in the text, sender and time of matches whose vectors were upserted without them,
+// from the local message store embed writes
+func withStoredMessages(matches []QueryResponse) error {
+	var missing []string
+	for _, match := range matches {
+		if match.Text() == "" {
+			missing = append(missing, match.ID)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	stored, err := store.Get(missing)
+	if err != nil {
+		return err
+	}
+	for i, match := range matches {
+		message, ok := stored[match.ID]
+		if !ok || match.Text() != "" {
+			continue
+		}
+		if matches[i].Metadata == nil {
+			matches[i].Metadata = map[string]interface{}{}
+		}
+		matches[i].Metadata["text"] = message.Text
+		matches[i].Metadata["sender"] = message.Sender
+		matches[i].Metadata["timestamp"] = float64(message.Timestamp.Unix()) // as decoded from JSON
+	}
+	return nil
+}
+
+// Merges the best archived matches into the index's, by score. A vector in both, as after an
+// interrupted archive run, is only returned once.
+func withArchive(indexName string, matches []QueryResponse, queryVector []float64, topK int, filter Filter, includeValues bool) ([]QueryResponse, error) {
+	archived, err := archive.Search(indexName, queryVector, topK, filter.keeps)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, match := range matches {
+		seen[match.ID] = true
+	}
+	for _, a := range archived {
+		if seen[a.ID] {
+			continue
+		}
+		match := QueryResponse{ID: a.ID, Score: a.Score, Metadata: a.Metadata}
+		if includeValues {
+			match.Values = a.Values
+		}
+		matches = append(matches, match)
+	}
+	sort.SliceStable(matches, func(a, b int) bool { return matches[a].Score > matches[b].Score })
+	return matches, nil
+}
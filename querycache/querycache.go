@@ -0,0 +1,155 @@
+package querycache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pisush/fin-chat/secure"
+)
+
+const Path = "./query_cache.json" // encrypted with --encrypt, results hold message text
+
+// How long results are reused, 0 when the cache is off
+var ttl time.Duration
+
+var (
+	mu      sync.Mutex
+	cleared = map[string]time.Time{} // index/namespace -> when Invalidate last cleared it
+)
+
+// The results of one search
+type entry struct {
+	Index     string          `json:"index"`
+	Namespace string          `json:"namespace"`
+	Stored    time.Time       `json:"stored"`
+	Results   json.RawMessage `json:"results"`
+}
+
+// Turns the cache on for searches, reusing their results for ttl, or off with 0. Writes to
+// the index clear it either way, so turning it on later doesn't bring back stale results.
+func SetTTL(d time.Duration) {
+	ttl = d
+}
+
+// Whether searches are cached
+func Enabled() bool {
+	return ttl > 0
+}
+
+// The cache key of a search: a hash of everything that decides its results, e.g. the query
+// text, the index, the filter and the number of results
+func Key(parts ...interface{}) string {
+	data, _ := json.Marshal(parts)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Reads the results stored under key into out, if they are younger than the TTL
+func Get(key string, out interface{}) (bool, error) {
+	if !Enabled() {
+		return false, nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	entries, err := load()
+	if err != nil {
+		return false, err
+	}
+	e, ok := entries[key]
+	if !ok || time.Since(e.Stored) > ttl {
+		return false, nil
+	}
+	return true, json.Unmarshal(e.Results, out)
+}
+
+// Stores the results of a search of the namespace under key, dropping the expired ones
+func Put(index, namespace, key string, results interface{}) error {
+	if !Enabled() {
+		return nil
+	}
+	data, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	entries, err := load()
+	if err != nil {
+		return err
+	}
+	for k, e := range entries {
+		if time.Since(e.Stored) > ttl {
+			delete(entries, k)
+		}
+	}
+	entries[key] = entry{Index: index, Namespace: namespace, Stored: time.Now(), Results: data}
+	return save(entries)
+}
+
+// Drops the results of searches of the namespace, after its vectors changed. The cache is
+// only read if it changed since the namespace was last cleared, so a long upsert doesn't
+// read it for every batch.
+func Invalidate(index, namespace string) {
+	mu.Lock()
+	defer mu.Unlock()
+	info, err := os.Stat(Path)
+	if errors.Is(err, fs.ErrNotExist) || err == nil && !info.ModTime().After(cleared[index+"/"+namespace]) {
+		return
+	}
+	drop(func(e entry) bool { return e.Index == index && e.Namespace == namespace })
+	cleared[index+"/"+namespace] = time.Now()
+}
+
+// Drops the results of every search of the index, after it was deleted
+func InvalidateIndex(index string) {
+	mu.Lock()
+	defer mu.Unlock()
+	drop(func(e entry) bool { return e.Index == index })
+}
+
+// Drops the matching entries. A cache that can't be read or written is removed altogether,
+// which is never wrong, rather than failing the write to the index that made it stale.
+func drop(matches func(entry) bool) {
+	entries, err := load()
+	if err != nil {
+		os.Remove(Path)
+		return
+	}
+	dropped := false
+	for k, e := range entries {
+		if matches(e) {
+			delete(entries, k)
+			dropped = true
+		}
+	}
+	if dropped && save(entries) != nil {
+		os.Remove(Path)
+	}
+}
+
+// Reads the cache file, a missing one is an empty cache
+func load() (map[string]entry, error) {
+	entries := map[string]entry{}
+	data, err := secure.ReadFile(Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entries, json.Unmarshal(data, &entries)
+}
+
+func save(entries map[string]entry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return secure.WriteFile(Path, data, 0644)
+}
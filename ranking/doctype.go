@@ -0,0 +1,54 @@
+package ranking
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pisush/fin-chat/query"
+	"github.com/pisush/fin-chat/spam"
+	"github.com/pisush/fin-chat/system"
+)
+
+// Document types the boost stage can weigh, besides the spam categories
+const (
+	TypeMessage   = "message"   // regular conversation
+	TypeForwarded = "forwarded" // pasted or forwarded content, e.g. "---------- Forwarded message ---------"
+	TypeLink      = "link"      // a message that is mostly a link
+	TypeMedia     = "media"     // a media placeholder of the export, e.g. "<Media omitted>"
+)
+
+var (
+	linkRegex = regexp.MustCompile(`(?i)\b(https?://|www\.)\S+`)
+
+	// Exports carry no forwarding flag, so forwarded text is told by the header it was pasted with
+	forwardedMarkers = []string{"forwarded message", "forwarded from", "begin forwarded message", "הודעה שהועברה", "הועבר מ"}
+)
+
+// The type of a matched message: a spam category (promotional, bot or notification), or one
+// of TypeForwarded, TypeMedia, TypeLink and TypeMessage
+func DocType(match query.QueryResponse) string {
+	text := match.Text()
+	if category, _ := match.Metadata["spam_category"].(string); category != "" {
+		return category
+	}
+	if result := spam.Classify(text, match.Sender()); result.Spam() {
+		return result.Category
+	}
+
+	lower := strings.ToLower(strings.TrimSpace(text))
+	for _, marker := range forwardedMarkers {
+		if strings.Contains(lower, marker) {
+			return TypeForwarded
+		}
+	}
+	if system.Classify(text) == system.Media {
+		return TypeMedia
+	}
+	if links := linkRegex.FindAllString(text, -1); len(links) > 0 {
+		rest := linkRegex.ReplaceAllString(text, "")
+		if len(strings.Fields(rest)) <= 3 {
+			return TypeLink
+		}
+	}
+	return TypeMessage
+}
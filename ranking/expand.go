@@ -0,0 +1,130 @@
+package ranking
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pisush/fin-chat/lang"
+	"github.com/pisush/fin-chat/llm"
+	"github.com/pisush/fin-chat/query"
+)
+
+// The languages the chat model is asked to translate queries into, by lang code
+var languageNames = map[string]string{
+	lang.Hebrew:  "Hebrew",
+	lang.English: "English",
+	lang.Arabic:  "Arabic",
+	lang.Russian: "Russian",
+}
+
+// A number or bullet at the start of a line, e.g. "2. " or "- "
+var listMarker = regexp.MustCompile(`^\s*(\d+[.)]|[-*•])\s+`)
+
+// Paraphrases searched for every query by dense stages that don't set expand, from --expand
+var defaultExpand int
+
+func SetExpand(n int) {
+	defaultExpand = n
+}
+
+// Searches for the query and for n paraphrases of it, merging the matches: short casual
+// queries find more when they are also searched in the words a message would use. When
+// the matches of the query are in other languages too, the query is also searched in
+// translation to each of them. A match found by several gets its best score.
+func expandedSearch(search searchFunc, indexName, queryMessage string, n, candidates int, filter query.Filter, log *log.Logger) ([]query.QueryResponse, error) {
+	matches, err := search(indexName, queryMessage, candidates, filter, log)
+	if err != nil {
+		return nil, err
+	}
+	note(matches, func(m query.QueryResponse) string { return fmt.Sprintf("dense %.4f", m.Score) })
+
+	variants, err := expansions(queryMessage, n, otherLanguages(queryMessage, matches))
+	if err != nil {
+		log.Printf("Error expanding the query, searching it as it is: %v", err)
+		return matches, nil
+	}
+
+	byID := map[string]int{}
+	for i, match := range matches {
+		byID[match.ID] = i
+	}
+	for _, variant := range variants {
+		found, err := search(indexName, variant, candidates, filter, log)
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range found {
+			i, seen := byID[match.ID]
+			if seen && matches[i].Score >= match.Score {
+				continue
+			}
+			if explain {
+				match.Explanation = append(match.Explanation, fmt.Sprintf("dense %.4f for %q", match.Score, variant))
+			}
+			if seen {
+				matches[i] = match
+			} else {
+				byID[match.ID] = len(matches)
+				matches = append(matches, match)
+			}
+		}
+	}
+	sortByScore(matches)
+	return matches[:min(candidates, len(matches))], nil
+}
+
+// The languages of the matches other than the query's, by the lang metadata or, for vectors
+// upserted before it was recorded, their text
+func otherLanguages(queryMessage string, matches []query.QueryResponse) []string {
+	queryLanguage := lang.Detect(queryMessage)
+	seen := map[string]bool{}
+	var languages []string
+	for _, match := range matches {
+		language, _ := match.Metadata["lang"].(string)
+		if language == "" {
+			language = lang.Detect(match.Text())
+		}
+		if language == "" || language == queryLanguage || seen[language] || languageNames[language] == "" {
+			continue
+		}
+		seen[language] = true
+		languages = append(languages, language)
+	}
+	sort.Strings(languages)
+	return languages
+}
+
+// Has the chat model write n paraphrases of the query and its translations into the
+// languages, one per line
+func expansions(queryMessage string, n int, languages []string) ([]string, error) {
+	instructions := fmt.Sprintf("You rewrite search queries over a chat archive. Reply with %d rewordings of the query "+
+		"in its own language, using the words a chat message about the same thing would use", n)
+	for _, language := range languages {
+		instructions += ", then the query translated into " + languageNames[language]
+	}
+	instructions += ". One per line, without numbering or anything else."
+
+	reply, err := llm.Complete([]llm.Message{
+		{Role: "system", Content: instructions},
+		{Role: "user", Content: queryMessage},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{strings.ToLower(strings.TrimSpace(queryMessage)): true}
+	var variants []string
+	for _, line := range strings.Split(reply, "\n") {
+		// Models number or bullet the lines anyway at times
+		line = strings.TrimSpace(listMarker.ReplaceAllString(line, ""))
+		if line == "" || seen[strings.ToLower(line)] {
+			continue
+		}
+		seen[strings.ToLower(line)] = true
+		variants = append(variants, line)
+	}
+	return variants[:min(n+len(languages), len(variants))], nil
+}
@@ -0,0 +1,56 @@
+package ranking
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pisush/fin-chat/query"
+)
+
+// The keyword fallback, from --keyword-fallback: when no dense match scores threshold, the
+// messages of the embeddings file are searched for the query's words too. 0 is off.
+var (
+	fallbackThreshold  float64
+	fallbackEmbeddings string
+)
+
+func SetKeywordFallback(embeddingsFileName string, threshold float64) {
+	fallbackEmbeddings, fallbackThreshold = embeddingsFileName, threshold
+}
+
+// Puts the keyword matches of the query before the ranked matches if the best dense score
+// is below the threshold: a name or a phone number is found by its words, not its meaning.
+// If the keyword search fails, the ranked matches are kept.
+func withKeywordFallback(indexName, queryMessage string, topK int, filter query.Filter, matches []query.QueryResponse, bestDense float64, log *log.Logger) []query.QueryResponse {
+	if fallbackThreshold == 0 || bestDense >= fallbackThreshold {
+		return matches
+	}
+	found, err := query.KeywordSearch(indexName, fallbackEmbeddings, queryMessage, topK, filter, log)
+	if err != nil {
+		log.Printf("Error in the keyword fallback search, keeping the dense matches: %v", err)
+		return matches
+	}
+
+	seen := map[string]bool{}
+	for i := range found {
+		seen[found[i].ID] = true
+		if explain {
+			found[i].Explanation = []string{fmt.Sprintf("keyword %.2f, best dense %.4f below %.2f", found[i].Score, bestDense, fallbackThreshold)}
+		}
+	}
+	for _, match := range matches {
+		if !seen[match.ID] {
+			found = append(found, match)
+		}
+	}
+	return found[:min(topK, len(found))]
+}
+
+// The highest score of the matches, 0 for none
+func bestScore(matches []query.QueryResponse) float64 {
+	best := 0.0
+	for _, match := range matches {
+		best = max(best, match.Score)
+	}
+	return best
+}
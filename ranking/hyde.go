@@ -0,0 +1,74 @@
+package ranking
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/llm"
+	"github.com/pisush/fin-chat/query"
+)
+
+const hydeSnippet = 80 // characters of the hypothetical message shown by --explain
+
+// Whether dense stages that don't set hyde search with a hypothetical answer, from --hyde
+var defaultHyDE bool
+
+func SetHyDE(on bool) {
+	defaultHyDE = on
+}
+
+var (
+	hypotheticalsMu sync.Mutex
+	hypotheticals   = map[string]string{} // query -> message written for it in this run
+)
+
+// Wraps a search to embed a hypothetical chat message answering the query instead of the
+// query itself (HyDE, hypothetical document embeddings): a question lies far from the
+// messages answering it, while a made up answer, even with the facts wrong, reads like them.
+// If the chat model fails, the query is searched as it is.
+func hydeSearch(search searchFunc) searchFunc {
+	return func(indexName, queryMessage string, topK int, filter query.Filter, log *log.Logger) ([]query.QueryResponse, error) {
+		message, err := hypothetical(queryMessage)
+		if err != nil {
+			log.Printf("Error writing a hypothetical answer, searching the query as it is: %v", err)
+			return search(indexName, queryMessage, topK, filter, log)
+		}
+		matches, err := search(indexName, message, topK, filter, log)
+		note(matches, func(query.QueryResponse) string {
+			return fmt.Sprintf("hyde %q", grapheme.Snippet(message, hydeSnippet))
+		})
+		return matches, err
+	}
+}
+
+// Has the chat model write a message answering the query, once per query in a run, so that
+// a repeated search embeds the same text and can be answered by the query cache
+func hypothetical(queryMessage string) (string, error) {
+	hypotheticalsMu.Lock()
+	message, ok := hypotheticals[queryMessage]
+	hypotheticalsMu.Unlock()
+	if ok {
+		return message, nil
+	}
+
+	reply, err := llm.Complete([]llm.Message{
+		{Role: "system", Content: "Write a short message from a group chat that answers the question, in the question's " +
+			"language and the casual style of a chat. Make up details if you don't know them. Reply with the message only."},
+		{Role: "user", Content: queryMessage},
+	})
+	if err != nil {
+		return "", err
+	}
+	message = strings.TrimSpace(reply)
+	if message == "" {
+		return "", fmt.Errorf("empty reply")
+	}
+
+	hypotheticalsMu.Lock()
+	hypotheticals[queryMessage] = message
+	hypotheticalsMu.Unlock()
+	return message, nil
+}
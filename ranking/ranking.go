@@ -0,0 +1,405 @@
+package ranking
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pisush/fin-chat/cluster"
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/llm"
+	"github.com/pisush/fin-chat/query"
+)
+
+const DefaultConfigPath = "./ranking.json"
+
+// Stage types, in the order they usually run
+const (
+	StageDense  = "dense"  // nearest neighbors from Pinecone, always the first stage
+	StageHybrid = "hybrid" // merges the dense score with keyword overlap
+	StageRerank = "rerank" // has the chat model reorder the best candidates
+	StageMMR    = "mmr"    // maximal marginal relevance, trading relevance for variety
+	StageBoost  = "boost"  // multiplies scores for recent messages and chosen senders
+)
+
+const (
+	defaultCandidates = 4   // dense candidates per result asked for, when the later stages reorder them
+	defaultAlpha      = 0.3 // weight of the keyword score in hybrid
+	defaultRerankTop  = 20
+	defaultLambda     = 0.7 // relevance share of the MMR score
+	rerankSnippet     = 300
+)
+
+// One step of a pipeline. Each stage only reads the parameters of its type.
+type Stage struct {
+	Type string `json:"type"`
+
+	Candidates int     `json:"candidates,omitempty"` // dense: results fetched, default 4 per result wanted
+	Expand     int     `json:"expand,omitempty"`     // dense: paraphrases of the query also searched, default --expand
+	HyDE       bool    `json:"hyde,omitempty"`       // dense: search with a hypothetical answer, default --hyde
+	Alpha      float64 `json:"alpha,omitempty"`      // hybrid: keyword weight between 0 and 1, default 0.3
+	TopN       int     `json:"top_n,omitempty"`      // rerank: candidates reordered, default 20
+	Lambda     float64 `json:"lambda,omitempty"`     // mmr: relevance weight between 0 and 1, default 0.7
+
+	RecencyHalfLifeDays float64            `json:"recency_half_life_days,omitempty"` // boost: age at which the recency boost halves
+	RecencyWeight       float64            `json:"recency_weight,omitempty"`         // boost: boost of a brand new message, e.g. 0.2 for +20%
+	Senders             map[string]float64 `json:"senders,omitempty"`                // boost: score multiplier per sender
+	Types               map[string]float64 `json:"types,omitempty"`                  // boost: score multiplier per document type, see DocType
+}
+
+// The pipeline of every collection (namespace), and the default for the others
+type Config struct {
+	Default     []Stage            `json:"default,omitempty"`
+	Collections map[string][]Stage `json:"collections,omitempty"`
+}
+
+var config Config
+
+// Whether Search records in each match how its score came about
+var explain bool
+
+func SetExplain(on bool) {
+	explain = on
+}
+
+// Reads the pipelines from the JSON file at path, a missing file keeps plain dense search
+func LoadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var c Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if err := validate(c.Default); err != nil {
+		return fmt.Errorf("%s: default pipeline: %w", path, err)
+	}
+	for name, stages := range c.Collections {
+		if err := validate(stages); err != nil {
+			return fmt.Errorf("%s: pipeline of %s: %w", path, name, err)
+		}
+	}
+	config = c
+	return nil
+}
+
+func validate(stages []Stage) error {
+	for i, stage := range stages {
+		switch stage.Type {
+		case StageDense:
+			if i != 0 {
+				return fmt.Errorf("dense must be the first stage")
+			}
+		case StageHybrid, StageRerank, StageMMR, StageBoost:
+		default:
+			return fmt.Errorf("unknown stage %q", stage.Type)
+		}
+		if stage.Expand < 0 {
+			return fmt.Errorf("%s: expand can't be negative", stage.Type)
+		}
+		if stage.Alpha < 0 || stage.Alpha > 1 || stage.Lambda < 0 || stage.Lambda > 1 {
+			return fmt.Errorf("%s: alpha and lambda must be between 0 and 1", stage.Type)
+		}
+	}
+	return nil
+}
+
+// The stages used for a namespace, starting with the dense one
+func pipeline(namespace string) []Stage {
+	stages, ok := config.Collections[namespace]
+	if !ok {
+		stages = config.Default
+	}
+	if len(stages) == 0 || stages[0].Type != StageDense {
+		stages = append([]Stage{{Type: StageDense}}, stages...)
+	}
+	return stages
+}
+
+// A search of the index, query.QueryPinecone or query.QueryPineconeWithValues
+type searchFunc func(indexName, queryMessage string, topK int, filter query.Filter, log *log.Logger) ([]query.QueryResponse, error)
+
+// Runs the query through the pipeline configured for the filter's namespace and returns the topK best
+func Search(indexName, queryMessage string, topK int, filter query.Filter, log *log.Logger) ([]query.QueryResponse, error) {
+	stages := pipeline(filter.Namespace)
+	expand := stages[0].Expand
+	if expand == 0 {
+		expand = defaultExpand
+	}
+	hyde := stages[0].HyDE || defaultHyDE
+	if len(stages) == 1 && expand == 0 && !hyde {
+		matches, err := query.QueryPinecone(indexName, queryMessage, topK, filter, log)
+		if err != nil {
+			return nil, err
+		}
+		note(matches, func(m query.QueryResponse) string { return fmt.Sprintf("dense %.4f", m.Score) })
+		return withKeywordFallback(indexName, queryMessage, topK, filter, matches, bestScore(matches), log), nil
+	}
+
+	// Without later stages to reorder them, the expanded search only needs topK of each
+	candidates := stages[0].Candidates
+	if candidates == 0 && len(stages) > 1 {
+		candidates = topK * defaultCandidates
+	}
+	candidates = max(candidates, topK)
+
+	var search searchFunc = query.QueryPinecone
+	for _, stage := range stages {
+		if stage.Type == StageMMR {
+			search = query.QueryPineconeWithValues
+		}
+	}
+	if hyde {
+		search = hydeSearch(search)
+	}
+	var matches []query.QueryResponse
+	var err error
+	if expand > 0 {
+		matches, err = expandedSearch(search, indexName, queryMessage, expand, candidates, filter, log)
+	} else {
+		matches, err = search(indexName, queryMessage, candidates, filter, log)
+		note(matches, func(m query.QueryResponse) string { return fmt.Sprintf("dense %.4f", m.Score) })
+	}
+	if err != nil {
+		return nil, err
+	}
+	bestDense := bestScore(matches)
+
+	for _, stage := range stages[1:] {
+		switch stage.Type {
+		case StageHybrid:
+			matches = hybrid(queryMessage, matches, withDefault(stage.Alpha, defaultAlpha))
+		case StageRerank:
+			topN := stage.TopN
+			if topN == 0 {
+				topN = defaultRerankTop
+			}
+			if matches, err = rerank(queryMessage, matches, topN); err != nil {
+				log.Printf("Error reranking, keeping the previous order: %v", err)
+			}
+		case StageMMR:
+			matches = mmr(matches, topK, withDefault(stage.Lambda, defaultLambda))
+		case StageBoost:
+			matches = boost(matches, stage, time.Now())
+		}
+	}
+
+	if len(matches) > topK {
+		matches = matches[:topK]
+	}
+	return withKeywordFallback(indexName, queryMessage, topK, filter, matches, bestDense, log), nil
+}
+
+// Appends a step to the explanation of every match, with --explain
+func note(matches []query.QueryResponse, step func(query.QueryResponse) string) {
+	if !explain {
+		return
+	}
+	for i := range matches {
+		matches[i].Explanation = append(matches[i].Explanation, step(matches[i]))
+	}
+}
+
+func withDefault(value, fallback float64) float64 {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
+// Scores are min-max normalized over the candidates first, so that cosine scores bunched
+// around 0.8 and keyword shares between 0 and 1 weigh what alpha says
+func hybrid(queryMessage string, matches []query.QueryResponse, alpha float64) []query.QueryResponse {
+	terms := keywords(queryMessage)
+	dense := make([]float64, len(matches))
+	keyword := make([]float64, len(matches))
+	for i, match := range matches {
+		dense[i] = match.Score
+		keyword[i] = overlap(terms, keywords(match.Text()))
+	}
+	normalize(dense)
+	normalize(keyword)
+	for i := range matches {
+		matches[i].Score = (1-alpha)*dense[i] + alpha*keyword[i]
+		if explain {
+			matches[i].Explanation = append(matches[i].Explanation,
+				fmt.Sprintf("hybrid (1-%.2f)*%.3f dense + %.2f*%.3f keywords = %.4f", alpha, dense[i], alpha, keyword[i], matches[i].Score))
+		}
+	}
+	sortByScore(matches)
+	return matches
+}
+
+func keywords(text string) map[string]bool {
+	words := map[string]bool{}
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if len([]rune(word)) > 1 {
+			words[word] = true
+		}
+	}
+	return words
+}
+
+// The share of the query terms found in the text
+func overlap(terms, text map[string]bool) float64 {
+	if len(terms) == 0 {
+		return 0
+	}
+	found := 0
+	for term := range terms {
+		if text[term] {
+			found++
+		}
+	}
+	return float64(found) / float64(len(terms))
+}
+
+func normalize(values []float64) {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	for i, v := range values {
+		if hi > lo {
+			values[i] = (v - lo) / (hi - lo)
+		} else {
+			values[i] = 0
+		}
+	}
+}
+
+// Asks the chat model to order the topN best candidates by relevance. They get scores
+// from 2 down to just above 1 in the new order, so they stay ahead of the rest.
+func rerank(queryMessage string, matches []query.QueryResponse, topN int) ([]query.QueryResponse, error) {
+	n := min(topN, len(matches))
+	if n < 2 {
+		return matches, nil
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Query: %s\n\n", queryMessage)
+	for i, match := range matches[:n] {
+		fmt.Fprintf(&sb, "[%d] %s: %s\n", i+1, match.Sender(), grapheme.Snippet(match.Text(), rerankSnippet))
+	}
+	reply, err := llm.Complete([]llm.Message{
+		{Role: "system", Content: "Order these chat messages by how well they answer the query, most relevant first. " +
+			"Reply with the message numbers only, comma separated, e.g. 3,1,2."},
+		{Role: "user", Content: sb.String()},
+	})
+	if err != nil {
+		return matches, err
+	}
+
+	var order []int
+	used := map[int]bool{}
+	for _, field := range strings.FieldsFunc(reply, func(r rune) bool { return r < '0' || r > '9' }) {
+		i, err := strconv.Atoi(field)
+		if err != nil || i < 1 || i > n || used[i-1] {
+			continue
+		}
+		used[i-1] = true
+		order = append(order, i-1)
+	}
+	for i := 0; i < n; i++ { // the ones the model left out keep their order at the end
+		if !used[i] {
+			order = append(order, i)
+		}
+	}
+
+	reranked := make([]query.QueryResponse, 0, len(matches))
+	for rank, i := range order {
+		match := matches[i]
+		match.Score = 2 - float64(rank)/float64(n) // above every unranked cosine score
+		if explain {
+			match.Explanation = append(match.Explanation, fmt.Sprintf("rerank #%d of %d = %.4f", rank+1, n, match.Score))
+		}
+		reranked = append(reranked, match)
+	}
+	return append(reranked, matches[n:]...), nil
+}
+
+// Picks k matches one by one, each maximizing lambda * relevance - (1-lambda) * its highest
+// similarity to the ones already picked. The rest follow in their previous order.
+func mmr(matches []query.QueryResponse, k int, lambda float64) []query.QueryResponse {
+	if len(matches) == 0 || len(matches[0].Values) == 0 {
+		return matches
+	}
+	relevance := make([]float64, len(matches))
+	for i, match := range matches {
+		relevance[i] = match.Score
+	}
+	normalize(relevance)
+
+	picked := make([]bool, len(matches))
+	var selected []query.QueryResponse
+	for len(selected) < min(k, len(matches)) {
+		best, bestScore := -1, math.Inf(-1)
+		for i, match := range matches {
+			if picked[i] {
+				continue
+			}
+			redundancy := 0.0
+			for _, s := range selected {
+				redundancy = math.Max(redundancy, cluster.Cosine(match.Values, s.Values))
+			}
+			if score := lambda*relevance[i] - (1-lambda)*redundancy; score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		picked[best] = true
+		if explain {
+			matches[best].Explanation = append(matches[best].Explanation,
+				fmt.Sprintf("mmr pick #%d, %.2f*relevance - %.2f*redundancy = %.4f", len(selected)+1, lambda, 1-lambda, bestScore))
+		}
+		selected = append(selected, matches[best])
+	}
+	for i, match := range matches {
+		if !picked[i] {
+			selected = append(selected, match)
+		}
+	}
+	return selected
+}
+
+func boost(matches []query.QueryResponse, stage Stage, now time.Time) []query.QueryResponse {
+	for i, match := range matches {
+		formula := []string{fmt.Sprintf("%.4f", match.Score)}
+		if stage.RecencyWeight != 0 && stage.RecencyHalfLifeDays > 0 {
+			ageDays := math.Max(now.Sub(match.Timestamp()).Hours()/24, 0)
+			matches[i].Score *= 1 + stage.RecencyWeight*math.Pow(0.5, ageDays/stage.RecencyHalfLifeDays)
+			formula = append(formula, fmt.Sprintf("(1 + %.2f*0.5^(%.1f/%.1f days))", stage.RecencyWeight, ageDays, stage.RecencyHalfLifeDays))
+		}
+		if factor, ok := stage.Senders[match.Sender()]; ok {
+			matches[i].Score *= factor
+			formula = append(formula, fmt.Sprintf("%.2f sender", factor))
+		}
+		if factor, ok := stage.Types[DocType(match)]; ok {
+			matches[i].Score *= factor
+			formula = append(formula, fmt.Sprintf("%.2f %s", factor, DocType(match)))
+		}
+		if explain {
+			matches[i].Explanation = append(matches[i].Explanation,
+				fmt.Sprintf("boost %s = %.4f", strings.Join(formula, " * "), matches[i].Score))
+		}
+	}
+	sortByScore(matches)
+	return matches
+}
+
+func sortByScore(matches []query.QueryResponse) {
+	sort.SliceStable(matches, func(a, b int) bool { return matches[a].Score > matches[b].Score })
+}
@@ -0,0 +1,87 @@
+package redact
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Placeholders the masked parts are replaced with
+const (
+	Email = "[email]"
+	Link  = "[link]"
+	Card  = "[card]"
+	Phone = "[phone]"
+)
+
+var (
+	emailRegex = regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`)
+	urlRegex   = regexp.MustCompile(`(?i)\b(https?://|www\.)\S+`)
+	cardRegex  = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+	phoneRegex = regexp.MustCompile(`(?:\+|\b)\d[\d ().-]{6,}\d\b`)
+	dateRegex  = regexp.MustCompile(`\d{4}-\d{1,2}-\d{1,2}|\d{1,2}[./-]\d{1,2}[./-]\d{2,4}`)
+)
+
+const (
+	minPhoneDigits = 9 // fewer are more likely amounts, codes or years
+	maxPhoneDigits = 15
+)
+
+var enabled bool
+
+// Turns masking on or off for everything sent to OpenAI
+func SetEnabled(on bool) {
+	enabled = on
+}
+
+func Enabled() bool {
+	return enabled
+}
+
+// The text with its email addresses, links, credit card numbers and phone numbers replaced
+// by placeholders, or as it is if redaction is off
+func Text(text string) string {
+	if !enabled {
+		return text
+	}
+	text = emailRegex.ReplaceAllString(text, Email)
+	text = urlRegex.ReplaceAllString(text, Link)
+	text = cardRegex.ReplaceAllStringFunc(text, func(number string) string {
+		if luhn(digits(number)) {
+			return Card
+		}
+		return number
+	})
+	return phoneRegex.ReplaceAllStringFunc(text, func(number string) string {
+		n := len(digits(number))
+		if n < minPhoneDigits || n > maxPhoneDigits || dateRegex.MatchString(number) {
+			return number
+		}
+		return Phone
+	})
+}
+
+func digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// Whether the number passes the Luhn checksum that every card number has
+func luhn(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,412 @@
+package remote
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/httpclient"
+)
+
+const (
+	CacheDir = "./.remote" // local copies of the objects, by scheme, bucket and key
+
+	SchemeS3  = "s3"
+	SchemeGCS = "gs"
+
+	awsKeyEnv      = "AWS_ACCESS_KEY_ID"
+	awsSecretEnv   = "AWS_SECRET_ACCESS_KEY"
+	awsTokenEnv    = "AWS_SESSION_TOKEN"
+	awsRegionEnv   = "AWS_REGION"
+	awsEndpointEnv = "AWS_ENDPOINT_URL"          // for S3 compatible stores such as MinIO or R2
+	gcsKeyEnv      = "FINCHAT_GCS_ACCESS_KEY_ID" // an HMAC key of a service account, see the README
+	gcsSecretEnv   = "FINCHAT_GCS_SECRET"
+
+	defaultRegion = "us-east-1"
+	gcsEndpoint   = "https://storage.googleapis.com"
+	gcsRegion     = "auto"
+	timeout       = 10 * time.Minute // per object, backups shards are large
+)
+
+// Returned when a conditional write finds the object changed, or already there
+var ErrConflict = errors.New("the object was changed by someone else")
+
+// An object, or with a trailing key prefix a "directory", in a bucket
+type object struct {
+	scheme string
+	bucket string
+	key    string
+}
+
+// Whether path is an object storage URL, s3://bucket/key or gs://bucket/key, rather than a local path
+func IsURL(p string) bool {
+	return strings.HasPrefix(p, SchemeS3+"://") || strings.HasPrefix(p, SchemeGCS+"://")
+}
+
+func parse(rawURL string) (object, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return object{}, err
+	}
+	if (u.Scheme != SchemeS3 && u.Scheme != SchemeGCS) || u.Host == "" {
+		return object{}, fmt.Errorf("%s is not an s3:// or gs:// URL with a bucket", rawURL)
+	}
+	return object{scheme: u.Scheme, bucket: u.Host, key: strings.Trim(u.Path, "/")}, nil
+}
+
+// Where the local copy of an object is kept
+func LocalPath(rawURL string) (string, error) {
+	o, err := parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(CacheDir, o.scheme, o.bucket, filepath.FromSlash(o.key)), nil
+}
+
+// Downloads the object to its local copy and returns the copy's path. A missing object
+// removes the copy, so that opening it fails like a missing local file would, and creating
+// it starts afresh.
+func Fetch(rawURL string) (string, error) {
+	o, err := parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	local, _ := LocalPath(rawURL)
+	err = o.download(local)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := os.Remove(local); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		return local, nil
+	}
+	return local, err
+}
+
+// Uploads a local file to the object at rawURL, replacing it
+func Put(localPath, rawURL string) error {
+	o, err := parse(rawURL)
+	if err != nil {
+		return err
+	}
+	return o.upload(localPath)
+}
+
+// Downloads every object under the URL, as a directory, and returns the local directory
+// holding them. A prefix without objects is an error.
+func FetchDir(rawURL string) (string, error) {
+	o, err := parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	local, _ := LocalPath(rawURL)
+	keys, err := o.list()
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("%s: %w", rawURL, fs.ErrNotExist)
+	}
+	if err := os.RemoveAll(local); err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		file := object{scheme: o.scheme, bucket: o.bucket, key: key}
+		if err := file.download(filepath.Join(local, filepath.FromSlash(strings.TrimPrefix(key, o.key+"/")))); err != nil {
+			return "", fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return local, nil
+}
+
+// Uploads every file of a local directory under the URL. The file named last, if given, is
+// uploaded after all others, so that e.g. a backup's manifest only appears once its shards are there.
+func PutDir(localDir, rawURL, last string) error {
+	o, err := parse(rawURL)
+	if err != nil {
+		return err
+	}
+	var names []string
+	err = filepath.WalkDir(localDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(name))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(names, func(a, b int) bool { return names[a] != last && names[b] == last })
+
+	for _, name := range names {
+		file := object{scheme: o.scheme, bucket: o.bucket, key: path.Join(o.key, name)}
+		if err := file.upload(filepath.Join(localDir, filepath.FromSlash(name))); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (o object) download(local string) error {
+	resp, err := o.do(http.MethodGet, "", nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+	// Written next to the copy and renamed, so an interrupted download doesn't leave half a file
+	tmp := local + ".part"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, local)
+}
+
+func (o object) upload(local string) error {
+	file, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	payloadHash, err := hashFile(file)
+	if err != nil {
+		return err
+	}
+	resp, err := o.do(http.MethodPut, "", nil, file, payloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// The keys of every object under the key, taken as a directory, page by page
+func (o object) list() ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		params := url.Values{"list-type": {"2"}, "prefix": {o.key + "/"}}
+		if token != "" {
+			params.Set("continuation-token", token)
+		}
+		bucket := object{scheme: o.scheme, bucket: o.bucket}
+		resp, err := bucket.do(http.MethodGet, params.Encode(), nil, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, content := range page.Contents {
+			if !strings.HasSuffix(content.Key, "/") {
+				keys = append(keys, content.Key)
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Sends a signed request for the object, with the extra headers given. The body is read
+// from the start, its SHA-256 is given; requests without a body pass nil and "". A 404 is
+// fs.ErrNotExist, a failed condition ErrConflict, other failures carry the store's error message.
+func (o object) do(method, rawQuery string, header http.Header, body io.ReadSeeker, payloadHash string) (*http.Response, error) {
+	endpoint, region, creds, err := o.config()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.RawQuery = canonicalQuery(query) // sent exactly as signed
+	req.URL = endpoint
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	hash := emptyHash
+	if body != nil {
+		size, err := body.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(body)
+		req.ContentLength = size
+		hash = payloadHash
+	}
+	sign(req, creds, region, hash, time.Now().UTC())
+
+	client := httpclient.WithTimeout(timeout)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s://%s/%s: %w", o.scheme, o.bucket, o.key, fs.ErrNotExist)
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s://%s/%s: %w", o.scheme, o.bucket, o.key, ErrConflict)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s %s://%s/%s: %s %s", method, o.scheme, o.bucket, o.key, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
+
+// The URL of the object, the region to sign for and the keys, from the environment
+func (o object) config() (*url.URL, string, credentials, error) {
+	if o.scheme == SchemeGCS {
+		creds := credentials{key: os.Getenv(gcsKeyEnv), secret: os.Getenv(gcsSecretEnv)}
+		if creds.key == "" || creds.secret == "" {
+			return nil, "", creds, fmt.Errorf("%s and %s are needed for gs:// URLs", gcsKeyEnv, gcsSecretEnv)
+		}
+		endpoint, err := o.pathStyle(gcsEndpoint)
+		return endpoint, gcsRegion, creds, err
+	}
+
+	creds := credentials{key: os.Getenv(awsKeyEnv), secret: os.Getenv(awsSecretEnv), token: os.Getenv(awsTokenEnv)}
+	if creds.key == "" || creds.secret == "" {
+		return nil, "", creds, fmt.Errorf("%s and %s are needed for s3:// URLs", awsKeyEnv, awsSecretEnv)
+	}
+	region := os.Getenv(awsRegionEnv)
+	if region == "" {
+		region = defaultRegion
+	}
+	// Custom endpoints get path-style URLs, which every S3 compatible store understands
+	if custom := os.Getenv(awsEndpointEnv); custom != "" {
+		endpoint, err := o.pathStyle(custom)
+		return endpoint, region, creds, err
+	}
+	return withKey(&url.URL{Scheme: "https", Host: o.bucket + ".s3." + region + ".amazonaws.com"}, "/"+o.key), region, creds, nil
+}
+
+// The object's URL at an endpoint that has the bucket in the path
+func (o object) pathStyle(endpoint string) (*url.URL, error) {
+	base, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return withKey(base, base.Path+"/"+o.bucket+"/"+o.key), nil
+}
+
+// Sets the path, escaped the way the signature expects, so that the signed and the sent path are the same
+func withKey(u *url.URL, p string) *url.URL {
+	u.Path = p
+	u.RawPath = escapePath(p)
+	return u
+}
+
+// The content of a small object and its version, which conditional writes are checked
+// against: the ETag on S3, the generation on GCS
+func Get(rawURL string) ([]byte, string, error) {
+	o, err := parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := o.do(http.MethodGet, "", nil, nil, "")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return data, o.version(resp.Header), err
+}
+
+// Writes data to the object only if it is still at version, or with an empty version only
+// if it doesn't exist yet. Returns the new version, or ErrConflict if the condition failed.
+func PutIf(rawURL string, data []byte, version string) (string, error) {
+	o, err := parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	header := http.Header{}
+	switch {
+	case o.scheme == SchemeGCS && version == "":
+		header.Set("X-Goog-If-Generation-Match", "0")
+	case o.scheme == SchemeGCS:
+		header.Set("X-Goog-If-Generation-Match", version)
+	case version == "":
+		header.Set("If-None-Match", "*")
+	default:
+		header.Set("If-Match", version)
+	}
+	resp, err := o.do(http.MethodPut, "", header, bytes.NewReader(data), hexHash(data))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return o.version(resp.Header), nil
+}
+
+// Deletes the object, a missing one is no error
+func Delete(rawURL string) error {
+	o, err := parse(rawURL)
+	if err != nil {
+		return err
+	}
+	resp, err := o.do(http.MethodDelete, "", nil, nil, "")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (o object) version(header http.Header) string {
+	if o.scheme == SchemeGCS {
+		return header.Get("X-Goog-Generation")
+	}
+	return header.Get("ETag")
+}
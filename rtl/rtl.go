@@ -0,0 +1,155 @@
+package rtl
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pisush/fin-chat/grapheme"
+)
+
+// How right-to-left text is written to the terminal
+const (
+	ModeIsolate = "isolate" // logical order wrapped in directional isolates, for terminals with bidi support
+	ModeVisual  = "visual"  // reordered for display, for terminals that print everything left to right
+	ModeOff     = "off"     // printed as is
+)
+
+const (
+	firstStrongIsolate = '\u2068'
+	popDirectional     = '\u2069'
+)
+
+// Direction of a character, after neutrals are resolved
+type direction int
+
+const (
+	neutral direction = iota
+	ltr
+	rtl
+)
+
+// Brackets swap when a right-to-left run is reversed
+var mirrored = map[string]string{"(": ")", ")": "(", "[": "]", "]": "[", "{": "}", "}": "{", "<": ">", ">": "<"}
+
+// Prepares one field of output (a sender, a message) for the terminal
+func Display(s, mode string) string {
+	if !HasRTL(s) {
+		return s
+	}
+	switch mode {
+	case ModeIsolate:
+		return string(firstStrongIsolate) + s + string(popDirectional)
+	case ModeVisual:
+		lines := strings.Split(s, "\n")
+		for i, line := range lines {
+			lines[i] = visual(line)
+		}
+		return strings.Join(lines, "\n")
+	default:
+		return s
+	}
+}
+
+// Whether s contains Hebrew or Arabic letters
+func HasRTL(s string) bool {
+	for _, r := range s {
+		if isRTL(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reorders a line from logical to visual order: right-to-left runs are reversed,
+// left-to-right runs such as English words and numbers keep their order, and for a
+// line starting in Hebrew the runs themselves are laid out from right to left.
+func visual(line string) string {
+	clusters := grapheme.Split(line)
+	dirs := make([]direction, len(clusters))
+	base := ltr
+	baseSet := false
+	for i, c := range clusters {
+		dirs[i] = classify(c)
+		if !baseSet && dirs[i] != neutral {
+			base = dirs[i]
+			baseSet = true
+		}
+	}
+	resolveNeutrals(dirs, base)
+
+	// Group the clusters into runs of one direction
+	type run struct {
+		dir      direction
+		clusters []string
+	}
+	var runs []run
+	for i, c := range clusters {
+		if len(runs) == 0 || runs[len(runs)-1].dir != dirs[i] {
+			runs = append(runs, run{dir: dirs[i]})
+		}
+		runs[len(runs)-1].clusters = append(runs[len(runs)-1].clusters, c)
+	}
+
+	if base == rtl {
+		for i, j := 0, len(runs)-1; i < j; i, j = i+1, j-1 {
+			runs[i], runs[j] = runs[j], runs[i]
+		}
+	}
+
+	var sb strings.Builder
+	for _, r := range runs {
+		if r.dir != rtl {
+			sb.WriteString(strings.Join(r.clusters, ""))
+			continue
+		}
+		for i := len(r.clusters) - 1; i >= 0; i-- {
+			c := r.clusters[i]
+			if m, ok := mirrored[c]; ok {
+				c = m
+			}
+			sb.WriteString(c)
+		}
+	}
+	return sb.String()
+}
+
+// Neutrals between two runs of the same direction join them, otherwise take the base direction
+func resolveNeutrals(dirs []direction, base direction) {
+	for i := 0; i < len(dirs); {
+		if dirs[i] != neutral {
+			i++
+			continue
+		}
+		j := i
+		for j < len(dirs) && dirs[j] == neutral {
+			j++
+		}
+
+		resolved := base
+		if i > 0 && j < len(dirs) && dirs[i-1] == dirs[j] {
+			resolved = dirs[j]
+		}
+		for k := i; k < j; k++ {
+			dirs[k] = resolved
+		}
+		i = j
+	}
+}
+
+// Letters and digits are strong, everything else is neutral
+func classify(cluster string) direction {
+	r, _ := utf8.DecodeRuneInString(cluster)
+	switch {
+	case isRTL(r):
+		return rtl
+	case unicode.IsLetter(r), unicode.IsDigit(r):
+		return ltr
+	default:
+		return neutral
+	}
+}
+
+func isRTL(r rune) bool {
+	return unicode.In(r, unicode.Hebrew, unicode.Arabic)
+}
@@ -0,0 +1,172 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// The API keys, named as in the environment, the keychain and the secret managers' JSON
+const (
+	OpenAI   = "openai"
+	Pinecone = "pinecone"
+	Telegram = "telegram" // the token of the Telegram bot, only for the bot action
+	Twilio   = "twilio"   // the auth token of the Twilio account of the WhatsApp bot
+	Server   = "server"   // the key searches of serve need, when it has no tenants
+)
+
+// Where the keys are read from, see SetSource
+const (
+	SourceAuto     = ""         // the environment, then the keychain
+	SourceEnv      = "env"      // OPENAI_API_KEY and PINECONE_API_KEY
+	SourceKeychain = "keychain" // macOS Keychain or the Linux secret service
+	prefixAWS      = "aws:"     // aws:<secret id> in AWS Secrets Manager
+	prefixGCP      = "gcp:"     // gcp:<project>/<secret> in Google Secret Manager
+
+	keychainService = "fin-chat"
+)
+
+var envNames = map[string]string{OpenAI: "OPENAI_API_KEY", Pinecone: "PINECONE_API_KEY", Telegram: "TELEGRAM_BOT_TOKEN", Twilio: "TWILIO_AUTH_TOKEN", Server: "FINCHAT_API_KEY"}
+
+var (
+	source  = SourceAuto
+	profile string // see SetProfile
+
+	mu      sync.Mutex
+	cache   = map[string]string{}
+	managed map[string]string // the JSON of a secret manager's secret, fetched once
+)
+
+// Picks where the API keys come from: env, keychain, aws:<secret id> or gcp:<project>/<secret>.
+// A secret manager's secret holds JSON with "openai" and "pinecone" keys. The default tries the
+// environment, then the keychain.
+func SetSource(keySource string) error {
+	switch {
+	case keySource == SourceAuto, keySource == SourceEnv, keySource == SourceKeychain:
+	case strings.HasPrefix(keySource, prefixAWS) && len(keySource) > len(prefixAWS):
+	case strings.HasPrefix(keySource, prefixGCP) && strings.Count(keySource, "/") == 1 && !strings.HasSuffix(keySource, "/"):
+	default:
+		return fmt.Errorf("unknown key source %q, use env, keychain, aws:<secret id> or gcp:<project>/<secret>", keySource)
+	}
+	source = keySource
+	return nil
+}
+
+// Makes the keys of a named profile come first: OPENAI_API_KEY_WORK before OPENAI_API_KEY and
+// the keychain account work/openai before openai, for the profile work
+func SetProfile(name string) {
+	profile = name
+}
+
+// The API key of a service, OpenAI, Pinecone, a bot's or serve's, read once per run
+func Get(name string) (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if key, ok := cache[name]; ok {
+		return key, nil
+	}
+
+	var key string
+	var err error
+	switch {
+	case source == SourceEnv:
+		key = env(name)
+	case source == SourceKeychain:
+		key, err = keychain(name)
+	case strings.HasPrefix(source, prefixAWS), strings.HasPrefix(source, prefixGCP):
+		key, err = fromManager(name)
+	default:
+		if key = env(name); key == "" {
+			key, err = keychain(name)
+			if errors.Is(err, exec.ErrNotFound) {
+				err = nil // no keychain tool, the message below says what to do
+			}
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading the %s API key: %w", name, err)
+	}
+	if key == "" {
+		return "", fmt.Errorf("no %s API key: set %s, add it to the keychain as %s/%s or use --keys, see the README", name, envNames[name], keychainService, name)
+	}
+	cache[name] = key
+	return key, nil
+}
+
+// The key in the environment, the profile's variable first
+func env(name string) string {
+	if profile != "" {
+		if key := os.Getenv(envNames[name] + "_" + strings.ToUpper(strings.ReplaceAll(profile, "-", "_"))); key != "" {
+			return key
+		}
+	}
+	return os.Getenv(envNames[name])
+}
+
+// The key stored under the fin-chat service, the profile's account first, empty if there is none
+func keychain(name string) (string, error) {
+	accounts := []string{name}
+	if profile != "" {
+		accounts = []string{profile + "/" + name, name}
+	}
+	for _, account := range accounts {
+		var cmd *exec.Cmd
+		switch runtime.GOOS {
+		case "darwin":
+			cmd = exec.Command("security", "find-generic-password", "-s", keychainService, "-a", account, "-w")
+		case "linux":
+			cmd = exec.Command("secret-tool", "lookup", "service", keychainService, "account", account)
+		default:
+			return "", fmt.Errorf("no keychain support on %s", runtime.GOOS)
+		}
+		out, err := run(cmd)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			continue // not stored
+		}
+		if err != nil || out != "" {
+			return out, err
+		}
+	}
+	return "", nil
+}
+
+// The key from the secret manager's secret
+func fromManager(name string) (string, error) {
+	if managed == nil {
+		var cmd *exec.Cmd
+		if id, ok := strings.CutPrefix(source, prefixAWS); ok {
+			cmd = exec.Command("aws", "secretsmanager", "get-secret-value", "--secret-id", id, "--query", "SecretString", "--output", "text")
+		} else {
+			project, secret, _ := strings.Cut(strings.TrimPrefix(source, prefixGCP), "/")
+			cmd = exec.Command("gcloud", "secrets", "versions", "access", "latest", "--secret", secret, "--project", project)
+		}
+		out, err := run(cmd)
+		if err != nil {
+			return "", err
+		}
+		if err := json.Unmarshal([]byte(out), &managed); err != nil {
+			return "", fmt.Errorf("the secret %s isn't a JSON object of strings: %w", source, err)
+		}
+	}
+	return managed[name], nil
+}
+
+// Runs a command and returns its trimmed output, its error output in the error if it fails
+func run(cmd *exec.Cmd) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %w: %s", cmd.Args[0], err, msg)
+		}
+		return "", fmt.Errorf("%s: %w", cmd.Args[0], err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
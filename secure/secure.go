@@ -0,0 +1,452 @@
+package secure
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// An encrypted file is the header, magic and how its key is derived, and then frames of up to
+// frameSize bytes of content, each its sealed length and AES-GCM sealed bytes. Appending adds
+// frames, so files that grow by appends stay encrypted without being rewritten. Files of the
+// first version have only the salt after their magic, their key is keyRounds of SHA-256.
+const (
+	magic     = "FINCHAT-AES2\n"
+	magicV1   = "FINCHAT-AES1\n"
+	saltSize  = 16
+	frameSize = 64 << 10
+	maxSealed = frameSize + 12 + 16 // a frame's nonce and tag
+	keyRounds = 100000
+
+	KeyEnv = "FINCHAT_ENCRYPTION_KEY"
+)
+
+// How a key is derived from a passphrase, stored with what it encrypts as KDFSize bytes: the
+// KDF's ID, three bytes of its parameters and the salt. New keys use scrypt with the parameters
+// below; stored ones are derived as they say, so the parameters can be raised later.
+const (
+	KDFSize = 4 + saltSize
+
+	kdfSHA256 = 0 // keyRounds of SHA-256, of the first files; only read
+	kdfScrypt = 1 // the parameters are log2 of N, r and p
+
+	scryptLogN = 15 // 32 MiB and about 100ms per key
+	scryptR    = 8
+	scryptP    = 1
+)
+
+// The version 1 header size, and the current one's
+var headerSizes = map[string]int{magicV1: len(magicV1) + saltSize, magic: len(magic) + KDFSize}
+
+var (
+	enabled    bool
+	passphrase string
+
+	keysMu sync.Mutex
+	keys   = map[string][]byte{} // KDF -> key, deriving one takes a while
+)
+
+// Sets up encryption at rest. The passphrase comes from FINCHAT_ENCRYPTION_KEY, or with on
+// from prompt when that isn't set. With on, the files written are encrypted; without it
+// encrypted files can still be read if the passphrase is set, new ones are written in plain.
+func Setup(on bool, prompt func() (string, error)) error {
+	enabled = on
+	passphrase = os.Getenv(KeyEnv)
+	if passphrase != "" || !on {
+		return nil
+	}
+	var err error
+	if passphrase, err = prompt(); err != nil {
+		return err
+	}
+	if passphrase == "" {
+		return fmt.Errorf("encrypting needs a passphrase, in %s or typed in", KeyEnv)
+	}
+	return nil
+}
+
+func Enabled() bool {
+	return enabled
+}
+
+// A new KDF for a key: scrypt, with a random salt
+func NewKDF() ([]byte, error) {
+	kdf := make([]byte, KDFSize)
+	kdf[0], kdf[1], kdf[2], kdf[3] = kdfScrypt, scryptLogN, scryptR, scryptP
+	if _, err := rand.Read(kdf[4:]); err != nil {
+		return nil, err
+	}
+	return kdf, nil
+}
+
+// The KDF of the keys before NewKDF, the salt then was all there was
+func LegacyKDF(salt []byte) []byte {
+	return append(make([]byte, 4), salt...)
+}
+
+// The AES-256 key of a passphrase, derived as kdf says. The salt keeps equal passphrases from
+// giving equal keys; scrypt's memory makes guessing a weak one costly, even on GPUs.
+func Key(passphrase string, kdf []byte) ([]byte, error) {
+	if len(kdf) != KDFSize {
+		return nil, errors.New("damaged key parameters")
+	}
+	salt := kdf[4:]
+	switch kdf[0] {
+	case kdfSHA256:
+		sum := sha256.Sum256(append(append([]byte{}, salt...), passphrase...))
+		for i := 0; i < keyRounds; i++ {
+			sum = sha256.Sum256(sum[:])
+		}
+		return sum[:], nil
+	case kdfScrypt:
+		logN, r, p := int(kdf[1]), int(kdf[2]), int(kdf[3])
+		if logN < 10 || logN > 24 || r < 1 || p < 1 {
+			return nil, fmt.Errorf("unsupported scrypt parameters N=2^%d, r=%d, p=%d", logN, r, p)
+		}
+		return scrypt.Key([]byte(passphrase), salt, 1<<logN, r, p, 32)
+	}
+	return nil, fmt.Errorf("unknown key derivation %d, written by a newer version?", kdf[0])
+}
+
+// Encrypts with AES-GCM, the random nonce is written before the ciphertext. aad isn't
+// encrypted, but Unseal fails unless it's given the same.
+func Seal(key, plain, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, aad), nil
+}
+
+func Unseal(key, sealed, aad []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], aad)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Opens a file, plain or encrypted, for reading its content
+func Open(path string) (io.ReadCloser, error) {
+	return OpenAt(path, 0)
+}
+
+// Opens a file for reading from offset on. For an encrypted file the offset is in the file,
+// not the content, and has to be where an append began, e.g. the file's size at an earlier time.
+func OpenAt(path string, offset int64) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	key, size, err := header(file, path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if key == nil {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return file, nil
+	}
+
+	offset = max(offset, int64(size))
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &reader{file: file, in: bufio.NewReader(file), key: key, offset: offset, path: path}, nil
+}
+
+// Reads a whole file, plain or encrypted
+func ReadFile(path string) ([]byte, error) {
+	r, err := Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Writes a whole file, encrypted if encryption is on
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	w, err := create(path, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Creates or truncates a file, encrypted if encryption is on
+func Create(path string) (*Writer, error) {
+	return create(path, 0644)
+}
+
+func create(path string, perm os.FileMode) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		return &Writer{file: file}, nil
+	}
+	w, err := newEncrypted(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// Opens a file for appending, creating it if needed. An encrypted file stays encrypted; a
+// plain one is encrypted first if encryption is on.
+func Append(path string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		if !enabled {
+			return &Writer{file: file}, nil
+		}
+		w, err := newEncrypted(file)
+		if err != nil {
+			file.Close()
+		}
+		return w, err
+	}
+
+	key, _, err := header(file, path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if key == nil && enabled {
+		file.Close()
+		if err := encryptInPlace(path); err != nil {
+			return nil, err
+		}
+		return Append(path)
+	}
+	end, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Writer{file: file, key: key, offset: end}, nil
+}
+
+// Rewrites a plain file encrypted, through a temporary file so it's never half done
+func encryptInPlace(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".encrypting"
+	if err := WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Reads the header of an open file and returns its key, nil for a plain file, and the
+// header's size. Leaves the file at an unspecified position.
+func header(file *os.File, path string) ([]byte, int, error) {
+	head := make([]byte, headerSizes[magic])
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, 0, err
+	}
+	var kdf []byte
+	switch {
+	case bytes.HasPrefix(head[:n], []byte(magic)) && n == headerSizes[magic]:
+		kdf = head[len(magic):]
+	case bytes.HasPrefix(head[:n], []byte(magicV1)) && n >= headerSizes[magicV1]:
+		kdf = LegacyKDF(head[len(magicV1):headerSizes[magicV1]])
+	case bytes.HasPrefix(head[:n], []byte(magic)), bytes.HasPrefix(head[:n], []byte(magicV1)):
+		return nil, 0, fmt.Errorf("%s: damaged header", path)
+	default:
+		return nil, 0, nil
+	}
+	if passphrase == "" {
+		return nil, 0, fmt.Errorf("%s is encrypted, set %s to its passphrase", path, KeyEnv)
+	}
+	key, err := keyFor(kdf)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, headerSizes[string(head[:len(magic)])], nil
+}
+
+// The key of the passphrase for kdf, derived once per run: scrypt takes a while on purpose
+func keyFor(kdf []byte) ([]byte, error) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+	if key, ok := keys[string(kdf)]; ok {
+		return key, nil
+	}
+	key, err := Key(passphrase, kdf)
+	if err != nil {
+		return nil, err
+	}
+	keys[string(kdf)] = key
+	return key, nil
+}
+
+// Writes a header with a new KDF to an empty file
+func newEncrypted(file *os.File) (*Writer, error) {
+	kdf, err := NewKDF()
+	if err != nil {
+		return nil, err
+	}
+	key, err := keyFor(kdf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(append([]byte(magic), kdf...)); err != nil {
+		return nil, err
+	}
+	return &Writer{file: file, key: key, offset: int64(headerSizes[magic])}, nil
+}
+
+// Writes to a file in plain or encrypted. Content is sealed in frames, written when they
+// are full and by Sync and Close, which have to be called.
+type Writer struct {
+	file   *os.File
+	key    []byte // nil for a plain file
+	buf    []byte
+	offset int64 // where the next frame goes
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.key == nil {
+		return w.file.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= frameSize {
+		if err := w.flush(frameSize); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Writes the pending content and commits the file to disk
+func (w *Writer) Sync() error {
+	if err := w.flush(len(w.buf)); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func (w *Writer) Close() error {
+	if err := w.flush(len(w.buf)); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// Seals the first n pending bytes into a frame, bound to its place in the file so frames
+// can't be reordered
+func (w *Writer) flush(n int) error {
+	if w.key == nil || n == 0 {
+		return nil
+	}
+	sealed, err := Seal(w.key, w.buf[:n], position(w.offset))
+	if err != nil {
+		return err
+	}
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(sealed)))
+	if _, err := w.file.Write(append(frame, sealed...)); err != nil {
+		return err
+	}
+	w.offset += int64(len(frame) + len(sealed))
+	w.buf = append(w.buf[:0], w.buf[n:]...)
+	return nil
+}
+
+func position(offset int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(offset))
+}
+
+// Decrypts the frames of a file as they are read
+type reader struct {
+	file    *os.File
+	in      *bufio.Reader
+	key     []byte
+	offset  int64 // of the next frame
+	pending []byte
+	path    string
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		var size [4]byte
+		if _, err := io.ReadFull(r.in, size[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, io.EOF
+			}
+			return 0, fmt.Errorf("%s: truncated frame", r.path)
+		}
+		// A damaged length mustn't make it allocate up to 4 GiB
+		n := binary.BigEndian.Uint32(size[:])
+		if n > maxSealed {
+			return 0, fmt.Errorf("%s: damaged frame of %d bytes", r.path, n)
+		}
+		sealed := make([]byte, n)
+		if _, err := io.ReadFull(r.in, sealed); err != nil {
+			return 0, fmt.Errorf("%s: truncated frame", r.path)
+		}
+		plain, err := Unseal(r.key, sealed, position(r.offset))
+		if err != nil {
+			return 0, fmt.Errorf("can't decrypt %s, wrong passphrase or damaged file", r.path)
+		}
+		r.offset += int64(len(size) + len(sealed))
+		r.pending = plain
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *reader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,234 @@
+package sentiment
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/llm"
+)
+
+// How messages are scored at upsert, from --sentiment
+const (
+	ModeOff   = "off"
+	ModeLocal = "local" // a small word-list model, nothing leaves the machine
+	ModeLLM   = "llm"   // OpenAI's chat model, in batches
+)
+
+// The tone of a message, stored as the tone metadata
+const (
+	Positive = "positive"
+	Neutral  = "neutral"
+	Negative = "negative"
+	Angry    = "angry" // negative and heated: insults, swearing, shouting
+)
+
+const (
+	neutralBand = 0.2 // scores closer to 0 than this are neutral
+	llmBatch    = 20  // messages scored per chat completion
+	maxChars    = 500 // of a message sent to be scored
+
+	prompt = "Rate the sentiment of each numbered chat message. Reply with one line per message: " +
+		"its number, a score from -1 (very negative) to 1 (very positive), and one of positive, neutral, " +
+		"negative or angry, e.g. \"3: -0.8 angry\". Nothing else."
+)
+
+var mode = ModeOff
+
+// Picks how messages are scored: ModeOff, ModeLocal or ModeLLM
+func SetMode(sentimentMode string) error {
+	switch sentimentMode {
+	case ModeOff, ModeLocal, ModeLLM:
+		mode = sentimentMode
+		return nil
+	}
+	return fmt.Errorf("unknown sentiment mode %q, use %s, %s or %s", sentimentMode, ModeOff, ModeLocal, ModeLLM)
+}
+
+func Mode() string {
+	return mode
+}
+
+// Checks a tone to search for, from --tone
+func ValidTone(tone string) error {
+	switch tone {
+	case "", Positive, Neutral, Negative, Angry:
+		return nil
+	}
+	return fmt.Errorf("unknown tone %q, use %s, %s, %s or %s", tone, Positive, Neutral, Negative, Angry)
+}
+
+// The sentiment of one message
+type Result struct {
+	Score float64 // from -1, very negative, to 1, very positive
+	Tone  string
+}
+
+// Scores the texts with the current mode, nil under ModeOff. Under ModeLLM a batch the chat
+// model fails on, or lines it doesn't answer, are scored locally; the error is returned with
+// the results for logging.
+func Score(texts []string) ([]Result, error) {
+	if mode == ModeOff {
+		return nil, nil
+	}
+	results := make([]Result, len(texts))
+	for i, text := range texts {
+		results[i] = Classify(text)
+	}
+	if mode == ModeLocal {
+		return results, nil
+	}
+
+	var failed error
+	for start := 0; start < len(texts); start += llmBatch {
+		end := min(start+llmBatch, len(texts))
+		if err := scoreBatch(texts[start:end], results[start:end]); err != nil {
+			failed = err
+		}
+	}
+	return results, failed
+}
+
+var answerLine = regexp.MustCompile(`^\s*(\d+)[:.)]\s*(-?\d+(?:\.\d+)?)\s*,?\s*([a-z]+)?`)
+
+// Overwrites the local results of the texts with the chat model's
+func scoreBatch(texts []string, results []Result) error {
+	var sb strings.Builder
+	for i, text := range texts {
+		fmt.Fprintf(&sb, "%d: %s\n", i+1, strings.Join(strings.Fields(grapheme.Snippet(text, maxChars)), " "))
+	}
+	answer, err := llm.Complete([]llm.Message{
+		{Role: "system", Content: prompt},
+		{Role: "user", Content: sb.String()},
+	})
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(strings.ToLower(answer), "\n") {
+		match := answerLine.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(match[1])
+		score, err := strconv.ParseFloat(match[2], 64)
+		if n < 1 || n > len(texts) || err != nil {
+			continue
+		}
+		score = math.Max(-1, math.Min(1, score))
+		tone := match[3]
+		if ValidTone(tone) != nil || tone == "" {
+			tone = toneOf(score, false)
+		}
+		results[n-1] = Result{Score: score, Tone: tone}
+	}
+	return nil
+}
+
+// Scores a message with the word lists: positive and negative words count for and against,
+// a negation just before a word turns it around, and exclamation marks or capitals make it
+// stronger. Negative messages with insults or swearing, or shouted, are angry.
+func Classify(text string) Result {
+	lower := strings.ToLower(text)
+	words := strings.FieldsFunc(lower, func(r rune) bool { return !unicode.IsLetter(r) && r != '\'' })
+
+	sum, hits := 0.0, 0
+	heated := false
+	for i, word := range words {
+		weight, ok := lexicon[word]
+		if !ok {
+			continue
+		}
+		if angerWords[word] {
+			heated = true
+		}
+		if i > 0 && negations[words[i-1]] {
+			weight = -weight / 2 // "not bad" is mildly good, not great
+		}
+		sum += weight
+		hits++
+	}
+	for phrase, weight := range phrases {
+		if strings.Contains(lower, phrase) {
+			sum += weight
+			hits++
+		}
+	}
+	if hits == 0 {
+		return Result{Tone: Neutral}
+	}
+
+	intensity := 1.0
+	if strings.Count(text, "!") >= 2 {
+		intensity += 0.3
+	}
+	if shouting(text) {
+		intensity += 0.3
+		heated = true
+	}
+	score := math.Tanh(intensity * sum / math.Sqrt(float64(hits)+1))
+	return Result{Score: math.Round(score*100) / 100, Tone: toneOf(score, heated)}
+}
+
+func toneOf(score float64, heated bool) string {
+	switch {
+	case score <= -neutralBand && heated:
+		return Angry
+	case score <= -neutralBand:
+		return Negative
+	case score >= neutralBand:
+		return Positive
+	}
+	return Neutral
+}
+
+// Weights of the words the local model knows, English and Hebrew
+var lexicon = map[string]float64{
+	"good": 1, "great": 1.5, "excellent": 2, "amazing": 2, "awesome": 2, "love": 1.5, "loved": 1.5, "like": 0.5,
+	"happy": 1.5, "glad": 1, "thanks": 1, "thank": 1, "perfect": 2, "nice": 1, "wonderful": 2, "best": 1.5,
+	"congrats": 2, "congratulations": 2, "fun": 1, "enjoy": 1, "enjoyed": 1, "yay": 1.5, "cool": 0.5, "beautiful": 1.5,
+	"bad": -1, "worse": -1.5, "worst": -2, "terrible": -2, "awful": -2, "horrible": -2, "hate": -2, "hated": -2,
+	"sad": -1.5, "sorry": -0.5, "problem": -0.5, "broken": -1, "annoying": -1.5, "annoyed": -1.5, "disappointed": -1.5,
+	"upset": -1.5, "angry": -2, "furious": -2.5, "mad": -1.5, "sick": -1, "tired": -0.5, "unacceptable": -2,
+	"ridiculous": -2, "disgusting": -2.5, "stupid": -2, "idiot": -2.5, "idiots": -2.5, "useless": -2, "scam": -2,
+	"damn": -1.5, "shit": -2, "fuck": -2.5, "fucking": -2.5, "wtf": -2, "pathetic": -2, "liar": -2, "lied": -1.5,
+	"טוב": 1, "מעולה": 2, "מצוין": 2, "אוהב": 1.5, "אוהבת": 1.5, "תודה": 1, "כיף": 1.5, "שמח": 1.5, "שמחה": 1.5,
+	"מושלם": 2, "יפה": 1, "מדהים": 2, "מזל": 1, "אחלה": 1.5, "גרוע": -2, "רע": -1, "שונא": -2, "שונאת": -2,
+	"עצוב": -1.5, "מבאס": -1.5, "נמאס": -2, "מעצבן": -2, "כועס": -2, "כועסת": -2, "חוצפה": -2, "מטומטם": -2.5,
+	"אידיוט": -2.5, "זבל": -2, "בושה": -2, "שקרן": -2, "נורא": -1.5, "איום": -2, "מגעיל": -2.5, "חרא": -2,
+}
+
+// Multi-word expressions, matched in the lowercase text
+var phrases = map[string]float64{
+	"fed up": -2, "sick of": -2, "no way": -1, "well done": 1.5, "can't wait": 1.5, "מזל טוב": 2, "כל הכבוד": 2, "די כבר": -2,
+}
+
+// Words that make a negative message angry
+var angerWords = map[string]bool{
+	"angry": true, "furious": true, "mad": true, "unacceptable": true, "ridiculous": true, "disgusting": true,
+	"stupid": true, "idiot": true, "idiots": true, "damn": true, "shit": true, "fuck": true, "fucking": true,
+	"wtf": true, "pathetic": true, "liar": true, "נמאס": true, "מעצבן": true, "כועס": true, "כועסת": true,
+	"חוצפה": true, "מטומטם": true, "אידיוט": true, "זבל": true, "בושה": true, "שקרן": true, "מגעיל": true, "חרא": true,
+}
+
+var negations = map[string]bool{
+	"not": true, "no": true, "never": true, "isn't": true, "wasn't": true, "don't": true, "didn't": true,
+	"doesn't": true, "לא": true, "אין": true, "בלי": true,
+}
+
+// Whether most of the letters of a long enough message are capitals, as spam tells it
+func shouting(text string) bool {
+	var letters, upper int
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	return letters >= 12 && upper*10 >= letters*7
+}
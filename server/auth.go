@@ -0,0 +1,63 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/pisush/fin-chat/tenants"
+)
+
+// What a request's key lets it do: search the index, and with a tenant's key only the tenant's
+// namespace of it
+type grant struct {
+	index, namespace string
+	scoped           bool // the namespace is the tenant's, not the request's to pick
+	role             string
+}
+
+// An endpoint of the API, called only once the request's key has the role it needs
+type apiHandler func(w http.ResponseWriter, r *http.Request, g grant)
+
+// Checks the key of every API request, as "Authorization: Bearer <key>": with tenants a
+// tenant's, otherwise the server's own, which may do anything with the index
+type auth struct {
+	indexName string
+	key       string // the server's own, unused with tenants
+	keys      *tenantKeys
+	log       *log.Logger
+}
+
+// Serves h on path for the keys with role. Every /api/ endpoint is added through here, so none
+// can be reached without a key, nor one that writes with a key that only reads.
+func (a *auth) handle(mux *http.ServeMux, path, role string, h apiHandler) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		g, ok := a.check(r)
+		if !ok {
+			a.log.Printf("Rejected a request to %s without a valid key from %s", path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fin-chat"`)
+			http.Error(w, "missing or unknown API key", http.StatusUnauthorized)
+			return
+		}
+		if !tenants.Allows(g.role, role) {
+			a.log.Printf("Rejected a request to %s from %s, its key's role %q can't %s", path, r.RemoteAddr, g.role, role)
+			http.Error(w, "the API key's role doesn't allow this", http.StatusForbidden)
+			return
+		}
+		h(w, r, g)
+	})
+}
+
+// What the request's key grants, false if it has none or an unknown one
+func (a *auth) check(r *http.Request) (grant, bool) {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return grant{}, false
+	}
+	if a.keys != nil {
+		_, tenant, ok := a.keys.current().Authenticate(key)
+		return grant{index: tenant.Index, namespace: tenant.Namespace, scoped: true, role: tenant.Role}, ok
+	}
+	return grant{index: a.indexName, role: tenants.RoleDelete}, tenants.Equal(key, a.key)
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pisush/fin-chat/anonymize"
+	"github.com/pisush/fin-chat/doctor"
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/query"
+	"github.com/pisush/fin-chat/ranking"
+	"github.com/pisush/fin-chat/sentiment"
+	"github.com/pisush/fin-chat/tenants"
+	"github.com/pisush/fin-chat/timezone"
+)
+
+const (
+	searchTopK      = 10               // results shown per search in the web UI
+	readyTTL        = 15 * time.Second // how long /readyz reuses its checks, probes come every few seconds
+	shutdownTimeout = 10 * time.Second // for the searches running when the server is stopped
+)
+
+//go:embed static
+var static embed.FS
+
+// A single search hit as returned to the web UI
+type SearchResult struct {
+	ID     string  `json:"id"`
+	Score  float64 `json:"score"`
+	Text   string  `json:"text"`
+	Sender string  `json:"sender"`
+	Time   string  `json:"time"`
+}
+
+// Serves the search UI and its JSON API on addr until the server fails or ctx is done, with
+// /healthz and /readyz for a container's liveness and readiness probes. model is the embedding
+// model readiness checks OpenAI's key can use. Every search needs a key: key, the server's own,
+// or with tenants registered in tenantsPath a tenant's, which reads only the tenant's index and
+// namespace.
+func Serve(ctx context.Context, addr, indexName, model, key, tenantsPath string, log *log.Logger) error {
+	staticFiles, err := fs.Sub(static, "static")
+	if err != nil {
+		log.Printf("Error loading embedded web UI: %v", err)
+		return err
+	}
+	keys, err := loadTenantKeys(tenantsPath, log)
+	if err != nil {
+		return err
+	}
+	if keys == nil && key == "" {
+		return errors.New("serving needs a key, or tenants with keys of their own")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(staticFiles)))
+	auth := &auth{indexName: indexName, key: key, keys: keys, log: log}
+	auth.handle(mux, "/api/search", tenants.RoleRead, searchHandler(log))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.Handle("/readyz", &readiness{indexName: indexName, model: model, keys: keys, log: log})
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error stopping the web UI server: %v", err)
+		}
+	}()
+
+	fmt.Println(i18n.T("serve.listening", addr))
+	if keys != nil {
+		fmt.Println(i18n.T("serve.tenants", len(keys.registry.Tenants), tenantsPath))
+	}
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-done
+	return nil
+}
+
+// Handles GET /readyz: 200 once OpenAI, Pinecone and the index answer, 503 while any doesn't.
+// Anyone can ask, so the body only says whether it's ready; which check failed, and why, is
+// in the log, with the names of the indexes.
+type readiness struct {
+	indexName, model string
+	keys             *tenantKeys
+	log              *log.Logger
+
+	mu      sync.Mutex
+	checked time.Time
+	ready   bool
+}
+
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rd.mu.Lock()
+	if time.Since(rd.checked) > readyTTL {
+		indexes := []string{rd.indexName}
+		if rd.keys != nil {
+			indexes = rd.keys.indexes()
+		}
+		checks := doctor.Backends(rd.model, indexes...)
+		rd.ready = doctor.Passed(checks)
+		rd.checked = time.Now()
+		for _, check := range checks {
+			if check.Err != nil {
+				rd.log.Printf("Not ready, %s: %v", check.Name, check.Err)
+			}
+		}
+	}
+	ready := rd.ready
+	rd.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(struct {
+		Ready bool `json:"ready"`
+	}{ready}); err != nil {
+		rd.log.Printf("Error encoding the readiness: %v", err)
+	}
+}
+
+// Handles GET /api/search?q=...&sender=...&from=YYYY-MM-DD&to=YYYY-MM-DD&namespace=...&lang=...&tone=...&mentions=...
+// With a tenant's key, the namespace is the tenant's, whatever namespace asks for.
+func searchHandler(log *log.Logger) apiHandler {
+	return func(w http.ResponseWriter, r *http.Request, g grant) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		params := r.URL.Query()
+		namespace := params.Get("namespace")
+		if g.scoped {
+			namespace = g.namespace
+		}
+
+		queryMessage := strings.TrimSpace(params.Get("q"))
+		if queryMessage == "" {
+			http.Error(w, "missing search text", http.StatusBadRequest)
+			return
+		}
+
+		filter, err := parseFilter(params.Get("sender"), params.Get("from"), params.Get("to"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.Namespace = namespace
+		filter.Language = params.Get("lang")
+		filter.Tone = params.Get("tone")
+		filter.Mentions = params.Get("mentions")
+		if err := sentiment.ValidTone(filter.Tone); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		matches, err := ranking.Search(g.index, queryMessage, searchTopK, filter, log)
+		if err != nil {
+			log.Printf("Error querying Pinecone from web UI: %v", err)
+			http.Error(w, "search failed", http.StatusBadGateway)
+			return
+		}
+
+		results := make([]SearchResult, 0, len(matches))
+		for _, match := range matches {
+			results = append(results, SearchResult{
+				ID:     match.ID,
+				Score:  match.Score,
+				Text:   anonymize.Reveal(match.Text()),
+				Sender: anonymize.Reveal(match.Sender()),
+				Time:   match.Timestamp().Format("2006-01-02 15:04"),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(results); err != nil {
+			log.Printf("Error encoding search results: %v", err)
+		}
+	}
+}
+
+// Builds a query filter from the raw form values, the "to" date is inclusive
+func parseFilter(sender, from, to string) (query.Filter, error) {
+	filter := query.Filter{Sender: strings.TrimSpace(sender)}
+
+	if from != "" {
+		fromDate, err := timezone.ParseDate(from)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from date: %s", from)
+		}
+		filter.From = fromDate
+	}
+
+	if to != "" {
+		toDate, err := timezone.ParseDate(to)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to date: %s", to)
+		}
+		filter.To = toDate.AddDate(0, 0, 1).Add(-time.Second)
+	}
+
+	return filter, nil
+}
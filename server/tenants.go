@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pisush/fin-chat/tenants"
+)
+
+// The tenants of a server serving several, read again when their file changes, so keys added,
+// rotated or removed with the tenants command take effect without a restart
+type tenantKeys struct {
+	path string
+	log  *log.Logger
+
+	mu       sync.Mutex
+	modTime  time.Time
+	registry *tenants.Registry
+}
+
+// The tenants of path, nil if it registers none: the server then serves a single user. A
+// server started with tenants keeps requiring keys, even if the file is emptied or removed.
+func loadTenantKeys(path string, log *log.Logger) (*tenantKeys, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	registry, err := tenants.Load(path)
+	if err != nil || len(registry.Tenants) == 0 {
+		return nil, err
+	}
+	return &tenantKeys{path: path, log: log, modTime: info.ModTime(), registry: registry}, nil
+}
+
+// The registry as the file has it now. If it can't be read, e.g. halfway through being
+// written, the last one read is kept; a removed file has no tenants left.
+func (k *tenantKeys) current() *tenants.Registry {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	info, err := os.Stat(k.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &tenants.Registry{}
+	}
+	if err != nil || info.ModTime().Equal(k.modTime) {
+		return k.registry
+	}
+	registry, err := tenants.Load(k.path)
+	if err != nil {
+		k.log.Printf("Error reloading %s, keeping the tenants read before: %v", k.path, err)
+		return k.registry
+	}
+	k.registry, k.modTime = registry, info.ModTime()
+	return registry
+}
+
+// The indexes of the tenants, sorted, for /readyz to check
+func (k *tenantKeys) indexes() []string {
+	seen := map[string]bool{}
+	var indexes []string
+	for _, tenant := range k.current().Tenants {
+		if !seen[tenant.Index] {
+			seen[tenant.Index] = true
+			indexes = append(indexes, tenant.Index)
+		}
+	}
+	sort.Strings(indexes)
+	return indexes
+}
@@ -0,0 +1,112 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/secure"
+)
+
+const (
+	sessionsDir = "./sessions"
+	idLayout    = "20060102-150405" // session IDs are their start time, which also sorts them
+)
+
+// One question of a session with what was retrieved for it
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Question  string    `json:"question"`
+	Retrieved []string  `json:"retrieved"` // vector IDs of the retrieved messages
+	Answer    string    `json:"answer"`
+}
+
+// A recorded interactive query or ask session
+type Session struct {
+	ID      string    `json:"id"`
+	Mode    string    `json:"mode"` // the action, query or ask
+	Started time.Time `json:"started"`
+	Entries []Entry   `json:"entries"`
+}
+
+// Starts a new transcript, nothing is written until the first entry
+func New(mode string) *Session {
+	started := time.Now()
+	return &Session{ID: started.Format(idLayout), Mode: mode, Started: started}
+}
+
+// Records a question and saves the transcript right away, so it survives the terminal closing
+func (s *Session) Add(question string, retrieved []string, answer string) error {
+	s.Entries = append(s.Entries, Entry{Time: time.Now(), Question: question, Retrieved: retrieved, Answer: answer})
+	return s.save()
+}
+
+func (s *Session) save() error {
+	if err := os.MkdirAll(sessionsDir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return secure.WriteFile(filepath.Join(sessionsDir, s.ID+".json"), data, 0644)
+}
+
+// Reads a recorded session by ID
+func Load(id string) (*Session, error) {
+	data, err := secure.ReadFile(filepath.Join(sessionsDir, id+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no session %s", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("reading session %s: %w", id, err)
+	}
+	return &s, nil
+}
+
+// The IDs of all recorded sessions, oldest first
+func List() ([]string, error) {
+	files, err := os.ReadDir(sessionsDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, file := range files {
+		if !file.IsDir() && filepath.Ext(file.Name()) == ".json" {
+			ids = append(ids, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Renders the transcript as plain text for the terminal
+func (s *Session) Format() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s session %s (%d questions)\n", s.Mode, s.Started.Format("2006-01-02 15:04"), len(s.Entries))
+	for _, entry := range s.Entries {
+		fmt.Fprintf(&sb, "\n[%s] > %s\n", entry.Time.Format("15:04:05"), entry.Question)
+		if entry.Answer != "" {
+			fmt.Fprintln(&sb, entry.Answer)
+		}
+		if len(entry.Retrieved) > 0 {
+			fmt.Fprintf(&sb, "retrieved: %s\n", strings.Join(entry.Retrieved, ", "))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,139 @@
+package spam
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// What is done with promotional, bot and notification messages
+const (
+	ModeOff  = "off"  // not classified
+	ModeTag  = "tag"  // tagged in the vector metadata at upsert and left out of search results
+	ModeSkip = "skip" // not embedded at all
+)
+
+// Categories of messages that aren't conversation
+const (
+	Promotional  = "promotional"
+	Bot          = "bot"
+	Notification = "notification"
+)
+
+const threshold = 0.5 // probability above which a message is spam
+
+var mode = ModeOff
+
+// Picks what happens to classified messages: ModeOff, ModeTag or ModeSkip
+func SetMode(spamMode string) error {
+	switch spamMode {
+	case ModeOff, ModeTag, ModeSkip:
+		mode = spamMode
+		return nil
+	}
+	return fmt.Errorf("unknown spam mode %q, use %s, %s or %s", spamMode, ModeOff, ModeTag, ModeSkip)
+}
+
+func Mode() string {
+	return mode
+}
+
+// The verdict on one message. Category is empty for regular messages.
+type Result struct {
+	Category    string
+	Probability float64
+}
+
+func (r Result) Spam() bool {
+	return r.Category != ""
+}
+
+// A weighted signal of the model, pointing towards one category
+type feature struct {
+	category string
+	weight   float64
+	match    func(text, lower, sender string) bool
+}
+
+var (
+	urlRegex       = regexp.MustCompile(`(?i)\b(https?://|www\.)\S+`)
+	codeRegex      = regexp.MustCompile(`\b\d{4,8}\b`)
+	shortCodeRegex = regexp.MustCompile(`^\+?[\d\s-]{3,6}$`) // SMS short codes such as 72345
+	// "bot" as a word or a CamelCase suffix (GitHubBot), but not inside a name (Talbot)
+	botSenderRegex = regexp.MustCompile(`(?i:\bbot\b|_bot\b|\bbot_|no-?reply|\bnotifications?\b|\balerts?\b)|[a-z]Bot\b`)
+)
+
+// Bias and weights of a small logistic model over hand-picked features,
+// tuned so that one strong signal or two weak ones tip a message over
+const bias = -3.0
+
+var features = []feature{
+	{Promotional, 1.5, func(text, lower, sender string) bool { return urlRegex.MatchString(text) }},
+	{Promotional, 2.0, func(text, lower, sender string) bool { return containsAny(lower, promoWords) }},
+	{Promotional, 3.5, func(text, lower, sender string) bool { return containsAny(lower, unsubscribeWords) }},
+	{Promotional, 1.0, func(text, lower, sender string) bool { return strings.Count(text, "!") >= 3 }},
+	{Promotional, 1.0, func(text, lower, sender string) bool { return shouting(text) }},
+	{Notification, 2.0, func(text, lower, sender string) bool { return containsAny(lower, notificationWords) }},
+	{Notification, 3.0, func(text, lower, sender string) bool {
+		return codeRegex.MatchString(text) && containsAny(lower, codeWords)
+	}},
+	{Bot, 4.0, func(text, lower, sender string) bool { return botSenderRegex.MatchString(sender) }},
+	{Bot, 2.0, func(text, lower, sender string) bool { return shortCodeRegex.MatchString(strings.TrimSpace(sender)) }},
+}
+
+var (
+	promoWords        = []string{"sale", "discount", "% off", "limited time", "buy now", "order now", "special offer", "coupon", "promo code", "free shipping", "מבצע", "הנחה", "קופון", "לזמן מוגבל", "משלוח חינם"}
+	unsubscribeWords  = []string{"unsubscribe", "to stop receiving", "reply stop", "להסרה", "להסרת"}
+	notificationWords = []string{"your order", "has been shipped", "has been delivered", "payment received", "your appointment", "reminder:", "do not reply", "הזמנתך", "נשלחה", "תזכורת:", "התשלום התקבל"}
+	codeWords         = []string{"code", "otp", "verification", "password", "קוד"}
+)
+
+// Classifies a message by its text and sender
+func Classify(text, sender string) Result {
+	lower := strings.ToLower(text)
+	scores := map[string]float64{}
+	z := bias
+	for _, f := range features {
+		if f.match(text, lower, sender) {
+			z += f.weight
+			scores[f.category] += f.weight
+		}
+	}
+
+	result := Result{Probability: 1 / (1 + math.Exp(-z))}
+	if result.Probability < threshold {
+		return result
+	}
+	// The category contributing the most evidence, in a fixed order on ties
+	for _, category := range []string{Bot, Notification, Promotional} {
+		if result.Category == "" || scores[category] > scores[result.Category] {
+			result.Category = category
+		}
+	}
+	return result
+}
+
+func containsAny(s string, words []string) bool {
+	for _, word := range words {
+		if strings.Contains(s, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether most of the letters of a long enough message are capitals
+func shouting(text string) bool {
+	var letters, upper int
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	return letters >= 12 && upper*10 >= letters*7
+}
@@ -0,0 +1,108 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"time"
+
+	"github.com/pisush/fin-chat/secure"
+)
+
+const stateFilePath = "./state.json"
+
+// Values learned in previous runs and kept between them
+type State struct {
+	BatchSizes map[string]int `json:"batch_sizes,omitempty"` // provider -> learned batch size
+	Bookmarks  []Bookmark     `json:"bookmarks,omitempty"`   // in the order they were added
+
+	Ingested       map[string]IngestedFile `json:"ingested,omitempty"`         // sha256 of the content -> file, for watch
+	HighWaterMarks map[string]time.Time    `json:"high_water_marks,omitempty"` // chat -> newest message embedded, for --incremental
+	Digest         *Digest                 `json:"digest,omitempty"`
+	Deleted        []Deleted               `json:"deleted,omitempty"`   // soft-deleted vectors, oldest first
+	Schedules      map[string]time.Time    `json:"schedules,omitempty"` // scheduled action of the pipeline spec -> when apply last ran it
+	Summaries      map[string]string       `json:"summaries,omitempty"` // summary vector ID -> hash of the messages it summarizes
+}
+
+// A vector hidden from searches by forget, deleted from the index once the restore window passes
+type Deleted struct {
+	ID        string    `json:"id"`
+	Namespace string    `json:"namespace,omitempty"`
+	Text      string    `json:"text,omitempty"` // to tell what it was when listing
+	At        time.Time `json:"at"`
+}
+
+// Where the periodic digest of watch --digest left off
+type Digest struct {
+	Last   time.Time `json:"last"`   // when the last digest was due
+	Offset int64     `json:"offset"` // size of the embeddings file then, later rows are new content
+}
+
+// An export file the watch action has ingested
+type IngestedFile struct {
+	Name string    `json:"name"`
+	At   time.Time `json:"at"`
+}
+
+// A search result saved for later review
+type Bookmark struct {
+	ID        string    `json:"id"`
+	Namespace string    `json:"namespace,omitempty"`
+	Sender    string    `json:"sender"`
+	Timestamp time.Time `json:"timestamp"`
+	Text      string    `json:"text"`
+	Added     time.Time `json:"added"`
+}
+
+// Reads the state file, a missing file is an empty state
+func Load() (*State, error) {
+	st := &State{BatchSizes: map[string]int{}, Ingested: map[string]IngestedFile{}, HighWaterMarks: map[string]time.Time{}, Schedules: map[string]time.Time{}, Summaries: map[string]string{}}
+
+	data, err := secure.ReadFile(stateFilePath) // bookmarks hold message text
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	if st.BatchSizes == nil {
+		st.BatchSizes = map[string]int{}
+	}
+	if st.Ingested == nil {
+		st.Ingested = map[string]IngestedFile{}
+	}
+	if st.HighWaterMarks == nil {
+		st.HighWaterMarks = map[string]time.Time{}
+	}
+	if st.Schedules == nil {
+		st.Schedules = map[string]time.Time{}
+	}
+	if st.Summaries == nil {
+		st.Summaries = map[string]string{}
+	}
+	return st, nil
+}
+
+// Writes the state file
+func (st *State) Save() error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return secure.WriteFile(stateFilePath, data, 0644)
+}
+
+// Adds a bookmark unless the vector is already bookmarked, reporting whether it was added
+func (st *State) AddBookmark(bookmark Bookmark) bool {
+	for _, existing := range st.Bookmarks {
+		if existing.ID == bookmark.ID && existing.Namespace == bookmark.Namespace {
+			return false
+		}
+	}
+	st.Bookmarks = append(st.Bookmarks, bookmark)
+	return true
+}
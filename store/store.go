@@ -0,0 +1,168 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pisush/fin-chat/secure"
+	"github.com/pisush/fin-chat/timezone"
+
+	_ "modernc.org/sqlite" // pure Go, so the tool still builds without a C compiler
+)
+
+// The SQLite database of every embedded message by vector ID. It holds message text in plain,
+// so it isn't written with --encrypt.
+const Path = "./messages.db"
+
+const maxLookup = 500 // IDs per query, below SQLite's limit on parameters
+
+const schema = `CREATE TABLE IF NOT EXISTS messages (
+	id        TEXT PRIMARY KEY,
+	text      TEXT NOT NULL,
+	sender    TEXT NOT NULL,
+	timestamp INTEGER NOT NULL,
+	chat      TEXT NOT NULL
+)`
+
+// A message as embed wrote it, under the ID of its vector
+type Message struct {
+	ID        string
+	Text      string
+	Sender    string
+	Timestamp time.Time
+	Chat      string // the namespace
+}
+
+var (
+	mu sync.Mutex
+	db *sql.DB // opened on first use
+)
+
+// Opens the database, creating it if create is set. Without it, a missing database is nil.
+func open(create bool) (*sql.DB, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if db != nil {
+		return db, nil
+	}
+	if _, err := os.Stat(Path); !create && errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	conn, err := sql.Open("sqlite", Path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(schema); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	db = conn
+	return db, nil
+}
+
+// Closes the database, the next use opens it again
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if db == nil {
+		return nil
+	}
+	err := db.Close()
+	db = nil
+	return err
+}
+
+// Whether Put writes the messages, i.e. encryption is off
+func Enabled() bool {
+	return !secure.Enabled()
+}
+
+// Adds the messages, replacing those already stored under their IDs
+func Put(messages []Message) error {
+	if !Enabled() || len(messages) == 0 {
+		return nil
+	}
+	conn, err := open(true)
+	if err != nil {
+		return err
+	}
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("INSERT OR REPLACE INTO messages (id, text, sender, timestamp, chat) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, m := range messages {
+		if _, err := stmt.Exec(m.ID, m.Text, m.Sender, m.Timestamp.Unix(), m.Chat); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// The stored messages with the IDs, those not stored are left out. No database is no messages.
+func Get(ids []string) (map[string]Message, error) {
+	found := map[string]Message{}
+	conn, err := open(false)
+	if conn == nil || err != nil {
+		return found, err
+	}
+	for start := 0; start < len(ids); start += maxLookup {
+		chunk := ids[start:min(start+maxLookup, len(ids))]
+		rows, err := conn.Query("SELECT id, text, sender, timestamp, chat FROM messages WHERE id IN ("+placeholders(len(chunk))+")", args(chunk)...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var m Message
+			var timestamp int64
+			if err := rows.Scan(&m.ID, &m.Text, &m.Sender, &timestamp, &m.Chat); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			m.Timestamp = timezone.Clock(time.Unix(timestamp, 0))
+			found[m.ID] = m
+		}
+		if err := rows.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// Removes the messages with the IDs, after their vectors were deleted for good
+func Delete(ids []string) error {
+	conn, err := open(false)
+	if conn == nil || err != nil {
+		return err
+	}
+	for start := 0; start < len(ids); start += maxLookup {
+		chunk := ids[start:min(start+maxLookup, len(ids))]
+		if _, err := conn.Exec("DELETE FROM messages WHERE id IN ("+placeholders(len(chunk))+")", args(chunk)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+func args(ids []string) []interface{} {
+	values := make([]interface{}, len(ids))
+	for i, id := range ids {
+		values[i] = id
+	}
+	return values
+}
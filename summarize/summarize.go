@@ -0,0 +1,91 @@
+package summarize
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/embed"
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/llm"
+)
+
+const (
+	maxChunkChars = 12000 // chat text summarized per request, leaving room for the reply
+
+	chunkPrompt = "Summarize this part of a WhatsApp group chat. " +
+		"List the topics discussed, any decisions made and any open questions, with who was involved."
+	finalPrompt = "Combine these partial summaries of a WhatsApp group chat into one summary in markdown " +
+		"with the sections \"## Key topics\", \"## Decisions\" and \"## Open questions\". " +
+		"Keep it concise and mention who was involved."
+)
+
+// Keeps the messages sent between from and to, zero times leave that side open
+func FilterByDate(messages []embed.Message, from, to time.Time) []embed.Message {
+	var selected []embed.Message
+	for _, msg := range messages {
+		if !from.IsZero() && msg.Timestamp.Before(from) {
+			continue
+		}
+		if !to.IsZero() && msg.Timestamp.After(to) {
+			continue
+		}
+		selected = append(selected, msg)
+	}
+	return selected
+}
+
+// Produces a markdown summary of the messages: key topics, decisions and open questions.
+// Long chats are summarized chunk by chunk and the partial summaries combined.
+func Summarize(messages []embed.Message, log *log.Logger) (string, error) {
+	if len(messages) == 0 {
+		return "", fmt.Errorf("no messages to summarize")
+	}
+
+	chunks := chunkMessages(messages, maxChunkChars)
+	partials := make([]string, 0, len(chunks))
+	for i, chunk := range chunks {
+		fmt.Println(i18n.T("summarize.part", i+1, len(chunks)))
+		partial, err := llm.Complete([]llm.Message{
+			{Role: "system", Content: chunkPrompt},
+			{Role: "user", Content: chunk},
+		})
+		if err != nil {
+			log.Printf("Error summarizing chunk %d: %v", i+1, err)
+			return "", err
+		}
+		partials = append(partials, partial)
+	}
+
+	summary, err := llm.Complete([]llm.Message{
+		{Role: "system", Content: finalPrompt},
+		{Role: "user", Content: strings.Join(partials, "\n\n---\n\n")},
+	})
+	if err != nil {
+		log.Printf("Error combining summaries: %v", err)
+		return "", err
+	}
+
+	first, last := messages[0].Timestamp, messages[len(messages)-1].Timestamp
+	header := fmt.Sprintf("# Chat summary %s to %s\n\n", first.Format("2006-01-02"), last.Format("2006-01-02"))
+	return header + summary, nil
+}
+
+// Groups "[date] sender: text" lines into chunks of at most maxChars each
+func chunkMessages(messages []embed.Message, maxChars int) []string {
+	var chunks []string
+	var sb strings.Builder
+	for _, msg := range messages {
+		line := fmt.Sprintf("[%s] %s: %s\n", msg.Timestamp.Format("2006-01-02 15:04"), msg.Sender, msg.Text)
+		if sb.Len() > 0 && sb.Len()+len(line) > maxChars {
+			chunks = append(chunks, sb.String())
+			sb.Reset()
+		}
+		sb.WriteString(line)
+	}
+	if sb.Len() > 0 {
+		chunks = append(chunks, sb.String())
+	}
+	return chunks
+}
@@ -0,0 +1,85 @@
+package system
+
+import (
+	"fmt"
+	"strings"
+)
+
+// What is done with media placeholders and system messages, from --system-messages
+const (
+	ModeKeep = "keep" // embedded like any message
+	ModeTag  = "tag"  // tagged in the vector metadata at upsert and left out of search results
+	ModeSkip = "skip" // not embedded at all
+)
+
+// Kinds of messages that aren't anything anyone wrote
+const (
+	Media  = "media"  // a placeholder for an attachment the export left out, e.g. "<Media omitted>"
+	Notice = "notice" // written by the app, e.g. "Messages and calls are end-to-end encrypted"
+)
+
+const maxNoticeChars = 300 // longer messages that mention a notice are someone's own
+
+var mode = ModeSkip
+
+// Picks what happens to placeholders and system messages: ModeKeep, ModeTag or ModeSkip
+func SetMode(systemMode string) error {
+	switch systemMode {
+	case ModeKeep, ModeTag, ModeSkip:
+		mode = systemMode
+		return nil
+	}
+	return fmt.Errorf("unknown system messages mode %q, use %s, %s or %s", systemMode, ModeKeep, ModeTag, ModeSkip)
+}
+
+func Mode() string {
+	return mode
+}
+
+var (
+	// Found anywhere in a message, the brackets don't come up in conversation
+	mediaMarkers = []string{"<media omitted>", "<המדיה לא נכללה>", "<attached: ", "<מצורף: "}
+	// The whole message, as iOS exports write them
+	mediaMessages = map[string]bool{
+		"image omitted": true, "video omitted": true, "audio omitted": true, "sticker omitted": true,
+		"document omitted": true, "gif omitted": true, "contact card omitted": true, "null": true,
+		"התמונה הושמטה": true, "הסרטון הושמט": true, "השמע הושמט": true, "המדבקה הושמטה": true,
+		"המסמך הושמט": true, "ה-gif הושמט": true, "כרטיס איש הקשר הושמט": true,
+	}
+	noticePhrases = []string{
+		"messages and calls are end-to-end encrypted", "joined using this group's invite link", "created group",
+		"created this group", "changed the subject", "changed this group's icon", "deleted this group's icon",
+		"changed the group description", "changed this group's settings", "you're now an admin", "you are now an admin",
+		"security code changed", "your security code with", "missed voice call", "missed video call",
+		"this message was deleted", "you deleted this message", "changed their phone number", "turned on disappearing messages",
+		"turned off disappearing messages", "waiting for this message",
+		"ההודעות והשיחות מוצפנות מקצה לקצה", "הצטרף/ה באמצעות קישור ההזמנה", "הצטרפת באמצעות קישור ההזמנה",
+		"יצר/ה את הקבוצה", "יצרת את הקבוצה", "שינה/תה את נושא הקבוצה", "שינה/תה את הסמל של הקבוצה",
+		"שינה/תה את תיאור הקבוצה", "את/ה עכשיו מנהל/ת", "קוד האבטחה שלך עם", "שיחה קולית שלא נענתה", "שיחת וידאו שלא נענתה",
+		"ההודעה נמחקה", "מחקת את ההודעה", "שינה/תה את מספר הטלפון", "הפעיל/ה הודעות זמניות", "כיבה/תה הודעות זמניות",
+		"ממתין להודעה זו", "הוסיף/ה", "הסיר/ה", "יצא/ה", "הצטרף/ה",
+	}
+)
+
+// The kind of a message, Media, Notice or empty for everything else. Exports' bidi marks must
+// be gone already, see normalize.Text.
+func Classify(text string) string {
+	lower := strings.ReplaceAll(strings.ToLower(strings.TrimSpace(text)), "’", "'")
+	for _, marker := range mediaMarkers {
+		if strings.Contains(lower, marker) {
+			return Media
+		}
+	}
+	if mediaMessages[lower] {
+		return Media
+	}
+	if len([]rune(lower)) > maxNoticeChars {
+		return ""
+	}
+	for _, phrase := range noticePhrases {
+		if strings.Contains(lower, phrase) {
+			return Notice
+		}
+	}
+	return ""
+}
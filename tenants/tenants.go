@@ -0,0 +1,170 @@
+package tenants
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+)
+
+const DefaultPath = "./tenants.json"
+
+const (
+	keyPrefix = "fck_" // tells a fin-chat key apart in a config file or a leak scan
+	keyBytes  = 24
+)
+
+// What a key may do, each role also what the roles before it may. serve only searches for now;
+// ingest and delete are for the endpoints that will write, so keys made today can't.
+const (
+	RoleRead   = "read"
+	RoleIngest = "ingest"
+	RoleDelete = "delete"
+)
+
+var roles = []string{RoleRead, RoleIngest, RoleDelete}
+
+// Who a key of serve belongs to, and the only vectors its searches read: the namespace of the index
+type Tenant struct {
+	Index     string `json:"index"`
+	Namespace string `json:"namespace,omitempty"`
+	Role      string `json:"role,omitempty"` // empty for keys made before roles, which read
+	KeyHash   string `json:"key_sha256"`     // the key itself is shown once, when it's made
+}
+
+func ValidRole(role string) error {
+	if rank(role) < 0 {
+		return fmt.Errorf("unknown role %q, use %s", role, strings.Join(roles, ", "))
+	}
+	return nil
+}
+
+// Whether a key with role may do what needs the role need. An unknown role may do nothing.
+func Allows(role, need string) bool {
+	if role == "" {
+		role = RoleRead
+	}
+	have := rank(role)
+	return have >= 0 && rank(need) >= 0 && have >= rank(need)
+}
+
+func rank(role string) int {
+	for i, r := range roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// The tenants registered with "tenants add", by name
+type Registry struct {
+	Tenants map[string]Tenant `json:"tenants"`
+}
+
+// Reads the registry, a missing file is an empty one
+func Load(path string) (*Registry, error) {
+	r := &Registry{Tenants: map[string]Tenant{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(r); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if r.Tenants == nil {
+		r.Tenants = map[string]Tenant{}
+	}
+	return r, nil
+}
+
+// Only its owner can read the file, it maps every key to the index it reads
+func (r *Registry) Save(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// The registered tenant called name
+func (r *Registry) Lookup(name string) (Tenant, error) {
+	tenant, ok := r.Tenants[name]
+	if !ok {
+		if len(r.Tenants) == 0 {
+			return Tenant{}, fmt.Errorf("no tenant %q, none are registered yet: add one with tenants add", name)
+		}
+		return Tenant{}, fmt.Errorf("no tenant %q, there are: %s", name, strings.Join(r.Names(), ", "))
+	}
+	return tenant, nil
+}
+
+// The names of the registered tenants, sorted
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.Tenants))
+	for name := range r.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The tenant whose vectors are in the namespace of the index, if any. Two tenants never share
+// one, or each could search the other's messages.
+func (r *Registry) Owner(index, namespace string) (string, bool) {
+	for name, tenant := range r.Tenants {
+		if tenant.Index == index && tenant.Namespace == namespace {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// The tenant a key belongs to. Every hash is compared, in constant time, so how long it takes
+// doesn't tell how close a guess came.
+func (r *Registry) Authenticate(key string) (string, Tenant, bool) {
+	keyHash := hashOf(key)
+	var found string
+	for name, tenant := range r.Tenants {
+		if subtle.ConstantTimeCompare([]byte(keyHash), []byte(tenant.KeyHash)) == 1 {
+			found = name
+		}
+	}
+	if found == "" {
+		return "", Tenant{}, false
+	}
+	return found, r.Tenants[found], true
+}
+
+// A new random key, and the hash the registry keeps of it
+func NewKey() (key, hash string, err error) {
+	b := make([]byte, keyBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = keyPrefix + hex.EncodeToString(b)
+	return key, hashOf(key), nil
+}
+
+func hashOf(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Whether key is want, in constant time. Hashed first, so neither length is given away either.
+func Equal(key, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashOf(key)), []byte(hashOf(want))) == 1
+}
@@ -0,0 +1,53 @@
+package timezone
+
+import (
+	"fmt"
+	"time"
+	_ "time/tzdata" // so zones load on machines and containers without a zoneinfo database
+)
+
+const dateLayout = "2006-01-02"
+
+// The zone the clocks of chat exports were in, from --timezone. Under UTC, the default, the
+// times an export writes are stored as they are.
+var location = time.UTC
+
+// Reads the clocks of exports in the named IANA zone, e.g. Asia/Jerusalem, or Local for this
+// machine's. Empty is UTC.
+func Set(name string) error {
+	if name == "" {
+		location = time.UTC
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("unknown timezone %q, use an IANA name such as Europe/London: %v", name, err)
+	}
+	location = loc
+	return nil
+}
+
+func Location() *time.Location {
+	return location
+}
+
+// Whether a zone other than UTC was set
+func Enabled() bool {
+	return location != time.UTC
+}
+
+// The moment a time an export writes without a zone stands for, given parsed as UTC. Daylight
+// saving follows the zone's rules for that day.
+func FromClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), location)
+}
+
+// The time on the export's clock
+func Clock(t time.Time) time.Time {
+	return t.In(location)
+}
+
+// The start of a day given as 2006-01-02, on the export's clock
+func ParseDate(value string) (time.Time, error) {
+	return time.ParseInLocation(dateLayout, value, location)
+}
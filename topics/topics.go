@@ -0,0 +1,153 @@
+package topics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/anonymize"
+	"github.com/pisush/fin-chat/cluster"
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/llm"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+const (
+	maxTopics       = 30 // without a k, see cluster.DefaultK
+	representatives = 5  // messages shown per topic, the closest to its centroid
+	labelSamples    = 20 // messages sent to the chat model to name a topic
+	topSenders      = 3
+	snippetChars    = 200
+
+	labelPrompt = "These messages from a chat are about one topic. Reply with a short name for the topic, " +
+		"three to six words, and nothing else."
+)
+
+// A cluster of the messages
+type Topic struct {
+	Label           string // named by the chat model, empty without Label
+	Size            int
+	From, To        time.Time
+	Senders         []string      // who wrote the most of it, most first
+	Representatives []vectors.Row // closest to the centroid first
+	samples         []vectors.Row // sent to be labeled
+}
+
+// Clusters the rows into k topics, or a number fitting their count if k is 0, largest first.
+// Rows without values are left out.
+func Find(rows []vectors.Row, k int) []Topic {
+	var points [][]float64
+	var kept []vectors.Row
+	for _, row := range rows {
+		if len(row.Values) > 0 {
+			points = append(points, row.Values)
+			kept = append(kept, row)
+		}
+	}
+	if k <= 0 {
+		k = cluster.DefaultK(len(kept), maxTopics)
+	}
+	assignments, centroids := cluster.KMeans(points, k)
+
+	members := make([][]int, len(centroids))
+	for i, c := range assignments {
+		members[c] = append(members[c], i)
+	}
+	var found []Topic
+	for c, centroid := range centroids {
+		if len(members[c]) == 0 {
+			continue
+		}
+		closest := append([]int(nil), members[c]...)
+		sort.SliceStable(closest, func(i, j int) bool {
+			return cluster.Cosine(points[closest[i]], centroid) > cluster.Cosine(points[closest[j]], centroid)
+		})
+
+		topic := Topic{Size: len(members[c]), From: kept[members[c][0]].Timestamp, To: kept[members[c][0]].Timestamp}
+		counts := map[string]int{}
+		for _, i := range members[c] {
+			row := kept[i]
+			counts[row.Sender]++
+			if row.Timestamp.Before(topic.From) {
+				topic.From = row.Timestamp
+			}
+			if row.Timestamp.After(topic.To) {
+				topic.To = row.Timestamp
+			}
+		}
+		for sender := range counts {
+			topic.Senders = append(topic.Senders, sender)
+		}
+		sort.Slice(topic.Senders, func(i, j int) bool {
+			a, b := topic.Senders[i], topic.Senders[j]
+			return counts[a] > counts[b] || (counts[a] == counts[b] && a < b)
+		})
+		if len(topic.Senders) > topSenders {
+			topic.Senders = topic.Senders[:topSenders]
+		}
+		for n, i := range closest {
+			if n < representatives {
+				topic.Representatives = append(topic.Representatives, kept[i])
+			}
+			if n < labelSamples {
+				topic.samples = append(topic.samples, kept[i])
+			}
+		}
+		found = append(found, topic)
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Size > found[j].Size })
+	return found
+}
+
+// Names every topic with the chat model, from the messages closest to its centroid
+func Label(found []Topic, log *log.Logger) error {
+	for i := range found {
+		var sb strings.Builder
+		for _, row := range found[i].samples {
+			sb.WriteString("- " + grapheme.Snippet(row.Text, snippetChars) + "\n")
+		}
+		label, err := llm.Complete([]llm.Message{
+			{Role: "system", Content: labelPrompt},
+			{Role: "user", Content: sb.String()},
+		})
+		if err != nil {
+			log.Printf("Error labeling topic %d: %v", i+1, err)
+			return err
+		}
+		found[i].Label = strings.Trim(strings.TrimSpace(label), "\"'.")
+	}
+	return nil
+}
+
+// Writes the markdown report of the topics of total messages: per topic its size, time span,
+// main senders and representative messages
+func WriteReport(w io.Writer, found []Topic, total int) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Topics of the chat\n\n%d messages in %d topics.\n", total, len(found))
+	for i, topic := range found {
+		label := topic.Label
+		if label == "" {
+			label = fmt.Sprintf("Topic %d", i+1)
+		}
+		fmt.Fprintf(&sb, "\n## %d. %s\n\n", i+1, label)
+		fmt.Fprintf(&sb, "%d messages (%.0f%%), %s to %s", topic.Size, 100*float64(topic.Size)/float64(max(total, 1)),
+			topic.From.Format("2006-01-02"), topic.To.Format("2006-01-02"))
+		senders := make([]string, len(topic.Senders))
+		for j, sender := range topic.Senders {
+			senders[j] = anonymize.Reveal(sender)
+		}
+		if len(senders) > 0 {
+			fmt.Fprintf(&sb, ", mostly %s", strings.Join(senders, ", "))
+		}
+		sb.WriteString(".\n\n")
+		for _, row := range topic.Representatives {
+			fmt.Fprintf(&sb, "- [%s] **%s**: %s\n", row.Timestamp.Format("2006-01-02 15:04"), anonymize.Reveal(row.Sender),
+				anonymize.Reveal(grapheme.Snippet(row.Text, snippetChars)))
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
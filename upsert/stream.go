@@ -0,0 +1,72 @@
+package upsert
+
+import (
+	"log"
+	"sort"
+
+	"github.com/pisush/fin-chat/batch"
+	"github.com/pisush/fin-chat/dedup"
+	"github.com/pisush/fin-chat/notify"
+)
+
+// Upserts rows as embed writes them, for messages streamed in, see embed.Stream.
+// Close saves what it learned.
+type Streamer struct {
+	indexName string
+	ledger    *dedup.Ledger
+	sizer     *batch.Sizer
+	log       *log.Logger
+}
+
+func NewStreamer(indexName string, log *log.Logger) (*Streamer, error) {
+	ledger, err := dedup.Load(indexName)
+	if err != nil {
+		return nil, err
+	}
+	return &Streamer{indexName: indexName, ledger: ledger, sizer: NewSizer(log), log: log}, nil
+}
+
+// Upserts the rows of the embeddings file, skipping invalid ones and messages upserted
+// before. Only an error every later batch would get too, see stops, is returned.
+func (s *Streamer) Upsert(records [][]string) error {
+	var pending []UpsertData
+	invalid, duplicates := 0, 0
+	for _, fields := range records {
+		row, err := parseFields(fields)
+		if err != nil {
+			s.log.Printf("Error reading a streamed row: %v", err)
+			invalid++
+			continue
+		}
+		if s.ledger.Has(row.Namespace, row.Hash) {
+			duplicates++
+			continue
+		}
+		pending = append(pending, row)
+	}
+	tagSentiment(pending, s.log)
+	tagEntities(pending, s.log)
+	// Vectors sends one namespace per request
+	sort.SliceStable(pending, func(a, b int) bool { return pending[a].Namespace < pending[b].Namespace })
+
+	upserted, err := Vectors(s.indexName, pending, s.sizer, s.log)
+	notify.Count("upsert", map[string]int{"rows": len(records), "upserted": upserted, "failed": invalid + len(pending) - upserted, "duplicates": duplicates})
+	if err != nil {
+		return err
+	}
+	// Which of a failed batch's vectors made it isn't known, they stay out of the ledger
+	if upserted == len(pending) {
+		for _, row := range pending {
+			s.ledger.Add(row.Namespace, row.Hash)
+		}
+	}
+	s.log.Printf("Upserted %d of %d streamed rows", upserted, len(pending))
+	return nil
+}
+
+func (s *Streamer) Close() {
+	if err := s.ledger.Save(); err != nil {
+		s.log.Printf("Error saving the content hash ledger: %v", err)
+	}
+	s.sizer.Save(s.log)
+}
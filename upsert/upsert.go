@@ -1,215 +1,895 @@
 package upsert
 
 import (
-	"bufio"
-	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
-	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/batch"
+	"github.com/pisush/fin-chat/dedup"
+	"github.com/pisush/fin-chat/embed"
+	"github.com/pisush/fin-chat/entities"
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/httpclient"
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/lang"
+	"github.com/pisush/fin-chat/linereader"
+	"github.com/pisush/fin-chat/lock"
+	"github.com/pisush/fin-chat/notify"
+	"github.com/pisush/fin-chat/pinecone"
+	"github.com/pisush/fin-chat/querycache"
+	"github.com/pisush/fin-chat/redact"
+	"github.com/pisush/fin-chat/secure"
+	"github.com/pisush/fin-chat/sentiment"
+	"github.com/pisush/fin-chat/spam"
+	"github.com/pisush/fin-chat/system"
+	"github.com/pisush/fin-chat/timezone"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+const (
+	pcVectorUpsert = "vectors/upsert"
+	pcQuery        = "query"
+
+	indexName = "whatsapp-chat"
+
+	batchProvider    = "pinecone"
+	initialBatchSize = 10
+	maxBatchSize     = 1000            // Pinecone's limit on vectors per upsert request
+	maxPayloadBytes  = 2 * 1024 * 1024 // Pinecone's limit on the size of an upsert request
+	payloadOverhead  = len(`{"vectors":[]}`)
+
+	indexReadyPoll    = 2 * time.Second // how often a new index is checked for readiness
+	indexReadyTimeout = 5 * time.Minute
+
+	maxMetadataTextBytes = 32 << 10 // keeps metadata under Pinecone's 40KB per vector
+	maxHashLookup        = 1000     // Pinecone's topK limit for queries returning metadata
+
+	readBufferSize = 1 << 20  // read buffer for the embeddings file
+	maxLineBytes   = 64 << 20 // rows longer than this are reported and skipped
+
+	RejectedPath = "./rejected.csv"        // rows upsert skipped as invalid, with the reason, rewritten every run
+	FailedPath   = "./failed_upserts.json" // rows Pinecone didn't take, for --retry-failed, rewritten every run
 )
 
+// Distance metrics of Pinecone indexes: https://docs.pinecone.io/docs/indexes#distance-metrics
 const (
-	pcAPIKey                     = "PINECONE-API-Key"
-	pcEnv                        = "gcp-starter" // Other envs: https://docs.pinecone.io/docs/projects
-	pcAPIURL                     = ".pinecone.io/"
-	pcCtrlPrefix                 = "https://controller."
-	pcProjectIDPath              = "actions/whoami"
-	pcCreateorConnectToIndexPath = "databases/"
-	pcVectorUpsert               = "vectors/upsert"
-
-	indexName      = "whatsapp-chat"
-	indexDimension = 1536     // stadnard response size from OpenAI's Ada-002
-	indexMetric    = "cosine" // or eculidean or dotproduct: https://docs.pinecone.io/docs/indexes#distance-metrics
+	MetricCosine     = "cosine"
+	MetricDotProduct = "dotproduct"
+	MetricEuclidean  = "euclidean"
 )
 
+// The metric indexes are created with and searched by, from --metric
+var indexMetric = MetricCosine
+
+func SetMetric(metric string) error {
+	switch metric {
+	case MetricCosine, MetricDotProduct, MetricEuclidean:
+		indexMetric = metric
+		return nil
+	}
+	return fmt.Errorf("unknown metric %q, use %s, %s or %s", metric, MetricCosine, MetricDotProduct, MetricEuclidean)
+}
+
+func Metric() string {
+	return indexMetric
+}
+
+// Whether this run still holds the lease on the index, checked before every batch; always, by
+// default, for runs that took none
+var leaseHeld = func() bool { return true }
+
+// Stops the upserts with lock.ErrLost once held returns false: another machine took over the
+// index, and batches from both would interleave
+func SetLease(held func() bool) {
+	leaseHeld = held
+}
+
+// Whether err stops the upserts: every batch after it would fail, or mustn't be sent
+func stops(err error) bool {
+	return pinecone.Fatal(err) || errors.Is(err, lock.ErrLost)
+}
+
 // Used for upserting data to the vector DBs
 type UpsertData struct {
-	Metadata  map[string]string `json:"metadata"` // TODO: here goes the original message
-	ID        string            `json:"id"`
-	Values    []float64         `json:"values"`
-	Namespace string            `json:"namespace"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	ID        string                 `json:"id"`
+	Values    []float64              `json:"values"`
+	Namespace string                 `json:"-"` // sent once per request, not per vector
+	Hash      string                 `json:"-"` // content hash, also in the metadata
+	line      int                    // in the embeddings file, for the failed rows ledger
 }
 
 func GetOrCreatePineconeIndex(indexName string, log *log.Logger) error {
-	// Step 1: Establish a connection to the index
-	connectionURL := pcCtrlPrefix + pcEnv + pcAPIURL + pcCreateorConnectToIndexPath + indexName
-	req, err := http.NewRequest(http.MethodGet, connectionURL, nil)
+	// Step 1: Check whether the index exists
+	_, err := pinecone.DescribeIndex(indexName)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, pinecone.ErrIndexNotFound) {
+		log.Printf("Error in getOrCreatePineconeIndex: can't describe index %s: %v", indexName, err)
+		return err
+	}
+
+	// Step 2: If the index does not exist, create it
+	fmt.Println(i18n.T("upsert.creating_index", indexName))
+	log.Printf("Index %s not found, creating a new one", indexName)
+	if err := pinecone.CreateIndex(indexName, embed.Dimension(), indexMetric); err != nil {
+		log.Printf("Failed to create index: %v", err)
+		return err
+	}
+
+	// New indexes take a moment before they accept vectors
+	for start := time.Now(); ; time.Sleep(indexReadyPoll) {
+		index, err := pinecone.DescribeIndex(indexName)
+		if err == nil && index.Status.Ready {
+			break
+		}
+		if time.Since(start) > indexReadyTimeout {
+			return fmt.Errorf("index %s was created but isn't ready after %v", indexName, indexReadyTimeout)
+		}
+	}
+	fmt.Println(i18n.T("upsert.created_index", indexName))
+	log.Printf("Successfully created index: %s", indexName)
+
+	return nil
+}
+
+// Checks that the index can hold the embeddings of the file: its dimension must be the
+// embedding model's and the file's, and its metric the one the index is created with.
+// Mismatches are refused here, Pinecone would reject every batch with a terse error.
+func ValidateIndex(indexName string, filePath string) error {
+	index, err := pinecone.DescribeIndex(indexName)
 	if err != nil {
-		log.Printf("Error in getOrCreatePineconeIndex: can't create a new Get request to establish connection: %v", err)
+		return fmt.Errorf("can't describe index %s: %w", indexName, err)
+	}
+	if err := CheckIndex(index); err != nil {
 		return err
 	}
-	req.Header.Set("Api-Key", pcAPIKey)
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	dimension, err := fileDimension(filePath)
+	if err != nil {
+		return err
+	}
+	if dimension != 0 && dimension != index.Dimension {
+		return fmt.Errorf("%s holds %d-dimensional embeddings, but index %s has dimension %d; embed it again with the current model", filePath, dimension, indexName, index.Dimension)
+	}
+	return nil
+}
+
+// Checks the index's dimension is the embedding model's, and its metric the one the index
+// is created with
+func CheckIndex(index *pinecone.Index) error {
+	if index.Dimension != embed.Dimension() {
+		return fmt.Errorf("index %s has dimension %d, but the embedding model produces %d; delete it or upsert to another index", index.Name, index.Dimension, embed.Dimension())
+	}
+	if index.Metric != indexMetric {
+		return fmt.Errorf("index %s uses the %s metric, but search expects %s; run with --metric %s, or delete it or upsert to another index", index.Name, index.Metric, indexMetric, index.Metric)
+	}
+	return nil
+}
 
+// The number of embedding values in the first row of the file, 0 if the file is empty
+func fileDimension(filePath string) (int, error) {
+	file, err := vectors.Open(filePath, 0)
 	if err != nil {
-		log.Printf("Error in getOrCreatePineconeIndex: can't do the POST request to establish connection: %v", err)
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := linereader.New(file, readBufferSize, maxLineBytes)
+	if !scanner.Scan() {
+		return 0, scanner.Err()
+	}
+	fields, err := vectors.FormatOf(filePath).Fields(scanner.Text())
+	if err != nil {
+		return 0, fmt.Errorf("reading the first row of %s: %w", filePath, err)
+	}
+	if len(fields) <= vectors.MetadataColumns {
+		return 0, nil
+	}
+	values, err := vectors.ParseValues(fields[vectors.MetadataColumns:])
+	if err != nil {
+		return 0, fmt.Errorf("reading the first row of %s: %w", filePath, err)
+	}
+	return len(values), nil
+}
 
+func UpsertDataToPinecone(indexName string, filePath string, log *log.Logger) error {
+	return upsertFile(indexName, filePath, nil, log)
+}
+
+// Upserts again only the rows that failed in the previous run, as listed in FailedPath.
+// The ones that fail again stay listed.
+func RetryFailed(indexName string, log *log.Logger) error {
+	failed, err := loadFailures()
+	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	if len(failed.Rows) == 0 {
+		fmt.Println(i18n.T("upsert.nothing_to_retry"))
+		return nil
+	}
+	only := make(map[int]string, len(failed.Rows))
+	for _, row := range failed.Rows {
+		only[row.Line] = row.ID
+	}
+	fmt.Println(i18n.T("upsert.retrying", len(only)))
+	return upsertFile(indexName, failed.File, only, log)
+}
 
-	// Check the response to see if the index exists
-	if resp.StatusCode != http.StatusOK {
-		// Step 2: If the index does not exist, create it
-		fmt.Println("Index doesn't exist, creating a new one", indexName)
-		log.Printf("Index " + indexName + "not found, creating a new one")
-		createIndexURL := pcCtrlPrefix + pcEnv + pcAPIURL + pcCreateorConnectToIndexPath
-		client := &http.Client{}
-		// Creating a structured data to send as JSON
-		data := map[string]interface{}{
-			"name":      indexName,
-			"dimension": indexDimension, // Assuming 'dimension' is a predefined constant with the correct value
-			"metric":    indexMetric,    // Assuming 'metric' is a predefined constant with the correct value
-		}
-		jsonData, err := json.Marshal(data)
-		if err != nil {
-			log.Printf("Error marshalling data: %v", err)
-			return err
+// Upserts the rows of the file, or with only just the rows at those line numbers, which must
+// still have the given IDs
+func upsertFile(indexName string, filePath string, only map[int]string, log *log.Logger) error {
+	fmt.Println(i18n.T("upsert.from", filePath))
+	if err := ValidateIndex(indexName, filePath); err != nil {
+		log.Printf("Refusing to upsert %s: %v", filePath, err)
+		return err
+	}
+	upsertURL, err := pinecone.URL(indexName, pcVectorUpsert)
+	if err != nil {
+		log.Printf("Error looking up the index host: %v", err)
+		return err
+	}
+	queryURL, err := pinecone.URL(indexName, pcQuery)
+	if err != nil {
+		log.Printf("Error looking up the index host: %v", err)
+		return err
+	}
+	client := httpclient.Client()
+
+	file, err := vectors.Open(filePath, 0)
+	if err != nil {
+		log.Fatalf("Failed to open file: %v", err)
+		return err
+	}
+	defer file.Close()
+	scanner := linereader.New(file, readBufferSize, maxLineBytes)
+	format := vectors.FormatOf(filePath)
+
+	lineNumber := 0
+	rows := 0
+	successCount := 0
+	failCount := 0
+	duplicates := 0
+	notUnit := 0 // vectors a dotproduct index would score by their length too
+
+	rejected := &rejects{}
+	defer rejected.close(log)
+	failed := &failures{File: filePath}
+	defer func() {
+		if err := failed.save(); err != nil {
+			log.Printf("Error writing %s: %v", FailedPath, err)
 		}
+	}()
 
-		// Create a new request to check if the index exists
-		req, err := http.NewRequest(http.MethodPost, createIndexURL, bytes.NewBuffer(jsonData))
-		if err != nil {
-			log.Printf("Error in getOrCreatePineconeIndex: can't create a new POST request to create index: %v", err)
-			return err
+	// Messages upserted before from this machine are skipped without asking the index
+	ledger, err := dedup.Load(indexName)
+	if err != nil {
+		log.Printf("Error reading the content hash ledger: %v", err)
+		return err
+	}
+	defer func() {
+		if err := ledger.Save(); err != nil {
+			log.Printf("Error saving the content hash ledger: %v", err)
 		}
-		req.Header.Set("Api-Key", pcAPIKey)
-		req.Header.Set("Content-Type", "application/json")
+	}()
 
-		// Send the request and reading the response
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("Error in getOrCreatePineconeIndex: can't do the POST request to create index: %v", err)
-			return err
+	sizer := batch.NewSizer(batchProvider, initialBatchSize, maxBatchSize, log)
+	defer sizer.Save(log)
+
+	var pending []UpsertData
+	var fatal error           // a wrong key, a plan limit, the wrong dimension or a lost lease, see stops
+	seen := map[string]bool{} // hashes of this file's rows, to skip repeated messages
+	// Upserts the pending vectors in batches, retrying rejected batches at a smaller size
+	upsertPending := func() {
+		if fatal != nil {
+			failCount += len(pending)
+			failed.add(pending, fatal)
+			pending = nil
+			return
 		}
-		defer resp.Body.Close()
+		var skipped int
+		pending, skipped = dropIndexed(client, queryURL, pending, log)
+		duplicates += skipped
+		tagSentiment(pending, log)
+		tagEntities(pending, log)
 
-		// Handle the response
-		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-			bodyBytes, err := io.ReadAll(resp.Body)
+		for len(pending) > 0 {
+			n, err := payloadFit(pending[:sameNamespace(pending, sizer.Size())])
 			if err != nil {
-				log.Printf("Error reading response body: %v", err)
+				log.Printf("Error upserting %s: %v", pending[0].ID, err)
+				failCount++
+				failed.add(pending[:1], err)
+				pending = pending[1:]
+				continue
+			}
+			err = upsertBatch(client, indexName, upsertURL, pending[:n])
+			if stops(err) {
+				fatal = err
+				log.Printf("Stopped upserting at %s: %v", pending[0].ID, err)
+				failCount += len(pending)
+				failed.add(pending, err)
+				pending = nil
+				return
+			}
+			if err != nil && batch.ShouldShrink(err) && n > 1 {
+				sizer.Failure()
+				log.Printf("Upsert batch of %d rejected, retrying with %d: %v", n, sizer.Size(), err)
+				continue
+			}
+			if err != nil {
+				log.Printf("Error upserting %s to %s: %v", pending[0].ID, pending[n-1].ID, err)
+				failCount += n
+				failed.add(pending[:n], err)
 			} else {
-				log.Printf("Failed to create index, status code: %d, response: %s", resp.StatusCode, string(bodyBytes))
+				sizer.Success()
+				successCount += n
+				for _, vector := range pending[:n] {
+					ledger.Add(vector.Namespace, vector.Hash)
+				}
 			}
-			return fmt.Errorf("failed to create index, status code: %d", resp.StatusCode)
+			pending = pending[n:]
 		}
-		fmt.Println("Successfully created index: ", indexName)
-		log.Printf("Successfully created index: %s", indexName)
 	}
 
-	return nil
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		wantID, retried := only[lineNumber]
+		if only != nil && !retried {
+			continue
+		}
+		rows++
+		if scanner.Truncated() {
+			log.Printf("Row at line %d is longer than %d bytes - skipping", lineNumber, maxLineBytes)
+			rejected.add(lineNumber, fmt.Sprintf("longer than %d bytes", maxLineBytes), "")
+			failCount++
+			continue
+		}
+		row, err := parseRow(format, line)
+		if err != nil {
+			log.Printf("Error reading row at line %d: %v", lineNumber, err)
+			rejected.add(lineNumber, err.Error(), line)
+			failCount++
+			continue
+		}
+		if retried && row.ID != wantID {
+			log.Printf("Row at line %d is %s, not the %s that failed - the file changed, skipping", lineNumber, row.ID, wantID)
+			rejected.add(lineNumber, fmt.Sprintf("was %s when it failed, the file changed since", wantID), line)
+			failCount++
+			continue
+		}
+		row.line = lineNumber
+
+		if ledger.Has(row.Namespace, row.Hash) || seen[row.Hash] {
+			duplicates++
+			continue
+		}
+		seen[row.Hash] = true
+		if indexMetric == MetricDotProduct && !vectors.IsUnit(row.Values) {
+			notUnit++
+		}
+
+		pending = append(pending, row)
+		if len(pending) >= sizer.Size() {
+			upsertPending()
+		}
+	}
+	upsertPending()
+
+	log.Printf("Process Summary: Lines Processed=%d, Upserted Successfully=%d, Failed=%d", rows, successCount, failCount)
+	fmt.Println(i18n.T("upsert.summary", rows, successCount, failCount))
+	notify.Count("upsert", map[string]int{"rows": rows, "upserted": successCount, "failed": failCount, "duplicates": duplicates})
+	if duplicates > 0 {
+		log.Printf("Skipped %d rows already in the index", duplicates)
+		fmt.Println(i18n.T("upsert.duplicates", duplicates))
+	}
+	if rejected.count > 0 {
+		fmt.Println(i18n.T("upsert.rejected", rejected.count, RejectedPath))
+	}
+	if notUnit > 0 {
+		fmt.Println(i18n.T("upsert.not_unit", notUnit))
+	}
+	if len(failed.Rows) > 0 {
+		fmt.Println(i18n.T("upsert.failed", len(failed.Rows), FailedPath))
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("Scanner error: %v", err)
+		return err
+	}
+
+	return fatal
 }
 
-func UpsertDataToPinecone(indexName string, filePath string, log *log.Logger) error {
-	// Step 1: Get the project ID
-	fmt.Println("Upserting from: ", filePath)
-	whoamiURL := pcCtrlPrefix + pcEnv + pcAPIURL + pcProjectIDPath
-	req, err := http.NewRequest(http.MethodGet, whoamiURL, nil)
+// Reads the file like UpsertDataToPinecone and reports how many vectors it would upsert to
+// each namespace, without sending anything. Rows that don't parse or don't have the dimension
+// of the embedding model are counted as invalid and logged with their line number.
+func DryRun(indexName, filePath string, log *log.Logger) error {
+	fmt.Println(i18n.T("upsert.dry_run_from", filePath))
+	file, err := vectors.Open(filePath, 0)
 	if err != nil {
-		log.Printf("Error creating new request: %v", err)
 		return err
 	}
-	req.Header.Set("Api-Key", pcAPIKey)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	defer file.Close()
+	scanner := linereader.New(file, readBufferSize, maxLineBytes)
+	format := vectors.FormatOf(filePath)
+
+	ledger, err := dedup.Load(indexName)
 	if err != nil {
-		log.Printf("Error in HTTP request: %v", err)
+		log.Printf("Error reading the content hash ledger: %v", err)
 		return err
 	}
-	defer resp.Body.Close()
 
-	var result map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&result)
-	if err != nil {
-		log.Printf("Error decoding response: %v", err)
+	rejected := &rejects{}
+	defer rejected.close(log)
+
+	lineNumber, invalid, duplicates, notUnit := 0, 0, 0, 0
+	perNamespace := map[string]int{}
+	seen := map[string]bool{}
+	for scanner.Scan() {
+		lineNumber++
+		if scanner.Truncated() {
+			log.Printf("Dry run: row at line %d is longer than %d bytes", lineNumber, maxLineBytes)
+			rejected.add(lineNumber, fmt.Sprintf("longer than %d bytes", maxLineBytes), "")
+			invalid++
+			continue
+		}
+		row, err := parseRow(format, scanner.Text())
+		if err != nil {
+			log.Printf("Dry run: invalid row at line %d: %v", lineNumber, err)
+			rejected.add(lineNumber, err.Error(), scanner.Text())
+			invalid++
+			continue
+		}
+		if ledger.Has(row.Namespace, row.Hash) || seen[row.Hash] {
+			duplicates++
+			continue
+		}
+		seen[row.Hash] = true
+		if indexMetric == MetricDotProduct && !vectors.IsUnit(row.Values) {
+			notUnit++
+		}
+		perNamespace[row.Namespace]++
+	}
+	if err := scanner.Err(); err != nil {
 		return err
 	}
-	pcProjectID := result["project_name"].(string)
 
-	// Step 2: Upsert data
-	upsertURL := "https://" + indexName + "-" + pcProjectID + ".svc." + pcEnv + pcAPIURL + pcVectorUpsert
+	namespaces := make([]string, 0, len(perNamespace))
+	for namespace := range perNamespace {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	valid := 0
+	for _, namespace := range namespaces {
+		name := namespace
+		if name == "" {
+			name = i18n.T("upsert.default_namespace")
+		}
+		fmt.Println(i18n.T("upsert.dry_run_namespace", name, perNamespace[namespace]))
+		valid += perNamespace[namespace]
+	}
+	fmt.Println(i18n.T("upsert.dry_run_summary", lineNumber, valid, invalid, duplicates))
+	if rejected.count > 0 {
+		fmt.Println(i18n.T("upsert.rejected", rejected.count, RejectedPath))
+	}
+	if notUnit > 0 {
+		fmt.Println(i18n.T("upsert.not_unit", notUnit))
+	}
+	return nil
+}
 
-	file, err := os.Open(filePath)
+// Parses a row of the embeddings file into the vector to upsert. A row is only valid with
+// all metadata columns, exactly embed.Dimension() values and every one of them a finite number.
+func parseRow(format vectors.Format, line string) (UpsertData, error) {
+	fields, err := format.Fields(line)
+	if err != nil {
+		return UpsertData{}, err
+	}
+	return parseFields(fields)
+}
+
+// Parses the fields of a row, see parseRow
+func parseFields(fields []string) (UpsertData, error) {
+	if len(fields) <= vectors.MetadataColumns {
+		return UpsertData{}, fmt.Errorf("%d columns, no embedding values", len(fields))
+	}
+	values, err := vectors.ParseValues(fields[vectors.MetadataColumns:])
+	if err != nil {
+		return UpsertData{}, err
+	}
+	for i := range values {
+		if math.IsNaN(values[i]) || math.IsInf(values[i], 0) {
+			return UpsertData{}, fmt.Errorf("embedding value %d is %v", i+1, values[i])
+		}
+	}
+	if len(values) != embed.Dimension() {
+		return UpsertData{}, fmt.Errorf("%d embedding values, the index expects %d", len(values), embed.Dimension())
+	}
+	values = vectors.Normalize(values)
+
+	metadata, err := rowMetadata(fields[:vectors.MetadataColumns])
+	if err != nil {
+		return UpsertData{}, fmt.Errorf("metadata: %w", err)
+	}
+	hash := metadata["hash"].(string)
+	return UpsertData{
+		ID:        vectors.ID(fields[5], hash),
+		Values:    values,
+		Metadata:  metadata,
+		Namespace: fields[5],
+		Hash:      hash,
+	}, nil
+}
+
+// The rows skipped as invalid, written to RejectedPath as line,reason,row once the first one comes
+type rejects struct {
+	file   *secure.Writer // holds the rows' text, encrypted like the embeddings file
+	writer *csv.Writer
+	count  int
+}
+
+func (r *rejects) add(lineNumber int, reason, row string) {
+	r.count++
+	if r.writer == nil {
+		file, err := secure.Create(RejectedPath)
+		if err != nil {
+			return // the row is in err.log either way
+		}
+		r.file, r.writer = file, csv.NewWriter(file)
+		r.writer.Write([]string{"line", "reason", "row"})
+	}
+	r.writer.Write([]string{strconv.Itoa(lineNumber), reason, row})
+}
+
+func (r *rejects) close(log *log.Logger) {
+	if r.writer == nil {
+		return
+	}
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		log.Printf("Error writing %s: %v", RejectedPath, err)
+	}
+	if err := r.file.Close(); err != nil {
+		log.Printf("Error writing %s: %v", RejectedPath, err)
+	}
+}
+
+// The rows Pinecone didn't take, kept in FailedPath with the file they're from
+type failures struct {
+	File string      `json:"file"`
+	Rows []failedRow `json:"rows"`
+}
+
+type failedRow struct {
+	Line  int    `json:"line"`
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+func (f *failures) add(rows []UpsertData, err error) {
+	for _, row := range rows {
+		f.Rows = append(f.Rows, failedRow{Line: row.line, ID: row.ID, Error: err.Error()})
+	}
+}
+
+// Writes the ledger, or removes it when nothing failed
+func (f *failures) save() error {
+	if len(f.Rows) == 0 {
+		if err := os.Remove(FailedPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
 	if err != nil {
-		log.Fatalf("Failed to open file: %v", err)
 		return err
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
+	return os.WriteFile(FailedPath, data, 0644)
+}
 
-	lineNumber := 0
-	successCount := 0
-	failCount := 0
+// The ledger of the previous run, empty if nothing failed
+func loadFailures() (*failures, error) {
+	data, err := os.ReadFile(FailedPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &failures{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f failures
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", FailedPath, err)
+	}
+	return &f, nil
+}
 
-	for scanner.Scan() {
-		lineNumber++
-		line := scanner.Text()
-		valuesStr := strings.Split(line, ",")
-		values := make([]float64, len(valuesStr))
-		for i, v := range valuesStr {
-			values[i], err = strconv.ParseFloat(v, 64)
-			if err != nil {
-				log.Printf("Error parsing float value at line %d: %v", lineNumber, err)
+// Builds the vector metadata from the text,sender,timestamp,id,reply_to,namespace columns of a row
+func rowMetadata(fields []string) (map[string]interface{}, error) {
+	timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := map[string]interface{}{
+		"text":      grapheme.TruncateBytes(redact.Text(fields[0]), maxMetadataTextBytes), // with --redact the original stays in the embeddings file
+		"sender":    redact.Text(fields[1]),
+		"timestamp": timestamp,                                                    // numeric so it can be used in range filters
+		"date":      timezone.Clock(time.Unix(timestamp, 0)).Format("2006-01-02"), // the day on the export's clock
+		"hash":      dedup.Hash(fields[0], fields[1], time.Unix(timestamp, 0)),
+		"ingested":  time.Now().Unix(), // for searches --as-of a date
+	}
+	// With --timezone, the time the export showed, with its offset from UTC
+	if timezone.Enabled() {
+		metadata["local_time"] = timezone.Clock(time.Unix(timestamp, 0)).Format(time.RFC3339)
+	}
+	if language := lang.Detect(fields[0]); language != "" {
+		metadata["lang"] = language
+	}
+	if fields[3] != "" {
+		metadata["message_id"] = fields[3]
+	}
+	if fields[4] != "" {
+		metadata["reply_to"] = fields[4]
+	}
+	// Tagged on every vector, so search can leave out the spam ones with a $ne filter
+	if spam.Mode() == spam.ModeTag {
+		result := spam.Classify(fields[0], fields[1])
+		metadata["spam"] = result.Spam()
+		if result.Spam() {
+			metadata["spam_category"] = result.Category
+		}
+	}
+	// Likewise, left out of searches with a $ne filter
+	if system.Mode() == system.ModeTag {
+		kind := system.Classify(fields[0])
+		metadata["system"] = kind != ""
+		if kind != "" {
+			metadata["system_kind"] = kind
+		}
+	}
+	return metadata, nil
+}
+
+// Stores the sentiment of every vector's message as its sentiment and tone metadata, with
+// --sentiment. Only the vectors about to be upserted are scored, an LLM call each batch.
+func tagSentiment(pending []UpsertData, log *log.Logger) {
+	if sentiment.Mode() == sentiment.ModeOff || len(pending) == 0 {
+		return
+	}
+	texts := make([]string, len(pending))
+	for i, vector := range pending {
+		texts[i], _ = vector.Metadata["text"].(string)
+	}
+	results, err := sentiment.Score(texts)
+	if err != nil {
+		log.Printf("Error scoring sentiment, scored %d messages locally instead: %v", len(texts), err)
+	}
+	for i, result := range results {
+		pending[i].Metadata["sentiment"] = result.Score // numeric for range filters
+		pending[i].Metadata["tone"] = result.Tone
+	}
+}
+
+// Stores the people, places and organizations every vector's message mentions as its people,
+// places and organizations metadata, with --entities
+func tagEntities(pending []UpsertData, log *log.Logger) {
+	if entities.Mode() == entities.ModeOff || len(pending) == 0 {
+		return
+	}
+	texts := make([]string, len(pending))
+	for i, vector := range pending {
+		texts[i], _ = vector.Metadata["text"].(string)
+	}
+	results, err := entities.Extract(texts)
+	if err != nil {
+		log.Printf("Error extracting mentions, read %d messages locally instead: %v", len(texts), err)
+	}
+	for i, result := range results {
+		for key, names := range result.Metadata() {
+			pending[i].Metadata[key] = names
+		}
+	}
+}
+
+// Drops the vectors whose content hash is already in the index, asking once per group of
+// vectors sharing a namespace. If the index can't be asked, all vectors are kept.
+func dropIndexed(client httpclient.Doer, queryURL string, pending []UpsertData, log *log.Logger) ([]UpsertData, int) {
+	var kept []UpsertData
+	skipped := 0
+	for start := 0; start < len(pending); {
+		n := sameNamespace(pending[start:], maxHashLookup)
+		group := pending[start : start+n]
+		start += n
+
+		indexed, err := indexedHashes(client, queryURL, group)
+		if err != nil {
+			log.Printf("Error checking the index for existing messages, upserting them anyway: %v", err)
+		}
+		for _, vector := range group {
+			if indexed[vector.Hash] {
+				skipped++
 				continue
 			}
+			kept = append(kept, vector)
 		}
+	}
+	return kept, skipped
+}
 
-		data := map[string]interface{}{
-			"vectors": []map[string]interface{}{
-				{
-					"id":     fmt.Sprintf("vector_id_%d", lineNumber),
-					"values": values,
-				},
-			},
+// Returns which of the vectors' hashes are stored in the index. The query is restricted to
+// those hashes by a metadata filter, so any of their values works as the query vector.
+func indexedHashes(client httpclient.Doer, queryURL string, group []UpsertData) (map[string]bool, error) {
+	hashes := make([]string, len(group))
+	for i, vector := range group {
+		hashes[i] = vector.Hash
+	}
+	data := map[string]interface{}{
+		"vector":          group[0].Values,
+		"topK":            len(group),
+		"includeMetadata": true,
+		"filter":          map[string]interface{}{"hash": map[string]interface{}{"$in": hashes}},
+	}
+	if group[0].Namespace != "" {
+		data["namespace"] = group[0].Namespace
+	}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := pinecone.NewRequest(http.MethodPost, queryURL, jsonData)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, pinecone.ReadError(resp)
+	}
+
+	var response struct {
+		Matches []struct {
+			Metadata map[string]interface{} `json:"metadata"`
+		} `json:"matches"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	indexed := map[string]bool{}
+	for _, match := range response.Matches {
+		if hash, ok := match.Metadata["hash"].(string); ok {
+			indexed[hash] = true
 		}
+	}
+	return indexed, nil
+}
 
-		jsonData, err := json.Marshal(data)
+// The batch sizer of Pinecone upserts, starting at the size learned in previous runs
+func NewSizer(log *log.Logger) *batch.Sizer {
+	return batch.NewSizer(batchProvider, initialBatchSize, maxBatchSize, log)
+}
+
+// Upserts vectors as they are, without the deduplication of UpsertDataToPinecone, e.g. to
+// restore a backup. Vectors of one namespace should be next to each other. Returns how
+// many were upserted; the ones in failed batches are logged and counted out, but an error
+// every batch would get, or a lost lease, see stops, ends it and is returned. The sizer,
+// from NewSizer, may be shared by concurrent calls so they tune one batch size together.
+func Vectors(indexName string, pending []UpsertData, sizer *batch.Sizer, log *log.Logger) (int, error) {
+	upsertURL, err := pinecone.URL(indexName, pcVectorUpsert)
+	if err != nil {
+		return 0, err
+	}
+	client := httpclient.Client()
+
+	upserted := 0
+	for len(pending) > 0 {
+		n, err := payloadFit(pending[:sameNamespace(pending, sizer.Size())])
 		if err != nil {
-			log.Printf("Error marshalling data at line %d: %v", lineNumber, err)
+			log.Printf("Error upserting %s: %v", pending[0].ID, err)
+			pending = pending[1:]
 			continue
 		}
-
-		req, err := http.NewRequest(http.MethodPost, upsertURL, bytes.NewBuffer(jsonData))
-		if err != nil {
-			log.Printf("Error creating new request at line %d: %v", lineNumber, err)
+		err = upsertBatch(client, indexName, upsertURL, pending[:n])
+		if stops(err) {
+			return upserted, err
+		}
+		if err != nil && batch.ShouldShrink(err) && n > 1 {
+			sizer.Failure()
+			log.Printf("Upsert batch of %d rejected, retrying with %d: %v", n, sizer.Size(), err)
 			continue
 		}
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Api-Key", pcAPIKey)
+		if err != nil {
+			log.Printf("Error upserting %s to %s: %v", pending[0].ID, pending[n-1].ID, err)
+		} else {
+			sizer.Success()
+			upserted += n
+		}
+		pending = pending[n:]
+	}
+	return upserted, nil
+}
+
+// Returns how many of the leading vectors, up to max, share the first vector's namespace
+func sameNamespace(vectors []UpsertData, max int) int {
+	n := 1
+	for n < len(vectors) && n < max && vectors[n].Namespace == vectors[0].Namespace {
+		n++
+	}
+	return n
+}
 
-		resp, err := client.Do(req)
+// Returns how many of the leading vectors fit in a single request under maxPayloadBytes
+func payloadFit(vectors []UpsertData) (int, error) {
+	size := payloadOverhead
+	if len(vectors) > 0 && vectors[0].Namespace != "" {
+		size += len(`,"namespace":""`) + len(vectors[0].Namespace)
+	}
+	for i, vector := range vectors {
+		vectorJSON, err := json.Marshal(vector)
 		if err != nil {
-			log.Printf("Error in HTTP request at line %d: %v", lineNumber, err)
-			failCount++
-			continue
+			return 0, err
+		}
+		size += len(vectorJSON)
+		if i > 0 {
+			size++ // separating comma
 		}
 
-		if resp.StatusCode >= 400 {
-			log.Printf("HTTP error at line %d: %s", lineNumber, resp.Status)
-			failCount++
-		} else {
-			successCount++
+		if size > maxPayloadBytes {
+			if i == 0 {
+				return 0, fmt.Errorf("vector is %d bytes, over the %d bytes request limit", len(vectorJSON), maxPayloadBytes)
+			}
+			return i, nil
 		}
-		resp.Body.Close()
 	}
+	return len(vectors), nil
+}
 
-	log.Printf("Process Summary: Lines Processed=%d, Upserted Successfully=%d, Failed=%d", lineNumber, successCount, failCount)
-	fmt.Printf("Process Summary: Lines Processed=%d, Upserted Successfully=%d, Failed=%d\n", lineNumber, successCount, failCount)
+// Sends one upsert request with all the given vectors, which share a namespace, and drops
+// the cached searches of the namespace
+func upsertBatch(client httpclient.Doer, indexName, upsertURL string, vectors []UpsertData) error {
+	if !leaseHeld() {
+		return fmt.Errorf("%w, not upserting to %s", lock.ErrLost, indexName)
+	}
+	data := map[string]interface{}{"vectors": vectors}
+	if vectors[0].Namespace != "" {
+		data["namespace"] = vectors[0].Namespace
+	}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
 
-	if err := scanner.Err(); err != nil {
-		log.Printf("Scanner error: %v", err)
+	req, err := pinecone.NewRequest(http.MethodPost, upsertURL, jsonData)
+	if err != nil {
 		return err
 	}
 
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return pinecone.ReadError(resp)
+	}
+	querycache.Invalidate(indexName, vectors[0].Namespace)
 	return nil
 }
@@ -0,0 +1,295 @@
+package usage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pisush/fin-chat/httpclient"
+)
+
+const (
+	ledgerPath = "./usage.jsonl" // one line per action run, appended
+
+	openAIHost     = "api.openai.com"
+	pineconeDomain = ".pinecone.io"
+	minWriteUnits  = 5    // Pinecone's minimum per write request
+	writeUnitBytes = 1024 // Pinecone bills a write unit per KB written
+	readUnitPrice  = 16.0 // US dollars per million read units, Pinecone serverless standard plan
+	writeUnitPrice = 4.0  // US dollars per million write units
+	perMillion     = 1e6
+)
+
+// OpenAI's prices in US dollars per million input and output tokens, by model name prefix.
+// The longest matching prefix wins, so gpt-4o-mini isn't billed as gpt-4o.
+var openAIPrices = map[string][2]float64{
+	"text-embedding-ada-002": {0.10, 0},
+	"text-embedding-3-small": {0.02, 0},
+	"text-embedding-3-large": {0.13, 0},
+	"gpt-3.5-turbo":          {0.50, 1.50},
+	"gpt-4o-mini":            {0.15, 0.60},
+	"gpt-4o":                 {2.50, 10},
+}
+
+// What one run of an action used, as a line of the ledger. Read units are Pinecone's own
+// count, write units are estimated from the size of the requests.
+type Entry struct {
+	Time             time.Time `json:"time"`
+	Action           string    `json:"action"`
+	Chat             string    `json:"chat"`
+	OpenAIRequests   int       `json:"openai_requests"`
+	EmbeddingTokens  int       `json:"embedding_tokens"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	PineconeRequests int       `json:"pinecone_requests"`
+	ReadUnits        float64   `json:"read_units"`
+	WriteUnits       float64   `json:"write_units"`
+	Seconds          float64   `json:"seconds"`
+	Cost             float64   `json:"cost_usd"` // at the prices of the time of the run
+}
+
+// The tokens of every kind
+func (e Entry) Tokens() int {
+	return e.EmbeddingTokens + e.PromptTokens + e.CompletionTokens
+}
+
+func (e *Entry) add(other Entry) {
+	e.OpenAIRequests += other.OpenAIRequests
+	e.EmbeddingTokens += other.EmbeddingTokens
+	e.PromptTokens += other.PromptTokens
+	e.CompletionTokens += other.CompletionTokens
+	e.PineconeRequests += other.PineconeRequests
+	e.ReadUnits += other.ReadUnits
+	e.WriteUnits += other.WriteUnits
+	e.Seconds += other.Seconds
+	e.Cost += other.Cost
+}
+
+// The sum of the entries that share a key, e.g. an action or a chat
+type Total struct {
+	Key  string
+	Runs int
+	Entry
+}
+
+var (
+	mu      sync.Mutex
+	current *Entry    // the action running, nil before the first
+	started time.Time // when it began
+	ended   []Entry   // the actions of this run that are done
+)
+
+// Starts counting for an action over a chat, ending the action before it
+func Begin(action, chat string) {
+	mu.Lock()
+	defer mu.Unlock()
+	end()
+	current = &Entry{Time: time.Now().UTC(), Action: action, Chat: chat}
+	started = time.Now()
+}
+
+func end() {
+	if current == nil {
+		return
+	}
+	current.Seconds = time.Since(started).Seconds()
+	ended = append(ended, *current)
+	current = nil
+}
+
+// Ends the current action and appends the actions of this run to the ledger
+func Flush(log *log.Logger) {
+	mu.Lock()
+	end()
+	run := ended
+	ended = nil
+	mu.Unlock()
+
+	if len(run) == 0 {
+		return
+	}
+	if err := appendToLedger(run); err != nil {
+		log.Printf("Error writing the usage ledger: %v", err)
+	}
+}
+
+func appendToLedger(run []Entry) error {
+	file, err := os.OpenFile(ledgerPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, entry := range run {
+		if err := encoder.Encode(entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// Every entry of the ledger, oldest first. No ledger is no entries.
+func Load() ([]Entry, error) {
+	file, err := os.Open(ledgerPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// The entries summed by key, the costliest first
+func Totals(entries []Entry, key func(Entry) string) []Total {
+	byKey := map[string]*Total{}
+	for _, entry := range entries {
+		k := key(entry)
+		if byKey[k] == nil {
+			byKey[k] = &Total{Key: k}
+		}
+		byKey[k].Runs++
+		byKey[k].add(entry)
+	}
+	totals := make([]Total, 0, len(byKey))
+	for _, total := range byKey {
+		totals = append(totals, *total)
+	}
+	sort.Slice(totals, func(a, b int) bool {
+		if totals[a].Cost != totals[b].Cost {
+			return totals[a].Cost > totals[b].Cost
+		}
+		return totals[a].Key < totals[b].Key
+	})
+	return totals
+}
+
+// Wraps the client OpenAI and Pinecone requests are sent with, to count them and the tokens
+// and units they use for the current action
+func Meter(next httpclient.Doer) httpclient.Doer {
+	return meter{next: next}
+}
+
+type meter struct {
+	next httpclient.Doer
+}
+
+func (m meter) Do(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	openAI, pinecone := host == openAIHost, strings.HasSuffix(host, pineconeDomain)
+	resp, err := m.next.Do(req)
+	if !openAI && !pinecone {
+		return resp, err
+	}
+
+	// The usage is in the body, which is read here and handed on from memory
+	var body []byte
+	ok := err == nil && resp.StatusCode >= 200 && resp.StatusCode <= 299
+	if ok {
+		body, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		return resp, err
+	}
+	if openAI {
+		current.OpenAIRequests++
+	} else {
+		current.PineconeRequests++
+	}
+	switch {
+	case ok && openAI:
+		countTokens(req.URL.Path, body)
+	case ok:
+		countUnits(req, body)
+	}
+	return resp, err
+}
+
+// Adds the tokens an OpenAI response reports, and their cost
+func countTokens(path string, body []byte) {
+	var response struct {
+		Model string `json:"model"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	if json.Unmarshal(body, &response) != nil {
+		return
+	}
+	input, output := response.Usage.PromptTokens, response.Usage.CompletionTokens
+	if strings.HasSuffix(path, "/embeddings") {
+		current.EmbeddingTokens += input
+	} else {
+		current.PromptTokens += input
+		current.CompletionTokens += output
+	}
+	price := priceOf(response.Model)
+	current.Cost += (float64(input)*price[0] + float64(output)*price[1]) / perMillion
+}
+
+// The price of the model, zero for one not in openAIPrices
+func priceOf(model string) [2]float64 {
+	var price [2]float64
+	longest := 0
+	for prefix, p := range openAIPrices {
+		if strings.HasPrefix(model, prefix) && len(prefix) > longest {
+			price, longest = p, len(prefix)
+		}
+	}
+	return price
+}
+
+// Adds the read units a Pinecone response reports, or the write units a write request
+// is estimated to have taken: one per KB sent, at least minWriteUnits
+func countUnits(req *http.Request, body []byte) {
+	var response struct {
+		Usage struct {
+			ReadUnits float64 `json:"readUnits"`
+		} `json:"usage"`
+	}
+	if json.Unmarshal(body, &response) == nil && response.Usage.ReadUnits > 0 {
+		current.ReadUnits += response.Usage.ReadUnits
+		current.Cost += response.Usage.ReadUnits * readUnitPrice / perMillion
+	}
+
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/vectors/upsert"), strings.HasSuffix(req.URL.Path, "/vectors/update"),
+		strings.HasSuffix(req.URL.Path, "/vectors/delete"):
+		units := max(float64(minWriteUnits), float64((req.ContentLength+writeUnitBytes-1)/writeUnitBytes))
+		current.WriteUnits += units
+		current.Cost += units * writeUnitPrice / perMillion
+	}
+}
@@ -0,0 +1,87 @@
+package vectors
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// How embedding values are written to the embeddings file
+const (
+	EncodingDecimal = "decimal" // a column per value, with a fixed number of decimals
+	EncodingFloat32 = "float32" // one column of the values as float32, base64 encoded
+
+	DefaultDecimals = 6 // ada-002 values are around 0.01, so this keeps 4 significant digits or more
+
+	float32Prefix = "f32:" // marks the float32 column, so files can mix both encodings
+)
+
+var (
+	encoding = EncodingDecimal
+	decimals = DefaultDecimals
+)
+
+// Sets how embed writes values, from --vector-encoding and --vector-decimals. float32 rows
+// are about half the size of decimal ones; both read back the same to retrieval.
+func SetEncoding(name string, places int) error {
+	switch name {
+	case EncodingDecimal, EncodingFloat32:
+	default:
+		return fmt.Errorf("unknown vector encoding %q, use %s or %s", name, EncodingDecimal, EncodingFloat32)
+	}
+	if places < 1 || places > 17 {
+		return fmt.Errorf("--vector-decimals must be between 1 and 17, not %d", places)
+	}
+	encoding, decimals = name, places
+	return nil
+}
+
+// The columns of the values in the encoding set
+func FormatValues(values []float64) []string {
+	if encoding == EncodingFloat32 {
+		buf := make([]byte, 0, 4*len(values))
+		for _, v := range values {
+			buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v)))
+		}
+		return []string{float32Prefix + base64.StdEncoding.EncodeToString(buf)}
+	}
+	columns := make([]string, len(values))
+	for i, v := range values {
+		columns[i] = strconv.FormatFloat(v, 'f', decimals, 64)
+	}
+	return columns
+}
+
+// Parses the value columns of a row, in either encoding
+func ParseValues(columns []string) ([]float64, error) {
+	if isFloat32(columns) {
+		buf, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(columns[0], float32Prefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid float32 values: %v", err)
+		}
+		if len(buf)%4 != 0 {
+			return nil, fmt.Errorf("invalid float32 values: %d bytes", len(buf))
+		}
+		values := make([]float64, len(buf)/4)
+		for i := range values {
+			values[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:])))
+		}
+		return values, nil
+	}
+
+	values := make([]float64, len(columns))
+	for i, v := range columns {
+		var err error
+		if values[i], err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("embedding value %d: %w", i+1, err)
+		}
+	}
+	return values, nil
+}
+
+func isFloat32(columns []string) bool {
+	return len(columns) == 1 && strings.HasPrefix(columns[0], float32Prefix)
+}
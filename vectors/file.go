@@ -0,0 +1,177 @@
+package vectors
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/pisush/fin-chat/secure"
+)
+
+// How an embeddings file is written, from its name: rows are CSV, or JSON objects in a file
+// named .jsonl, and the file is gzipped when its name ends in .gz, e.g. embeddings.csv.gz
+type Format struct {
+	JSONLines bool
+	Gzip      bool
+}
+
+func FormatOf(path string) Format {
+	return Format{
+		JSONLines: strings.HasSuffix(strings.TrimSuffix(path, ".gz"), ".jsonl"),
+		Gzip:      strings.HasSuffix(path, ".gz"),
+	}
+}
+
+// A row as a JSON line, with the numbers as embed wrote them
+type jsonRow struct {
+	Text      string        `json:"text"`
+	Sender    string        `json:"sender"`
+	Timestamp json.Number   `json:"timestamp"`
+	MessageID string        `json:"message_id,omitempty"`
+	ReplyTo   string        `json:"reply_to,omitempty"`
+	Namespace string        `json:"namespace,omitempty"`
+	Values    []json.Number `json:"values,omitempty"`
+	Float32   string        `json:"float32,omitempty"` // the values in the float32 encoding instead
+}
+
+// Splits a line of the embeddings file into the fields of a row: text,sender,timestamp,id,
+// reply_to,namespace and the embedding values
+func (f Format) Fields(line string) ([]string, error) {
+	if !f.JSONLines {
+		return csv.NewReader(strings.NewReader(line)).Read()
+	}
+	var row jsonRow
+	if err := json.Unmarshal([]byte(line), &row); err != nil {
+		return nil, err
+	}
+	fields := []string{row.Text, row.Sender, row.Timestamp.String(), row.MessageID, row.ReplyTo, row.Namespace}
+	if row.Float32 != "" {
+		return append(fields, float32Prefix+row.Float32), nil
+	}
+	for _, v := range row.Values {
+		fields = append(fields, v.String())
+	}
+	return fields, nil
+}
+
+// Opens the embeddings file for reading its lines, see secure.OpenAt for the offset. A gzipped
+// file is read as the gzip streams appended to it, so the offset has to be where one began.
+func Open(path string, offset int64) (io.ReadCloser, error) {
+	file, err := secure.OpenAt(path, offset)
+	if err != nil || !FormatOf(path).Gzip {
+		return file, err
+	}
+	reader, err := gzip.NewReader(bufio.NewReader(file))
+	if errors.Is(err, io.EOF) { // nothing from offset on
+		return file, nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return gzipReader{reader, file}, nil
+}
+
+type gzipReader struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (r gzipReader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
+
+// Writes rows to an embeddings file in its format. Sync and Close have to be called.
+type Writer struct {
+	file   *secure.Writer
+	format Format
+	gz     *gzip.Writer // the gzip stream being written, nil until a row comes after Sync
+	csv    *csv.Writer
+}
+
+// Creates or truncates an embeddings file, encrypted if encryption is on
+func Create(path string) (*Writer, error) {
+	file, err := secure.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{file: file, format: FormatOf(path)}, nil
+}
+
+// Opens an embeddings file for appending rows, creating it if needed
+func Append(path string) (*Writer, error) {
+	file, err := secure.Append(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{file: file, format: FormatOf(path)}, nil
+}
+
+// Writes a row, as Row.Record gives its fields
+func (w *Writer) Write(record []string) error {
+	var out io.Writer = w.file
+	if w.format.Gzip {
+		if w.gz == nil {
+			w.gz = gzip.NewWriter(w.file)
+		}
+		out = w.gz
+	}
+	if !w.format.JSONLines {
+		if w.csv == nil {
+			w.csv = csv.NewWriter(out)
+		}
+		return w.csv.Write(record)
+	}
+
+	row := jsonRow{Text: record[0], Sender: record[1], Timestamp: json.Number(record[2]), MessageID: record[3], ReplyTo: record[4], Namespace: record[5]}
+	if columns := record[MetadataColumns:]; isFloat32(columns) {
+		row.Float32 = strings.TrimPrefix(columns[0], float32Prefix)
+	} else {
+		for _, v := range columns {
+			row.Values = append(row.Values, json.Number(v))
+		}
+	}
+	line, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(append(line, '\n'))
+	return err
+}
+
+// Writes out the rows so far and commits them to disk. A gzipped file's stream is ended,
+// so the file reads whole, and the next row starts another.
+func (w *Writer) Sync() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func (w *Writer) Close() error {
+	if err := w.flush(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+func (w *Writer) flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	w.gz, w.csv = nil, nil
+	return err
+}
@@ -0,0 +1,46 @@
+package vectors
+
+import "math"
+
+const unitTolerance = 0.01 // how far from 1 a vector's length may be and still count as normalized
+
+// Whether vectors are scaled to length 1 before they are upserted or queried, from --normalize
+var normalize bool
+
+func SetNormalize(on bool) {
+	normalize = on
+}
+
+// The vector scaled to length 1 if --normalize is on, otherwise as it is
+func Normalize(values []float64) []float64 {
+	if !normalize {
+		return values
+	}
+	return Unit(values)
+}
+
+// Scales the vector to length 1, in place. The zero vector stays as it is.
+func Unit(values []float64) []float64 {
+	length := Length(values)
+	if length == 0 {
+		return values
+	}
+	for i := range values {
+		values[i] /= length
+	}
+	return values
+}
+
+// The L2 norm of the vector
+func Length(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v * v
+	}
+	return math.Sqrt(sum)
+}
+
+// Whether the vector's length is 1, give or take rounding, as dot product scores need
+func IsUnit(values []float64) bool {
+	return math.Abs(Length(values)-1) <= unitTolerance
+}
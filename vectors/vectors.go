@@ -0,0 +1,121 @@
+package vectors
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pisush/fin-chat/dedup"
+	"github.com/pisush/fin-chat/linereader"
+	"github.com/pisush/fin-chat/timezone"
+)
+
+const (
+	MetadataColumns = 6 // text,sender,timestamp,id,reply_to,namespace precede the embedding in each row
+
+	readBufferSize = 1 << 20  // read buffer for the embeddings file
+	maxLineBytes   = 64 << 20 // rows longer than this are reported and skipped
+)
+
+// One row of the embeddings file
+type Row struct {
+	ID        string // the stable vector ID the row is upserted with
+	Text      string
+	Sender    string
+	Timestamp time.Time
+	MessageID string
+	ReplyTo   string
+	Namespace string
+	Values    []float64
+}
+
+// The vector ID of a message: "msg-" and the first 128 bits, in hex, of the SHA-256 of the
+// chat (its namespace), a NUL byte and the message's content hash (see dedup.Hash).
+// The same message always gets the same ID, whatever line of which export it came from,
+// so upserting it again overwrites it instead of another vector.
+func ID(chat, contentHash string) string {
+	sum := sha256.Sum256([]byte(chat + "\x00" + contentHash))
+	return "msg-" + hex.EncodeToString(sum[:16])
+}
+
+// Reads all rows of an embeddings file, logging and skipping rows that don't parse
+func ReadFile(path string, log *log.Logger) ([]Row, error) {
+	rows, _, err := ReadFileFrom(path, 0, log)
+	return rows, err
+}
+
+// Reads the rows from byte offset on, e.g. the rows appended since an earlier read, and
+// returns the offset of the end of the file. An offset past the end, as when the file was
+// written anew since, reads the whole file.
+func ReadFileFrom(path string, offset int64, log *log.Logger) ([]Row, int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > info.Size() {
+		offset = 0
+	}
+	// An encrypted file is decrypted as it's read, the offsets are in the file as it is on disk
+	file, err := Open(path, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	format := FormatOf(path)
+	var rows []Row
+	scanner := linereader.New(file, readBufferSize, maxLineBytes)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		if scanner.Truncated() {
+			log.Printf("Row at line %d is longer than %d bytes - skipping", lineNumber, maxLineBytes)
+			continue
+		}
+		row, err := parseRow(format, scanner.Text())
+		if err != nil {
+			log.Printf("Error reading row at line %d: %v", lineNumber, err)
+			continue
+		}
+		row.ID = ID(row.Namespace, dedup.Hash(row.Text, row.Sender, row.Timestamp))
+		rows = append(rows, row)
+	}
+	return rows, info.Size(), scanner.Err()
+}
+
+// The row as the fields of a line of the embeddings file, as ReadFile reads them
+func (r Row) Record() []string {
+	record := []string{r.Text, r.Sender, strconv.FormatInt(r.Timestamp.Unix(), 10), r.MessageID, r.ReplyTo, r.Namespace}
+	return append(record, FormatValues(r.Values)...)
+}
+
+func parseRow(format Format, line string) (Row, error) {
+	fields, err := format.Fields(line)
+	if err != nil {
+		return Row{}, err
+	}
+	if len(fields) <= MetadataColumns {
+		return Row{}, fmt.Errorf("row has no embedding")
+	}
+
+	timestamp, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return Row{}, fmt.Errorf("invalid timestamp: %v", err)
+	}
+	values, err := ParseValues(fields[MetadataColumns:])
+	if err != nil {
+		return Row{}, err
+	}
+
+	return Row{
+		Text:      fields[0],
+		Sender:    fields[1],
+		Timestamp: timezone.Clock(time.Unix(timestamp, 0)),
+		MessageID: fields[3],
+		ReplyTo:   fields[4],
+		Namespace: fields[5],
+		Values:    values,
+	}, nil
+}
@@ -0,0 +1,169 @@
+package visualize
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	perplexity         = 30 // roughly how many neighbors each message keeps close
+	tsneIterations     = 750
+	exaggeration       = 12   // of the affinities over the first iterations, to form clusters early
+	exaggerationRounds = 100  // iterations with exaggeration and lower momentum
+	maxTSNEPoints      = 2000 // exact t-SNE compares every pair on every iteration
+	perplexitySteps    = 50   // of the binary search for each point's bandwidth
+)
+
+// Projects the points to 2D with t-SNE, which keeps similar messages together at the cost of
+// the distances between groups, unlike PCA. Starts from the PCA projection, so the same
+// points always give the same plot.
+func TSNE(points [][]float64) ([][2]float64, error) {
+	n := len(points)
+	if n > maxTSNEPoints {
+		return nil, fmt.Errorf("t-SNE of %d messages would take too long, the limit is %d; use --projection pca", n, maxTSNEPoints)
+	}
+	projected := PCA(points)
+	if n < 3 {
+		return projected, nil
+	}
+
+	p := affinities(points)
+
+	// Scaled down, t-SNE expects a start close to the origin
+	spread := 0.0
+	for _, y := range projected {
+		spread = math.Max(spread, math.Max(math.Abs(y[0]), math.Abs(y[1])))
+	}
+	y := make([][2]float64, n)
+	for i := range projected {
+		if spread > 0 {
+			y[i] = [2]float64{projected[i][0] / spread * 1e-2, projected[i][1] / spread * 1e-2}
+		}
+	}
+
+	learningRate := math.Max(float64(n)/exaggeration, 50) // as openTSNE picks it
+	velocity := make([][2]float64, n)
+	gains := make([][2]float64, n)
+	for i := range gains {
+		gains[i] = [2]float64{1, 1}
+	}
+	q := make([]float64, n*n)
+	for iteration := 0; iteration < tsneIterations; iteration++ {
+		scale, momentum := 1.0, 0.8
+		if iteration < exaggerationRounds {
+			scale, momentum = exaggeration, 0.5
+		}
+
+		// Student-t similarities of the current layout
+		sum := 0.0
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				dx, dy := y[i][0]-y[j][0], y[i][1]-y[j][1]
+				v := 1 / (1 + dx*dx + dy*dy)
+				q[i*n+j], q[j*n+i] = v, v
+				sum += 2 * v
+			}
+		}
+
+		for i := 0; i < n; i++ {
+			var grad [2]float64
+			for j := 0; j < n; j++ {
+				if i == j {
+					continue
+				}
+				v := q[i*n+j]
+				force := (scale*p[i*n+j] - v/sum) * v
+				grad[0] += 4 * force * (y[i][0] - y[j][0])
+				grad[1] += 4 * force * (y[i][1] - y[j][1])
+			}
+			for d := 0; d < 2; d++ {
+				// Steps grow while the gradient keeps its direction, as in the reference implementation
+				if (grad[d] > 0) != (velocity[i][d] > 0) {
+					gains[i][d] += 0.2
+				} else {
+					gains[i][d] = math.Max(gains[i][d]*0.8, 0.01)
+				}
+				velocity[i][d] = momentum*velocity[i][d] - learningRate*gains[i][d]*grad[d]
+			}
+		}
+		var mean [2]float64
+		for i := range y {
+			y[i][0] += velocity[i][0]
+			y[i][1] += velocity[i][1]
+			mean[0] += y[i][0] / float64(n)
+			mean[1] += y[i][1] / float64(n)
+		}
+		for i := range y {
+			y[i][0] -= mean[0]
+			y[i][1] -= mean[1]
+		}
+	}
+	return y, nil
+}
+
+// The symmetric joint probabilities of t-SNE, n×n: each point's Gaussian over its cosine
+// distances to the others, with the bandwidth that gives it the set perplexity
+func affinities(points [][]float64) []float64 {
+	n := len(points)
+	unit := make([][]float64, n)
+	for i, point := range points {
+		unit[i] = append([]float64(nil), point...)
+		normalize(unit[i])
+	}
+	distances := make([]float64, n*n)
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			d := 1 - dot(unit[i], unit[j])
+			distances[i*n+j], distances[j*n+i] = d, d
+		}
+	}
+
+	target := math.Log(math.Min(perplexity, float64(n-1)/3))
+	conditional := make([]float64, n*n)
+	for i := 0; i < n; i++ {
+		row := conditional[i*n : (i+1)*n]
+		beta, low, high := 1.0, 0.0, math.Inf(1)
+		for step := 0; step < perplexitySteps; step++ {
+			sum, weighted := 0.0, 0.0
+			for j := 0; j < n; j++ {
+				if j == i {
+					row[j] = 0
+					continue
+				}
+				row[j] = math.Exp(-beta * distances[i*n+j])
+				sum += row[j]
+				weighted += row[j] * distances[i*n+j]
+			}
+			if sum == 0 {
+				beta /= 2
+				continue
+			}
+			entropy := math.Log(sum) + beta*weighted/sum
+			for j := range row {
+				row[j] /= sum
+			}
+			if math.Abs(entropy-target) < 1e-5 {
+				break
+			}
+			if entropy > target {
+				low = beta
+				if math.IsInf(high, 1) {
+					beta *= 2
+				} else {
+					beta = (beta + high) / 2
+				}
+			} else {
+				high = beta
+				beta = (beta + low) / 2
+			}
+		}
+	}
+
+	p := make([]float64, n*n)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			p[i*n+j] = math.Max((conditional[i*n+j]+conditional[j*n+i])/(2*float64(n)), 1e-12)
+		}
+	}
+	return p
+}
@@ -0,0 +1,202 @@
+package visualize
+
+import (
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pisush/fin-chat/cluster"
+	"github.com/pisush/fin-chat/grapheme"
+	"github.com/pisush/fin-chat/vectors"
+)
+
+const (
+	powerIterations = 100 // enough for the leading components of chat embeddings to settle
+	maxTopics       = 12  // clusters the "topic" coloring uses
+	tooltipChars    = 160 // message text shown when hovering a point
+	seed            = 1   // fixed so the same embeddings always give the same plot
+)
+
+//go:embed template.html
+var pageTemplate string
+
+var page = template.Must(template.New("visualization").Parse(pageTemplate))
+
+// A message as plotted in the page
+type Point struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	ID     string  `json:"id"`
+	Sender string  `json:"sender"`
+	Time   int64   `json:"time"`
+	Topic  int     `json:"topic"`
+	Text   string  `json:"text"`
+}
+
+// How the embeddings are projected to 2D, from --projection
+const (
+	ProjectionPCA  = "pca"  // fast, keeps the broad shape: far apart messages stay far apart
+	ProjectionTSNE = "tsne" // slow, keeps neighbors together, so topics show as islands
+)
+
+// Checks a --projection value
+func ValidProjection(projection string) error {
+	switch projection {
+	case ProjectionPCA, ProjectionTSNE:
+		return nil
+	}
+	return fmt.Errorf("unknown projection %q, use %s or %s", projection, ProjectionPCA, ProjectionTSNE)
+}
+
+// Projects the rows to 2D and gives every one its topic, a k-means cluster
+func Project(rows []vectors.Row, projection string) ([]Point, error) {
+	points := make([][]float64, len(rows))
+	for i, row := range rows {
+		points[i] = row.Values
+	}
+
+	projected := PCA(points)
+	if projection == ProjectionTSNE {
+		var err error
+		if projected, err = TSNE(points); err != nil {
+			return nil, err
+		}
+	}
+	topics, _ := cluster.KMeans(points, cluster.DefaultK(len(rows), maxTopics))
+
+	plotted := make([]Point, len(rows))
+	for i, row := range rows {
+		plotted[i] = Point{
+			X:      projected[i][0],
+			Y:      projected[i][1],
+			ID:     row.ID,
+			Sender: row.Sender,
+			Time:   row.Timestamp.Unix(),
+			Topic:  topics[i],
+			Text:   grapheme.Snippet(row.Text, tooltipChars),
+		}
+	}
+	return plotted, nil
+}
+
+// Writes a self-contained HTML scatter plot of the points to path, colored by sender, topic
+// or time
+func WriteHTML(path string, points []Point) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := page.Execute(file, points); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Writes the points as CSV with the columns x,y,sender,date,text,cluster,id, to plot them
+// elsewhere, e.g. in a notebook
+func WriteCSV(path string, points []Point) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"x", "y", "sender", "date", "text", "cluster", "id"})
+	for _, p := range points {
+		writer.Write([]string{
+			strconv.FormatFloat(p.X, 'f', 4, 64), strconv.FormatFloat(p.Y, 'f', 4, 64), p.Sender,
+			time.Unix(p.Time, 0).UTC().Format(time.RFC3339), p.Text, strconv.Itoa(p.Topic), p.ID,
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Projects the points onto their first two principal components, found by power iteration
+func PCA(points [][]float64) [][2]float64 {
+	projected := make([][2]float64, len(points))
+	if len(points) == 0 {
+		return projected
+	}
+
+	dims := len(points[0])
+	mean := make([]float64, dims)
+	for _, p := range points {
+		for d, v := range p {
+			mean[d] += v / float64(len(points))
+		}
+	}
+	centered := make([][]float64, len(points))
+	for i, p := range points {
+		centered[i] = make([]float64, dims)
+		for d, v := range p {
+			centered[i][d] = v - mean[d]
+		}
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	var components [][]float64
+	for c := 0; c < 2; c++ {
+		component := make([]float64, dims)
+		for d := range component {
+			component[d] = rng.NormFloat64()
+		}
+		for iteration := 0; iteration < powerIterations; iteration++ {
+			// component = Xᵀ X component, without forming the covariance matrix
+			next := make([]float64, dims)
+			for _, p := range centered {
+				score := dot(p, component)
+				for d, v := range p {
+					next[d] += score * v
+				}
+			}
+			// Keeps the second component orthogonal to the first
+			for _, previous := range components {
+				overlap := dot(next, previous)
+				for d := range next {
+					next[d] -= overlap * previous[d]
+				}
+			}
+			if !normalize(next) {
+				break // no variance left in this direction
+			}
+			component = next
+		}
+		components = append(components, component)
+	}
+
+	for i, p := range centered {
+		projected[i] = [2]float64{dot(p, components[0]), dot(p, components[1])}
+	}
+	return projected
+}
+
+func dot(a, b []float64) float64 {
+	sum := 0.0
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
+
+// Scales v to unit length in place, false if it is all zeros
+func normalize(v []float64) bool {
+	n := math.Sqrt(dot(v, v))
+	if n == 0 {
+		return false
+	}
+	for i := range v {
+		v[i] /= n
+	}
+	return true
+}
@@ -0,0 +1,128 @@
+package watch
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pisush/fin-chat/i18n"
+	"github.com/pisush/fin-chat/state"
+)
+
+const PollInterval = 10 * time.Second // there is no portable file notification API in the standard library
+
+type fileInfo struct {
+	size    int64
+	modTime time.Time
+}
+
+// Polls dir for new export files and calls ingest on each one once it has stopped changing.
+// Ingested files are recorded by content hash in the state file, so a file is never ingested
+// twice, even when it is dropped again under another name. idle, if not nil, is called after
+// every poll. Only returns if dir can't be created.
+func Run(dir string, ingest func(path string) error, idle func(), log *log.Logger) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	fmt.Println(i18n.T("watch.watching", dir))
+
+	previous := map[string]fileInfo{}
+	for {
+		current, err := scan(dir)
+		if err != nil {
+			log.Printf("Error scanning %s: %v", dir, err)
+		}
+
+		names := make([]string, 0, len(current))
+		for name := range current {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			// Only files that looked the same on the previous poll, so copies in progress are left alone
+			if info, ok := previous[name]; !ok || info != current[name] {
+				continue
+			}
+			if err := ingestOnce(filepath.Join(dir, name), ingest, log); err != nil {
+				fmt.Println(i18n.T("watch.error", name, err))
+				log.Printf("Error ingesting %s: %v", name, err)
+			}
+		}
+
+		previous = current
+		if idle != nil {
+			idle()
+		}
+		time.Sleep(PollInterval)
+	}
+}
+
+// Regular, non-hidden files in dir
+func scan(dir string) (map[string]fileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]fileInfo{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue // removed since ReadDir
+		}
+		files[entry.Name()] = fileInfo{size: info.Size(), modTime: info.ModTime()}
+	}
+	return files, nil
+}
+
+func ingestOnce(path string, ingest func(path string) error, log *log.Logger) error {
+	hash, err := fileHash(path)
+	if err != nil {
+		return err
+	}
+
+	st, err := state.Load()
+	if err != nil {
+		return err
+	}
+	if _, done := st.Ingested[hash]; done {
+		return nil
+	}
+
+	fmt.Println(i18n.T("watch.ingesting", filepath.Base(path)))
+	if err := ingest(path); err != nil {
+		return err
+	}
+
+	// Reloaded, ingesting also saves the learned batch sizes
+	if st, err = state.Load(); err != nil {
+		return err
+	}
+	st.Ingested[hash] = state.IngestedFile{Name: filepath.Base(path), At: time.Now().UTC()}
+	return st.Save()
+}
+
+func fileHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}